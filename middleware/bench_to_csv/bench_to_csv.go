@@ -230,6 +230,20 @@ func GetBenchmarkResults(benchmarks []func(*testing.B)) []*benchResult {
 	return benchResults
 }
 
+func aliceGroup() *middleware.PrivacyGroup {
+	group := middleware.NewPrivacyGroup("TestGroup")
+	group.Add("alice")
+	return group
+}
+
+func aliceRequestPolicy() *middleware.RequestPolicy {
+	return &middleware.RequestPolicy{
+		RequesterID:                 "alice",
+		PreferredProcessingLocation: middleware.Local,
+		HasAllRequiredData:          true,
+	}
+}
+
 func validFuncMap() map[string]middleware.TableTransform {
 	funcMap := make(map[string]middleware.TableTransform)
 	funcMap["TestGroup"] = make(middleware.TableTransform)
@@ -383,10 +397,10 @@ func benchmarkMySQLPrivateDatabaseQueryReadNoCaching(b *testing.B, queryString s
 	funcMap := validFuncMap()
 	colMap := map[string][]string{"TestGroup": {}}
 
-	group := &middleware.PrivacyGroup{"TestGroup", map[string]bool{"alice": true}}
+	group := aliceGroup()
 
 	staticDataPolicy := middleware.NewStaticDataPolicy([]*middleware.PrivacyGroup{group},
-		middleware.DataTransforms{group: &middleware.TableOperations{funcMap, colMap}})
+		middleware.DataTransforms{group: &middleware.TableOperations{TableTransforms: funcMap, ExcludedCols: colMap}})
 
 	db := middleware.MySQLPrivateDatabase{
 		DataPolicy:  staticDataPolicy,
@@ -493,7 +507,7 @@ func BenchmarkMySQLPrivateDatabase_Query_Read_No_Caching_25000(b *testing.B) {
 }
 
 func benchmarkMySQLPrivateDatabaseQuery(b *testing.B, db middleware.MySQLPrivateDatabase, queryString string) *sql.Rows {
-	r, err := db.Query(queryString, &middleware.RequestPolicy{"alice", middleware.Local, true})
+	r, err := db.Query(queryString, aliceRequestPolicy())
 	if err != nil {
 		b.Error(err.Error())
 	}
@@ -505,10 +519,10 @@ func benchmarkMySQLPrivateDatabaseQueryReadCaching(b *testing.B, queryString str
 	funcMap := validFuncMap()
 	colMap := map[string][]string{"TestGroup": {}}
 
-	group := &middleware.PrivacyGroup{"TestGroup", map[string]bool{"alice": true}}
+	group := aliceGroup()
 
 	staticDataPolicy := middleware.NewStaticDataPolicy([]*middleware.PrivacyGroup{group},
-		middleware.DataTransforms{group: &middleware.TableOperations{funcMap, colMap}})
+		middleware.DataTransforms{group: &middleware.TableOperations{TableTransforms: funcMap, ExcludedCols: colMap}})
 
 	db := middleware.MySQLPrivateDatabase{
 		DataPolicy:  staticDataPolicy,
@@ -523,7 +537,7 @@ func benchmarkMySQLPrivateDatabaseQueryReadCaching(b *testing.B, queryString str
 	db.SetConnMaxLifetime(time.Second * 20)
 
 	// Make the query once so we know we have a cached version of the table
-	_, err = db.Query(queryString, &middleware.RequestPolicy{"alice", middleware.Local, true})
+	_, err = db.Query(queryString, aliceRequestPolicy())
 	if err != nil {
 		b.Error(err.Error())
 	}
@@ -765,10 +779,10 @@ func benchmarkMySQLPrivateDatabaseExecWrite(b *testing.B, execString string, arg
 	funcMap := validFuncMap()
 	colMap := map[string][]string{}
 
-	group := &middleware.PrivacyGroup{"TestGroup", map[string]bool{"alice": true}}
+	group := aliceGroup()
 
 	staticDataPolicy := middleware.NewStaticDataPolicy([]*middleware.PrivacyGroup{group},
-		middleware.DataTransforms{group: &middleware.TableOperations{funcMap, colMap}})
+		middleware.DataTransforms{group: &middleware.TableOperations{TableTransforms: funcMap, ExcludedCols: colMap}})
 
 	db := middleware.MySQLPrivateDatabase{
 		DataPolicy:  staticDataPolicy,
@@ -785,7 +799,7 @@ func benchmarkMySQLPrivateDatabaseExecWrite(b *testing.B, execString string, arg
 	b.StartTimer()
 
 	_, err = db.Exec(execString,
-		&middleware.RequestPolicy{"alice", middleware.Local, true},
+		aliceRequestPolicy(),
 		args...)
 	if err != nil {
 		b.Error(err.Error())
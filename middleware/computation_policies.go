@@ -89,11 +89,13 @@ func (p ProcessingLocation) ToString() string {
 	return ""
 }
 
-// RequestPolicy stores the preferred location for processing of a request (and the identity of the requester?)
+// RequestPolicy stores the preferred location for processing of a request, the identity of the requester and the
+// purpose the requested data will be used for, such as billing or research
 type RequestPolicy struct {
 	RequesterID                 string
 	PreferredProcessingLocation ProcessingLocation
 	HasAllRequiredData          bool
+	Purpose                     string
 }
 
 // AddToParams adds each of its fields as a parameter in the passed Values struct
@@ -103,16 +105,20 @@ func (p *RequestPolicy) AddToParams(params *url.Values) {
 	params.Set("requester_id", p.RequesterID)
 	params.Set("preferred_processing_location", preferredProcessingLocation)
 	params.Set("has_all_required_data", hasAllRequiredData)
+	if p.Purpose != "" {
+		params.Set("purpose", p.Purpose)
+	}
 
 	return
 }
 
-// BuildRequestPolicy takes a http request and extracts the values for a RequestPolicy from its parameters
+// BuildRequestPolicy takes a http request and extracts the values for a RequestPolicy from its parameters, requests
+// without a requester ID are given the AnonymousRequesterID
 func BuildRequestPolicy(req *http.Request) (*RequestPolicy, error) {
 	params := req.URL.Query()
 	requesterID := params.Get("requester_id")
 	if requesterID == "" {
-		return nil, errors.New("a context cannot be parsed from the request as there is no requester ID")
+		requesterID = AnonymousRequesterID
 	}
 
 	preferredProcessingLocation := params.Get("preferred_processing_location")
@@ -135,5 +141,6 @@ func BuildRequestPolicy(req *http.Request) (*RequestPolicy, error) {
 	return &RequestPolicy{RequesterID: requesterID,
 		PreferredProcessingLocation: preferredProcessingLocationEnum,
 		HasAllRequiredData:          hasAllRequiredDataBool,
+		Purpose:                     params.Get("purpose"),
 	}, nil
 }
@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"github.com/stretchr/testify/require"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRequestPolicy_AddToParams(t *testing.T) {
+	requestPolicy := &RequestPolicy{
+		RequesterID:                 "alice",
+		PreferredProcessingLocation: Remote,
+		HasAllRequiredData:          true,
+		Purpose:                     "billing",
+	}
+
+	params := url.Values{}
+	requestPolicy.AddToParams(&params)
+
+	req := httptest.NewRequest("GET", "/?"+params.Encode(), nil)
+	parsedPolicy, err := BuildRequestPolicy(req)
+	require.NoError(t, err)
+	require.Equal(t, requestPolicy, parsedPolicy)
+
+	// The purpose is optional
+	requestPolicy.Purpose = ""
+	params = url.Values{}
+	requestPolicy.AddToParams(&params)
+	require.NotContains(t, params, "purpose")
+
+	req = httptest.NewRequest("GET", "/?"+params.Encode(), nil)
+	parsedPolicy, err = BuildRequestPolicy(req)
+	require.NoError(t, err)
+	require.Equal(t, requestPolicy, parsedPolicy)
+}
@@ -0,0 +1,323 @@
+package middleware
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ConflictStrategy decides how the TableOperations of several privacy groups are combined when an entity is a member
+// of more than one of them
+type ConflictStrategy int
+
+const (
+	// MergeOrFail combines the operations of every group, excluding the columns excluded by any of them, and fails if
+	// more than one group transforms the same table
+	MergeOrFail ConflictStrategy = iota
+	// FirstMatch applies only the operations of the first group, in the order of the policy, the entity is a member of
+	FirstMatch ConflictStrategy = iota
+	// HighestPriority applies only the operations of the groups with the highest Priority, the operations of groups
+	// with equal priority are combined as with MergeOrFail
+	HighestPriority ConflictStrategy = iota
+	// MostRestrictive applies the operations of every group, transforms on the same column are applied one after
+	// another in group order and a row is dropped if any of them drops it. Row transforms are applied in group order.
+	// SQLTransforms are applied by the database so come before any Go transforms of the same column.
+	MostRestrictive ConflictStrategy = iota
+	// LeastRestrictive shows anything which any one of the groups would see. A column is only hidden if every group
+	// hides it, a row is visible if it satisfies the filters of any group and a column is only transformed if every
+	// group which can see it transforms it, in which case the transform of the first of those groups is used. Row
+	// transforms are only applied if every group has them for a table, in which case those of the first group in the
+	// policy's order are, as functions cannot be compared to find the least restrictive. Groups should be listed with
+	// those whose row transforms should win first.
+	LeastRestrictive ConflictStrategy = iota
+)
+
+// ConflictStrategyFromString converts a string to the relevant ConflictStrategy
+func ConflictStrategyFromString(strategy string) (ConflictStrategy, error) {
+	switch strings.ToLower(strategy) {
+	case "merge-or-fail":
+		return MergeOrFail, nil
+	case "first-match":
+		return FirstMatch, nil
+	case "highest-priority":
+		return HighestPriority, nil
+	case "most-restrictive":
+		return MostRestrictive, nil
+	case "least-restrictive":
+		return LeastRestrictive, nil
+	default:
+		return 0, fmt.Errorf("cannot parse %s as a conflict strategy", strategy)
+	}
+}
+
+// ToString converts from a ConflictStrategy to the relevant string
+func (c ConflictStrategy) ToString() string {
+	switch c {
+	case MergeOrFail:
+		return "merge-or-fail"
+	case FirstMatch:
+		return "first-match"
+	case HighestPriority:
+		return "highest-priority"
+	case MostRestrictive:
+		return "most-restrictive"
+	case LeastRestrictive:
+		return "least-restrictive"
+	}
+	return ""
+}
+
+// combine returns the TableOperations resulting from applying the strategy to the operations of each group an entity
+// is a member of, which are passed in group order with the group each came from
+func (c ConflictStrategy) combine(groups []*PrivacyGroup, groupOperations []*TableOperations) (*TableOperations,
+	error) {
+	switch c {
+	case MergeOrFail:
+		return mergeAll(groupOperations)
+	case FirstMatch:
+		return mergeAll(groupOperations[:1])
+	case HighestPriority:
+		highest := groups[0].Priority()
+		for _, group := range groups {
+			if group.Priority() > highest {
+				highest = group.Priority()
+			}
+		}
+		var prioritised []*TableOperations
+		for i, tableOperations := range groupOperations {
+			if groups[i].Priority() == highest {
+				prioritised = append(prioritised, tableOperations)
+			}
+		}
+		return mergeAll(prioritised)
+	case MostRestrictive:
+		return mostRestrictive(groupOperations), nil
+	case LeastRestrictive:
+		return leastRestrictive(groupOperations), nil
+	default:
+		return nil, fmt.Errorf("unknown conflict strategy %d", c)
+	}
+}
+
+func mergeAll(groupOperations []*TableOperations) (*TableOperations, error) {
+	allTableOperations := NewTableOperations()
+	for _, tableOperations := range groupOperations {
+		err := allTableOperations.merge(tableOperations)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return allTableOperations, nil
+}
+
+func mostRestrictive(groupOperations []*TableOperations) *TableOperations {
+	allTableOperations := NewTableOperations()
+	for _, tableOperations := range groupOperations {
+		allTableOperations.mergeRowTransforms(tableOperations)
+		allTableOperations.mergeRestrictions(tableOperations)
+
+		for tableName, tableTransform := range tableOperations.TableTransforms {
+			allTableTransform, ok := allTableOperations.TableTransforms[tableName]
+			if !ok {
+				allTableTransform = make(TableTransform)
+				allTableOperations.TableTransforms[tableName] = allTableTransform
+			}
+			for col, transform := range tableTransform {
+				transformID, hasID := tableOperations.TransformIDs[tableName][col]
+				if tableOperations.SideEffects[tableName][col] {
+					allTableOperations.setSideEffects(tableName, col)
+				}
+				if existing, ok := allTableTransform[col]; ok {
+					allTableTransform[col] = composeTransforms(existing, transform)
+					// The composition only has an ID if both transforms do
+					existingID, existingHasID := allTableOperations.TransformIDs[tableName][col]
+					delete(allTableOperations.TransformIDs[tableName], col)
+					if existingHasID && hasID {
+						allTableOperations.setTransformID(tableName, col, existingID+" then "+transformID)
+					}
+				} else {
+					allTableTransform[col] = transform
+					if hasID {
+						allTableOperations.setTransformID(tableName, col, transformID)
+					}
+				}
+			}
+		}
+
+		for tableName, sqlTableTransform := range tableOperations.SQLTransforms {
+			allSQLTableTransform, ok := allTableOperations.SQLTransforms[tableName]
+			if !ok {
+				allSQLTableTransform = make(SQLTableTransform)
+				allTableOperations.SQLTransforms[tableName] = allSQLTableTransform
+			}
+			for col, transform := range sqlTableTransform {
+				if existing, ok := allSQLTableTransform[col]; ok {
+					allSQLTableTransform[col] = composeSQLTransforms(existing, transform)
+				} else {
+					allSQLTableTransform[col] = transform
+				}
+			}
+		}
+	}
+	return allTableOperations
+}
+
+// composeSQLTransforms returns an SQLTransform which applies first and then second
+func composeSQLTransforms(first SQLTransform, second SQLTransform) SQLTransform {
+	return func(column string) string {
+		return second(first(column))
+	}
+}
+
+// composeTransforms returns a ColumnTransform which applies first and then second, the row is excluded if either of
+// them excludes it
+func composeTransforms(first ColumnTransform, second ColumnTransform) ColumnTransform {
+	return func(value interface{}) (interface{}, bool, error) {
+		value, excludeRow, err := first(value)
+		if err != nil || excludeRow {
+			return value, excludeRow, err
+		}
+		return second(value)
+	}
+}
+
+func leastRestrictive(groupOperations []*TableOperations) *TableOperations {
+	allTableOperations := NewTableOperations()
+
+	var tables []string
+	for _, tableOperations := range groupOperations {
+		tables = mergeStringSlice(tables, tableOperations.tables())
+	}
+
+	// Only restrict to aggregates if every group does
+	allTableOperations.AggregatesOnly = true
+	for _, tableOperations := range groupOperations {
+		allTableOperations.AggregatesOnly = allTableOperations.AggregatesOnly && tableOperations.AggregatesOnly
+	}
+
+	for _, tableName := range tables {
+		// Only keep an allow-list if every group has one, in which case a column allowed by any group is allowed
+		var allowedCols []string
+		everyGroupAllows := true
+		for _, tableOperations := range groupOperations {
+			cols, ok := tableOperations.AllowedCols[tableName]
+			if !ok {
+				everyGroupAllows = false
+				break
+			}
+			allowedCols = mergeStringSlice(allowedCols, cols)
+		}
+		if everyGroupAllows {
+			allTableOperations.AllowedCols[tableName] = append([]string{}, allowedCols...)
+		}
+
+		// Columns are excluded if no group can see them
+		var excludedCols []string
+		for _, tableOperations := range groupOperations {
+			for _, col := range tableOperations.ExcludedCols[tableName] {
+				if !anyColumnVisible(groupOperations, tableName, col) {
+					excludedCols = mergeStringSlice(excludedCols, []string{col})
+				}
+			}
+		}
+		if len(excludedCols) > 0 {
+			allTableOperations.ExcludedCols[tableName] = excludedCols
+		}
+
+		// A column is transformed only if every group which can see it transforms it, in SQL or in Go
+		tableTransform := make(TableTransform)
+		sqlTableTransform := make(SQLTableTransform)
+		var transformedCols []string
+		for _, tableOperations := range groupOperations {
+			transformedCols = mergeStringSlice(transformedCols, tableOperations.transformedColumns(tableName))
+		}
+		for _, col := range transformedCols {
+			var first *TableOperations
+			for _, other := range groupOperations {
+				if !other.columnVisible(tableName, col) {
+					continue
+				}
+				if !contains(other.transformedColumns(tableName), col) {
+					first = nil
+					break
+				}
+				if first == nil {
+					first = other
+				}
+			}
+			if first == nil {
+				continue
+			}
+			if transform, ok := first.TableTransforms[tableName][col]; ok {
+				tableTransform[col] = transform
+				if transformID, ok := first.TransformIDs[tableName][col]; ok {
+					allTableOperations.setTransformID(tableName, col, transformID)
+				}
+				if first.SideEffects[tableName][col] {
+					allTableOperations.setSideEffects(tableName, col)
+				}
+			}
+			if transform, ok := first.SQLTransforms[tableName][col]; ok {
+				sqlTableTransform[col] = transform
+			}
+		}
+		if len(tableTransform) > 0 {
+			allTableOperations.TableTransforms[tableName] = tableTransform
+		}
+		if len(sqlTableTransform) > 0 {
+			allTableOperations.SQLTransforms[tableName] = sqlTableTransform
+		}
+
+		everyGroupRowTransforms := true
+		for _, tableOperations := range groupOperations {
+			if len(tableOperations.RowTransforms[tableName]) == 0 {
+				everyGroupRowTransforms = false
+				break
+			}
+		}
+		if everyGroupRowTransforms {
+			// Which group's row transforms reveal the most cannot be known, so the group listed first decides
+			allTableOperations.RowTransforms[tableName] = groupOperations[0].RowTransforms[tableName]
+		}
+
+		// Rows are visible, or writable, if they satisfy the filters of any group, so there are none if a group has
+		// none
+		rowFilters := anyRowFilters(groupOperations,
+			func(t *TableOperations) []RowFilter { return t.RowFilters[tableName] })
+		if rowFilters != nil {
+			allTableOperations.RowFilters[tableName] = rowFilters
+		}
+		writeFilters := anyRowFilters(groupOperations,
+			func(t *TableOperations) []RowFilter { return t.WriteFilters[tableName] })
+		if writeFilters != nil {
+			allTableOperations.WriteFilters[tableName] = writeFilters
+		}
+	}
+
+	return allTableOperations
+}
+
+// anyRowFilters returns filters which rows satisfy if they satisfy the filters of any group, it returns nil if a
+// group has no filters
+func anyRowFilters(groupOperations []*TableOperations, filters func(*TableOperations) []RowFilter) []RowFilter {
+	var anyOf [][]RowFilter
+	for _, tableOperations := range groupOperations {
+		rowFilters := filters(tableOperations)
+		if len(rowFilters) == 0 {
+			return nil
+		}
+		anyOf = append(anyOf, rowFilters)
+	}
+	if len(anyOf) == 1 {
+		return anyOf[0]
+	}
+	return []RowFilter{{AnyOf: anyOf}}
+}
+
+func anyColumnVisible(groupOperations []*TableOperations, tableName string, column string) bool {
+	for _, tableOperations := range groupOperations {
+		if tableOperations.columnVisible(tableName, column) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,346 @@
+package middleware
+
+import (
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func appendTransform(suffix string) ColumnTransform {
+	return func(i interface{}) (interface{}, bool, error) {
+		return i.(string) + suffix, false, nil
+	}
+}
+
+func dropTransform(value string) ColumnTransform {
+	return func(i interface{}) (interface{}, bool, error) {
+		return i, strings.Contains(i.(string), value), nil
+	}
+}
+
+// conflictingDataPolicy returns a policy where alice is a member of three groups, all of which have operations on
+// table1
+func conflictingDataPolicy(strategy ConflictStrategy) *StaticDataPolicy {
+	group1 := NewPrivacyGroup("Group1")
+	group1.Add("alice")
+	group1.SetPriority(1)
+	group2 := NewPrivacyGroup("Group2")
+	group2.AddMany([]string{"alice", "bob"})
+	group2.SetPriority(5)
+	group3 := NewPrivacyGroup("Group3")
+	group3.AddMany([]string{"alice", "bob"})
+	group3.SetPriority(5)
+
+	transforms := DataTransforms{
+		group1: {
+			TableTransforms: map[string]TableTransform{"table1": {"col1": appendTransform("-1")}},
+			ExcludedCols:    map[string][]string{"table1": {"col2", "col3"}},
+			RowFilters:      map[string][]RowFilter{"table1": {{Column: "region", Operator: "=", Value: "EU"}}},
+		},
+		group2: {
+			TableTransforms: map[string]TableTransform{
+				"table1": {"col1": appendTransform("-2"), "col3": appendTransform("-2")},
+			},
+			ExcludedCols: map[string][]string{"table1": {"col2"}},
+			AllowedCols:  map[string][]string{"table1": {"col1", "col2", "col3"}},
+			RowFilters:   map[string][]RowFilter{"table1": {{Column: "owner_id", Operator: "=", Value: RequesterIDValue}}},
+		},
+		group3: {
+			TableTransforms: map[string]TableTransform{"table1": {"col1": dropTransform("secret")}},
+			AllowedCols:     map[string][]string{"table1": {"col1", "col4"}},
+		},
+	}
+
+	return NewStaticDataPolicyWithStrategy([]*PrivacyGroup{group1, group2, group3}, transforms, strategy)
+}
+
+func applyTransform(t *testing.T, tableOperations *TableOperations, column string, value string) (interface{}, bool) {
+	transform, ok := tableOperations.TableTransforms["table1"][column]
+	require.True(t, ok)
+	transformed, excludeRow, err := transform(value)
+	require.NoError(t, err)
+	return transformed, excludeRow
+}
+
+func TestStaticDataPolicy_Resolve_MergeOrFail(t *testing.T) {
+	dataPolicy := conflictingDataPolicy(MergeOrFail)
+
+	_, err := dataPolicy.Resolve("alice")
+	require.EqualError(t, err, "multiple data policies with different transforms for the same table apply, cannot resolve")
+}
+
+func TestStaticDataPolicy_Resolve_FirstMatch(t *testing.T) {
+	dataPolicy := conflictingDataPolicy(FirstMatch)
+
+	tableOperations, err := dataPolicy.Resolve("alice")
+	require.NoError(t, err)
+
+	transformed, _ := applyTransform(t, tableOperations, "col1", "a")
+	require.Equal(t, "a-1", transformed)
+	require.NotContains(t, tableOperations.TableTransforms["table1"], "col3")
+	require.Equal(t, []string{"col2", "col3"}, tableOperations.ExcludedCols["table1"])
+	require.Empty(t, tableOperations.AllowedCols)
+	require.Len(t, tableOperations.RowFilters["table1"], 1)
+
+	// Bob's first group is Group2
+	tableOperations, err = dataPolicy.Resolve("bob")
+	require.NoError(t, err)
+	transformed, _ = applyTransform(t, tableOperations, "col1", "a")
+	require.Equal(t, "a-2", transformed)
+}
+
+func TestStaticDataPolicy_Resolve_HighestPriority(t *testing.T) {
+	dataPolicy := conflictingDataPolicy(HighestPriority)
+
+	// Group2 and Group3 share the highest priority and both transform col1
+	_, err := dataPolicy.Resolve("alice")
+	require.EqualError(t, err, "multiple data policies with different transforms for the same table apply, cannot resolve")
+
+	before := dataPolicy.LastUpdated()
+	time.Sleep(time.Millisecond)
+	dataPolicy.privacyGroups[2].SetPriority(0)
+	require.True(t, dataPolicy.LastUpdated().After(before))
+	tableOperations, err := dataPolicy.Resolve("alice")
+	require.NoError(t, err)
+
+	transformed, _ := applyTransform(t, tableOperations, "col1", "a")
+	require.Equal(t, "a-2", transformed)
+	require.Equal(t, []string{"col2"}, tableOperations.ExcludedCols["table1"])
+	require.Equal(t, []RowFilter{{Column: "owner_id", Operator: "=", Value: RequesterIDValue}},
+		tableOperations.RowFilters["table1"])
+}
+
+func TestStaticDataPolicy_Resolve_MostRestrictive(t *testing.T) {
+	dataPolicy := conflictingDataPolicy(MostRestrictive)
+
+	tableOperations, err := dataPolicy.Resolve("alice")
+	require.NoError(t, err)
+
+	// Transforms are composed in group order and any of them can drop the row
+	transformed, excludeRow := applyTransform(t, tableOperations, "col1", "a")
+	require.Equal(t, "a-1-2", transformed)
+	require.False(t, excludeRow)
+	_, excludeRow = applyTransform(t, tableOperations, "col1", "secret")
+	require.True(t, excludeRow)
+
+	// Only col1 is allowed by both allow-lists and not excluded
+	require.True(t, tableOperations.columnVisible("table1", "col1"))
+	for _, col := range []string{"col2", "col3", "col4", "col5"} {
+		require.False(t, tableOperations.columnVisible("table1", col), col)
+	}
+
+	require.Equal(t, []RowFilter{
+		{Column: "region", Operator: "=", Value: "EU"},
+		{Column: "owner_id", Operator: "=", Value: RequesterIDValue},
+	}, tableOperations.RowFilters["table1"])
+
+	// Resolving must not change the policy itself
+	tableOperations, err = dataPolicy.Resolve("alice")
+	require.NoError(t, err)
+	transformed, _ = applyTransform(t, tableOperations, "col1", "a")
+	require.Equal(t, "a-1-2", transformed)
+}
+
+func TestStaticDataPolicy_Resolve_LeastRestrictive(t *testing.T) {
+	dataPolicy := conflictingDataPolicy(LeastRestrictive)
+
+	tableOperations, err := dataPolicy.Resolve("alice")
+	require.NoError(t, err)
+
+	// Group1 has no allow-list so every column it does not exclude is visible
+	require.NotContains(t, tableOperations.AllowedCols, "table1")
+	// col2 is hidden from every group, col3 is visible to Group2
+	require.Equal(t, []string{"col2"}, tableOperations.ExcludedCols["table1"])
+	require.True(t, tableOperations.columnVisible("table1", "col3"))
+	require.True(t, tableOperations.columnVisible("table1", "col5"))
+
+	// Every group transforms col1 so the first group's transform is used, only Group2 can see col3
+	transformed, _ := applyTransform(t, tableOperations, "col1", "a")
+	require.Equal(t, "a-1", transformed)
+	transformed, _ = applyTransform(t, tableOperations, "col3", "a")
+	require.Equal(t, "a-2", transformed)
+
+	// Group3 has no row filters so every row is visible
+	require.Empty(t, tableOperations.RowFilters["table1"])
+
+	// Bob can see rows satisfying the filters of either of his groups
+	dataPolicy.transforms[dataPolicy.privacyGroups[2]].RowFilters = map[string][]RowFilter{
+		"table1": {{Column: "deleted", Operator: "IS NULL"}},
+	}
+	tableOperations, err = dataPolicy.Resolve("bob")
+	require.NoError(t, err)
+	require.Equal(t, []RowFilter{{AnyOf: [][]RowFilter{
+		{{Column: "owner_id", Operator: "=", Value: RequesterIDValue}},
+		{{Column: "deleted", Operator: "IS NULL"}},
+	}}}, tableOperations.RowFilters["table1"])
+	require.Equal(t, []string{"col1", "col2", "col3", "col4"}, tableOperations.AllowedCols["table1"])
+	require.False(t, tableOperations.columnVisible("table1", "col2"))
+	require.True(t, tableOperations.columnVisible("table1", "col4"))
+
+	// Write filters are combined in the same way as row filters
+	require.Empty(t, tableOperations.WriteFilters["table1"])
+	dataPolicy.transforms[dataPolicy.privacyGroups[1]].WriteFilters = map[string][]RowFilter{
+		"table1": {{Column: "owner_id", Operator: "=", Value: RequesterIDValue}},
+	}
+	dataPolicy.transforms[dataPolicy.privacyGroups[2]].WriteFilters = map[string][]RowFilter{
+		"table1": {{Column: "region", Operator: "=", Value: "EU"}},
+	}
+	tableOperations, err = dataPolicy.Resolve("bob")
+	require.NoError(t, err)
+	require.Equal(t, []RowFilter{{AnyOf: [][]RowFilter{
+		{{Column: "owner_id", Operator: "=", Value: RequesterIDValue}},
+		{{Column: "region", Operator: "=", Value: "EU"}},
+	}}}, tableOperations.WriteFilters["table1"])
+}
+
+func TestConflictStrategyFromString(t *testing.T) {
+	for _, strategy := range []ConflictStrategy{MergeOrFail, FirstMatch, HighestPriority, MostRestrictive, LeastRestrictive} {
+		parsed, err := ConflictStrategyFromString(strategy.ToString())
+		require.NoError(t, err)
+		require.Equal(t, strategy, parsed)
+	}
+
+	_, err := ConflictStrategyFromString("random")
+	require.EqualError(t, err, "cannot parse random as a conflict strategy")
+}
+
+func TestStaticDataPolicy_Resolve_RowTransforms(t *testing.T) {
+	group1 := NewPrivacyGroup("Group1")
+	group1.Add("alice")
+	group2 := NewPrivacyGroup("Group2")
+	group2.Add("alice")
+
+	var applied []string
+	recordRowTransform := func(name string) RowTransform {
+		return func(row map[string]interface{}) (bool, error) {
+			applied = append(applied, name)
+			return false, nil
+		}
+	}
+
+	transforms := DataTransforms{
+		group1: {RowTransforms: map[string][]RowTransform{"table1": {recordRowTransform("1")}}},
+		group2: {RowTransforms: map[string][]RowTransform{
+			"table1": {recordRowTransform("2a"), recordRowTransform("2b")},
+			"table2": {recordRowTransform("2c")},
+		}},
+	}
+
+	testCases := []struct {
+		strategy ConflictStrategy
+		table1   []string
+		table2   []string
+	}{
+		{MergeOrFail, []string{"1", "2a", "2b"}, []string{"2c"}},
+		{FirstMatch, []string{"1"}, nil},
+		{MostRestrictive, []string{"1", "2a", "2b"}, []string{"2c"}},
+		{LeastRestrictive, []string{"1"}, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.strategy.ToString(), func(t *testing.T) {
+			dataPolicy := NewStaticDataPolicyWithStrategy([]*PrivacyGroup{group1, group2}, transforms, tc.strategy)
+			tableOperations, err := dataPolicy.Resolve("alice")
+			require.NoError(t, err)
+
+			for table, expected := range map[string][]string{"table1": tc.table1, "table2": tc.table2} {
+				applied = nil
+				for _, rowTransform := range tableOperations.RowTransforms[table] {
+					_, err := rowTransform(nil)
+					require.NoError(t, err)
+				}
+				require.Equal(t, expected, applied, table)
+			}
+		})
+	}
+
+	// The least restrictive row transforms cannot be known, so those of the group listed first are applied
+	dataPolicy := NewStaticDataPolicyWithStrategy([]*PrivacyGroup{group2, group1}, transforms, LeastRestrictive)
+	tableOperations, err := dataPolicy.Resolve("alice")
+	require.NoError(t, err)
+	applied = nil
+	for _, rowTransform := range tableOperations.RowTransforms["table1"] {
+		_, err := rowTransform(nil)
+		require.NoError(t, err)
+	}
+	require.Equal(t, []string{"2a", "2b"}, applied)
+}
+
+func TestStaticDataPolicy_Resolve_SQLTransforms(t *testing.T) {
+	group1 := NewPrivacyGroup("Group1")
+	group1.Add("alice")
+	group2 := NewPrivacyGroup("Group2")
+	group2.Add("alice")
+
+	transforms := DataTransforms{
+		group1: {SQLTransforms: map[string]SQLTableTransform{"table1": {"col1": RoundSQLTransform(0)}}},
+		group2: {
+			SQLTransforms:   map[string]SQLTableTransform{"table1": {"col1": HashSQLTransform("")}},
+			TableTransforms: map[string]TableTransform{"table1": {"col2": appendTransform("-2")}},
+		},
+	}
+
+	dataPolicy := NewStaticDataPolicyWithStrategy([]*PrivacyGroup{group1, group2}, transforms, MergeOrFail)
+	_, err := dataPolicy.Resolve("alice")
+	require.EqualError(t, err, "multiple data policies with different transforms for the same table apply, cannot resolve")
+
+	// SQL transforms are composed by nesting their expressions
+	dataPolicy.Strategy = MostRestrictive
+	tableOperations, err := dataPolicy.Resolve("alice")
+	require.NoError(t, err)
+	require.Equal(t, "SHA2(CONCAT('', ROUND(`col1`, 0)), 256)", tableOperations.SQLTransforms["table1"]["col1"]("`col1`"))
+	require.False(t, tableOperations.inline("table1"))
+
+	// Only group2 transforms col2 so it is not transformed, both transform col1 so group1's transform is used
+	dataPolicy.Strategy = LeastRestrictive
+	tableOperations, err = dataPolicy.Resolve("alice")
+	require.NoError(t, err)
+	require.Equal(t, []string{"col1"}, tableOperations.transformedColumns("table1"))
+	require.Equal(t, "ROUND(`col1`, 0)", tableOperations.SQLTransforms["table1"]["col1"]("`col1`"))
+	require.True(t, tableOperations.inline("table1"))
+}
+
+func TestStaticDataPolicy_Resolve_TransformIDs(t *testing.T) {
+	dataPolicy := conflictingDataPolicy(MostRestrictive)
+	dataPolicy.transforms[dataPolicy.privacyGroups[0]].setTransformID("table1", "col1", "append-1")
+	dataPolicy.transforms[dataPolicy.privacyGroups[1]].setTransformID("table1", "col1", "append-2")
+	dataPolicy.transforms[dataPolicy.privacyGroups[1]].setTransformID("table1", "col3", "append-2")
+
+	// Group3's transform of col1 has no ID so neither does the composition of every group's transform
+	tableOperations, err := dataPolicy.Resolve("alice")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"col3": "append-2"}, tableOperations.TransformIDs["table1"])
+
+	dataPolicy.transforms[dataPolicy.privacyGroups[2]].setTransformID("table1", "col1", "drop-secret")
+	tableOperations, err = dataPolicy.Resolve("alice")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"col1": "append-1 then append-2 then drop-secret", "col3": "append-2"},
+		tableOperations.TransformIDs["table1"])
+
+	// The ID of the transform which is used is kept
+	dataPolicy.Strategy = LeastRestrictive
+	tableOperations, err = dataPolicy.Resolve("alice")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"col1": "append-1", "col3": "append-2"}, tableOperations.TransformIDs["table1"])
+}
+
+func TestStaticDataPolicy_Resolve_SideEffects(t *testing.T) {
+	dataPolicy := conflictingDataPolicy(MostRestrictive)
+	dataPolicy.transforms[dataPolicy.privacyGroups[1]].setSideEffects("table1", "col1")
+
+	// Composing a transform with side effects gives one with side effects
+	tableOperations, err := dataPolicy.Resolve("alice")
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{"col1": true}, tableOperations.SideEffects["table1"])
+
+	// Only the side effects of the transform which is used are kept
+	dataPolicy.Strategy = LeastRestrictive
+	tableOperations, err = dataPolicy.Resolve("alice")
+	require.NoError(t, err)
+	require.Empty(t, tableOperations.SideEffects["table1"])
+	dataPolicy.transforms[dataPolicy.privacyGroups[0]].setSideEffects("table1", "col1")
+	tableOperations, err = dataPolicy.Resolve("alice")
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{"col1": true}, tableOperations.SideEffects["table1"])
+}
@@ -0,0 +1,428 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// conformanceBackend describes a PrivateRelationalDatabase implementation for the conformance suite
+type conformanceBackend struct {
+	// newDatabase returns a database with the DataPolicy which is connected for the duration of the test
+	newDatabase func(t *testing.T, dataPolicy DataPolicy, cacheTables bool) PrivateRelationalDatabase
+	// updateResolution is the precision with which the database records when tables change, tests wait this long
+	// between building a cached table and changing its source table
+	updateResolution time.Duration
+	// foldsTableNames is whether the database matches table names regardless of case
+	foldsTableNames bool
+}
+
+// conformanceTable is the table created by the conformance suite
+const conformanceTable = "conformance_people"
+
+// conformanceAdmin is the requester the suite uses to set up its fixture, they can see and change everything
+const conformanceAdmin = "conformance_admin"
+
+// conformanceReader is the requester the suite applies its TableOperations to
+const conformanceReader = "conformance_reader"
+
+// conformancePolicy returns a policy which gives the reader the TableOperations and the admin full access, the
+// readers' group is returned so that tests can change the policy
+func conformancePolicy(tableOperations *TableOperations) (*StaticDataPolicy, *PrivacyGroup) {
+	admins := NewPrivacyGroup("ConformanceAdmins")
+	admins.Add(conformanceAdmin)
+	readers := NewPrivacyGroup("ConformanceReaders")
+	readers.Add(conformanceReader)
+	return NewStaticDataPolicy([]*PrivacyGroup{admins, readers}, DataTransforms{
+		admins:  NewTableOperations(),
+		readers: tableOperations,
+	}), readers
+}
+
+// createConformanceFixture replaces the suite's table with one holding three people, the statements only use SQL
+// which every backend understands. The middleware refuses to change the schema so the table is created on the
+// underlying database, and its updates tracked as Connect would have.
+func createConformanceFixture(t *testing.T, db PrivateRelationalDatabase) {
+	pd := db.(interface{ core() *privateDatabase }).core()
+	_, err := pd.database.Exec("DROP TABLE IF EXISTS " + conformanceTable)
+	require.NoError(t, err)
+	_, err = pd.database.Exec("CREATE TABLE " + conformanceTable +
+		" (id INTEGER PRIMARY KEY, name VARCHAR(64), dob DATE, salary INTEGER)")
+	require.NoError(t, err)
+	if pd.CacheTables {
+		require.NoError(t, pd.trackTableUpdates(context.Background()))
+	}
+
+	admin := localRequestPolicy(conformanceAdmin)
+	_, err = db.Exec("INSERT INTO "+conformanceTable+" (id, name, dob, salary) VALUES "+
+		"(1, 'alice', '1990-05-17', 50000), (2, 'bob', '1985-11-02', 60000), (3, 'charlie', '2001-01-30', 70000)",
+		admin)
+	require.NoError(t, err)
+}
+
+// conformanceNames returns the names the reader sees, in order of id
+func conformanceNames(t *testing.T, db PrivateRelationalDatabase) []string {
+	rows, err := db.Query("SELECT name FROM "+conformanceTable+" ORDER BY id", localRequestPolicy(conformanceReader))
+	require.NoError(t, err)
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		require.NoError(t, rows.Scan(&name))
+		names = append(names, name)
+	}
+	require.NoError(t, rows.Err())
+	return names
+}
+
+// testConformance checks that a backend gives the guarantees every PrivateRelationalDatabase must, each test runs
+// with and without cached tables
+func testConformance(t *testing.T, backend conformanceBackend) {
+	for _, cacheTables := range []bool{false, true} {
+		cacheTables := cacheTables
+		t.Run(fmt.Sprintf("CacheTables=%t", cacheTables), func(t *testing.T) {
+			setUp := func(t *testing.T, tableOperations *TableOperations) (PrivateRelationalDatabase, *PrivacyGroup) {
+				policy, readers := conformancePolicy(tableOperations)
+				db := backend.newDatabase(t, policy, cacheTables)
+				createConformanceFixture(t, db)
+				return db, readers
+			}
+
+			t.Run("Exclusions", func(t *testing.T) {
+				tableOperations := NewTableOperations()
+				tableOperations.ExcludedCols[conformanceTable] = []string{"salary"}
+				db, _ := setUp(t, tableOperations)
+
+				rows, err := db.Query("SELECT * FROM "+conformanceTable, localRequestPolicy(conformanceReader))
+				require.NoError(t, err)
+				cols, err := rows.Columns()
+				require.NoError(t, err)
+				require.NoError(t, rows.Close())
+				require.Equal(t, []string{"id", "name", "dob"}, cols)
+
+				_, err = db.Query("SELECT salary FROM "+conformanceTable, localRequestPolicy(conformanceReader))
+				require.Error(t, err)
+			})
+
+			t.Run("Transforms", func(t *testing.T) {
+				redact, err := RedactSQLTransform(1, "*")
+				require.NoError(t, err)
+				tableOperations := NewTableOperations()
+				tableOperations.TableTransforms[conformanceTable] = TableTransform{"salary": RoundTransform(-5)}
+				tableOperations.SQLTransforms[conformanceTable] = SQLTableTransform{"name": redact}
+				db, _ := setUp(t, tableOperations)
+
+				rows, err := db.Query("SELECT name, salary FROM "+conformanceTable+" ORDER BY id",
+					localRequestPolicy(conformanceReader))
+				require.NoError(t, err)
+				defer rows.Close()
+
+				var (
+					names    []string
+					salaries []float64
+				)
+				for rows.Next() {
+					var (
+						name   string
+						salary float64
+					)
+					require.NoError(t, rows.Scan(&name, &salary))
+					names = append(names, name)
+					salaries = append(salaries, salary)
+				}
+				require.NoError(t, rows.Err())
+				require.Equal(t, []string{"a****", "b**", "c******"}, names)
+				require.Len(t, salaries, 3)
+				for _, salary := range salaries {
+					// Rounding to a negative number of places is only exact to floating point precision
+					require.InDelta(t, 100000, salary, 0.001)
+				}
+
+				// Transforms do not apply to other requesters
+				var salary float64
+				row, err := db.QueryRow("SELECT salary FROM "+conformanceTable+" WHERE id = 1",
+					localRequestPolicy(conformanceAdmin))
+				require.NoError(t, err)
+				require.NoError(t, row.Scan(&salary))
+				require.Equal(t, float64(50000), salary)
+			})
+
+			t.Run("RowDrops", func(t *testing.T) {
+				dropBob, err := DropRowIfTransform("=", "bob")
+				require.NoError(t, err)
+				tableOperations := NewTableOperations()
+				tableOperations.RowFilters[conformanceTable] = []RowFilter{
+					{Column: "salary", Operator: "<", Value: 65000},
+				}
+				tableOperations.TableTransforms[conformanceTable] = TableTransform{"name": dropBob}
+				db, _ := setUp(t, tableOperations)
+
+				require.Equal(t, []string{"alice"}, conformanceNames(t, db))
+			})
+
+			t.Run("WriteChecks", func(t *testing.T) {
+				tableOperations := NewTableOperations()
+				tableOperations.ExcludedCols[conformanceTable] = []string{"salary"}
+				db, _ := setUp(t, tableOperations)
+
+				// Writes which refer to columns excluded from the requester are refused
+				_, err := db.Exec("UPDATE "+conformanceTable+" SET salary = 0", localRequestPolicy(conformanceReader))
+				require.Error(t, err)
+				_, err = db.Exec("DELETE FROM "+conformanceTable+" WHERE salary > 70000",
+					localRequestPolicy(conformanceReader))
+				require.Error(t, err)
+				require.Equal(t, []string{"alice", "bob", "charlie"}, conformanceNames(t, db))
+
+				// Writes which only refer to visible columns are allowed
+				_, err = db.Exec("UPDATE "+conformanceTable+" SET name = 'alice' WHERE id = 1",
+					localRequestPolicy(conformanceReader))
+				require.NoError(t, err)
+
+				// Transformed columns can be written but not read, as the rows affected would reveal their values
+				delete(tableOperations.ExcludedCols, conformanceTable)
+				tableOperations.TableTransforms[conformanceTable] = TableTransform{"salary": RoundTransform(-5)}
+				_, err = db.Exec("UPDATE "+conformanceTable+" SET name = 'alicia', salary = 55000 WHERE id = 1",
+					localRequestPolicy(conformanceReader))
+				require.NoError(t, err)
+				require.Equal(t, []string{"alicia", "bob", "charlie"}, conformanceNames(t, db))
+				_, err = db.Exec("DELETE FROM "+conformanceTable+" WHERE salary = 60000",
+					localRequestPolicy(conformanceReader))
+				require.Error(t, err)
+				_, err = db.Exec("UPDATE "+conformanceTable+" SET name = salary WHERE id = 1",
+					localRequestPolicy(conformanceReader))
+				require.Error(t, err)
+
+				// Rows the requester cannot read are not written either
+				tableOperations.RowFilters[conformanceTable] = []RowFilter{
+					{Column: "name", Operator: "!=", Value: "bob"},
+				}
+				result, err := db.Exec("DELETE FROM "+conformanceTable+" WHERE id = 2",
+					localRequestPolicy(conformanceReader))
+				require.NoError(t, err)
+				rowsAffected, err := result.RowsAffected()
+				require.NoError(t, err)
+				require.Equal(t, int64(0), rowsAffected)
+				result, err = db.Exec("UPDATE "+conformanceTable+" SET dob = '2000-01-01'",
+					localRequestPolicy(conformanceReader))
+				require.NoError(t, err)
+				rowsAffected, err = result.RowsAffected()
+				require.NoError(t, err)
+				require.Equal(t, int64(2), rowsAffected)
+				tableOperations.RowFilters[conformanceTable] = nil
+
+				// Requesters outside the policy cannot write
+				_, err = db.Exec("UPDATE "+conformanceTable+" SET name = 'bobby' WHERE id = 2",
+					localRequestPolicy("conformance_stranger"))
+				require.Error(t, err)
+			})
+
+			t.Run("WriteFilters", func(t *testing.T) {
+				tableOperations := NewTableOperations()
+				tableOperations.WriteFilters[conformanceTable] = []RowFilter{
+					{Column: "salary", Operator: "<", Value: 65000},
+				}
+				db, _ := setUp(t, tableOperations)
+				reader := localRequestPolicy(conformanceReader)
+
+				// Updates and deletes only change the rows the requester may write, and only count those
+				result, err := db.Exec("UPDATE "+conformanceTable+" SET name = 'robert' WHERE name = 'bob'", reader)
+				require.NoError(t, err)
+				rowsAffected, err := result.RowsAffected()
+				require.NoError(t, err)
+				require.Equal(t, int64(1), rowsAffected)
+				result, err = db.Exec("UPDATE "+conformanceTable+" SET name = 'charles' WHERE name = 'charlie'", reader)
+				require.NoError(t, err)
+				rowsAffected, err = result.RowsAffected()
+				require.NoError(t, err)
+				require.Equal(t, int64(0), rowsAffected)
+
+				// Rows cannot be updated so that the requester could no longer write them
+				result, err = db.Exec("UPDATE "+conformanceTable+" SET salary = 90000 WHERE id = 1", reader)
+				require.NoError(t, err)
+				rowsAffected, err = result.RowsAffected()
+				require.NoError(t, err)
+				require.Equal(t, int64(0), rowsAffected)
+
+				result, err = db.Exec("DELETE FROM "+conformanceTable, reader)
+				require.NoError(t, err)
+				rowsAffected, err = result.RowsAffected()
+				require.NoError(t, err)
+				require.Equal(t, int64(2), rowsAffected)
+
+				// Inserted rows must satisfy the filters
+				_, err = db.Exec("INSERT INTO "+conformanceTable+" (id, name, dob, salary) "+
+					"VALUES (4, 'dave', '1970-01-01', 40000)", reader)
+				require.NoError(t, err)
+				_, err = db.Exec("INSERT INTO "+conformanceTable+" (id, name, dob, salary) "+
+					"VALUES (5, 'erin', '1972-01-01', 80000)", reader)
+				require.Equal(t, ErrWriteDenied, err)
+				_, err = db.Exec("INSERT INTO "+conformanceTable+" (id, name) VALUES (6, 'frank')", reader)
+				require.Equal(t, ErrWriteDenied, err)
+
+				require.Equal(t, []string{"charlie", "dave"}, conformanceNames(t, db))
+			})
+
+			t.Run("TableNameCase", func(t *testing.T) {
+				if !backend.foldsTableNames {
+					t.Skip("the database matches table names by case")
+				}
+				tableOperations := NewTableOperations()
+				tableOperations.ExcludedCols[conformanceTable] = []string{"salary"}
+				tableOperations.RowFilters[conformanceTable] = []RowFilter{{Column: "name", Operator: "!=", Value: "bob"}}
+				tableOperations.WriteFilters[conformanceTable] = []RowFilter{
+					{Column: "name", Operator: "!=", Value: "bob"},
+				}
+				db, _ := setUp(t, tableOperations)
+				reader := localRequestPolicy(conformanceReader)
+				upperTable := strings.ToUpper(conformanceTable)
+
+				// The policy for a table applies however a query writes its name
+				_, err := db.Query("SELECT name, salary FROM "+upperTable, reader)
+				require.Error(t, err)
+				rows, err := db.Query("SELECT * FROM "+upperTable+" ORDER BY id", reader)
+				require.NoError(t, err)
+				cols, err := rows.Columns()
+				require.NoError(t, err)
+				var names []string
+				for rows.Next() {
+					var (
+						id        int
+						name, dob string
+					)
+					require.NoError(t, rows.Scan(&id, &name, &dob))
+					names = append(names, name)
+				}
+				require.NoError(t, rows.Close())
+				require.Equal(t, []string{"id", "name", "dob"}, cols)
+				require.Equal(t, []string{"alice", "charlie"}, names)
+
+				_, err = db.Exec("UPDATE "+upperTable+" SET salary = 0", reader)
+				require.Error(t, err)
+				result, err := db.Exec("DELETE FROM "+upperTable+" WHERE id = 2", reader)
+				require.NoError(t, err)
+				rowsAffected, err := result.RowsAffected()
+				require.NoError(t, err)
+				require.Equal(t, int64(0), rowsAffected)
+			})
+
+			t.Run("CacheInvalidation", func(t *testing.T) {
+				tableOperations := NewTableOperations()
+				tableOperations.TableTransforms[conformanceTable] = TableTransform{"salary": RoundTransform(-5)}
+				db, readers := setUp(t, tableOperations)
+				require.Equal(t, []string{"alice", "bob", "charlie"}, conformanceNames(t, db))
+
+				// Changing the table is seen by the next query
+				time.Sleep(backend.updateResolution)
+				_, err := db.Exec("INSERT INTO "+conformanceTable+" (id, name, dob, salary) "+
+					"VALUES (4, 'dave', '1970-01-01', 80000)", localRequestPolicy(conformanceAdmin))
+				require.NoError(t, err)
+				require.Equal(t, []string{"alice", "bob", "charlie", "dave"}, conformanceNames(t, db))
+
+				// Changing the policy is seen by the next query
+				time.Sleep(backend.updateResolution)
+				tableOperations.RowFilters[conformanceTable] = []RowFilter{{Column: "name", Operator: "!=", Value: "bob"}}
+				readers.Add("conformance_other_reader")
+				require.Equal(t, []string{"alice", "charlie", "dave"}, conformanceNames(t, db))
+			})
+
+			t.Run("Concurrency", func(t *testing.T) {
+				tableOperations := NewTableOperations()
+				tableOperations.TableTransforms[conformanceTable] = TableTransform{"salary": RoundTransform(-5)}
+				tableOperations.RowFilters[conformanceTable] = []RowFilter{{Column: "name", Operator: "!=", Value: "bob"}}
+				db, _ := setUp(t, tableOperations)
+
+				const queriers = 8
+				var wg sync.WaitGroup
+				results := make(chan error, queriers)
+				for i := 0; i < queriers; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for j := 0; j < 5; j++ {
+							var count int
+							row, err := db.QueryRow("SELECT COUNT(*) FROM "+conformanceTable,
+								localRequestPolicy(conformanceReader))
+							if err == nil {
+								err = row.Scan(&count)
+							}
+							if err == nil && count != 2 {
+								err = fmt.Errorf("read %d rows rather than 2", count)
+							}
+							if err != nil {
+								results <- err
+								return
+							}
+						}
+						results <- nil
+					}()
+				}
+				wg.Wait()
+				close(results)
+				for err := range results {
+					require.NoError(t, err)
+				}
+			})
+		})
+	}
+}
+
+// conformanceConnection reads the connection details of a database server for the conformance suite from the
+// environment variables with the prefix, the test is skipped if <prefix>_HOST is not set
+func conformanceConnection(t *testing.T, prefix string) (user, password, databaseName, host string, port int) {
+	host = os.Getenv(prefix + "_HOST")
+	if host == "" {
+		t.Skipf("%s_HOST is not set", prefix)
+	}
+	port, err := strconv.Atoi(os.Getenv(prefix + "_PORT"))
+	require.NoError(t, err, "%s_PORT must be a port number", prefix)
+	return os.Getenv(prefix + "_USER"), os.Getenv(prefix + "_PASSWORD"), os.Getenv(prefix + "_DATABASE"), host, port
+}
+
+func TestConformance_SQLite(t *testing.T) {
+	testConformance(t, conformanceBackend{
+		newDatabase: func(t *testing.T, dataPolicy DataPolicy, cacheTables bool) PrivateRelationalDatabase {
+			db := &SQLitePrivateDatabase{DataPolicy: dataPolicy, CacheTables: cacheTables}
+			require.NoError(t, db.Connect("", "", filepath.Join(t.TempDir(), "conformance.db"), "", 0))
+			t.Cleanup(func() { db.Close() })
+			return db
+		},
+		updateResolution: 5 * time.Millisecond,
+		foldsTableNames:  true,
+	})
+}
+
+func TestConformance_MySQL(t *testing.T) {
+	user, password, databaseName, host, port := conformanceConnection(t, "PAM_TEST_MYSQL")
+	testConformance(t, conformanceBackend{
+		newDatabase: func(t *testing.T, dataPolicy DataPolicy, cacheTables bool) PrivateRelationalDatabase {
+			db := &MySQLPrivateDatabase{DataPolicy: dataPolicy, CacheTables: cacheTables}
+			require.NoError(t, db.Connect(user, password, databaseName, host, port))
+			t.Cleanup(func() { db.Close() })
+			return db
+		},
+		// MySQL records when tables were updated to the second
+		updateResolution: time.Second,
+	})
+}
+
+func TestConformance_Postgres(t *testing.T) {
+	user, password, databaseName, host, port := conformanceConnection(t, "PAM_TEST_POSTGRES")
+	testConformance(t, conformanceBackend{
+		newDatabase: func(t *testing.T, dataPolicy DataPolicy, cacheTables bool) PrivateRelationalDatabase {
+			db := &PostgresPrivateDatabase{DataPolicy: dataPolicy, CacheTables: cacheTables}
+			require.NoError(t, db.Connect(user, password, databaseName, host, port))
+			t.Cleanup(func() { db.Close() })
+			return db
+		},
+		updateResolution: 5 * time.Millisecond,
+		foldsTableNames:  true,
+	})
+}
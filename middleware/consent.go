@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// consentTableName is the table opt-outs are recorded in if a ConsentRegistry does not name one
+const consentTableName = "pam_consent"
+
+// ConsentRegistry records data subjects who have opted out of their data being used, either by particular requesters,
+// for particular purposes or at all. Rows about a subject who has opted out are removed from the transformed tables
+// built for the relevant requesters. The registry is a table in the database being queried with the columns
+// subject_key, requester_id and purpose, where a NULL requester_id or purpose matches every requester or purpose.
+// Purpose-specific opt-outs apply to requests which do not give a purpose.
+type ConsentRegistry struct {
+	// TableName is the name of the registry table, if it is empty pam_consent is used
+	TableName string
+	// SubjectColumns maps the name of each table holding data about subjects to the column holding the subject key,
+	// tables which are not listed are not filtered
+	SubjectColumns map[string]string
+}
+
+func (c *ConsentRegistry) tableName() string {
+	if c.TableName == "" {
+		return consentTableName
+	}
+	return c.TableName
+}
+
+// createTable creates the registry table if it does not exist
+func (c *ConsentRegistry) createTable(db *sql.DB, dialect sqlDialect) error {
+	if !identifierRegexp.MatchString(c.tableName()) {
+		return fmt.Errorf("%q is not a valid name for the consent registry", c.tableName())
+	}
+	for table, column := range c.SubjectColumns {
+		if !identifierRegexp.MatchString(column) {
+			return fmt.Errorf("%q is not a valid subject column for table %s", column, table)
+		}
+	}
+
+	_, err := db.Exec(dialect.consentTableSQL(c.tableName()))
+	return err
+}
+
+// appliesTo returns whether rows of the table are filtered by consent
+func (c *ConsentRegistry) appliesTo(tableName string) bool {
+	_, ok := c.SubjectColumns[tableName]
+	return ok
+}
+
+// sql returns a condition which is true for rows of the table whose subject has not opted out of the requester or
+// purpose, and the arguments for its placeholders. The condition is empty if the table is not filtered by consent.
+func (c *ConsentRegistry) sql(tableName string, requesterID string, purpose string) (string, []interface{}) {
+	subjectColumn, ok := c.SubjectColumns[tableName]
+	if !ok {
+		return "", nil
+	}
+
+	condition := fmt.Sprintf("NOT EXISTS (SELECT 1 FROM `%s` consent WHERE consent.subject_key = `%s`.`%s` "+
+		"AND (consent.requester_id IS NULL OR consent.requester_id = ?)", c.tableName(), tableName, subjectColumn)
+	args := []interface{}{requesterID}
+	if purpose != "" {
+		condition += " AND (consent.purpose IS NULL OR consent.purpose = ?)"
+		args = append(args, purpose)
+	}
+	return condition + ")", args
+}
+
+func (pd *privateDatabase) optOut(ctx context.Context, subjectKey string, requesterID string,
+	purpose string) error {
+	if pd.Consent == nil {
+		return fmt.Errorf("the database does not have a consent registry")
+	}
+
+	insertString, err := pd.dialect.nativeSQL(
+		fmt.Sprintf("INSERT INTO `%s` (subject_key, requester_id, purpose) VALUES (?, ?, ?)", pd.Consent.tableName()))
+	if err != nil {
+		return err
+	}
+	_, err = pd.database.ExecContext(ctx, insertString, subjectKey, nullIfEmpty(requesterID), nullIfEmpty(purpose))
+	return err
+}
+
+func (pd *privateDatabase) optIn(ctx context.Context, subjectKey string) error {
+	if pd.Consent == nil {
+		return fmt.Errorf("the database does not have a consent registry")
+	}
+
+	deleteString, err := pd.dialect.nativeSQL(fmt.Sprintf("DELETE FROM `%s` WHERE subject_key = ?", pd.Consent.tableName()))
+	if err != nil {
+		return err
+	}
+	_, err = pd.database.ExecContext(ctx, deleteString, subjectKey)
+	return err
+}
+
+func nullIfEmpty(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestConsentRegistry_SQL(t *testing.T) {
+	registry := &ConsentRegistry{SubjectColumns: map[string]string{"people": "id"}}
+
+	condition, args := registry.sql("people", "alice", "research")
+	require.Equal(t, "NOT EXISTS (SELECT 1 FROM `pam_consent` consent WHERE consent.subject_key = `people`.`id` "+
+		"AND (consent.requester_id IS NULL OR consent.requester_id = ?) "+
+		"AND (consent.purpose IS NULL OR consent.purpose = ?))", condition)
+	require.Equal(t, []interface{}{"alice", "research"}, args)
+
+	// Every opt-out for the requester applies to requests without a purpose
+	condition, args = registry.sql("people", "alice", "")
+	require.Equal(t, "NOT EXISTS (SELECT 1 FROM `pam_consent` consent WHERE consent.subject_key = `people`.`id` "+
+		"AND (consent.requester_id IS NULL OR consent.requester_id = ?))", condition)
+	require.Equal(t, []interface{}{"alice"}, args)
+
+	// Tables without a subject column are not filtered
+	require.False(t, registry.appliesTo("household_power_consumption"))
+	condition, args = registry.sql("household_power_consumption", "alice", "")
+	require.Equal(t, "", condition)
+	require.Empty(t, args)
+}
+
+func TestConsentRegistry_CreateTable_Invalid(t *testing.T) {
+	registry := &ConsentRegistry{TableName: "consent; DROP TABLE people"}
+	require.EqualError(t, registry.createTable(nil, mysqlDialect{}),
+		`"consent; DROP TABLE people" is not a valid name for the consent registry`)
+
+	registry = &ConsentRegistry{SubjectColumns: map[string]string{"people": "id`"}}
+	require.EqualError(t, registry.createTable(nil, mysqlDialect{}), "\"id`\" is not a valid subject column for table people")
+}
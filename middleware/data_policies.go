@@ -3,6 +3,7 @@ package middleware
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"time"
 )
 
@@ -10,42 +11,281 @@ type ColumnTransform func(interface{}) (transformedValue interface{}, excludeRow
 
 type TableTransform map[string]ColumnTransform
 
-// TableOperations contains functions to apply to tables before sending to an entity and columns to exclude
+// RequesterColumnTransform builds the ColumnTransform for a particular requester, it is used for transforms such as
+// pseudonymisation whose output depends on who is asking
+type RequesterColumnTransform func(requesterID string) ColumnTransform
+
+type RequesterTableTransform map[string]RequesterColumnTransform
+
+// RowTransform receives the values of the columns copied from a row by name. It can change any of the values, for
+// example depending on the value of another column, and can exclude the row. Row transforms see the values before
+// any ColumnTransform is applied.
+type RowTransform func(row map[string]interface{}) (excludeRow bool, err error)
+
+// SQLTransform returns an SQL expression which computes the transformed value of a column, the column is passed
+// already quoted. Unlike a ColumnTransform it is evaluated by the database, so a table whose transforms are all
+// SQLTransforms is not copied but read through a derived table in the rewritten query.
+type SQLTransform func(column string) string
+
+type SQLTableTransform map[string]SQLTransform
+
+// TableOperations contains functions to apply to tables before sending to an entity, columns to exclude and filters
+// which rows must satisfy to be included
 type TableOperations struct {
+	// TableTransforms are applied to the values of each column after any SQLTransforms and RowTransforms
 	TableTransforms map[string]TableTransform
-	ExcludedCols    map[string][]string
+	// TransformIDs identifies TableTransforms, such as by TransformID, so that requesters whose operations on a table
+	// are the same can share its cached transformed table. A table is only shared if each of its TableTransforms has
+	// an ID and it has no RowTransforms, as functions cannot be compared.
+	TransformIDs map[string]map[string]string
+	// SideEffects marks the columns whose TableTransforms or RequesterTransforms change anything outside of their
+	// result, such as a Pseudonymiser with a Vault recording the tokens it gives, so that they are not applied to
+	// sample values when the policy is validated
+	SideEffects map[string]map[string]bool
+	// SQLTransforms are applied by the database, before any RowTransforms or TableTransforms
+	SQLTransforms map[string]SQLTableTransform
+	// RequesterTransforms are turned into TableTransforms for the requester by ForRequester, which a DataPolicy must
+	// do before returning TableOperations from Resolve
+	RequesterTransforms map[string]RequesterTableTransform
+	// RowTransforms are applied in order before the TableTransforms. They are not applied to writes, so a requester
+	// can change and delete rows which their RowTransforms remove, and learn of those rows from the number of rows
+	// affected.
+	RowTransforms map[string][]RowTransform
+	// ExcludedCols are never visible, they apply to the columns listed in AllowedCols as well
+	ExcludedCols map[string][]string
+	// AllowedCols, if a table has an entry, lists the only columns of the table which are visible, so columns added to
+	// the table later are hidden by default
+	AllowedCols map[string][]string
+	// RowFilters limit the rows a requester can read and write
+	RowFilters map[string][]RowFilter
+	// WriteFilters limit the rows a requester can write to, see constrainWrite
+	WriteFilters map[string][]RowFilter
+	// AggregatesOnly only allows queries returning aggregates over the transformed tables
+	AggregatesOnly bool
 }
 
 // NewTableOperations returns a pointer to a TableOperations struct with initialised fields
 func NewTableOperations() *TableOperations {
 	return &TableOperations{
-		TableTransforms: make(map[string]TableTransform),
-		ExcludedCols:    make(map[string][]string),
+		TableTransforms:     make(map[string]TableTransform),
+		TransformIDs:        make(map[string]map[string]string),
+		SideEffects:         make(map[string]map[string]bool),
+		SQLTransforms:       make(map[string]SQLTableTransform),
+		RequesterTransforms: make(map[string]RequesterTableTransform),
+		RowTransforms:       make(map[string][]RowTransform),
+		ExcludedCols:        make(map[string][]string),
+		AllowedCols:         make(map[string][]string),
+		RowFilters:          make(map[string][]RowFilter),
+		WriteFilters:        make(map[string][]RowFilter),
+	}
+}
+
+// ForRequester returns TableOperations where the RequesterTransforms have been built for the requester and added to
+// the TableTransforms. It returns t itself if there are no RequesterTransforms.
+func (t *TableOperations) ForRequester(requesterID string) (*TableOperations, error) {
+	if len(t.RequesterTransforms) == 0 {
+		return t, nil
+	}
+
+	bound := *t
+	bound.TableTransforms = make(map[string]TableTransform)
+	bound.RequesterTransforms = nil
+	for tableName, tableTransform := range t.TableTransforms {
+		bound.TableTransforms[tableName] = tableTransform
+	}
+	for tableName, requesterTableTransform := range t.RequesterTransforms {
+		tableTransform := make(TableTransform)
+		for col, transform := range t.TableTransforms[tableName] {
+			tableTransform[col] = transform
+		}
+		for col, requesterTransform := range requesterTableTransform {
+			_, hasSQLTransform := t.SQLTransforms[tableName][col]
+			if _, ok := tableTransform[col]; ok || hasSQLTransform {
+				return nil, fmt.Errorf("the column %s of table %s has both a transform and a requester transform",
+					col, tableName)
+			}
+			tableTransform[col] = requesterTransform(requesterID)
+		}
+		bound.TableTransforms[tableName] = tableTransform
 	}
+	return &bound, nil
 }
 
 func (t *TableOperations) merge(tableOperations *TableOperations) error {
 	// Try to merge transforms, error if we have a clash
-	for id, transforms := range tableOperations.TableTransforms {
+	for _, id := range tableOperations.transformedTables() {
 		// Check for a clash
-		_, ok := t.TableTransforms[id]
-		if ok {
+		if contains(t.transformedTables(), id) {
 			return errors.New("multiple data policies with different transforms for the same table apply, cannot resolve")
 		}
+	}
+	for id, transforms := range tableOperations.TableTransforms {
 		t.TableTransforms[id] = transforms
 	}
+	for id, transformIDs := range tableOperations.TransformIDs {
+		for col, transformID := range transformIDs {
+			t.setTransformID(id, col, transformID)
+		}
+	}
+	for id, sideEffects := range tableOperations.SideEffects {
+		for col, hasSideEffects := range sideEffects {
+			if hasSideEffects {
+				t.setSideEffects(id, col)
+			}
+		}
+	}
+	for id, sqlTransforms := range tableOperations.SQLTransforms {
+		t.SQLTransforms[id] = sqlTransforms
+	}
+
+	t.mergeRowTransforms(tableOperations)
+	t.mergeRestrictions(tableOperations)
+	return nil
+}
+
+// mergeRowTransforms adds the row transforms of tableOperations after those of t
+func (t *TableOperations) mergeRowTransforms(tableOperations *TableOperations) {
+	for id, rowTransforms := range tableOperations.RowTransforms {
+		t.RowTransforms[id] = append(append([]RowTransform{}, t.RowTransforms[id]...), rowTransforms...)
+	}
+}
+
+// mergeRestrictions merges the excluded and allowed columns and the row and write filters of tableOperations into t
+// so that only what is visible or writable under both is visible or writable
+func (t *TableOperations) mergeRestrictions(tableOperations *TableOperations) {
+	t.AggregatesOnly = t.AggregatesOnly || tableOperations.AggregatesOnly
 
 	// Merge excluded columns
 	for id, excludedCols := range tableOperations.ExcludedCols {
 		t.ExcludedCols[id] = mergeStringSlice(t.ExcludedCols[id], excludedCols)
 	}
 
-	return nil
+	// Only columns allowed by every policy with an allow-list for a table are visible
+	for id, allowedCols := range tableOperations.AllowedCols {
+		currentAllowedCols, ok := t.AllowedCols[id]
+		if !ok {
+			t.AllowedCols[id] = allowedCols
+			continue
+		}
+		intersection := []string{}
+		for _, col := range currentAllowedCols {
+			if contains(allowedCols, col) {
+				intersection = append(intersection, col)
+			}
+		}
+		t.AllowedCols[id] = intersection
+	}
+
+	// Rows must satisfy the filters of every policy which applies
+	for id, rowFilters := range tableOperations.RowFilters {
+		t.RowFilters[id] = append(t.RowFilters[id], rowFilters...)
+	}
+	for id, writeFilters := range tableOperations.WriteFilters {
+		t.WriteFilters[id] = append(t.WriteFilters[id], writeFilters...)
+	}
+}
+
+// columnVisible returns whether a column of a table may be seen, given the excluded and allowed columns
+func (t *TableOperations) columnVisible(tableName string, column string) bool {
+	if contains(t.ExcludedCols[tableName], column) {
+		return false
+	}
+	allowedCols, ok := t.AllowedCols[tableName]
+	return !ok || contains(allowedCols, column)
+}
+
+// transformedTables returns the names of the tables which have TableTransforms or SQLTransforms
+func (t *TableOperations) transformedTables() []string {
+	var tables []string
+	for table := range t.TableTransforms {
+		tables = mergeStringSlice(tables, []string{table})
+	}
+	for table := range t.SQLTransforms {
+		tables = mergeStringSlice(tables, []string{table})
+	}
+	return tables
+}
+
+// transformedColumns returns the columns of the table which have a TableTransform or an SQLTransform
+func (t *TableOperations) transformedColumns(tableName string) []string {
+	var columns []string
+	for col := range t.TableTransforms[tableName] {
+		columns = mergeStringSlice(columns, []string{col})
+	}
+	for col := range t.SQLTransforms[tableName] {
+		columns = mergeStringSlice(columns, []string{col})
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+// setTransformID records the ID of the TableTransform of a column
+func (t *TableOperations) setTransformID(tableName string, col string, transformID string) {
+	if t.TransformIDs == nil {
+		t.TransformIDs = make(map[string]map[string]string)
+	}
+	if t.TransformIDs[tableName] == nil {
+		t.TransformIDs[tableName] = make(map[string]string)
+	}
+	t.TransformIDs[tableName][col] = transformID
+}
+
+// setSideEffects records that the TableTransform of a column has side effects
+func (t *TableOperations) setSideEffects(tableName string, col string) {
+	if t.SideEffects == nil {
+		t.SideEffects = make(map[string]map[string]bool)
+	}
+	if t.SideEffects[tableName] == nil {
+		t.SideEffects[tableName] = make(map[string]bool)
+	}
+	t.SideEffects[tableName][col] = true
+}
+
+// inline returns whether the database can apply every operation on the table, so that it does not need to be copied
+func (t *TableOperations) inline(tableName string) bool {
+	return len(t.TableTransforms[tableName]) == 0 && len(t.RowTransforms[tableName]) == 0
+}
+
+// tables returns the names of all of the tables the TableOperations refer to
+func (t *TableOperations) tables() []string {
+	var tables []string
+	for table := range t.TableTransforms {
+		tables = mergeStringSlice(tables, []string{table})
+	}
+	for table := range t.SQLTransforms {
+		tables = mergeStringSlice(tables, []string{table})
+	}
+	for table := range t.RequesterTransforms {
+		tables = mergeStringSlice(tables, []string{table})
+	}
+	for table := range t.RowTransforms {
+		tables = mergeStringSlice(tables, []string{table})
+	}
+	for table := range t.ExcludedCols {
+		tables = mergeStringSlice(tables, []string{table})
+	}
+	for table := range t.AllowedCols {
+		tables = mergeStringSlice(tables, []string{table})
+	}
+	for table := range t.RowFilters {
+		tables = mergeStringSlice(tables, []string{table})
+	}
+	for table := range t.WriteFilters {
+		tables = mergeStringSlice(tables, []string{table})
+	}
+	return tables
 }
 
 // transforms is a map from privacyGroups to TableOperations
 type DataTransforms map[*PrivacyGroup]*TableOperations
 
+// PurposeTransforms is a map from privacyGroups to the purposes declared for them and the TableOperations for each
+// purpose
+type PurposeTransforms map[*PrivacyGroup]map[string]*TableOperations
+
+// ErrPurposeNotDeclared is returned when a request gives a purpose which no group in a data policy declares
+var ErrPurposeNotDeclared = errors.New("the purpose of the request is not declared by the data policy")
+
 // DataPolicy allow us to get a function which must be applied to data before returning for a given identifier
 type DataPolicy interface {
 	// resolve takes an identifier for an entity and returns the TableOperatoinsg for the entity
@@ -53,54 +293,189 @@ type DataPolicy interface {
 	LastUpdated() time.Time
 }
 
+// PurposeAwareDataPolicy is an optional interface for a DataPolicy which selects TableOperations by the purpose of a
+// request as well as the identity of the requester
+type PurposeAwareDataPolicy interface {
+	ResolvePurpose(entityID string, purpose string) (*TableOperations, error)
+}
+
+// CoverageReporter is an optional interface for a DataPolicy which can list the tables it has TableOperations for, it
+// is used to warn about tables which no policy covers
+type CoverageReporter interface {
+	CoveredTables() []string
+}
+
 // StaticDataPolicy implements the DataPolicy interface and contains a list of privacyGroups and DataTransforms for them
 type StaticDataPolicy struct {
-	// privacyGroups is an ordered list of privacyGroups where the policy for the first group we are a member of is applied
+	// privacyGroups is an ordered list of privacyGroups, the order is used by strategies such as FirstMatch
 	privacyGroups []*PrivacyGroup
 	transforms    DataTransforms
 	created       time.Time
+	// Strategy decides how the TableOperations of each group an entity is a member of are combined, by default they
+	// are merged and conflicting transforms are an error
+	Strategy ConflictStrategy
+	// Default decides what entities which are not in any privacy group can access, by default they are denied
+	Default DefaultPolicy
+	// PublicGroup is the group whose TableOperations are used by the DefaultPublicGroup and DefaultAggregatesOnly
+	// policies, it does not need to be in the ordered list of privacy groups
+	PublicGroup *PrivacyGroup
+	// Purposes holds the TableOperations for each purpose declared for a group. Groups with declared purposes only
+	// apply to requests with one of those purposes, groups without any use their DataTransforms for every purpose.
+	Purposes PurposeTransforms
 }
 
 // NewStaticDataPolicy returns a pointer to a StaticDataPolicy with initialised fields
 func NewStaticDataPolicy(privacyGroups []*PrivacyGroup, transforms DataTransforms) *StaticDataPolicy {
+	return NewStaticDataPolicyWithStrategy(privacyGroups, transforms, MergeOrFail)
+}
+
+// NewStaticDataPolicyWithStrategy returns a pointer to a StaticDataPolicy which combines the TableOperations of
+// groups using the passed ConflictStrategy
+func NewStaticDataPolicyWithStrategy(privacyGroups []*PrivacyGroup, transforms DataTransforms,
+	strategy ConflictStrategy) *StaticDataPolicy {
 	return &StaticDataPolicy{
 		privacyGroups: privacyGroups,
 		transforms:    transforms,
 		created:       timeWithUTCLocation(time.Now()),
+		Strategy:      strategy,
 	}
 }
 
 // Resolve takes an entity ID and returns a pointer to the relevant TableOperations struct based on the privacyGroups
-// that the entity ID is in and the associated transforms stored in the StaticDataPolicy
+// that the entity ID is in and the associated transforms stored in the StaticDataPolicy. Entities which are not in
+// any privacy group get the Default policy, ErrAccessDenied is returned if this gives them no access.
 func (sdp *StaticDataPolicy) Resolve(entityID string) (*TableOperations, error) {
-	var privacyGroups []*PrivacyGroup
+	return sdp.ResolvePurpose(entityID, "")
+}
+
+// ResolvePurpose is like Resolve but only applies the groups which the purpose is declared for, or which do not
+// declare any purposes. ErrPurposeNotDeclared is returned if no group declares the purpose, otherwise a requester
+// with no group which allows the purpose gets ErrAccessDenied so that the error does not reveal their groups.
+func (sdp *StaticDataPolicy) ResolvePurpose(entityID string, purpose string) (*TableOperations, error) {
+	if !sdp.purposeDeclared(purpose) {
+		return nil, ErrPurposeNotDeclared
+	}
+
+	var (
+		member          bool
+		groups          []*PrivacyGroup
+		groupOperations []*TableOperations
+	)
 	for _, group := range sdp.privacyGroups {
-		if group.contains(entityID) {
-			privacyGroups = append(privacyGroups, group)
+		if !group.contains(entityID) {
+			continue
 		}
+		member = true
+		tableOperations, ok := sdp.operationsFor(group, purpose)
+		if !ok {
+			continue
+		}
+		tableOperations, err := tableOperations.ForRequester(entityID)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+		groupOperations = append(groupOperations, tableOperations)
+	}
+	if !member {
+		return sdp.resolveDefault(entityID, purpose)
 	}
-	if privacyGroups == nil {
-		return nil, fmt.Errorf("the entity %s is not part of any privacy group", entityID)
+	if groupOperations == nil {
+		return nil, ErrAccessDenied
 	}
 
-	// Make sure we only have one set of transforms but concatenate removed columns
-	allTableOperations := NewTableOperations()
-	for _, privacyGroup := range privacyGroups {
-		tableOperations, ok := sdp.transforms[privacyGroup]
-		if ok {
-			err := allTableOperations.merge(tableOperations)
-			if err != nil {
-				if err != nil {
-					return nil, err
-				}
-			}
+	return sdp.Strategy.combine(groups, groupOperations)
+}
+
+// purposeDeclared returns whether a request with the purpose can be resolved, purposes are ignored by policies which
+// do not declare any
+func (sdp *StaticDataPolicy) purposeDeclared(purpose string) bool {
+	if purpose == "" || len(sdp.Purposes) == 0 {
+		return true
+	}
+	for _, purposes := range sdp.Purposes {
+		if _, ok := purposes[purpose]; ok {
+			return true
 		}
 	}
+	return false
+}
+
+// operationsFor returns the TableOperations of a group for a purpose and whether the group applies to the purpose
+func (sdp *StaticDataPolicy) operationsFor(group *PrivacyGroup, purpose string) (*TableOperations, bool) {
+	if purposes := sdp.Purposes[group]; len(purposes) > 0 {
+		tableOperations, ok := purposes[purpose]
+		return tableOperations, ok
+	}
+
+	// A group without any TableOperations sees every table unmodified
+	tableOperations, ok := sdp.transforms[group]
+	if !ok {
+		tableOperations = NewTableOperations()
+	}
+	return tableOperations, true
+}
 
+func (sdp *StaticDataPolicy) resolveDefault(entityID string, purpose string) (*TableOperations, error) {
+	switch {
+	case sdp.Default == DefaultPublicGroup && sdp.PublicGroup != nil:
+	case sdp.Default == DefaultAggregatesOnly:
+	default:
+		return nil, ErrAccessDenied
+	}
+
+	// Copy the public group's operations so that they are not changed by restricting them to aggregates
+	allTableOperations := NewTableOperations()
+	if sdp.PublicGroup != nil {
+		tableOperations, ok := sdp.operationsFor(sdp.PublicGroup, purpose)
+		if !ok {
+			return nil, ErrAccessDenied
+		}
+		tableOperations, err := tableOperations.ForRequester(entityID)
+		if err != nil {
+			return nil, err
+		}
+		err = allTableOperations.merge(tableOperations)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if sdp.Default == DefaultAggregatesOnly {
+		allTableOperations.AggregatesOnly = true
+	}
 	return allTableOperations, nil
 }
 
+// LastUpdated returns the later of when the policy was created and when the members or priority of any of its groups
+// last changed, so that it moves forward when a grant starts, expires or is revoked
 func (sdp StaticDataPolicy) LastUpdated() time.Time {
-	// The static policy is not intended to be updated
-	return sdp.created
+	// The operations of the static policy are not intended to be updated but the members of its groups can be
+	lastUpdated := sdp.created
+	groups := sdp.privacyGroups
+	if sdp.PublicGroup != nil {
+		groups = append([]*PrivacyGroup{sdp.PublicGroup}, groups...)
+	}
+	for _, group := range groups {
+		lastChanged := timeWithUTCLocation(group.LastChanged().Local())
+		if lastChanged.After(lastUpdated) {
+			lastUpdated = lastChanged
+		}
+	}
+	return lastUpdated
+}
+
+// CoveredTables returns the names of all of the tables which the TableOperations of any privacy group, for any
+// purpose, refer to
+func (sdp *StaticDataPolicy) CoveredTables() []string {
+	var tables []string
+	for _, tableOperations := range sdp.transforms {
+		tables = mergeStringSlice(tables, tableOperations.tables())
+	}
+	for _, purposes := range sdp.Purposes {
+		for _, tableOperations := range purposes {
+			tables = mergeStringSlice(tables, tableOperations.tables())
+		}
+	}
+	sort.Strings(tables)
+	return tables
 }
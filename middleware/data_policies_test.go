@@ -5,6 +5,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestStaticDataPolicy_Resolve_Success(t *testing.T) {
@@ -92,3 +93,197 @@ func TestStaticDataPolicy_Resolve_Fail(t *testing.T) {
 	_, err := dataPolicy.Resolve("alice")
 	require.EqualError(t, err, "multiple data policies with different transforms for the same table apply, cannot resolve")
 }
+
+func TestStaticDataPolicy_Resolve_RowFilters(t *testing.T) {
+	group1 := NewPrivacyGroup("Group1")
+	group1.Add("alice")
+	group2 := NewPrivacyGroup("Group2")
+	group2.Add("alice")
+
+	transforms := DataTransforms{
+		group1: {
+			RowFilters: map[string][]RowFilter{"table1": {{Column: "region", Operator: "=", Value: "EU"}}},
+		},
+		group2: {
+			RowFilters: map[string][]RowFilter{
+				"table1": {{Column: "owner_id", Operator: "=", Value: RequesterIDValue}},
+				"table2": {{Column: "deleted", Operator: "IS NULL"}},
+			},
+		},
+	}
+
+	dataPolicy := NewStaticDataPolicy([]*PrivacyGroup{group1, group2}, transforms)
+
+	policy, err := dataPolicy.Resolve("alice")
+	require.NoError(t, err)
+
+	// Rows must satisfy the filters from every group
+	require.Equal(t, []RowFilter{
+		{Column: "region", Operator: "=", Value: "EU"},
+		{Column: "owner_id", Operator: "=", Value: RequesterIDValue},
+	}, policy.RowFilters["table1"])
+	require.Equal(t, []RowFilter{{Column: "deleted", Operator: "IS NULL"}}, policy.RowFilters["table2"])
+}
+
+func TestStaticDataPolicy_Resolve_AllowedCols(t *testing.T) {
+	group1 := NewPrivacyGroup("Group1")
+	group1.Add("alice")
+	group2 := NewPrivacyGroup("Group2")
+	group2.Add("alice")
+
+	transforms := DataTransforms{
+		group1: {
+			AllowedCols: map[string][]string{
+				"table1": {"col1", "col2", "col3"},
+				"table2": {"col1"},
+			},
+		},
+		group2: {
+			AllowedCols:  map[string][]string{"table1": {"col2", "col3", "col4"}},
+			ExcludedCols: map[string][]string{"table1": {"col3"}},
+		},
+	}
+
+	dataPolicy := NewStaticDataPolicy([]*PrivacyGroup{group1, group2}, transforms)
+
+	policy, err := dataPolicy.Resolve("alice")
+	require.NoError(t, err)
+
+	// Allow-lists are intersected and exclusions still apply
+	require.Equal(t, []string{"col2", "col3"}, policy.AllowedCols["table1"])
+	require.False(t, policy.columnVisible("table1", "col1"))
+	require.True(t, policy.columnVisible("table1", "col2"))
+	require.False(t, policy.columnVisible("table1", "col3"))
+	require.False(t, policy.columnVisible("table1", "col4"))
+
+	// An allow-list from a single group applies on its own
+	require.True(t, policy.columnVisible("table2", "col1"))
+	require.False(t, policy.columnVisible("table2", "col2"))
+
+	// Tables without an allow-list show every column which is not excluded
+	require.True(t, policy.columnVisible("table3", "col1"))
+}
+
+func TestStaticDataPolicy_CoveredTables(t *testing.T) {
+	group1 := NewPrivacyGroup("Group1")
+	group2 := NewPrivacyGroup("Group2")
+
+	transforms := DataTransforms{
+		group1: {
+			AllowedCols:  map[string][]string{"table1": {"col1"}},
+			ExcludedCols: map[string][]string{"table2": {"col1"}},
+		},
+		group2: {
+			TableTransforms: map[string]TableTransform{"table3": {}},
+			RowFilters:      map[string][]RowFilter{"table1": {{Column: "col1", Operator: "IS NULL"}}},
+		},
+	}
+
+	dataPolicy := NewStaticDataPolicy([]*PrivacyGroup{group1, group2}, transforms)
+	require.Equal(t, []string{"table1", "table2", "table3"}, dataPolicy.CoveredTables())
+}
+
+func purposeDataPolicy() *StaticDataPolicy {
+	analysts := NewPrivacyGroup("Analysts")
+	analysts.Add("alice")
+	support := NewPrivacyGroup("Support")
+	support.AddMany([]string{"alice", "bob"})
+	auditors := NewPrivacyGroup("Auditors")
+	auditors.Add("carol")
+
+	dataPolicy := NewStaticDataPolicy([]*PrivacyGroup{analysts, support, auditors}, DataTransforms{
+		auditors: {ExcludedCols: map[string][]string{"people": {"dob"}}},
+	})
+	dataPolicy.Purposes = PurposeTransforms{
+		analysts: {
+			"research": {AllowedCols: map[string][]string{"people": {"dob"}}},
+			"billing":  {AllowedCols: map[string][]string{"people": {"id", "name"}}},
+		},
+		support: {
+			"troubleshooting": {ExcludedCols: map[string][]string{"people": {"dob"}}},
+		},
+	}
+	return dataPolicy
+}
+
+func TestStaticDataPolicy_ResolvePurpose(t *testing.T) {
+	dataPolicy := purposeDataPolicy()
+
+	// The same requester sees different columns for each purpose
+	tableOperations, err := dataPolicy.ResolvePurpose("alice", "research")
+	require.NoError(t, err)
+	require.True(t, tableOperations.columnVisible("people", "dob"))
+	require.False(t, tableOperations.columnVisible("people", "name"))
+
+	tableOperations, err = dataPolicy.ResolvePurpose("alice", "billing")
+	require.NoError(t, err)
+	require.False(t, tableOperations.columnVisible("people", "dob"))
+	require.True(t, tableOperations.columnVisible("people", "name"))
+
+	tableOperations, err = dataPolicy.ResolvePurpose("alice", "troubleshooting")
+	require.NoError(t, err)
+	require.Equal(t, []string{"dob"}, tableOperations.ExcludedCols["people"])
+	require.Empty(t, tableOperations.AllowedCols)
+
+	// Groups without declared purposes apply to every declared purpose
+	tableOperations, err = dataPolicy.ResolvePurpose("carol", "billing")
+	require.NoError(t, err)
+	require.Equal(t, []string{"dob"}, tableOperations.ExcludedCols["people"])
+}
+
+func TestStaticDataPolicy_ResolvePurpose_Rejected(t *testing.T) {
+	dataPolicy := purposeDataPolicy()
+
+	// Purposes which no group declares are rejected for every requester
+	_, err := dataPolicy.ResolvePurpose("alice", "marketing")
+	require.Equal(t, ErrPurposeNotDeclared, err)
+	_, err = dataPolicy.ResolvePurpose("mallory", "marketing")
+	require.Equal(t, ErrPurposeNotDeclared, err)
+
+	// Bob's only group does not declare research, which gives the same error as an unknown requester
+	_, err = dataPolicy.ResolvePurpose("bob", "research")
+	require.Equal(t, ErrAccessDenied, err)
+	_, err = dataPolicy.ResolvePurpose("mallory", "research")
+	require.Equal(t, ErrAccessDenied, err)
+
+	// Requests without a purpose only get the groups which do not declare purposes
+	_, err = dataPolicy.Resolve("bob")
+	require.Equal(t, ErrAccessDenied, err)
+	_, err = dataPolicy.Resolve("carol")
+	require.NoError(t, err)
+
+	// Purposes are ignored by policies which do not declare any
+	dataPolicy.Purposes = nil
+	_, err = dataPolicy.ResolvePurpose("bob", "marketing")
+	require.NoError(t, err)
+}
+
+func TestStaticDataPolicy_Resolve_Grants(t *testing.T) {
+	group := NewPrivacyGroup("Contractors")
+	group.Grant("contractor", time.Time{}, time.Now().Add(50*time.Millisecond))
+
+	dataPolicy := NewStaticDataPolicy([]*PrivacyGroup{group}, DataTransforms{
+		group: {ExcludedCols: map[string][]string{"people": {"dob"}}},
+	})
+	created := dataPolicy.LastUpdated()
+
+	_, err := dataPolicy.Resolve("contractor")
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Once the grant lapses the contractor is denied and the policy counts as updated, so cached tables are rebuilt
+	_, err = dataPolicy.Resolve("contractor")
+	require.Equal(t, ErrAccessDenied, err)
+	expired := dataPolicy.LastUpdated()
+	require.True(t, expired.After(created))
+
+	// Revoking access also updates the policy
+	group.Grant("temp", time.Time{}, time.Time{})
+	_, err = dataPolicy.Resolve("temp")
+	require.NoError(t, err)
+	group.Remove("temp")
+	_, err = dataPolicy.Resolve("temp")
+	require.Equal(t, ErrAccessDenied, err)
+	require.True(t, dataPolicy.LastUpdated().After(expired))
+}
@@ -0,0 +1,349 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// DataPolicyFile is the declarative form of a StaticDataPolicy. It is an ordered list of privacy groups, each of which
+// names its members and the operations to apply to each table for them. In JSON it looks like:
+//
+//	{
+//	  "strategy": "first-match",
+//	  "default": "public-group",
+//	  "public_group": "Public",
+//	  "groups": [
+//	    {
+//	      "name": "CentralServer",
+//	      "members": ["server"],
+//	      "grants": [{"member": "contractor", "start": "2019-01-01T00:00:00Z", "expiry": "2019-07-01T00:00:00Z"}],
+//	      "priority": 1,
+//	      "tables": {
+//	        "household_power_consumption": {
+//	          "allowed_columns": ["datetime", "global_active_power", "region", "owner_id"],
+//	          "excluded_columns": ["owner_id"],
+//	          "transforms": {
+//	            "datetime": {"transform": "truncate-date", "params": {"unit": "month"}}
+//	          },
+//	          "row_filters": [
+//	            {"column": "region", "operator": "=", "value": "EU"},
+//	            {"column": "owner_id", "operator": "=", "value_from": "requester_id"}
+//	          ]
+//	        }
+//	      },
+//	      "purposes": {
+//	        "billing": {
+//	          "household_power_consumption": {"allowed_columns": ["datetime", "global_active_power"]}
+//	        }
+//	      }
+//	    }
+//	  ]
+//	}
+//
+// Transforms are taken from the built-in transform library, see TransformNames. The strategy is optional and is
+// parsed with ConflictStrategyFromString, priorities are only used by the highest-priority strategy. The default is
+// optional and is parsed with DefaultPolicyFromString, public_group names one of the groups to use for it. A group
+// with purposes only applies to requests with one of those purposes, using the tables given for that purpose.
+type DataPolicyFile struct {
+	Strategy    string                `json:"strategy"`
+	Default     string                `json:"default"`
+	PublicGroup string                `json:"public_group"`
+	Groups      []DataPolicyFileGroup `json:"groups"`
+}
+
+// DataPolicyFileGroup describes a privacy group and the operations applied to tables for its members
+type DataPolicyFileGroup struct {
+	Name     string                                    `json:"name"`
+	Members  []string                                  `json:"members"`
+	Grants   []DataPolicyFileGrant                     `json:"grants"`
+	Priority int                                       `json:"priority"`
+	Tables   map[string]DataPolicyFileTable            `json:"tables"`
+	Purposes map[string]map[string]DataPolicyFileTable `json:"purposes"`
+}
+
+// DataPolicyFileGrant describes a time-limited membership of a privacy group, the start and expiry are RFC 3339 times
+// and either can be left out
+type DataPolicyFileGrant struct {
+	Member string    `json:"member"`
+	Start  time.Time `json:"start"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// DataPolicyFileTable describes the columns to allow or exclude from a table, the transforms to apply to its columns
+// and the filters its rows must satisfy to be read or written. If allowed_columns is given only those columns are
+// visible.
+type DataPolicyFileTable struct {
+	AllowedColumns  *[]string                          `json:"allowed_columns"`
+	ExcludedColumns []string                           `json:"excluded_columns"`
+	Transforms      map[string]DataPolicyFileTransform `json:"transforms"`
+	RowFilters      []DataPolicyFileRowFilter          `json:"row_filters"`
+	WriteFilters    []DataPolicyFileRowFilter          `json:"write_filters"`
+}
+
+// DataPolicyFileTransform names a transform from the built-in transform library and the parameters to build it with.
+// Transforms which the database can evaluate are built as SQLTransforms.
+type DataPolicyFileTransform struct {
+	Transform string          `json:"transform"`
+	Params    TransformParams `json:"params"`
+}
+
+// DataPolicyFileRowFilter describes a RowFilter, its value is either given directly or taken from the request by
+// setting ValueFrom to "requester_id"
+type DataPolicyFileRowFilter struct {
+	Column    string      `json:"column"`
+	Operator  string      `json:"operator"`
+	Value     interface{} `json:"value"`
+	ValueFrom string      `json:"value_from"`
+}
+
+// LoadStaticDataPolicy reads a JSON data policy file from path and returns the StaticDataPolicy it describes
+func LoadStaticDataPolicy(path string) (*StaticDataPolicy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseStaticDataPolicy(data)
+}
+
+// ParseStaticDataPolicy parses a JSON data policy and returns the StaticDataPolicy it describes
+func ParseStaticDataPolicy(data []byte) (*StaticDataPolicy, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// Reject unknown fields so that a misspelt key cannot silently drop part of a policy
+	decoder.DisallowUnknownFields()
+
+	var policyFile DataPolicyFile
+	err := decoder.Decode(&policyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse data policy: %s", err.Error())
+	}
+
+	strategy := MergeOrFail
+	if policyFile.Strategy != "" {
+		strategy, err = ConflictStrategyFromString(policyFile.Strategy)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	defaultPolicy := DefaultDenyAll
+	if policyFile.Default != "" {
+		defaultPolicy, err = DefaultPolicyFromString(policyFile.Default)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	privacyGroups, transforms, purposeTransforms, err := policyFile.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	staticDataPolicy := NewStaticDataPolicyWithStrategy(privacyGroups, transforms, strategy)
+	staticDataPolicy.Default = defaultPolicy
+	staticDataPolicy.Purposes = purposeTransforms
+
+	if policyFile.PublicGroup != "" {
+		for _, group := range privacyGroups {
+			if group.Name() == policyFile.PublicGroup {
+				staticDataPolicy.PublicGroup = group
+			}
+		}
+		if staticDataPolicy.PublicGroup == nil {
+			return nil, fmt.Errorf("the public group %s is not defined", policyFile.PublicGroup)
+		}
+	}
+	if defaultPolicy == DefaultPublicGroup && staticDataPolicy.PublicGroup == nil {
+		return nil, fmt.Errorf("the public-group default policy requires a public_group")
+	}
+	return staticDataPolicy, nil
+}
+
+// Build validates the DataPolicyFile and returns the ordered privacy groups, the DataTransforms and the
+// PurposeTransforms it describes
+func (f *DataPolicyFile) Build() ([]*PrivacyGroup, DataTransforms, PurposeTransforms, error) {
+	var privacyGroups []*PrivacyGroup
+	transforms := make(DataTransforms)
+	purposeTransforms := make(PurposeTransforms)
+	seenGroups := make(map[string]bool)
+
+	for _, fileGroup := range f.Groups {
+		if fileGroup.Name == "" {
+			return nil, nil, nil, fmt.Errorf("every privacy group in a data policy must have a name")
+		}
+		if seenGroups[fileGroup.Name] {
+			return nil, nil, nil, fmt.Errorf("the privacy group %s is defined more than once", fileGroup.Name)
+		}
+		seenGroups[fileGroup.Name] = true
+
+		group := NewPrivacyGroup(fileGroup.Name)
+		group.AddMany(fileGroup.Members)
+		group.SetPriority(fileGroup.Priority)
+		for _, fileGrant := range fileGroup.Grants {
+			if fileGrant.Member == "" {
+				return nil, nil, nil, fmt.Errorf("privacy group %s: every grant must name a member", fileGroup.Name)
+			}
+			if !fileGrant.Start.IsZero() && !fileGrant.Expiry.IsZero() && !fileGrant.Expiry.After(fileGrant.Start) {
+				return nil, nil, nil, fmt.Errorf("privacy group %s: the grant to %s expires before it starts",
+					fileGroup.Name, fileGrant.Member)
+			}
+			group.Grant(fileGrant.Member, fileGrant.Start, fileGrant.Expiry)
+		}
+		privacyGroups = append(privacyGroups, group)
+
+		tableOperations, err := buildTableOperations(fileGroup.Tables)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("privacy group %s: %s", fileGroup.Name, err.Error())
+		}
+		transforms[group] = tableOperations
+
+		if len(fileGroup.Purposes) > 0 {
+			// The tables of a group are not used once it declares purposes so they must not be given
+			if len(fileGroup.Tables) > 0 {
+				return nil, nil, nil, fmt.Errorf("privacy group %s: tables must be given per purpose when a group "+
+					"declares purposes", fileGroup.Name)
+			}
+
+			purposes := make(map[string]*TableOperations)
+			for purpose, tables := range fileGroup.Purposes {
+				if !identifierRegexp.MatchString(purpose) {
+					return nil, nil, nil, fmt.Errorf("privacy group %s: %q is not a valid purpose", fileGroup.Name,
+						purpose)
+				}
+				purposes[purpose], err = buildTableOperations(tables)
+				if err != nil {
+					return nil, nil, nil, fmt.Errorf("privacy group %s, purpose %s: %s", fileGroup.Name, purpose,
+						err.Error())
+				}
+			}
+			purposeTransforms[group] = purposes
+		}
+	}
+
+	return privacyGroups, transforms, purposeTransforms, nil
+}
+
+func buildTableOperations(tables map[string]DataPolicyFileTable) (*TableOperations, error) {
+	tableOperations := NewTableOperations()
+	for tableName, table := range tables {
+		err := table.addTo(tableOperations, tableName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tableOperations, nil
+}
+
+func (t DataPolicyFileTable) addTo(tableOperations *TableOperations, tableName string) error {
+	if tableName == "" {
+		return fmt.Errorf("table names cannot be empty")
+	}
+
+	// A present but empty allow-list hides every column so is kept distinct from one which is not given
+	if t.AllowedColumns != nil {
+		for _, col := range *t.AllowedColumns {
+			if col == "" {
+				return fmt.Errorf("table %s: allowed column names cannot be empty", tableName)
+			}
+		}
+		tableOperations.AllowedCols[tableName] = append([]string{}, *t.AllowedColumns...)
+	}
+
+	for _, col := range t.ExcludedColumns {
+		if col == "" {
+			return fmt.Errorf("table %s: excluded column names cannot be empty", tableName)
+		}
+	}
+	if len(t.ExcludedColumns) > 0 {
+		tableOperations.ExcludedCols[tableName] = t.ExcludedColumns
+	}
+
+	if len(t.Transforms) > 0 {
+		tableTransform := make(TableTransform)
+		sqlTableTransform := make(SQLTableTransform)
+		for col, fileTransform := range t.Transforms {
+			if col == "" {
+				return fmt.Errorf("table %s: transformed column names cannot be empty", tableName)
+			}
+			// A transform on an excluded column would never be applied, which suggests a mistake in the policy
+			if contains(t.ExcludedColumns, col) {
+				return fmt.Errorf("table %s: column %s is both excluded and transformed", tableName, col)
+			}
+			if t.AllowedColumns != nil && !contains(*t.AllowedColumns, col) {
+				return fmt.Errorf("table %s: column %s is transformed but not allowed", tableName, col)
+			}
+
+			// Let the database apply the transform if it can so that the table does not need to be copied
+			sqlTransform, err := BuildSQLTransform(fileTransform.Transform, fileTransform.Params)
+			if err == nil {
+				sqlTableTransform[col] = sqlTransform
+				continue
+			} else if err != ErrNotSQLExpressible {
+				return fmt.Errorf("table %s, column %s: %s", tableName, col, err.Error())
+			}
+
+			transform, err := BuildTransform(fileTransform.Transform, fileTransform.Params)
+			if err != nil {
+				return fmt.Errorf("table %s, column %s: %s", tableName, col, err.Error())
+			}
+			tableTransform[col] = transform
+
+			// Requesters whose policies build the same transforms can share transformed tables
+			transformID, err := TransformID(fileTransform.Transform, fileTransform.Params)
+			if err != nil {
+				return fmt.Errorf("table %s, column %s: %s", tableName, col, err.Error())
+			}
+			tableOperations.setTransformID(tableName, col, transformID)
+		}
+		if len(tableTransform) > 0 {
+			tableOperations.TableTransforms[tableName] = tableTransform
+		}
+		if len(sqlTableTransform) > 0 {
+			tableOperations.SQLTransforms[tableName] = sqlTableTransform
+		}
+	}
+
+	for _, fileRowFilter := range t.RowFilters {
+		rowFilter, err := fileRowFilter.build()
+		if err != nil {
+			return fmt.Errorf("table %s: %s", tableName, err.Error())
+		}
+		tableOperations.RowFilters[tableName] = append(tableOperations.RowFilters[tableName], rowFilter)
+	}
+	for _, fileWriteFilter := range t.WriteFilters {
+		writeFilter, err := fileWriteFilter.build()
+		if err != nil {
+			return fmt.Errorf("table %s: %s", tableName, err.Error())
+		}
+		tableOperations.WriteFilters[tableName] = append(tableOperations.WriteFilters[tableName], writeFilter)
+	}
+
+	return nil
+}
+
+func (f DataPolicyFileRowFilter) build() (RowFilter, error) {
+	rowFilter := RowFilter{
+		Column:   f.Column,
+		Operator: f.Operator,
+		Value:    f.Value,
+	}
+
+	switch f.ValueFrom {
+	case "":
+	case "requester_id":
+		if f.Value != nil {
+			return RowFilter{}, fmt.Errorf("the row filter on %s cannot have both a value and a value_from", f.Column)
+		}
+		rowFilter.Value = RequesterIDValue
+	default:
+		return RowFilter{}, fmt.Errorf("unknown value_from %q for the row filter on %s", f.ValueFrom, f.Column)
+	}
+
+	err := rowFilter.validate()
+	if err != nil {
+		return RowFilter{}, err
+	}
+	return rowFilter, nil
+}
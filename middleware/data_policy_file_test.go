@@ -0,0 +1,318 @@
+package middleware
+
+import (
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const validDataPolicyJSON = `{
+  "groups": [
+    {
+      "name": "CentralServer",
+      "members": ["server"],
+      "tables": {
+        "household_power_consumption": {
+          "excluded_columns": ["voltage"],
+          "transforms": {
+            "datetime": {"transform": "truncate-date", "params": {"unit": "month"}}
+          }
+        }
+      }
+    },
+    {
+      "name": "Analysts",
+      "members": ["alice", "bob"],
+      "tables": {
+        "people": {
+          "allowed_columns": ["id", "name", "dob"],
+          "excluded_columns": ["dob"],
+          "transforms": {
+            "name": {"transform": "redact", "params": {"keep": 3}}
+          },
+          "row_filters": [
+            {"column": "region", "operator": "IN", "value": ["EU", "UK"]},
+            {"column": "owner", "operator": "=", "value_from": "requester_id"}
+          ],
+          "write_filters": [
+            {"column": "owner", "operator": "=", "value_from": "requester_id"}
+          ]
+        }
+      }
+    }
+  ]
+}`
+
+func TestParseStaticDataPolicy(t *testing.T) {
+	policy, err := ParseStaticDataPolicy([]byte(validDataPolicyJSON))
+	require.NoError(t, err)
+
+	require.Len(t, policy.privacyGroups, 2)
+	require.Equal(t, "CentralServer", policy.privacyGroups[0].Name())
+	require.Equal(t, "Analysts", policy.privacyGroups[1].Name())
+
+	tableOperations, err := policy.Resolve("server")
+	require.NoError(t, err)
+	require.Equal(t, []string{"voltage"}, tableOperations.ExcludedCols["household_power_consumption"])
+
+	// Transforms which the database can evaluate are built as SQLTransforms
+	require.Empty(t, tableOperations.TableTransforms)
+	transform := tableOperations.SQLTransforms["household_power_consumption"]["datetime"]
+	require.NotNil(t, transform)
+	require.Equal(t, "CAST(DATE_FORMAT(`datetime`, '%Y-%m-01') AS DATETIME)", transform("`datetime`"))
+
+	tableOperations, err = policy.Resolve("bob")
+	require.NoError(t, err)
+	require.Equal(t, []string{"dob"}, tableOperations.ExcludedCols["people"])
+	require.Equal(t, []string{"id", "name", "dob"}, tableOperations.AllowedCols["people"])
+	_, ok := tableOperations.AllowedCols["household_power_consumption"]
+	require.False(t, ok)
+	require.Equal(t, "CONCAT(LEFT(`name`, 3), REPEAT('*', GREATEST(CHAR_LENGTH(`name`) - 3, 0)))",
+		tableOperations.SQLTransforms["people"]["name"]("`name`"))
+	require.Equal(t, []RowFilter{
+		{Column: "region", Operator: "IN", Value: []interface{}{"EU", "UK"}},
+		{Column: "owner", Operator: "=", Value: RequesterIDValue},
+	}, tableOperations.RowFilters["people"])
+	require.Equal(t, []RowFilter{
+		{Column: "owner", Operator: "=", Value: RequesterIDValue},
+	}, tableOperations.WriteFilters["people"])
+
+	_, err = policy.Resolve("mallory")
+	require.Error(t, err)
+}
+
+func TestLoadStaticDataPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pam")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "policy.json")
+	err = ioutil.WriteFile(path, []byte(validDataPolicyJSON), 0644)
+	require.NoError(t, err)
+
+	policy, err := LoadStaticDataPolicy(path)
+	require.NoError(t, err)
+	require.Len(t, policy.privacyGroups, 2)
+
+	_, err = LoadStaticDataPolicy(filepath.Join(dir, "missing.json"))
+	require.Error(t, err)
+}
+
+func TestParseStaticDataPolicy_Invalid(t *testing.T) {
+	testCases := []struct {
+		name   string
+		policy string
+		err    string
+	}{
+		{
+			"unknown field",
+			`{"groups": [{"name": "g", "tables": {"t": {"exclude_columns": ["a"]}}}]}`,
+			`cannot parse data policy: json: unknown field "exclude_columns"`,
+		},
+		{
+			"unknown strategy",
+			`{"strategy": "random", "groups": []}`,
+			"cannot parse random as a conflict strategy",
+		},
+		{
+			"unknown default",
+			`{"default": "allow-all", "groups": []}`,
+			"cannot parse allow-all as a default policy",
+		},
+		{
+			"undefined public group",
+			`{"default": "aggregates-only", "public_group": "p", "groups": []}`,
+			"the public group p is not defined",
+		},
+		{
+			"public group default without a group",
+			`{"default": "public-group", "groups": []}`,
+			"the public-group default policy requires a public_group",
+		},
+		{
+			"tables and purposes",
+			`{"groups": [{"name": "g", "tables": {"t": {}}, "purposes": {"billing": {"t": {}}}}]}`,
+			"privacy group g: tables must be given per purpose when a group declares purposes",
+		},
+		{
+			"invalid purpose",
+			`{"groups": [{"name": "g", "purposes": {"bill ing": {"t": {}}}}]}`,
+			`privacy group g: "bill ing" is not a valid purpose`,
+		},
+		{
+			"bad purpose table",
+			`{"groups": [{"name": "g", "purposes": {"billing": {"t": {"excluded_columns": [""]}}}}]}`,
+			"privacy group g, purpose billing: table t: excluded column names cannot be empty",
+		},
+		{
+			"grant without a member",
+			`{"groups": [{"name": "g", "grants": [{"expiry": "2019-01-01T00:00:00Z"}]}]}`,
+			"privacy group g: every grant must name a member",
+		},
+		{
+			"grant expiring before it starts",
+			`{"groups": [{"name": "g", "grants": [{"member": "a", "start": "2019-01-01T00:00:00Z", ` +
+				`"expiry": "2018-01-01T00:00:00Z"}]}]}`,
+			"privacy group g: the grant to a expires before it starts",
+		},
+		{
+			"missing group name",
+			`{"groups": [{"members": ["alice"]}]}`,
+			"every privacy group in a data policy must have a name",
+		},
+		{
+			"duplicate group",
+			`{"groups": [{"name": "g"}, {"name": "g"}]}`,
+			"the privacy group g is defined more than once",
+		},
+		{
+			"unknown transform",
+			`{"groups": [{"name": "g", "tables": {"t": {"transforms": {"a": {"transform": "scramble"}}}}}]}`,
+			"privacy group g: table t, column a: unknown transform scramble",
+		},
+		{
+			"bad params",
+			`{"groups": [{"name": "g", "tables": {"t": {"transforms": {"a": {"transform": "bucket", "params": {"width": -1}}}}}}]}`,
+			"privacy group g: table t, column a: invalid parameters for transform bucket: bucket width must be positive, got -1",
+		},
+		{
+			"excluded and transformed",
+			`{"groups": [{"name": "g", "tables": {"t": {"excluded_columns": ["a"], "transforms": {"a": {"transform": "null-out"}}}}}]}`,
+			"privacy group g: table t: column a is both excluded and transformed",
+		},
+		{
+			"transformed but not allowed",
+			`{"groups": [{"name": "g", "tables": {"t": {"allowed_columns": ["b"], "transforms": {"a": {"transform": "null-out"}}}}}]}`,
+			"privacy group g: table t: column a is transformed but not allowed",
+		},
+		{
+			"bad row filter",
+			`{"groups": [{"name": "g", "tables": {"t": {"row_filters": [{"column": "a", "operator": "~", "value": 1}]}}}]}`,
+			`privacy group g: table t: unknown row filter operator "~"`,
+		},
+		{
+			"bad row filter value source",
+			`{"groups": [{"name": "g", "tables": {"t": {"row_filters": [{"column": "a", "operator": "=", "value_from": "ip"}]}}}]}`,
+			`privacy group g: table t: unknown value_from "ip" for the row filter on a`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseStaticDataPolicy([]byte(tc.policy))
+			require.EqualError(t, err, tc.err)
+		})
+	}
+}
+
+func TestParseStaticDataPolicy_EmptyAllowList(t *testing.T) {
+	policy, err := ParseStaticDataPolicy([]byte(`{"groups": [{"name": "g", "members": ["alice"], "tables": {"t": {"allowed_columns": []}}}]}`))
+	require.NoError(t, err)
+
+	tableOperations, err := policy.Resolve("alice")
+	require.NoError(t, err)
+	require.False(t, tableOperations.columnVisible("t", "a"))
+}
+
+func TestParseStaticDataPolicy_Strategy(t *testing.T) {
+	policy, err := ParseStaticDataPolicy([]byte(`{
+	  "strategy": "highest-priority",
+	  "groups": [
+	    {"name": "g1", "members": ["alice"], "tables": {"t": {"excluded_columns": ["a"]}}},
+	    {"name": "g2", "members": ["alice"], "priority": 2, "tables": {"t": {"excluded_columns": ["b"]}}}
+	  ]
+	}`))
+	require.NoError(t, err)
+	require.Equal(t, HighestPriority, policy.Strategy)
+
+	tableOperations, err := policy.Resolve("alice")
+	require.NoError(t, err)
+	require.Equal(t, []string{"b"}, tableOperations.ExcludedCols["t"])
+}
+
+func TestParseStaticDataPolicy_Default(t *testing.T) {
+	policy, err := ParseStaticDataPolicy([]byte(`{
+	  "default": "public-group",
+	  "public_group": "Public",
+	  "groups": [{"name": "Public", "tables": {"t": {"excluded_columns": ["a"]}}}]
+	}`))
+	require.NoError(t, err)
+	require.Equal(t, DefaultPublicGroup, policy.Default)
+	require.Equal(t, "Public", policy.PublicGroup.Name())
+
+	tableOperations, err := policy.Resolve(AnonymousRequesterID)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, tableOperations.ExcludedCols["t"])
+}
+
+func TestParseStaticDataPolicy_Purposes(t *testing.T) {
+	policy, err := ParseStaticDataPolicy([]byte(`{
+	  "groups": [{
+	    "name": "Analysts",
+	    "members": ["alice"],
+	    "purposes": {
+	      "billing": {"people": {"allowed_columns": ["id", "name"]}},
+	      "research": {"people": {"excluded_columns": ["name"]}}
+	    }
+	  }]
+	}`))
+	require.NoError(t, err)
+
+	tableOperations, err := policy.ResolvePurpose("alice", "billing")
+	require.NoError(t, err)
+	require.Equal(t, []string{"id", "name"}, tableOperations.AllowedCols["people"])
+
+	tableOperations, err = policy.ResolvePurpose("alice", "research")
+	require.NoError(t, err)
+	require.Equal(t, []string{"name"}, tableOperations.ExcludedCols["people"])
+
+	_, err = policy.ResolvePurpose("alice", "marketing")
+	require.Equal(t, ErrPurposeNotDeclared, err)
+	_, err = policy.Resolve("alice")
+	require.Equal(t, ErrAccessDenied, err)
+}
+
+func TestParseStaticDataPolicy_Grants(t *testing.T) {
+	policy, err := ParseStaticDataPolicy([]byte(`{
+	  "groups": [{
+	    "name": "Contractors",
+	    "grants": [
+	      {"member": "current", "start": "2019-01-01T00:00:00Z"},
+	      {"member": "expired", "start": "2019-01-01T00:00:00Z", "expiry": "2019-07-01T00:00:00Z"}
+	    ]
+	  }]
+	}`))
+	require.NoError(t, err)
+
+	_, err = policy.Resolve("current")
+	require.NoError(t, err)
+	_, err = policy.Resolve("expired")
+	require.Equal(t, ErrAccessDenied, err)
+}
+
+func TestParseStaticDataPolicy_GoTransforms(t *testing.T) {
+	policy, err := ParseStaticDataPolicy([]byte(`{"groups": [{"name": "Analysts", "members": ["alice"], "tables": {
+		"people": {"transforms": {
+			"name": {"transform": "regex-mask", "params": {"pattern": "[aeiou]"}},
+			"dob": {"transform": "truncate-date", "params": {"unit": "year"}}
+		}}
+	}}]}`))
+	require.NoError(t, err)
+
+	tableOperations, err := policy.Resolve("alice")
+	require.NoError(t, err)
+
+	// Transforms the database cannot evaluate are applied in Go, so the table is copied
+	masked, _, err := tableOperations.TableTransforms["people"]["name"]([]byte("alice"))
+	require.NoError(t, err)
+	require.Equal(t, "*l*c*", masked)
+	require.Contains(t, tableOperations.SQLTransforms["people"], "dob")
+	require.False(t, tableOperations.inline("people"))
+
+	// Transforms built from the library have IDs so that requesters with the same transforms can share tables
+	transformID, err := TransformID("regex-mask", TransformParams{"pattern": "[aeiou]"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"name": transformID}, tableOperations.TransformIDs["people"])
+}
@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"github.com/xwb1989/sqlparser"
+	"strings"
+)
+
+// AnonymousRequesterID is the identity given to requests which do not name a requester. It is resolved like any
+// other identity so it can be added to privacy groups, otherwise the default policy applies to it.
+const AnonymousRequesterID = "anonymous"
+
+// ErrAccessDenied is returned when a data policy gives a requester no access. The same error is returned whether or
+// not the requester is known so that it does not reveal which requester IDs exist.
+var ErrAccessDenied = errors.New("access denied by the data policy")
+
+// ErrAggregatesOnly is returned when a requester who may only run aggregate queries runs any other query
+var ErrAggregatesOnly = errors.New("only aggregate queries are permitted")
+
+// DefaultPolicy decides what a StaticDataPolicy gives to requesters who are not a member of any of its privacy groups
+type DefaultPolicy int
+
+const (
+	// DefaultDenyAll refuses every query from the requester
+	DefaultDenyAll DefaultPolicy = iota
+	// DefaultPublicGroup applies the TableOperations of the policy's public group
+	DefaultPublicGroup DefaultPolicy = iota
+	// DefaultAggregatesOnly only allows queries which return COUNT, SUM or AVG aggregates, the TableOperations of the
+	// public group apply if the policy has one. MIN and MAX are not allowed as they return a single row's value.
+	DefaultAggregatesOnly DefaultPolicy = iota
+)
+
+// DefaultPolicyFromString converts a string to the relevant DefaultPolicy
+func DefaultPolicyFromString(policy string) (DefaultPolicy, error) {
+	switch strings.ToLower(policy) {
+	case "deny-all":
+		return DefaultDenyAll, nil
+	case "public-group":
+		return DefaultPublicGroup, nil
+	case "aggregates-only":
+		return DefaultAggregatesOnly, nil
+	default:
+		return 0, fmt.Errorf("cannot parse %s as a default policy", policy)
+	}
+}
+
+// ToString converts from a DefaultPolicy to the relevant string
+func (d DefaultPolicy) ToString() string {
+	switch d {
+	case DefaultDenyAll:
+		return "deny-all"
+	case DefaultPublicGroup:
+		return "public-group"
+	case DefaultAggregatesOnly:
+		return "aggregates-only"
+	}
+	return ""
+}
+
+// requesterIDOrAnonymous returns the requester named by the RequestPolicy, or AnonymousRequesterID if it names none
+func requesterIDOrAnonymous(requestPolicy *RequestPolicy) string {
+	if requestPolicy == nil || requestPolicy.RequesterID == "" {
+		return AnonymousRequesterID
+	}
+	return requestPolicy.RequesterID
+}
+
+var aggregateFunctions = map[string]bool{
+	"count": true,
+	"sum":   true,
+	"avg":   true,
+}
+
+// checkAggregatesOnly returns ErrAggregatesOnly unless every SELECT in the statement, including subqueries, only
+// returns aggregates over all of the rows it matches. GROUP BY is not allowed as small groups reveal single rows.
+func checkAggregatesOnly(stmt sqlparser.Statement) error {
+	if _, ok := stmt.(*sqlparser.Select); !ok {
+		return ErrAggregatesOnly
+	}
+
+	aggregatesOnly := true
+	err := sqlparser.Walk(
+		func(node sqlparser.SQLNode) (kcontinue bool, err error) {
+			switch node := node.(type) {
+			case *sqlparser.Union:
+				aggregatesOnly = false
+			case *sqlparser.Select:
+				if len(node.GroupBy) > 0 || node.Distinct != "" {
+					aggregatesOnly = false
+				}
+				for _, selectExpr := range node.SelectExprs {
+					aliasedExpr, ok := selectExpr.(*sqlparser.AliasedExpr)
+					if !ok {
+						aggregatesOnly = false
+						continue
+					}
+					funcExpr, ok := aliasedExpr.Expr.(*sqlparser.FuncExpr)
+					if !ok || !aggregateFunctions[funcExpr.Name.Lowered()] || funcExpr.Distinct {
+						aggregatesOnly = false
+					}
+				}
+			}
+			return aggregatesOnly, nil
+		}, stmt)
+	if err != nil {
+		return err
+	}
+
+	if !aggregatesOnly {
+		return ErrAggregatesOnly
+	}
+	return nil
+}
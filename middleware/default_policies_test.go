@@ -0,0 +1,132 @@
+package middleware
+
+import (
+	"github.com/stretchr/testify/require"
+	"github.com/xwb1989/sqlparser"
+	"net/http/httptest"
+	"testing"
+)
+
+func defaultDataPolicy(defaultPolicy DefaultPolicy) *StaticDataPolicy {
+	members := NewPrivacyGroup("Members")
+	members.Add("alice")
+	public := NewPrivacyGroup("Public")
+
+	dataPolicy := NewStaticDataPolicy([]*PrivacyGroup{members}, DataTransforms{
+		members: {ExcludedCols: map[string][]string{"people": {"dob"}}},
+		public:  {ExcludedCols: map[string][]string{"people": {"name", "dob"}}},
+	})
+	dataPolicy.Default = defaultPolicy
+	dataPolicy.PublicGroup = public
+	return dataPolicy
+}
+
+func TestStaticDataPolicy_Resolve_DefaultDenyAll(t *testing.T) {
+	dataPolicy := defaultDataPolicy(DefaultDenyAll)
+
+	// The error does not depend on the requester
+	_, err := dataPolicy.Resolve("mallory")
+	require.Equal(t, ErrAccessDenied, err)
+	_, err = dataPolicy.Resolve(AnonymousRequesterID)
+	require.Equal(t, ErrAccessDenied, err)
+	require.NotContains(t, err.Error(), AnonymousRequesterID)
+
+	tableOperations, err := dataPolicy.Resolve("alice")
+	require.NoError(t, err)
+	require.Equal(t, []string{"dob"}, tableOperations.ExcludedCols["people"])
+}
+
+func TestStaticDataPolicy_Resolve_DefaultPublicGroup(t *testing.T) {
+	dataPolicy := defaultDataPolicy(DefaultPublicGroup)
+
+	tableOperations, err := dataPolicy.Resolve(AnonymousRequesterID)
+	require.NoError(t, err)
+	require.Equal(t, []string{"name", "dob"}, tableOperations.ExcludedCols["people"])
+	require.False(t, tableOperations.AggregatesOnly)
+
+	// Without a public group the default denies access
+	dataPolicy.PublicGroup = nil
+	_, err = dataPolicy.Resolve(AnonymousRequesterID)
+	require.Equal(t, ErrAccessDenied, err)
+}
+
+func TestStaticDataPolicy_Resolve_DefaultAggregatesOnly(t *testing.T) {
+	dataPolicy := defaultDataPolicy(DefaultAggregatesOnly)
+
+	tableOperations, err := dataPolicy.Resolve("mallory")
+	require.NoError(t, err)
+	require.True(t, tableOperations.AggregatesOnly)
+	require.Equal(t, []string{"name", "dob"}, tableOperations.ExcludedCols["people"])
+
+	// Members of a group are not restricted and the public group's operations are unchanged
+	tableOperations, err = dataPolicy.Resolve("alice")
+	require.NoError(t, err)
+	require.False(t, tableOperations.AggregatesOnly)
+	require.False(t, dataPolicy.transforms[dataPolicy.PublicGroup].AggregatesOnly)
+
+	dataPolicy.PublicGroup = nil
+	tableOperations, err = dataPolicy.Resolve("mallory")
+	require.NoError(t, err)
+	require.True(t, tableOperations.AggregatesOnly)
+	require.Empty(t, tableOperations.ExcludedCols)
+}
+
+func TestCheckAggregatesOnly(t *testing.T) {
+	testCases := []struct {
+		query   string
+		allowed bool
+	}{
+		{"SELECT COUNT(*) FROM people", true},
+		{"SELECT COUNT(id), AVG(id) AS a, SUM(id) FROM people WHERE name LIKE 'a%'", true},
+		{"SELECT COUNT(*) FROM people WHERE id IN (SELECT COUNT(id) FROM people)", true},
+		{"SELECT MAX(dob) FROM people WHERE name = 'alice'", false},
+		{"SELECT MIN(dob) FROM people", false},
+		{"SELECT COUNT(*) FROM people WHERE id IN (SELECT MAX(id) FROM people)", false},
+		{"SELECT * FROM people", false},
+		{"SELECT name FROM people", false},
+		{"SELECT COUNT(*), name FROM people", false},
+		{"SELECT COUNT(*) FROM people GROUP BY name", false},
+		{"SELECT COUNT(DISTINCT name) FROM people", false},
+		{"SELECT GROUP_CONCAT(name) FROM people", false},
+		{"SELECT COUNT(*) + 1 FROM people", false},
+		{"SELECT COUNT(*) FROM people WHERE id IN (SELECT id FROM people)", false},
+		{"SELECT COUNT(*) FROM people UNION SELECT name FROM people", false},
+		{"DELETE FROM people", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.query, func(t *testing.T) {
+			stmt, err := sqlparser.Parse(tc.query)
+			require.NoError(t, err)
+
+			err = checkAggregatesOnly(stmt)
+			if tc.allowed {
+				require.NoError(t, err)
+			} else {
+				require.Equal(t, ErrAggregatesOnly, err)
+			}
+		})
+	}
+}
+
+func TestBuildRequestPolicy_Anonymous(t *testing.T) {
+	req := httptest.NewRequest("GET", "/?preferred_processing_location=local&has_all_required_data=true", nil)
+	requestPolicy, err := BuildRequestPolicy(req)
+	require.NoError(t, err)
+	require.Equal(t, AnonymousRequesterID, requestPolicy.RequesterID)
+
+	require.Equal(t, AnonymousRequesterID, requesterIDOrAnonymous(&RequestPolicy{}))
+	require.Equal(t, AnonymousRequesterID, requesterIDOrAnonymous(nil))
+	require.Equal(t, "alice", requesterIDOrAnonymous(&RequestPolicy{RequesterID: "alice"}))
+}
+
+func TestDefaultPolicyFromString(t *testing.T) {
+	for _, defaultPolicy := range []DefaultPolicy{DefaultDenyAll, DefaultPublicGroup, DefaultAggregatesOnly} {
+		parsed, err := DefaultPolicyFromString(defaultPolicy.ToString())
+		require.NoError(t, err)
+		require.Equal(t, defaultPolicy, parsed)
+	}
+
+	_, err := DefaultPolicyFromString("allow-all")
+	require.EqualError(t, err, "cannot parse allow-all as a default policy")
+}
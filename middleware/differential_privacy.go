@@ -0,0 +1,506 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/xwb1989/sqlparser"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrPrivacyBudgetExhausted is returned when answering a query would take a requester over their privacy budget
+var ErrPrivacyBudgetExhausted = errors.New("the privacy budget for this requester has been exhausted")
+
+// NoiseMechanism is the distribution noise is drawn from when answering differentially private queries
+type NoiseMechanism int
+
+const (
+	// Laplace noise gives pure epsilon-differential privacy
+	Laplace NoiseMechanism = iota
+	// Gaussian noise gives (epsilon, delta)-differential privacy, the scale used is only valid for an epsilon below 1
+	// so the EpsilonPerQuery must be less than 1
+	Gaussian NoiseMechanism = iota
+)
+
+// ColumnBounds are the bounds values in a column are clamped to before being summed or averaged, they determine the
+// sensitivity of SUM and AVG queries and so how much noise is added
+type ColumnBounds struct {
+	Lower float64
+	Upper float64
+}
+
+// DifferentialPrivacyPolicy specifies the requesters whose read queries are answered with differentially private
+// aggregate results. Queries from members of its privacy groups must be a single SELECT over one table whose results
+// are COUNT, SUM or AVG aggregates, SUM and AVG are only allowed over columns with bounds. Each query spends
+// EpsilonPerQuery from the requester's Budget and is refused once the budget has been spent.
+type DifferentialPrivacyPolicy struct {
+	PrivacyGroups   []*PrivacyGroup
+	Mechanism       NoiseMechanism
+	EpsilonPerQuery float64
+	// Delta is only used by the Gaussian mechanism
+	Delta  float64
+	Budget float64
+	// Bounds maps table names to column names to the bounds of the column
+	Bounds map[string]map[string]ColumnBounds
+	// BudgetStore records the budget spent by each requester. If it is nil spending is recorded in the database being
+	// queried, by a MySQLPrivacyBudgetStore for MySQL or a PostgresPrivacyBudgetStore for PostgreSQL. There is no
+	// default for SQLite, so differentially private queries to SQLite fail unless a BudgetStore is given.
+	BudgetStore PrivacyBudgetStore
+
+	budgetStoreMutex sync.Mutex
+	// random returns a uniformly distributed float in [0, 1), it is only replaced in tests
+	random func() float64
+}
+
+func (dp *DifferentialPrivacyPolicy) appliesTo(requesterID string) bool {
+	for _, group := range dp.PrivacyGroups {
+		if group.contains(requesterID) {
+			return true
+		}
+	}
+	return false
+}
+
+func (dp *DifferentialPrivacyPolicy) validate() error {
+	if dp.EpsilonPerQuery <= 0 {
+		return errors.New("the epsilon spent per differentially private query must be positive")
+	}
+	if dp.Budget < dp.EpsilonPerQuery {
+		return errors.New("the privacy budget must allow at least one query")
+	}
+	if dp.Mechanism == Gaussian && (dp.Delta <= 0 || dp.Delta >= 1) {
+		return errors.New("the Gaussian mechanism requires a delta between 0 and 1")
+	}
+	if dp.Mechanism == Gaussian && dp.EpsilonPerQuery >= 1 {
+		return errors.New("the Gaussian mechanism requires an epsilon per query below 1")
+	}
+	for table, columns := range dp.Bounds {
+		for column, bounds := range columns {
+			if bounds.Lower > bounds.Upper {
+				return fmt.Errorf("the lower bound of %s.%s is greater than its upper bound", table, column)
+			}
+		}
+	}
+	return nil
+}
+
+// noise returns a sample of noise calibrated to the sensitivity of a result and the epsilon spent on it
+func (dp *DifferentialPrivacyPolicy) noise(sensitivity float64, epsilon float64) float64 {
+	random := dp.random
+	if random == nil {
+		random = cryptoRandomFloat64
+	}
+
+	switch dp.Mechanism {
+	case Gaussian:
+		sigma := sensitivity * math.Sqrt(2*math.Log(1.25/dp.Delta)) / epsilon
+		// Box-Muller transform, 1 - random() lies in (0, 1] so the logarithm is finite
+		return sigma * math.Sqrt(-2*math.Log(1-random())) * math.Cos(2*math.Pi*random())
+	default:
+		scale := sensitivity / epsilon
+		// u must lie in the open interval (-0.5, 0.5) for the logarithms to be finite, so 0 is redrawn
+		r := random()
+		for r == 0 {
+			r = random()
+		}
+		u := r - 0.5
+		if u < 0 {
+			return scale * math.Log(1+2*u)
+		}
+		return -scale * math.Log(1-2*u)
+	}
+}
+
+func cryptoRandomFloat64() float64 {
+	var b [8]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		panic(err)
+	}
+	// Use the top 53 bits so that every value is exactly representable
+	return float64(binary.BigEndian.Uint64(b[:])>>11) / (1 << 53)
+}
+
+// dpAggregate is one aggregate in the select list of a differentially private query
+type dpAggregate struct {
+	function    string
+	alias       string
+	bounds      ColumnBounds
+	sensitivity float64
+	// rawColumns are the indexes of the results of the rewritten query this aggregate is computed from, AVG uses
+	// a clamped sum and a count
+	rawColumns []int
+}
+
+// dpQueryPlan holds an aggregate query rewritten to clamp its inputs and how to compute the final results from it
+type dpQueryPlan struct {
+	query      string
+	aggregates []dpAggregate
+	rawColumns int
+}
+
+// plan checks that a query can be answered with differential privacy and rewrites it so that SUM and AVG operate on
+// clamped values
+func (dp *DifferentialPrivacyPolicy) plan(query string) (*dpQueryPlan, error) {
+	unsupported := errors.New("only SELECT queries over a single table returning COUNT, SUM or AVG aggregates are " +
+		"supported for this requester")
+
+	stmt, err := sqlparser.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	sel, ok := stmt.(*sqlparser.Select)
+	if !ok || len(sel.GroupBy) > 0 || sel.Having != nil || sel.Distinct != "" || len(sel.From) != 1 {
+		return nil, unsupported
+	}
+	tableExpr, ok := sel.From[0].(*sqlparser.AliasedTableExpr)
+	if !ok {
+		return nil, unsupported
+	}
+	table, ok := tableExpr.Expr.(sqlparser.TableName)
+	if !ok {
+		return nil, unsupported
+	}
+	tableBounds := dp.Bounds[table.Name.String()]
+
+	// Subqueries could read individual rows, so they are not allowed anywhere in the query
+	err = sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		if _, ok := node.(*sqlparser.Subquery); ok {
+			return false, unsupported
+		}
+		return true, nil
+	}, sel)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &dpQueryPlan{}
+	var rawExprs sqlparser.SelectExprs
+	addRaw := func(expr sqlparser.Expr) int {
+		rawExprs = append(rawExprs, &sqlparser.AliasedExpr{Expr: expr})
+		plan.rawColumns++
+		return plan.rawColumns - 1
+	}
+
+	for _, selectExpr := range sel.SelectExprs {
+		aliasedExpr, ok := selectExpr.(*sqlparser.AliasedExpr)
+		if !ok {
+			return nil, unsupported
+		}
+		funcExpr, ok := aliasedExpr.Expr.(*sqlparser.FuncExpr)
+		if !ok || funcExpr.Distinct || len(funcExpr.Exprs) != 1 {
+			return nil, unsupported
+		}
+
+		aggregate := dpAggregate{function: funcExpr.Name.Lowered(), alias: aliasedExpr.As.String()}
+		if aggregate.alias == "" {
+			// Name the column as MySQL would have done
+			aggregate.alias = sqlparser.String(aliasedExpr.Expr)
+		}
+
+		// COUNT(*) is the only aggregate which may be applied to something other than a column
+		if _, ok := funcExpr.Exprs[0].(*sqlparser.StarExpr); ok {
+			if aggregate.function != "count" {
+				return nil, unsupported
+			}
+			aggregate.sensitivity = 1
+			aggregate.rawColumns = []int{addRaw(funcExpr)}
+			plan.aggregates = append(plan.aggregates, aggregate)
+			continue
+		}
+
+		argument, ok := funcExpr.Exprs[0].(*sqlparser.AliasedExpr)
+		if !ok {
+			return nil, unsupported
+		}
+		column, ok := argument.Expr.(*sqlparser.ColName)
+		if !ok {
+			return nil, unsupported
+		}
+
+		switch aggregate.function {
+		case "count":
+			aggregate.sensitivity = 1
+			aggregate.rawColumns = []int{addRaw(funcExpr)}
+		case "sum", "avg":
+			bounds, ok := tableBounds[column.Name.String()]
+			if !ok {
+				return nil, fmt.Errorf("no bounds have been set for column %s so it cannot be aggregated",
+					column.Name.String())
+			}
+			aggregate.bounds = bounds
+			aggregate.sensitivity = math.Max(math.Abs(bounds.Lower), math.Abs(bounds.Upper))
+
+			clampedSum := &sqlparser.FuncExpr{
+				Name:  sqlparser.NewColIdent("SUM"),
+				Exprs: sqlparser.SelectExprs{&sqlparser.AliasedExpr{Expr: clamp(column, bounds)}},
+			}
+			aggregate.rawColumns = []int{addRaw(clampedSum)}
+			if aggregate.function == "avg" {
+				count := &sqlparser.FuncExpr{
+					Name:  sqlparser.NewColIdent("COUNT"),
+					Exprs: sqlparser.SelectExprs{&sqlparser.AliasedExpr{Expr: column}},
+				}
+				aggregate.rawColumns = append(aggregate.rawColumns, addRaw(count))
+			}
+		default:
+			return nil, unsupported
+		}
+		plan.aggregates = append(plan.aggregates, aggregate)
+	}
+
+	rewritten := *sel
+	rewritten.SelectExprs = rawExprs
+	rewritten.OrderBy = nil
+	rewritten.Limit = nil
+	plan.query = formatSQL(&rewritten)
+
+	return plan, nil
+}
+
+// clamp returns an expression which limits the values of a column to the passed bounds
+func clamp(column *sqlparser.ColName, bounds ColumnBounds) sqlparser.Expr {
+	greatest := &sqlparser.FuncExpr{
+		Name: sqlparser.NewColIdent("GREATEST"),
+		Exprs: sqlparser.SelectExprs{
+			&sqlparser.AliasedExpr{Expr: column},
+			&sqlparser.AliasedExpr{Expr: sqlparser.NewFloatVal([]byte(formatFloat(bounds.Lower)))},
+		},
+	}
+	return &sqlparser.FuncExpr{
+		Name: sqlparser.NewColIdent("LEAST"),
+		Exprs: sqlparser.SelectExprs{
+			&sqlparser.AliasedExpr{Expr: greatest},
+			&sqlparser.AliasedExpr{Expr: sqlparser.NewFloatVal([]byte(formatFloat(bounds.Upper)))},
+		},
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// noisyResults computes the final result of each aggregate from the results of the rewritten query, splitting
+// epsilon evenly between the raw results used
+func (plan *dpQueryPlan) noisyResults(raw []sql.NullFloat64, epsilon float64,
+	noise func(sensitivity float64, epsilon float64) float64) []interface{} {
+
+	epsilonPerResult := epsilon / float64(plan.rawColumns)
+
+	results := make([]interface{}, len(plan.aggregates))
+	for i, aggregate := range plan.aggregates {
+		// SUM over no rows is NULL, which is 0 for our purposes
+		value := raw[aggregate.rawColumns[0]].Float64
+
+		switch aggregate.function {
+		case "count":
+			noisyCount := math.Max(0, math.Round(value+noise(aggregate.sensitivity, epsilonPerResult)))
+			results[i] = int64(noisyCount)
+		case "sum":
+			results[i] = value + noise(aggregate.sensitivity, epsilonPerResult)
+		case "avg":
+			noisySum := value + noise(aggregate.sensitivity, epsilonPerResult)
+			noisyCount := raw[aggregate.rawColumns[1]].Float64 + noise(1, epsilonPerResult)
+			if noisyCount < 1 {
+				noisyCount = 1
+			}
+			// Post-processing does not affect the privacy guarantee, so keep the average within the bounds
+			results[i] = math.Min(aggregate.bounds.Upper, math.Max(aggregate.bounds.Lower, noisySum/noisyCount))
+		}
+	}
+	return results
+}
+
+// resultQuery returns a query which selects the passed results as columns with the names of the aggregates
+func (plan *dpQueryPlan) resultQuery() string {
+	var columns []string
+	for _, aggregate := range plan.aggregates {
+		columns = append(columns, fmt.Sprintf("? AS `%s`", strings.Replace(aggregate.alias, "`", "``", -1)))
+	}
+	return "SELECT " + strings.Join(columns, ", ")
+}
+
+// PrivacyBudgetStore records how much of their privacy budget each requester has spent
+type PrivacyBudgetStore interface {
+	// Spend records that a requester has spent epsilon, unless this would take their total over limit in which case
+	// ErrPrivacyBudgetExhausted is returned and nothing is recorded
+	Spend(requesterID string, epsilon float64, limit float64) error
+	// Spent returns the total epsilon spent by a requester
+	Spent(requesterID string) (float64, error)
+}
+
+// budgetTolerance allows for rounding errors when summing the epsilon spent on queries
+const budgetTolerance = 1e-9
+
+// InMemoryPrivacyBudgetStore is a PrivacyBudgetStore which does not persist spending between restarts
+type InMemoryPrivacyBudgetStore struct {
+	sync.Mutex
+	spent map[string]float64
+}
+
+// NewInMemoryPrivacyBudgetStore returns a pointer to an InMemoryPrivacyBudgetStore with initialised fields
+func NewInMemoryPrivacyBudgetStore() *InMemoryPrivacyBudgetStore {
+	return &InMemoryPrivacyBudgetStore{
+		spent: make(map[string]float64),
+	}
+}
+
+// Spend records that a requester has spent epsilon unless this would take their total over limit
+func (s *InMemoryPrivacyBudgetStore) Spend(requesterID string, epsilon float64, limit float64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.spent[requesterID]+epsilon > limit+budgetTolerance {
+		return ErrPrivacyBudgetExhausted
+	}
+	s.spent[requesterID] += epsilon
+	return nil
+}
+
+// Spent returns the total epsilon spent by a requester
+func (s *InMemoryPrivacyBudgetStore) Spent(requesterID string) (float64, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.spent[requesterID], nil
+}
+
+// MySQLPrivacyBudgetStore is a PrivacyBudgetStore which persists spending in a MySQL table
+type MySQLPrivacyBudgetStore struct {
+	database  *sql.DB
+	tableName string
+}
+
+// NewMySQLPrivacyBudgetStore returns a pointer to a MySQLPrivacyBudgetStore which records spending in the named
+// table, creating it if it does not exist
+func NewMySQLPrivacyBudgetStore(db *sql.DB, tableName string) (*MySQLPrivacyBudgetStore, error) {
+	createTableString := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s ("+
+		"requester_id VARCHAR(255) NOT NULL PRIMARY KEY, "+
+		"epsilon_spent DOUBLE NOT NULL DEFAULT 0);", tableName)
+	_, err := db.Exec(createTableString)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MySQLPrivacyBudgetStore{
+		database:  db,
+		tableName: tableName,
+	}, nil
+}
+
+// Spend records that a requester has spent epsilon unless this would take their total over limit, the row for the
+// requester is locked while this is checked so concurrent queries cannot overspend
+func (s *MySQLPrivacyBudgetStore) Spend(requesterID string, epsilon float64, limit float64) error {
+	tx, err := s.database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(fmt.Sprintf("INSERT IGNORE INTO %s (requester_id, epsilon_spent) VALUES (?, 0)", s.tableName),
+		requesterID)
+	if err != nil {
+		return err
+	}
+
+	var spent float64
+	err = tx.QueryRow(fmt.Sprintf("SELECT epsilon_spent FROM %s WHERE requester_id = ? FOR UPDATE", s.tableName),
+		requesterID).Scan(&spent)
+	if err != nil {
+		return err
+	}
+
+	if spent+epsilon > limit+budgetTolerance {
+		return ErrPrivacyBudgetExhausted
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET epsilon_spent = ? WHERE requester_id = ?", s.tableName),
+		spent+epsilon, requesterID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Spent returns the total epsilon spent by a requester
+func (s *MySQLPrivacyBudgetStore) Spent(requesterID string) (float64, error) {
+	var spent float64
+	err := s.database.QueryRow(fmt.Sprintf("SELECT epsilon_spent FROM %s WHERE requester_id = ?", s.tableName),
+		requesterID).Scan(&spent)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return spent, err
+}
+
+// PostgresPrivacyBudgetStore is a PrivacyBudgetStore which persists spending in a PostgreSQL table
+type PostgresPrivacyBudgetStore struct {
+	database  *sql.DB
+	tableName string
+}
+
+// NewPostgresPrivacyBudgetStore returns a pointer to a PostgresPrivacyBudgetStore which records spending in the named
+// table, creating it if it does not exist
+func NewPostgresPrivacyBudgetStore(db *sql.DB, tableName string) (*PostgresPrivacyBudgetStore, error) {
+	createTableString := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s ("+
+		"requester_id VARCHAR(255) NOT NULL PRIMARY KEY, "+
+		"epsilon_spent DOUBLE PRECISION NOT NULL DEFAULT 0);", tableName)
+	_, err := db.Exec(createTableString)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PostgresPrivacyBudgetStore{
+		database:  db,
+		tableName: tableName,
+	}, nil
+}
+
+// Spend records that a requester has spent epsilon unless this would take their total over limit, the row for the
+// requester is locked while this is checked so concurrent queries cannot overspend
+func (s *PostgresPrivacyBudgetStore) Spend(requesterID string, epsilon float64, limit float64) error {
+	tx, err := s.database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(fmt.Sprintf("INSERT INTO %s (requester_id, epsilon_spent) VALUES ($1, 0) "+
+		"ON CONFLICT (requester_id) DO NOTHING", s.tableName), requesterID)
+	if err != nil {
+		return err
+	}
+
+	var spent float64
+	err = tx.QueryRow(fmt.Sprintf("SELECT epsilon_spent FROM %s WHERE requester_id = $1 FOR UPDATE", s.tableName),
+		requesterID).Scan(&spent)
+	if err != nil {
+		return err
+	}
+
+	if spent+epsilon > limit+budgetTolerance {
+		return ErrPrivacyBudgetExhausted
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET epsilon_spent = $1 WHERE requester_id = $2", s.tableName),
+		spent+epsilon, requesterID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Spent returns the total epsilon spent by a requester
+func (s *PostgresPrivacyBudgetStore) Spent(requesterID string) (float64, error) {
+	var spent float64
+	err := s.database.QueryRow(fmt.Sprintf("SELECT epsilon_spent FROM %s WHERE requester_id = $1", s.tableName),
+		requesterID).Scan(&spent)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return spent, err
+}
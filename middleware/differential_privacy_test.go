@@ -0,0 +1,193 @@
+package middleware
+
+import (
+	"database/sql"
+	"github.com/stretchr/testify/require"
+	"math"
+	"testing"
+)
+
+func validDifferentialPrivacyPolicy() *DifferentialPrivacyPolicy {
+	group := NewPrivacyGroup("Researchers")
+	group.Add("alice")
+
+	return &DifferentialPrivacyPolicy{
+		PrivacyGroups:   []*PrivacyGroup{group},
+		Mechanism:       Laplace,
+		EpsilonPerQuery: 0.5,
+		Budget:          1,
+		Bounds: map[string]map[string]ColumnBounds{
+			"household_power_consumption": {
+				"global_active_power": {Lower: 0, Upper: 10},
+				"voltage":             {Lower: 200, Upper: 260},
+			},
+		},
+		BudgetStore: NewInMemoryPrivacyBudgetStore(),
+	}
+}
+
+func TestDifferentialPrivacyPolicy_AppliesTo(t *testing.T) {
+	dp := validDifferentialPrivacyPolicy()
+	require.True(t, dp.appliesTo("alice"))
+	require.False(t, dp.appliesTo("bob"))
+}
+
+func TestDifferentialPrivacyPolicy_Validate(t *testing.T) {
+	dp := validDifferentialPrivacyPolicy()
+	require.NoError(t, dp.validate())
+
+	dp.Mechanism = Gaussian
+	require.EqualError(t, dp.validate(), "the Gaussian mechanism requires a delta between 0 and 1")
+	dp.Delta = 1e-5
+	require.NoError(t, dp.validate())
+	dp.EpsilonPerQuery = 1
+	require.EqualError(t, dp.validate(), "the Gaussian mechanism requires an epsilon per query below 1")
+	dp.EpsilonPerQuery = 0.5
+
+	dp.Budget = 0.1
+	require.EqualError(t, dp.validate(), "the privacy budget must allow at least one query")
+}
+
+func TestDifferentialPrivacyPolicy_Plan(t *testing.T) {
+	dp := validDifferentialPrivacyPolicy()
+
+	plan, err := dp.plan("SELECT COUNT(*), SUM(global_active_power), AVG(voltage) AS v " +
+		"FROM household_power_consumption WHERE datetime BETWEEN ? AND ? ORDER BY 1 LIMIT 1")
+	require.NoError(t, err)
+
+	require.Equal(t, "select COUNT(*), SUM(LEAST(GREATEST(global_active_power, 0), 10)), "+
+		"SUM(LEAST(GREATEST(voltage, 200), 260)), COUNT(voltage) "+
+		"from household_power_consumption where `datetime` between ? and ?", plan.query)
+	require.Equal(t, 4, plan.rawColumns)
+
+	require.Len(t, plan.aggregates, 3)
+	require.Equal(t, "count", plan.aggregates[0].function)
+	require.Equal(t, "COUNT(*)", plan.aggregates[0].alias)
+	require.Equal(t, 1.0, plan.aggregates[0].sensitivity)
+	require.Equal(t, "sum", plan.aggregates[1].function)
+	require.Equal(t, 10.0, plan.aggregates[1].sensitivity)
+	require.Equal(t, "avg", plan.aggregates[2].function)
+	require.Equal(t, "v", plan.aggregates[2].alias)
+	require.Equal(t, 260.0, plan.aggregates[2].sensitivity)
+	require.Equal(t, []int{2, 3}, plan.aggregates[2].rawColumns)
+
+	require.Equal(t, "SELECT ? AS `COUNT(*)`, ? AS `SUM(global_active_power)`, ? AS `v`", plan.resultQuery())
+}
+
+func TestDifferentialPrivacyPolicy_Plan_Unsupported(t *testing.T) {
+	dp := validDifferentialPrivacyPolicy()
+
+	for _, query := range []string{
+		"SELECT * FROM household_power_consumption",
+		"SELECT voltage FROM household_power_consumption",
+		"SELECT COUNT(*) FROM household_power_consumption GROUP BY voltage",
+		"SELECT COUNT(DISTINCT voltage) FROM household_power_consumption",
+		"SELECT SUM(*) FROM household_power_consumption",
+		"SELECT MAX(voltage) FROM household_power_consumption",
+		"SELECT SUM(voltage + 1) FROM household_power_consumption",
+		"SELECT COUNT(*) FROM household_power_consumption, people",
+		"SELECT COUNT(*) FROM household_power_consumption WHERE voltage IN (SELECT voltage FROM people)",
+		"DELETE FROM household_power_consumption",
+	} {
+		t.Run(query, func(t *testing.T) {
+			_, err := dp.plan(query)
+			require.Error(t, err)
+		})
+	}
+
+	_, err := dp.plan("SELECT SUM(sub_metering_1) FROM household_power_consumption")
+	require.EqualError(t, err, "no bounds have been set for column sub_metering_1 so it cannot be aggregated")
+}
+
+func TestDpQueryPlan_NoisyResults(t *testing.T) {
+	dp := validDifferentialPrivacyPolicy()
+	plan, err := dp.plan("SELECT COUNT(*), SUM(global_active_power), AVG(voltage) FROM household_power_consumption")
+	require.NoError(t, err)
+
+	raw := []sql.NullFloat64{
+		{Float64: 10, Valid: true},
+		{Float64: 25.5, Valid: true},
+		{Float64: 2400, Valid: true},
+		{Float64: 10, Valid: true},
+	}
+
+	noNoise := func(sensitivity float64, epsilon float64) float64 { return 0 }
+	require.Equal(t, []interface{}{int64(10), 25.5, 240.0}, plan.noisyResults(raw, 1, noNoise))
+
+	// Noisy averages are kept within the bounds of the column
+	largeNoise := func(sensitivity float64, epsilon float64) float64 {
+		if sensitivity == 1 {
+			return 0
+		}
+		return 10000
+	}
+	results := plan.noisyResults(raw, 1, largeNoise)
+	require.Equal(t, 260.0, results[2])
+
+	// Counts are never negative and SUM over no rows is treated as 0
+	negativeNoise := func(sensitivity float64, epsilon float64) float64 { return -1000 }
+	results = plan.noisyResults(make([]sql.NullFloat64, 4), 1, negativeNoise)
+	require.Equal(t, int64(0), results[0])
+	require.Equal(t, -1000.0, results[1])
+	require.Equal(t, 200.0, results[2])
+
+	// Epsilon is split between each of the raw results
+	var epsilons []float64
+	recordEpsilon := func(sensitivity float64, epsilon float64) float64 {
+		epsilons = append(epsilons, epsilon)
+		return 0
+	}
+	plan.noisyResults(raw, 1, recordEpsilon)
+	require.Equal(t, []float64{0.25, 0.25, 0.25, 0.25}, epsilons)
+}
+
+func TestDifferentialPrivacyPolicy_Noise(t *testing.T) {
+	dp := validDifferentialPrivacyPolicy()
+
+	// With u = 0.75 the Laplace inverse CDF gives scale * ln(2)
+	dp.random = func() float64 { return 0.75 }
+	require.InDelta(t, 2*math.Ln2, dp.noise(1, 0.5), 1e-9)
+
+	// A random value of 0 is redrawn rather than giving infinite noise
+	draws := []float64{0, 0.25}
+	dp.random = func() float64 {
+		draw := draws[0]
+		draws = draws[1:]
+		return draw
+	}
+	require.InDelta(t, -2*math.Ln2, dp.noise(1, 0.5), 1e-9)
+
+	// The mean absolute value of Laplace noise is its scale
+	dp.random = nil
+	total := 0.0
+	samples := 20000
+	for i := 0; i < samples; i++ {
+		total += math.Abs(dp.noise(10, 1))
+	}
+	require.InDelta(t, 10, total/float64(samples), 0.5)
+
+	// The standard deviation of Gaussian noise is sigma
+	dp.Mechanism = Gaussian
+	dp.Delta = 1e-5
+	sigma := math.Sqrt(2*math.Log(1.25/dp.Delta)) / 0.5
+	sumOfSquares := 0.0
+	for i := 0; i < samples; i++ {
+		sample := dp.noise(1, 0.5)
+		sumOfSquares += sample * sample
+	}
+	require.InDelta(t, sigma, math.Sqrt(sumOfSquares/float64(samples)), 0.1*sigma)
+}
+
+func TestInMemoryPrivacyBudgetStore(t *testing.T) {
+	store := NewInMemoryPrivacyBudgetStore()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, store.Spend("alice", 0.1, 1))
+	}
+	require.Equal(t, ErrPrivacyBudgetExhausted, store.Spend("alice", 0.1, 1))
+	require.NoError(t, store.Spend("bob", 0.1, 1))
+
+	spent, err := store.Spent("alice")
+	require.NoError(t, err)
+	require.InDelta(t, 1, spent, 1e-9)
+}
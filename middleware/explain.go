@@ -0,0 +1,236 @@
+package middleware
+
+import (
+	"errors"
+	"github.com/xwb1989/sqlparser"
+	"sort"
+)
+
+// GroupMatcher is an optional interface for a DataPolicy which can list the privacy groups whose TableOperations
+// apply to a requester, it is used by Explain
+type GroupMatcher interface {
+	// MatchedGroups returns the names of the groups whose TableOperations apply to the entity for the purpose, and
+	// whether the entity is in no group so a default policy applies instead
+	MatchedGroups(entityID string, purpose string) (groups []string, usedDefault bool)
+}
+
+// Explanation describes what a requester can see and how a query would be run for them
+type Explanation struct {
+	RequesterID string
+	Purpose     string
+	// MatchedGroups are the privacy groups whose TableOperations were combined for the requester, they are only known
+	// if the DataPolicy implements GroupMatcher
+	MatchedGroups []string
+	// UsedDefault is whether the requester is in no privacy group so the default policy applies
+	UsedDefault    bool
+	AggregatesOnly bool
+	Tables         []TableExplanation
+	// RewrittenQuery is the query which would be run, against the transformed tables if it reads or constrained to
+	// the rows the requester may write if it writes, it is empty if no query was explained
+	RewrittenQuery string
+}
+
+// TableExplanation describes how a table is transformed for a requester
+type TableExplanation struct {
+	Table string
+	// VisibleColumns are copied into the transformed table and HiddenColumns are excluded or not allowed
+	VisibleColumns []string
+	HiddenColumns  []string
+	// TransformedColumns are the visible columns which have a ColumnTransform
+	TransformedColumns []string
+	RowTransforms      int
+	// RowFilter is the condition rows must satisfy to be copied, including consent, with RowFilterArgs for its
+	// placeholders
+	RowFilter     string
+	RowFilterArgs []interface{}
+	// WriteFilter is the condition rows must satisfy to be written, with WriteFilterArgs for its placeholders
+	WriteFilter     string
+	WriteFilterArgs []interface{}
+	// Inline is whether the database applies every operation so the table is read through DerivedTable rather than
+	// being copied into TransformedTable
+	Inline           bool
+	DerivedTable     string
+	TransformedTable string
+	// Cached is whether a valid cached transformed table would be used rather than building a new one
+	Cached bool
+}
+
+func (pd *privateDatabase) explain(query string, requestPolicy *RequestPolicy) (*Explanation, error) {
+	requesterID := requesterIDOrAnonymous(requestPolicy)
+	tableOperations, purpose, err := pd.resolve(requesterID, requestPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	explanation := &Explanation{
+		RequesterID:    requesterID,
+		Purpose:        purpose,
+		AggregatesOnly: tableOperations.AggregatesOnly,
+	}
+	if groupMatcher, ok := pd.DataPolicy.(GroupMatcher); ok {
+		explanation.MatchedGroups, explanation.UsedDefault = groupMatcher.MatchedGroups(requesterID, purpose)
+	}
+
+	tableNames := tableOperations.tables()
+	sort.Strings(tableNames)
+	queryReads := true
+	var stmt sqlparser.Statement
+	if query != "" {
+		query, _, err = pd.dialect.normaliseQuery(query, nil)
+		if err != nil {
+			return nil, err
+		}
+		stmt, err = sqlparser.Parse(query)
+		if err != nil {
+			return nil, err
+		}
+		switch stmt.(type) {
+		case *sqlparser.Select, *sqlparser.Union:
+		case *sqlparser.Update, *sqlparser.Insert, *sqlparser.Delete:
+			queryReads = false
+		default:
+			return nil, errors.New("unsupported query")
+		}
+		if tableOperations.AggregatesOnly {
+			err = checkAggregatesOnly(stmt)
+			if err != nil {
+				return nil, err
+			}
+		}
+		tableNames, err = pd.queryTableNames(stmt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	groupPrefix := transformedTablePrefix(requesterID, purpose)
+	substitutions := make(map[string]tableSubstitution)
+	for _, tableName := range tableNames {
+		tableExplanation, err := pd.explainTable(tableName, groupPrefix, tableOperations, requesterID, purpose)
+		if err != nil {
+			return nil, err
+		}
+
+		if !queryReads {
+			// Writes go to the original tables
+			tableExplanation.Inline = false
+			tableExplanation.DerivedTable = ""
+			tableExplanation.TransformedTable = ""
+			tableExplanation.Cached = false
+		} else {
+			substitutions[tableName] = tableSubstitution{
+				transformedTable: tableExplanation.TransformedTable,
+				derivedTable:     tableExplanation.DerivedTable,
+			}
+		}
+		explanation.Tables = append(explanation.Tables, tableExplanation)
+	}
+
+	if stmt != nil && !queryReads {
+		err = pd.checkWriteColumns(stmt, tableNames, tableOperations)
+		if err != nil {
+			return nil, err
+		}
+		explanation.RewrittenQuery = query
+		constrained, err := pd.constrainWrite(stmt, nil, tableOperations, requesterID, purpose)
+		if err != nil {
+			return nil, err
+		}
+		if constrained {
+			explanation.RewrittenQuery = formatDialectSQL(stmt, pd.dialect)
+		}
+	} else if stmt != nil {
+		explanation.RewrittenQuery = query
+		if len(substitutions) > 0 {
+			explanation.RewrittenQuery, err = pd.substituteTables(stmt, substitutions)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return explanation, nil
+}
+
+func (pd *privateDatabase) explainTable(tableName string, groupPrefix string, tableOperations *TableOperations,
+	requesterID string, purpose string) (TableExplanation, error) {
+	colsToCopy, colsToDrop, err := pd.getColsToCopy(tableName, tableOperations)
+	if err != nil {
+		return TableExplanation{}, err
+	}
+	rowFilter, rowFilterArgs, err := pd.rowFilter(tableName, tableOperations, requesterID, purpose)
+	if err != nil {
+		return TableExplanation{}, err
+	}
+	writeFilter, writeFilterArgs, err := rowFiltersSQL(tableOperations.WriteFilters[tableName], requesterID)
+	if err != nil {
+		return TableExplanation{}, err
+	}
+
+	tableExplanation := TableExplanation{
+		Table:           tableName,
+		VisibleColumns:  colsToCopy,
+		HiddenColumns:   colsToDrop,
+		RowTransforms:   len(tableOperations.RowTransforms[tableName]),
+		RowFilter:       rowFilter,
+		RowFilterArgs:   rowFilterArgs,
+		WriteFilter:     writeFilter,
+		WriteFilterArgs: writeFilterArgs,
+	}
+	transformedColumns := tableOperations.transformedColumns(tableName)
+	for _, column := range colsToCopy {
+		if contains(transformedColumns, column) {
+			tableExplanation.TransformedColumns = append(tableExplanation.TransformedColumns, column)
+		}
+	}
+
+	if tableOperations.inline(tableName) {
+		tableExplanation.Inline = true
+		tableExplanation.DerivedTable, err = pd.derivedTableSQL(tableName, tableOperations, requesterID, purpose)
+		return tableExplanation, err
+	}
+
+	tableExplanation.TransformedTable = groupPrefix + tableName
+	if pd.CacheTables {
+		sharedTableName, shared, err := pd.sharedTableName(tableName, tableOperations, requesterID, purpose)
+		if err != nil {
+			return TableExplanation{}, err
+		}
+		if shared {
+			tableExplanation.TransformedTable = sharedTableName
+		}
+		tableExplanation.Cached, err = pd.isTransformedTableValid(tableName, tableExplanation.TransformedTable)
+		if err != nil {
+			return TableExplanation{}, err
+		}
+	}
+	return tableExplanation, nil
+}
+
+// MatchedGroups returns the names of the privacy groups which the entity is a member of and which apply to the
+// purpose, in the order the Strategy sees them. An entity in no group gets the public group if the Default policy
+// uses it.
+func (sdp *StaticDataPolicy) MatchedGroups(entityID string, purpose string) ([]string, bool) {
+	var (
+		member bool
+		groups []string
+	)
+	for _, group := range sdp.privacyGroups {
+		if !group.contains(entityID) {
+			continue
+		}
+		member = true
+		if _, ok := sdp.operationsFor(group, purpose); ok {
+			groups = append(groups, group.Name())
+		}
+	}
+	if member {
+		return groups, false
+	}
+
+	if sdp.PublicGroup != nil && sdp.Default != DefaultDenyAll {
+		if _, ok := sdp.operationsFor(sdp.PublicGroup, purpose); ok {
+			groups = append(groups, sdp.PublicGroup.Name())
+		}
+	}
+	return groups, true
+}
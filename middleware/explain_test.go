@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestStaticDataPolicy_MatchedGroups(t *testing.T) {
+	group1 := NewPrivacyGroup("Group1")
+	group1.AddMany([]string{"alice", "bob"})
+	group2 := NewPrivacyGroup("Group2")
+	group2.Add("alice")
+	public := NewPrivacyGroup("Public")
+
+	dataPolicy := NewStaticDataPolicy([]*PrivacyGroup{group1, group2}, DataTransforms{})
+	dataPolicy.Purposes = PurposeTransforms{group2: {"research": NewTableOperations()}}
+
+	groups, usedDefault := dataPolicy.MatchedGroups("alice", "research")
+	require.Equal(t, []string{"Group1", "Group2"}, groups)
+	require.False(t, usedDefault)
+
+	// Group2 only applies to research
+	groups, usedDefault = dataPolicy.MatchedGroups("alice", "")
+	require.Equal(t, []string{"Group1"}, groups)
+	require.False(t, usedDefault)
+
+	groups, usedDefault = dataPolicy.MatchedGroups("eve", "")
+	require.Empty(t, groups)
+	require.True(t, usedDefault)
+
+	dataPolicy.PublicGroup = public
+	dataPolicy.Default = DefaultPublicGroup
+	groups, usedDefault = dataPolicy.MatchedGroups("eve", "")
+	require.Equal(t, []string{"Public"}, groups)
+	require.True(t, usedDefault)
+}
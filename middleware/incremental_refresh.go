@@ -0,0 +1,191 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"time"
+)
+
+// IncrementalRefresh configures how the cached transformed tables of a table are refreshed incrementally, see
+// TableCache. The rows added since a transformed table was last refreshed are found by KeyColumn, which must be unique,
+// never NULL and increase as rows are added, such as an auto-incremented primary key. Rows deleted from the table are
+// noticed, as fewer rows have keys up to the largest key seen, and cause the transformed table to be rebuilt.
+type IncrementalRefresh struct {
+	// KeyColumn is the column rows are added in the order of
+	KeyColumn string
+	// WatermarkColumn, if set, is a column which is never NULL and increases whenever a row is added or changed, such
+	// as when it was last modified. The rows with a watermark at or above the largest one seen are transformed again
+	// and replace their earlier versions, which are found by their keys, so KeyColumn must be copied to the
+	// transformed table unchanged and the table must have no RowTransforms. Rows sharing the largest watermark are
+	// read again on every refresh, so rows written with that watermark after the refresh are not missed, but a row
+	// must never be given a watermark below the largest one already committed. Without a WatermarkColumn rows must
+	// not be changed once they are added, as their changes would not be seen.
+	WatermarkColumn string
+}
+
+// refreshMarks records how much of a table a transformed table has been built from
+type refreshMarks struct {
+	// key is the largest key of the rows, or nil if there were none
+	key interface{}
+	// rows is the number of rows with keys up to key
+	rows int64
+	// watermark is the largest watermark of the rows, or nil if there were none or there is no WatermarkColumn
+	watermark interface{}
+}
+
+// incrementalRefresh returns how the transformed tables of a table are refreshed incrementally, it returns false if
+// they are rebuilt whenever the table changes
+func (c *TableCache) incrementalRefresh(tableName string, tableOperations *TableOperations) (IncrementalRefresh, bool) {
+	refresh, ok := c.Incremental[tableName]
+	if !ok || refresh.KeyColumn == "" {
+		return IncrementalRefresh{}, false
+	}
+	if refresh.WatermarkColumn != "" {
+		// Changed rows are found in the transformed table by their keys
+		keyCopied := tableOperations.columnVisible(tableName, refresh.KeyColumn) &&
+			!contains(tableOperations.transformedColumns(tableName), refresh.KeyColumn)
+		if !keyCopied || len(tableOperations.RowTransforms[tableName]) > 0 {
+			return IncrementalRefresh{}, false
+		}
+	}
+	return refresh, true
+}
+
+// condition returns the condition satisfied by the rows added, or changed if there is a WatermarkColumn, after the
+// previous marks and up to the current marks, and the arguments for its placeholders. Rows with the previous
+// watermark are included as rows may be written with it after the previous marks were read. The previous marks are
+// nil if the transformed table is being built.
+func (r IncrementalRefresh) condition(previous *refreshMarks, current *refreshMarks) (string, []interface{}) {
+	column, from, to, after := r.KeyColumn, interface{}(nil), current.key, ">"
+	if previous != nil {
+		from = previous.key
+	}
+	if r.WatermarkColumn != "" {
+		column, to, after = r.WatermarkColumn, current.watermark, ">="
+		if previous != nil {
+			from = previous.watermark
+		}
+	}
+
+	// No rows satisfy the condition if there were no rows when the current marks were read, as no value is <= NULL
+	if from == nil {
+		return fmt.Sprintf("`%s` <= ?", column), []interface{}{to}
+	}
+	return fmt.Sprintf("`%[1]s` %[2]s ? AND `%[1]s` <= ?", column, after), []interface{}{from, to}
+}
+
+// readRefreshMarks returns how much of a table there is to transform and the number of rows with keys up to the
+// previous marks, which is fewer than the previous marks record if rows have been deleted
+func (pd *privateDatabase) readRefreshMarks(ctx context.Context, tableName string, refresh IncrementalRefresh,
+	previous *refreshMarks) (*refreshMarks, int64, error) {
+	var previousKey interface{}
+	if previous != nil {
+		previousKey = previous.key
+	}
+
+	marksString := fmt.Sprintf("SELECT MAX(`%[1]s`), COUNT(`%[1]s`), COUNT(CASE WHEN `%[1]s` <= ? THEN 1 END)",
+		refresh.KeyColumn)
+	if refresh.WatermarkColumn != "" {
+		marksString += fmt.Sprintf(", MAX(`%s`)", refresh.WatermarkColumn)
+	}
+	marksString, err := pd.dialect.nativeSQL(marksString + " FROM " + tableName)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var (
+		marks        refreshMarks
+		previousRows int64
+	)
+	scanArgs := []interface{}{&marks.key, &marks.rows, &previousRows}
+	if refresh.WatermarkColumn != "" {
+		scanArgs = append(scanArgs, &marks.watermark)
+	}
+	err = pd.database.QueryRowContext(ctx, marksString, previousKey).Scan(scanArgs...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &marks, previousRows, nil
+}
+
+// refreshCachedTable merges the rows added or changed since a cached transformed table was last refreshed into it, it
+// returns false if the table must be rebuilt instead. This is the case if the cache has no marks for it, it has
+// expired, the policies which decide its contents have changed since it was built or rows have been deleted.
+func (pd *privateDatabase) refreshCachedTable(ctx context.Context, tableName string, transformedTableName string,
+	refresh IncrementalRefresh, tableOperations *TableOperations, requesterID string, purpose string) (bool, error) {
+	previous, ok := pd.Cache.marks(transformedTableName)
+	if !ok || pd.Cache.expired(transformedTableName, time.Now()) {
+		return false, nil
+	}
+	_, afterPolicyUpdate, err := pd.transformedTableCreated(tableName, transformedTableName)
+	if err != nil || !afterPolicyUpdate {
+		return false, err
+	}
+
+	marks, previousRows, err := pd.readRefreshMarks(ctx, tableName, refresh, &previous)
+	if err != nil {
+		return false, err
+	}
+	if previousRows != previous.rows {
+		// Rows have been deleted, which cannot be found from the rows which are left
+		return false, nil
+	}
+	// Rows with the largest watermark seen can change without changing the marks, so they are always read again
+	if refresh.WatermarkColumn == "" && reflect.DeepEqual(*marks, previous) {
+		pd.Cache.hit(transformedTableName, tableName, time.Now())
+		return true, nil
+	}
+
+	bytes, err := pd.mergeRows(ctx, tableName, transformedTableName, refresh, &previous, marks, tableOperations,
+		requesterID, purpose)
+	if err != nil {
+		// The table is rebuilt instead, this may fix the error if the table's columns have changed
+		log.Printf("PAM: failed to refresh %s, rebuilding it: %s", transformedTableName, err.Error())
+		pd.Cache.forget(transformedTableName)
+		return false, pd.dropTableIfExists(transformedTableName)
+	}
+	pd.Cache.refreshed(transformedTableName, bytes, marks)
+	return true, nil
+}
+
+// mergeRows transforms the rows between the previous and current marks and merges them into a transformed table in a
+// transaction, so that queries reading the transformed table do not see it partly refreshed. It returns the number of
+// bytes of the values written.
+func (pd *privateDatabase) mergeRows(ctx context.Context, tableName string, transformedTableName string,
+	refresh IncrementalRefresh, previous *refreshMarks, current *refreshMarks, tableOperations *TableOperations,
+	requesterID string, purpose string) (int64, error) {
+	colsToCopy, _, err := pd.getColsToCopy(tableName, tableOperations)
+	if err != nil {
+		return 0, err
+	}
+	condition, conditionArgs := refresh.condition(previous, current)
+
+	tx, err := pd.database.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if refresh.WatermarkColumn != "" {
+		// Changed rows replace their earlier versions, including those which the row filters now remove
+		deleteString, err := pd.dialect.nativeSQL(fmt.Sprintf("DELETE FROM %s WHERE `%s` IN (SELECT `%s` FROM %s "+
+			"WHERE %s)", transformedTableName, refresh.KeyColumn, refresh.KeyColumn, tableName, condition))
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.ExecContext(ctx, deleteString, conditionArgs...)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	session := &querySession{tx: tx, dialect: pd.dialect}
+	bytes, err := pd.copyRows(ctx, session, tableName, transformedTableName, colsToCopy, tableOperations, requesterID,
+		purpose, condition, conditionArgs)
+	if err != nil {
+		return 0, err
+	}
+	return bytes, tx.Commit()
+}
@@ -0,0 +1,149 @@
+package middleware
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// incrementalTestDatabase returns a caching SQLite database which refreshes the transformed tables of the people table
+// incrementally, with an updated column which is bumped whenever a row changes
+func incrementalTestDatabase(t *testing.T, tableOperations *TableOperations, refresh IncrementalRefresh) *SQLitePrivateDatabase {
+	db := &SQLitePrivateDatabase{
+		DataPolicy:  sqliteTestPolicy(tableOperations),
+		CacheTables: true,
+		Cache:       &TableCache{Incremental: map[string]IncrementalRefresh{"people": refresh}},
+	}
+	sqlitePrivateDBConnection(t, db)
+	_, err := db.database.Exec(`ALTER TABLE people ADD COLUMN updated INTEGER NOT NULL DEFAULT 1`)
+	require.NoError(t, err)
+	return db
+}
+
+// incrementalTestNames returns the names alice can see in the people table, in order of id
+func incrementalTestNames(t *testing.T, db *SQLitePrivateDatabase) []string {
+	rows, err := db.Query("SELECT name FROM people ORDER BY id", localRequestPolicy("alice"))
+	require.NoError(t, err)
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		require.NoError(t, rows.Scan(&name))
+		names = append(names, name)
+	}
+	require.NoError(t, rows.Err())
+	return names
+}
+
+func TestSQLitePrivateDatabase_Incremental_Refresh_Key(t *testing.T) {
+	tableOperations := NewTableOperations()
+	tableOperations.TableTransforms["people"] = TableTransform{"dob": truncateToYear(t)}
+	tableOperations.RowFilters["people"] = []RowFilter{{Column: "name", Operator: "!=", Value: "bob"}}
+	db := incrementalTestDatabase(t, tableOperations, IncrementalRefresh{KeyColumn: "id"})
+
+	require.Equal(t, []string{"alice", "charlie"}, incrementalTestNames(t, db))
+	require.Equal(t, []string{"alice", "charlie"}, incrementalTestNames(t, db))
+
+	// Only the added rows are transformed and merged into the transformed table
+	_, err := db.database.Exec(`INSERT INTO people (name, dob) VALUES ('dave', '1970-01-01'), ('bob', '1971-01-01')`)
+	require.NoError(t, err)
+	require.Equal(t, []string{"alice", "charlie", "dave"}, incrementalTestNames(t, db))
+	stats := db.Cache.Stats()
+	require.Equal(t, int64(1), stats.Misses)
+	require.Equal(t, int64(1), stats.Hits)
+	require.Equal(t, int64(1), stats.Refreshes)
+	require.Equal(t, int64(0), stats.Rebuilds)
+
+	// Deleting a row rebuilds the table
+	_, err = db.database.Exec(`DELETE FROM people WHERE name = 'alice'`)
+	require.NoError(t, err)
+	require.Equal(t, []string{"charlie", "dave"}, incrementalTestNames(t, db))
+	require.Equal(t, int64(1), db.Cache.Stats().Rebuilds)
+
+	// Changing the policy rebuilds the table
+	time.Sleep(5 * time.Millisecond)
+	tableOperations.RowFilters["people"] = nil
+	db.DataPolicy.(*StaticDataPolicy).privacyGroups[0].Add("bob")
+	_, err = db.database.Exec(`INSERT INTO people (name, dob) VALUES ('erin', '1972-01-01')`)
+	require.NoError(t, err)
+	require.Equal(t, []string{"bob", "charlie", "dave", "bob", "erin"}, incrementalTestNames(t, db))
+	require.Equal(t, int64(2), db.Cache.Stats().Rebuilds)
+	require.Equal(t, int64(1), db.Cache.Stats().Refreshes)
+}
+
+func TestSQLitePrivateDatabase_Incremental_Refresh_Watermark(t *testing.T) {
+	tableOperations := NewTableOperations()
+	tableOperations.TableTransforms["people"] = TableTransform{"dob": truncateToYear(t)}
+	tableOperations.RowFilters["people"] = []RowFilter{{Column: "name", Operator: "!=", Value: "bob"}}
+	db := incrementalTestDatabase(t, tableOperations, IncrementalRefresh{KeyColumn: "id", WatermarkColumn: "updated"})
+
+	require.Equal(t, []string{"alice", "charlie"}, incrementalTestNames(t, db))
+
+	// Changed rows replace their earlier versions, including rows the filters now remove
+	_, err := db.database.Exec(`UPDATE people SET name = 'alicia', updated = 2 WHERE name = 'alice'`)
+	require.NoError(t, err)
+	_, err = db.database.Exec(`UPDATE people SET name = 'bob', updated = 2 WHERE name = 'charlie'`)
+	require.NoError(t, err)
+	_, err = db.database.Exec(`INSERT INTO people (name, dob, updated) VALUES ('dave', '1970-01-01', 2)`)
+	require.NoError(t, err)
+	require.Equal(t, []string{"alicia", "dave"}, incrementalTestNames(t, db))
+
+	var dob time.Time
+	row, err := db.QueryRow("SELECT dob FROM people WHERE name = 'dave'", localRequestPolicy("alice"))
+	require.NoError(t, err)
+	require.NoError(t, row.Scan(&dob))
+	require.Equal(t, 1, dob.YearDay())
+
+	// Rows written with the largest watermark seen after a refresh are not missed
+	_, err = db.database.Exec(`UPDATE people SET name = 'david', updated = 2 WHERE name = 'dave'`)
+	require.NoError(t, err)
+	_, err = db.database.Exec(`INSERT INTO people (name, dob, updated) VALUES ('erin', '1972-01-01', 2)`)
+	require.NoError(t, err)
+	require.Equal(t, []string{"alicia", "david", "erin"}, incrementalTestNames(t, db))
+
+	// Each read refreshes the table as the rows with the largest watermark are read again
+	stats := db.Cache.Stats()
+	require.Equal(t, int64(3), stats.Refreshes)
+	require.Equal(t, int64(0), stats.Rebuilds)
+}
+
+func TestTableCache_IncrementalRefresh(t *testing.T) {
+	tableOperations := NewTableOperations()
+	cache := TableCache{Incremental: map[string]IncrementalRefresh{
+		"people": {KeyColumn: "id", WatermarkColumn: "updated"},
+		"orders": {KeyColumn: "id"},
+	}}
+
+	_, ok := cache.incrementalRefresh("people", tableOperations)
+	require.True(t, ok)
+	_, ok = cache.incrementalRefresh("pets", tableOperations)
+	require.False(t, ok)
+
+	// Changed rows cannot be found if their keys are not copied unchanged
+	tableOperations.SQLTransforms["people"] = SQLTableTransform{"id": HashSQLTransform("salt")}
+	_, ok = cache.incrementalRefresh("people", tableOperations)
+	require.False(t, ok)
+
+	// Rows which are only added do not need to be found
+	tableOperations.ExcludedCols["orders"] = []string{"id"}
+	_, ok = cache.incrementalRefresh("orders", tableOperations)
+	require.True(t, ok)
+}
+
+func TestIncrementalRefresh_Condition(t *testing.T) {
+	refresh := IncrementalRefresh{KeyColumn: "id"}
+	condition, args := refresh.condition(nil, &refreshMarks{key: int64(3), rows: 3})
+	require.Equal(t, "`id` <= ?", condition)
+	require.Equal(t, []interface{}{int64(3)}, args)
+
+	condition, args = refresh.condition(&refreshMarks{key: int64(3), rows: 3}, &refreshMarks{key: int64(5), rows: 5})
+	require.Equal(t, "`id` > ? AND `id` <= ?", condition)
+	require.Equal(t, []interface{}{int64(3), int64(5)}, args)
+
+	refresh.WatermarkColumn = "updated"
+	condition, args = refresh.condition(&refreshMarks{key: int64(3), watermark: int64(1)},
+		&refreshMarks{key: int64(3), watermark: int64(2)})
+	require.Equal(t, "`updated` >= ? AND `updated` <= ?", condition)
+	require.Equal(t, []interface{}{int64(1), int64(2)}, args)
+}
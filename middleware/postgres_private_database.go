@@ -0,0 +1,676 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/xwb1989/sqlparser"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// postgresDriverName is the name the PostgreSQL driver is registered under
+const postgresDriverName = "pam_postgres"
+
+// postgresRecordUpdateFunction is the trigger function which records that a table changed
+const postgresRecordUpdateFunction = "pam_record_update"
+
+func init() {
+	sql.Register(postgresDriverName, &afterRowsClosedDriver{Driver: &pq.Driver{}})
+}
+
+// PostgresPrivateDatabase is a wrapper around a PostgreSQL database which implements the PrivateRelationalDatabase
+// interface, it applies DataPolicies in the same way as MySQLPrivateDatabase. It is configured by setting its
+// DataPolicy, CacheTables, Cache, DifferentialPrivacy and Consent fields.
+//
+// Queries are written in PostgreSQL's SQL, with $1, $2 etc. as placeholders and identifiers quoted with double quotes,
+// but must otherwise be SQL the MySQL parser also reads, so casts are written with CAST rather than ::. Identifiers
+// are folded to lower case, as PostgreSQL folds unquoted identifiers, so tables and columns with upper case names are
+// not supported. PostgreSQL does not record when tables were last updated, so to tell whether cached tables are valid
+// Connect adds a trigger to each table which records its changes in pam_table_versions. The transformed tables of a
+// table created since then are rebuilt each time they are used, until the next Connect adds its trigger.
+type PostgresPrivateDatabase privateDatabase
+
+func (ppd *PostgresPrivateDatabase) core() *privateDatabase {
+	return (*privateDatabase)(ppd)
+}
+
+// Connect opens the connection to the PostgreSQL database, tables are read from the current schema of the connection
+// which queries may use to qualify them
+func (ppd *PostgresPrivateDatabase) Connect(user, password, databaseName, uri string, port int) error {
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(user, password),
+		Host:     fmt.Sprintf("%s:%d", uri, port),
+		Path:     databaseName,
+		RawQuery: "sslmode=disable",
+	}
+	db, err := sql.Open(postgresDriverName, dsn.String())
+	if err != nil {
+		return err
+	}
+
+	var schema string
+	err = db.QueryRow(`SELECT current_schema()`).Scan(&schema)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	return ppd.core().connect(db, schema, postgresDialect{})
+}
+
+// UncoveredTables returns the tables in the database which the DataPolicy has no TableOperations for, see
+// MySQLPrivateDatabase.UncoveredTables
+func (ppd *PostgresPrivateDatabase) UncoveredTables(ctx context.Context) ([]string, error) {
+	return ppd.core().uncoveredTables(ctx)
+}
+
+// Close closes the connection to the PostgreSQL database
+func (ppd *PostgresPrivateDatabase) Close() error {
+	return ppd.database.Close()
+}
+
+// Query runs a query over the tables as the DataPolicy resolved for the request policy allows them to be seen
+func (ppd *PostgresPrivateDatabase) Query(query string, requestPolicy *RequestPolicy, args ...interface{}) (*sql.Rows, error) {
+	return ppd.QueryContext(context.Background(), query, requestPolicy, args...)
+}
+
+// QueryContext runs a query over the tables as the DataPolicy resolved for the request policy allows them to be seen
+func (ppd *PostgresPrivateDatabase) QueryContext(ctx context.Context, query string, requestPolicy *RequestPolicy, args ...interface{}) (*sql.Rows, error) {
+	return ppd.core().queryContext(ctx, queryOptions{}, query, requestPolicy, args...)
+}
+
+// QueryRow runs a query which returns at most one row over the tables as the DataPolicy resolved for the request
+// policy allows them to be seen
+func (ppd *PostgresPrivateDatabase) QueryRow(query string, requestPolicy *RequestPolicy, args ...interface{}) (*sql.Row, error) {
+	return ppd.QueryRowContext(context.Background(), query, requestPolicy, args...)
+}
+
+// QueryRowContext runs a query which returns at most one row over the tables as the DataPolicy resolved for the
+// request policy allows them to be seen
+func (ppd *PostgresPrivateDatabase) QueryRowContext(ctx context.Context, query string, requestPolicy *RequestPolicy, args ...interface{}) (*sql.Row, error) {
+	return ppd.core().queryRowContext(ctx, queryOptions{}, query, requestPolicy, args...)
+}
+
+// Exec runs a statement, writes are refused if they touch columns the requester cannot see and only change the rows
+// their WriteFilters allow
+func (ppd *PostgresPrivateDatabase) Exec(query string, requestPolicy *RequestPolicy, args ...interface{}) (sql.Result, error) {
+	return ppd.ExecContext(context.Background(), query, requestPolicy, args...)
+}
+
+// ExecContext runs a statement, writes are refused if they touch columns the requester cannot see and only change the
+// rows their WriteFilters allow
+func (ppd *PostgresPrivateDatabase) ExecContext(ctx context.Context, query string, requestPolicy *RequestPolicy, args ...interface{}) (sql.Result, error) {
+	return ppd.core().execContext(ctx, queryOptions{}, query, requestPolicy, args...)
+}
+
+// Begin begins a transaction whose statements are run for the requester of the request policy
+func (ppd *PostgresPrivateDatabase) Begin(requestPolicy *RequestPolicy) (*Tx, error) {
+	return ppd.BeginTx(context.Background(), requestPolicy, nil)
+}
+
+// BeginTx begins a transaction whose statements are run for the requester of the request policy, see sql.DB.BeginTx
+func (ppd *PostgresPrivateDatabase) BeginTx(ctx context.Context, requestPolicy *RequestPolicy, opts *sql.TxOptions) (*Tx, error) {
+	return ppd.core().beginTx(ctx, requestPolicy, opts)
+}
+
+// Prepare returns a prepared statement for a query which can be run for any request policy
+func (ppd *PostgresPrivateDatabase) Prepare(query string) (*Stmt, error) {
+	return ppd.core().prepare(query)
+}
+
+// Stats returns database statistics
+func (ppd *PostgresPrivateDatabase) Stats() sql.DBStats {
+	return ppd.database.Stats()
+}
+
+// SetConnMaxLifetime sets the maximum amount of time a connection may be reused, see sql.DB.SetConnMaxLifetime
+func (ppd *PostgresPrivateDatabase) SetConnMaxLifetime(d time.Duration) {
+	ppd.database.SetConnMaxLifetime(d)
+}
+
+// SetMaxOpenConns sets the maximum number of open connections to the database, see sql.DB.SetMaxOpenConns
+func (ppd *PostgresPrivateDatabase) SetMaxOpenConns(n int) {
+	ppd.database.SetMaxOpenConns(n)
+}
+
+// SetMaxIdleConns sets the maximum number of idle connections to the database, see sql.DB.SetMaxIdleConns
+func (ppd *PostgresPrivateDatabase) SetMaxIdleConns(n int) {
+	ppd.database.SetMaxIdleConns(n)
+}
+
+// Ping verifies the connection to the database is still alive
+func (ppd *PostgresPrivateDatabase) Ping() error {
+	return ppd.database.Ping()
+}
+
+// PingContext verifies the connection to the database is still alive
+func (ppd *PostgresPrivateDatabase) PingContext(ctx context.Context) error {
+	return ppd.database.PingContext(ctx)
+}
+
+// Explain describes the TableOperations which apply to the requester and how a query would be rewritten, see
+// MySQLPrivateDatabase.Explain
+func (ppd *PostgresPrivateDatabase) Explain(query string, requestPolicy *RequestPolicy) (*Explanation, error) {
+	return ppd.core().explain(query, requestPolicy)
+}
+
+// Validate checks the DataPolicy and consent registry against the database, see MySQLPrivateDatabase.Validate
+func (ppd *PostgresPrivateDatabase) Validate(ctx context.Context) ([]PolicyProblem, error) {
+	return ppd.core().validate(ctx)
+}
+
+// OptOut records that the data subject has opted out of their data being seen by the requester for the purpose, see
+// MySQLPrivateDatabase.OptOut
+func (ppd *PostgresPrivateDatabase) OptOut(ctx context.Context, subjectKey string, requesterID string,
+	purpose string) error {
+	return ppd.core().optOut(ctx, subjectKey, requesterID, purpose)
+}
+
+// OptIn removes every opt-out recorded for the data subject
+func (ppd *PostgresPrivateDatabase) OptIn(ctx context.Context, subjectKey string) error {
+	return ppd.core().optIn(ctx, subjectKey)
+}
+
+// postgresDialect is the sqlDialect of PostgreSQL, the times tables were created and updated are recorded by the
+// middleware in pam_table_versions
+type postgresDialect struct{}
+
+// prepare creates the versions table and the function the triggers which record changes to tables run
+func (postgresDialect) prepare(db *sql.DB) error {
+	_, err := db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s ("+
+		"table_schema TEXT NOT NULL, "+
+		"table_name TEXT NOT NULL, "+
+		"updated_at TIMESTAMPTZ NOT NULL, "+
+		"PRIMARY KEY (table_schema, table_name));", tableVersionsTableName))
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("CREATE OR REPLACE FUNCTION %s() RETURNS trigger LANGUAGE plpgsql AS $$ "+
+		"BEGIN "+
+		"INSERT INTO %s (table_schema, table_name, updated_at) "+
+		"VALUES (TG_TABLE_SCHEMA, TG_TABLE_NAME, clock_timestamp()) "+
+		"ON CONFLICT (table_schema, table_name) DO UPDATE SET updated_at = EXCLUDED.updated_at; "+
+		"RETURN NULL; "+
+		"END $$;", postgresRecordUpdateFunction, tableVersionsTableName))
+	return err
+}
+
+func (postgresDialect) internalTable(tableName string) bool {
+	return tableName == tableVersionsTableName
+}
+
+// storedTableName folds the name to lower case, as PostgreSQL does for names which are not quoted. Quoted names are
+// folded too when they are written as plain identifiers, as formatPostgresIdentifier writes them in lower case.
+func (postgresDialect) storedTableName(db *sql.DB, databaseName string, tableName string) (string, error) {
+	if identifierRegexp.MatchString(tableName) {
+		return strings.ToLower(tableName), nil
+	}
+	return tableName, nil
+}
+
+func (postgresDialect) tablesQuery(databaseName string) (string, []interface{}) {
+	return `SELECT table_name FROM information_schema.tables WHERE table_schema = $1 AND table_type = 'BASE TABLE'`,
+		[]interface{}{databaseName}
+}
+
+func (postgresDialect) columnsQuery(databaseName string, tableName string) (string, []interface{}) {
+	return `SELECT column_name, data_type FROM information_schema.columns WHERE table_schema = $1 AND table_name = $2 ` +
+		`ORDER BY ordinal_position`, []interface{}{databaseName, strings.ToLower(tableName)}
+}
+
+func (postgresDialect) schemaQuery(databaseName string) (string, []interface{}) {
+	return `SELECT table_name, column_name, data_type FROM information_schema.columns WHERE table_schema = $1`,
+		[]interface{}{databaseName}
+}
+
+// createTableLike copies the columns of the table and records when the copy was created in the same transaction
+func (postgresDialect) createTableLike(db *sql.DB, tableName string, newTableName string, colsToDrop []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(fmt.Sprintf("CREATE TABLE %s (LIKE %s);", newTableName, tableName))
+	if err != nil {
+		return err
+	}
+
+	// Drop unnecessary columns
+	if len(colsToDrop) > 0 {
+		dropString := "DROP COLUMN " + strings.Join(colsToDrop, ", DROP COLUMN ")
+		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s %s;", newTableName, dropString))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = postgresRecordUpdate(tx, newTableName)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (postgresDialect) dropTableSQL(tableName string) []string {
+	return []string{
+		fmt.Sprintf("DROP TABLE IF EXISTS %s;", tableName),
+		fmt.Sprintf("DELETE FROM %s WHERE table_schema = current_schema() AND table_name = %s;",
+			tableVersionsTableName, pq.QuoteLiteral(strings.ToLower(tableName))),
+	}
+}
+
+// createTemporaryTableLike copies the columns of the table into a temporary table, which is created in the session's
+// own schema and found before tables of the same name in the current schema
+func (postgresDialect) createTemporaryTableLike(ctx context.Context, db sqlRunner, tableName string,
+	newTableName string, colsToDrop []string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("CREATE TEMPORARY TABLE %s (LIKE %s);", newTableName, tableName))
+	if err != nil {
+		return err
+	}
+
+	// Drop unnecessary columns
+	if len(colsToDrop) > 0 {
+		dropString := "DROP COLUMN " + strings.Join(colsToDrop, ", DROP COLUMN ")
+		_, err = db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE pg_temp.%s %s;", newTableName, dropString))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (postgresDialect) dropTemporaryTableSQL(tableName string) string {
+	return fmt.Sprintf("DROP TABLE IF EXISTS pg_temp.%s;", tableName)
+}
+
+func (postgresDialect) tableCreated(db *sql.DB, databaseName string, tableName string) (time.Time, bool, error) {
+	var createdAt pq.NullTime
+	err := db.QueryRow(fmt.Sprintf("SELECT v.updated_at FROM information_schema.tables t "+
+		"LEFT JOIN %s v ON v.table_schema = t.table_schema AND v.table_name = t.table_name "+
+		"WHERE t.table_schema = $1 AND t.table_name = $2", tableVersionsTableName),
+		databaseName, strings.ToLower(tableName)).Scan(&createdAt)
+	switch {
+	case err == sql.ErrNoRows:
+		return time.Time{}, false, nil
+	case err != nil:
+		return time.Time{}, false, err
+	case !createdAt.Valid:
+		return time.Time{}, true, fmt.Errorf("no creation time is recorded for %s, recreating", tableName)
+	}
+	return postgresLocalTime(createdAt.Time), true, nil
+}
+
+// trackUpdates adds a trigger to the table which records when it changes if it does not have one, in which case it
+// is recorded as having been updated now. An advisory lock stops concurrent calls adding the trigger twice.
+func (postgresDialect) trackUpdates(db *sql.DB, databaseName string, tableName string) error {
+	tableName = strings.ToLower(tableName)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, databaseName+"."+tableName)
+	if err != nil {
+		return err
+	}
+
+	tracked, err := postgresTracksUpdates(tx, databaseName, tableName)
+	if err != nil || tracked {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("CREATE TRIGGER %s AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON %s "+
+		"FOR EACH STATEMENT EXECUTE PROCEDURE %s();", postgresRecordUpdateFunction,
+		postgresQualifiedTableName(databaseName, tableName), postgresRecordUpdateFunction))
+	if err != nil {
+		return err
+	}
+	err = postgresRecordUpdate(tx, tableName)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// tableLastUpdated reads when the trigger added by trackUpdates last recorded a change to the table, a table without
+// one, such as one created since the middleware connected, is treated as having been updated now
+func (postgresDialect) tableLastUpdated(db *sql.DB, databaseName string, tableName string) (time.Time, error) {
+	tableName = strings.ToLower(tableName)
+	tx, err := db.Begin()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	var tables int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = $1 AND table_name = $2`,
+		databaseName, tableName).Scan(&tables)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if tables == 0 {
+		return time.Time{}, fmt.Errorf("table %s doesn't exist", tableName)
+	}
+
+	tracked, err := postgresTracksUpdates(tx, databaseName, tableName)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !tracked {
+		return postgresLocalTime(time.Now()), nil
+	}
+
+	var updatedAt time.Time
+	err = tx.QueryRow(fmt.Sprintf("SELECT updated_at FROM %s WHERE table_schema = $1 AND table_name = $2",
+		tableVersionsTableName), databaseName, tableName).Scan(&updatedAt)
+	if err == sql.ErrNoRows {
+		return time.Time{}, fmt.Errorf("no creation or last updated time could be found for %s", tableName)
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	return postgresLocalTime(updatedAt), tx.Commit()
+}
+
+// postgresTracksUpdates returns whether the table has the trigger which records its changes
+func postgresTracksUpdates(tx *sql.Tx, databaseName string, tableName string) (bool, error) {
+	var triggers int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM pg_trigger WHERE tgrelid = CAST($1 AS regclass) AND tgname = $2`,
+		postgresQualifiedTableName(databaseName, tableName), postgresRecordUpdateFunction).Scan(&triggers)
+	return triggers > 0, err
+}
+
+// postgresQualifiedTableName returns the quoted name of a table in the schema
+func postgresQualifiedTableName(databaseName string, tableName string) string {
+	return pq.QuoteIdentifier(databaseName) + "." + pq.QuoteIdentifier(tableName)
+}
+
+// postgresRecordUpdate records that a table in the current schema was updated, or created, now
+func postgresRecordUpdate(tx *sql.Tx, tableName string) error {
+	_, err := tx.Exec(fmt.Sprintf("INSERT INTO %s (table_schema, table_name, updated_at) "+
+		"VALUES (current_schema(), $1, clock_timestamp()) "+
+		"ON CONFLICT (table_schema, table_name) DO UPDATE SET updated_at = EXCLUDED.updated_at;",
+		tableVersionsTableName), strings.ToLower(tableName))
+	return err
+}
+
+// postgresLocalTime returns the local time of a recorded time labelled as UTC, as policy update times are
+func postgresLocalTime(t time.Time) time.Time {
+	return timeWithUTCLocation(t.In(time.Local))
+}
+
+func (postgresDialect) consentTableSQL(tableName string) string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s ("+
+		"subject_key VARCHAR(255) NOT NULL, "+
+		"requester_id VARCHAR(255), "+
+		"purpose VARCHAR(255)); "+
+		"CREATE INDEX IF NOT EXISTS %s_subject_key ON %s (subject_key);", tableName, tableName, tableName)
+}
+
+func (postgresDialect) privacyBudgetStore(db *sql.DB, tableName string) (PrivacyBudgetStore, error) {
+	return NewPostgresPrivacyBudgetStore(db, tableName)
+}
+
+// sampleValue returns a value like those the pq driver scans from a column of the PostgreSQL data type
+func (postgresDialect) sampleValue(dataType string) interface{} {
+	switch {
+	case dataType == "date" || strings.HasPrefix(dataType, "timestamp") || strings.HasPrefix(dataType, "time"):
+		return time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	case dataType == "smallint" || dataType == "integer" || dataType == "bigint":
+		return int64(1)
+	case dataType == "real" || dataType == "double precision":
+		return float64(1)
+	case dataType == "boolean":
+		return true
+	case dataType == "character" || dataType == "character varying" || dataType == "text":
+		return "sample"
+	case dataType == "numeric":
+		return []byte("1")
+	}
+	return []byte("sample")
+}
+
+// normaliseQuery rewrites the identifiers quoted with double quotes and the numbered placeholders of a PostgreSQL
+// query as MySQL's, string literals are rewritten as the parser expects backslashes to be escaped
+func (postgresDialect) normaliseQuery(query string, args []interface{}) (string, []interface{}, error) {
+	var (
+		normalised   strings.Builder
+		placeholders []int
+	)
+	// quoted returns the end of the quoted text starting at i, a doubled quote character is part of the text
+	quoted := func(i int) (int, error) {
+		for end := i + 1; end < len(query); end++ {
+			if query[end] != query[i] {
+				continue
+			}
+			if end+1 < len(query) && query[end+1] == query[i] {
+				end++
+				continue
+			}
+			return end, nil
+		}
+		return 0, fmt.Errorf("the query has an unterminated %c", query[i])
+	}
+
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; {
+		case c == '\'':
+			end, err := quoted(i)
+			if err != nil {
+				return "", nil, err
+			}
+			normalised.WriteString(quoteSQLString(strings.Replace(query[i+1:end], "''", "'", -1)))
+			i = end
+		case c == '"':
+			end, err := quoted(i)
+			if err != nil {
+				return "", nil, err
+			}
+			identifier := strings.Replace(query[i+1:end], `""`, `"`, -1)
+			normalised.WriteString("`" + strings.Replace(identifier, "`", "``", -1) + "`")
+			i = end
+		case c == '$' && i+1 < len(query) && query[i+1] >= '0' && query[i+1] <= '9':
+			end := i + 1
+			for end < len(query) && query[end] >= '0' && query[end] <= '9' {
+				end++
+			}
+			n, err := strconv.Atoi(query[i+1 : end])
+			if err != nil {
+				return "", nil, err
+			}
+			placeholders = append(placeholders, n)
+			normalised.WriteByte('?')
+			i = end - 1
+		default:
+			normalised.WriteByte(c)
+		}
+	}
+
+	if len(placeholders) == 0 || args == nil {
+		return normalised.String(), args, nil
+	}
+	orderedArgs := make([]interface{}, len(placeholders))
+	for i, n := range placeholders {
+		if n < 1 || n > len(args) {
+			return "", nil, fmt.Errorf("there is no argument for the placeholder $%d", n)
+		}
+		orderedArgs[i] = args[n-1]
+	}
+	return normalised.String(), orderedArgs, nil
+}
+
+func (d postgresDialect) nativeSQL(query string) (string, error) {
+	return formatNativeSQL(query, d)
+}
+
+func (postgresDialect) placeholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+// postgresDateFormats are the PostgreSQL to_char patterns of the MySQL DATE_FORMAT specifiers used by SQLTransforms
+var postgresDateFormats = map[byte]string{
+	'Y': "YYYY",
+	'm': "MM",
+	'd': "DD",
+	'H': "HH24",
+	'i': "MI",
+	's': "SS",
+	'S': "SS",
+}
+
+// formatNode writes the parts of MySQL's SQL which PostgreSQL does not share, including the functions used by
+// SQLTransforms
+func (postgresDialect) formatNode(buf *sqlparser.TrackedBuffer, node sqlparser.SQLNode) bool {
+	switch node := node.(type) {
+	case sqlparser.ColIdent:
+		formatPostgresIdentifier(buf, node, node.String())
+	case sqlparser.TableIdent:
+		formatPostgresIdentifier(buf, node, node.String())
+	case *sqlparser.SQLVal:
+		switch node.Type {
+		case sqlparser.StrVal:
+			buf.WriteString(pq.QuoteLiteral(string(node.Val)))
+		case sqlparser.HexVal:
+			buf.Myprintf("cast('\\x%s' as bytea)", node.Val)
+		default:
+			return false
+		}
+	case *sqlparser.Limit:
+		if node == nil || node.Offset == nil {
+			return false
+		}
+		buf.Myprintf(" limit %v offset %v", node.Rowcount, node.Offset)
+	case *sqlparser.Select:
+		// PostgreSQL has no dual table to select from
+		if len(node.From) != 1 || sqlparser.String(node.From[0]) != "dual" {
+			return false
+		}
+		buf.Myprintf("select %v%s%v%v%v%v%v%v%s", node.Comments, node.Distinct, node.SelectExprs, node.Where,
+			node.GroupBy, node.Having, node.OrderBy, node.Limit, node.Lock)
+	case *sqlparser.BinaryExpr:
+		// MySQL divides integers without truncating
+		if node.Operator != sqlparser.DivStr {
+			return false
+		}
+		buf.Myprintf("cast(%v as numeric) / %v", node.Left, node.Right)
+	case *sqlparser.ConvertExpr:
+		switch strings.ToLower(node.Type.Type) {
+		case "datetime":
+			buf.Myprintf("cast(%v as timestamp)", node.Expr)
+		case "char", "nchar":
+			buf.Myprintf("cast(%v as text)", node.Expr)
+		case "binary":
+			buf.Myprintf("cast(%v as bytea)", node.Expr)
+		case "signed", "unsigned":
+			buf.Myprintf("cast(%v as bigint)", node.Expr)
+		default:
+			return false
+		}
+	case *sqlparser.FuncExpr:
+		return formatPostgresFunction(buf, node)
+	default:
+		return false
+	}
+	return true
+}
+
+// formatPostgresIdentifier writes an identifier, quoting it with double quotes if MySQL would quote it. Names which
+// are only quoted as they are keywords are written in lower case, as PostgreSQL would fold them if they were not
+// quoted.
+func formatPostgresIdentifier(buf *sqlparser.TrackedBuffer, node sqlparser.SQLNode, name string) {
+	if !strings.HasPrefix(sqlparser.String(node), "`") {
+		buf.WriteString(name)
+		return
+	}
+	if identifierRegexp.MatchString(name) {
+		name = strings.ToLower(name)
+	}
+	buf.WriteString(pq.QuoteIdentifier(name))
+}
+
+// formatPostgresFunction writes the PostgreSQL equivalent of MySQL's DATE_FORMAT, SHA2 and ROUND. Functions which
+// PostgreSQL shares, or which have arguments that are not literals where literals are needed, are left to formatSQL.
+func formatPostgresFunction(buf *sqlparser.TrackedBuffer, node *sqlparser.FuncExpr) bool {
+	if !node.Qualifier.IsEmpty() || len(node.Exprs) != 2 {
+		return false
+	}
+	first, ok := node.Exprs[0].(*sqlparser.AliasedExpr)
+	if !ok {
+		return false
+	}
+	second, ok := node.Exprs[1].(*sqlparser.AliasedExpr)
+	if !ok {
+		return false
+	}
+	literal, _ := second.Expr.(*sqlparser.SQLVal)
+
+	switch node.Name.Lowered() {
+	case "date_format":
+		if literal == nil || literal.Type != sqlparser.StrVal {
+			return false
+		}
+		format, err := postgresDateFormat(string(literal.Val))
+		if err != nil {
+			return false
+		}
+		buf.Myprintf("to_char(%v, %s)", first.Expr, pq.QuoteLiteral(format))
+	case "sha2":
+		if literal == nil || literal.Type != sqlparser.IntVal {
+			return false
+		}
+		bits := string(literal.Val)
+		if bits == "0" {
+			bits = "256"
+		}
+		if bits != "224" && bits != "256" && bits != "384" && bits != "512" {
+			return false
+		}
+		buf.Myprintf("encode(sha%s(convert_to(cast(%v as text), 'UTF8')), 'hex')", bits, first.Expr)
+	case "round":
+		// PostgreSQL only rounds numerics to a number of places
+		buf.Myprintf("round(cast(%v as numeric), %v)", first.Expr, second.Expr)
+	default:
+		return false
+	}
+	return true
+}
+
+// postgresDateFormat returns the to_char pattern of a MySQL DATE_FORMAT format, text between the specifiers is quoted
+// so that it is not read as a pattern
+func postgresDateFormat(format string) (string, error) {
+	var (
+		pattern strings.Builder
+		text    strings.Builder
+	)
+	writeText := func() {
+		if text.Len() > 0 {
+			pattern.WriteString(`"` + text.String() + `"`)
+			text.Reset()
+		}
+	}
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i == len(format)-1 {
+			text.WriteByte(format[i])
+			continue
+		}
+		i++
+		if format[i] == '%' {
+			text.WriteByte('%')
+			continue
+		}
+		specifier, ok := postgresDateFormats[format[i]]
+		if !ok {
+			return "", errors.New("unsupported date format " + format)
+		}
+		writeText()
+		pattern.WriteString(specifier)
+	}
+	writeText()
+	return pattern.String(), nil
+}
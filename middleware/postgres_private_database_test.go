@@ -0,0 +1,182 @@
+package middleware
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+var _ PrivateRelationalDatabase = &PostgresPrivateDatabase{}
+
+// postgresPrivateDBConnection connects to the local PostgreSQL database and creates a "people" table like the one the
+// MySQL tests use
+func postgresPrivateDBConnection(t *testing.T, db *PostgresPrivateDatabase) {
+	err := db.Connect("demouser", "demopassword", "store1", "127.0.0.1", 5432)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.database.Exec(`DROP TABLE IF EXISTS people; ` +
+		`CREATE TABLE people (id SERIAL PRIMARY KEY, name VARCHAR(255), dob DATE)`)
+	require.NoError(t, err)
+	_, err = db.database.Exec(`INSERT INTO people (name, dob) VALUES ($1, $2), ($3, $4), ($5, $6)`,
+		"alice", time.Date(1990, 5, 17, 0, 0, 0, 0, time.UTC),
+		"bob", time.Date(1985, 11, 2, 0, 0, 0, 0, time.UTC),
+		"charlie", time.Date(2001, 1, 30, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	if db.CacheTables {
+		require.NoError(t, db.core().trackTableUpdates(context.Background()))
+		require.NoError(t, db.core().dropCachedTables("transformed_"))
+	}
+}
+
+func TestPostgresPrivateDatabase_Query_Excluded_Col(t *testing.T) {
+	tableOperations := NewTableOperations()
+	tableOperations.ExcludedCols["people"] = []string{"dob"}
+	db := PostgresPrivateDatabase{DataPolicy: sqliteTestPolicy(tableOperations)}
+	postgresPrivateDBConnection(t, &db)
+
+	rows, err := db.Query("SELECT * FROM people WHERE id = $1", localRequestPolicy("alice"), 1)
+	require.NoError(t, err)
+	cols, err := rows.Columns()
+	require.NoError(t, err)
+	require.Equal(t, []string{"id", "name"}, cols)
+	require.NoError(t, rows.Close())
+
+	_, err = db.Exec("UPDATE people SET dob = '2000-01-01'", localRequestPolicy("alice"))
+	require.EqualError(t, err, "ERROR 1054 (42S22): Unknown column 'dob'")
+}
+
+func TestPostgresPrivateDatabase_Query_Transforms(t *testing.T) {
+	tableOperations := NewTableOperations()
+	tableOperations.TableTransforms["people"] = TableTransform{"dob": truncateToYear(t)}
+	tableOperations.RowFilters["people"] = []RowFilter{{Column: "name", Operator: "!=", Value: "bob"}}
+	db := PostgresPrivateDatabase{DataPolicy: sqliteTestPolicy(tableOperations)}
+	postgresPrivateDBConnection(t, &db)
+
+	rows, err := db.Query(`SELECT "name", dob FROM people ORDER BY id LIMIT $2 OFFSET $1`,
+		localRequestPolicy("alice"), 1, 5)
+	require.NoError(t, err)
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var (
+			name string
+			dob  time.Time
+		)
+		require.NoError(t, rows.Scan(&name, &dob))
+		require.Equal(t, 1, dob.YearDay())
+		names = append(names, name)
+	}
+	require.NoError(t, rows.Err())
+	require.Equal(t, []string{"charlie"}, names)
+}
+
+func TestPostgresPrivateDatabase_Query_SQLTransforms(t *testing.T) {
+	tableOperations := NewTableOperations()
+	truncate, err := TruncateDateSQLTransform("month")
+	require.NoError(t, err)
+	redact, err := RedactSQLTransform(1, "*")
+	require.NoError(t, err)
+	tableOperations.SQLTransforms["people"] = SQLTableTransform{"dob": truncate, "name": redact}
+	db := PostgresPrivateDatabase{DataPolicy: sqliteTestPolicy(tableOperations)}
+	postgresPrivateDBConnection(t, &db)
+
+	row, err := db.QueryRow("SELECT name, dob FROM people WHERE id = $1", localRequestPolicy("alice"), 1)
+	require.NoError(t, err)
+	var (
+		name string
+		dob  time.Time
+	)
+	require.NoError(t, row.Scan(&name, &dob))
+	require.Equal(t, "a****", name)
+	require.True(t, time.Date(1990, 5, 1, 0, 0, 0, 0, time.UTC).Equal(dob))
+
+	tableOperations.SQLTransforms["people"] = SQLTableTransform{"name": HashSQLTransform("salt")}
+	row, err = db.QueryRow("SELECT name FROM people WHERE id = 1", localRequestPolicy("alice"))
+	require.NoError(t, err)
+	require.NoError(t, row.Scan(&name))
+	hashed, _, err := HashTransform("salt")("alice")
+	require.NoError(t, err)
+	require.Equal(t, hashed, name)
+}
+
+func TestPostgresPrivateDatabase_Query_Caching(t *testing.T) {
+	tableOperations := NewTableOperations()
+	tableOperations.TableTransforms["people"] = TableTransform{"dob": truncateToYear(t)}
+	db := PostgresPrivateDatabase{DataPolicy: sqliteTestPolicy(tableOperations), CacheTables: true}
+	postgresPrivateDBConnection(t, &db)
+
+	count := func() int {
+		var count int
+		row, err := db.QueryRow("SELECT COUNT(*) FROM people", localRequestPolicy("alice"))
+		require.NoError(t, err)
+		require.NoError(t, row.Scan(&count))
+		return count
+	}
+	require.Equal(t, 3, count())
+
+	valid, err := db.core().isTransformedTableValid("people", transformedTablePrefix("alice", "")+"people")
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// Changing the table invalidates the cached table
+	_, err = db.database.Exec(`INSERT INTO people (name, dob) VALUES ('dave', '1970-01-01')`)
+	require.NoError(t, err)
+	valid, err = db.core().isTransformedTableValid("people", transformedTablePrefix("alice", "")+"people")
+	require.NoError(t, err)
+	require.False(t, valid)
+	require.Equal(t, 4, count())
+}
+
+func TestPostgresDialect_NormaliseQuery(t *testing.T) {
+	testCases := []struct {
+		query           string
+		args            []interface{}
+		normalisedQuery string
+		normalisedArgs  []interface{}
+	}{
+		{"SELECT name FROM people", nil, "SELECT name FROM people", nil},
+		{`SELECT "name", 'it''s', 'a\b' FROM people`, nil, "SELECT `name`, 'it\\'s', 'a\\\\b' FROM people", nil},
+		{`SELECT "a""b" FROM people WHERE id = $2 AND name = $1 OR name = $1`, []interface{}{"alice", 1},
+			"SELECT `a\"b` FROM people WHERE id = ? AND name = ? OR name = ?", []interface{}{1, "alice", "alice"}},
+		{"SELECT '$1' FROM people", []interface{}{1}, "SELECT '$1' FROM people", []interface{}{1}},
+	}
+	for _, tc := range testCases {
+		normalisedQuery, normalisedArgs, err := postgresDialect{}.normaliseQuery(tc.query, tc.args)
+		require.NoError(t, err)
+		require.Equal(t, tc.normalisedQuery, normalisedQuery)
+		require.Equal(t, tc.normalisedArgs, normalisedArgs)
+	}
+
+	_, _, err := postgresDialect{}.normaliseQuery("SELECT name FROM people WHERE id = $2", []interface{}{1})
+	require.EqualError(t, err, "there is no argument for the placeholder $2")
+	_, _, err = postgresDialect{}.normaliseQuery(`SELECT "name FROM people`, nil)
+	require.EqualError(t, err, `the query has an unterminated "`)
+}
+
+func TestPostgresDialect_NativeSQL(t *testing.T) {
+	truncate, err := TruncateDateSQLTransform("month")
+	require.NoError(t, err)
+	testCases := []struct {
+		query  string
+		native string
+	}{
+		{"SELECT `name`, `order` FROM people WHERE id = ? AND name = 'it\\'s'",
+			"select name, \"order\" from people where id = $1 and name = 'it''s'"},
+		{"SELECT ? AS `count`", "select $1 as count"},
+		{"SELECT id FROM people LIMIT ?, ?", "select id from people limit $2 offset $1"},
+		{"SELECT " + truncate("`dob`") + " FROM people",
+			"select cast(to_char(dob, 'YYYY\"-\"MM\"-01\"') as timestamp) from people"},
+		{"SELECT " + HashSQLTransform("salt")("`name`") + " FROM people",
+			"select encode(sha256(convert_to(cast(CONCAT('salt', name) as text), 'UTF8')), 'hex') from people"},
+		{"SELECT " + RoundSQLTransform(1)("`price`") + ", price / 2 FROM people",
+			"select round(cast(price as numeric), 1), cast(price as numeric) / 2 from people"},
+	}
+	for _, tc := range testCases {
+		native, err := postgresDialect{}.nativeSQL(tc.query)
+		require.NoError(t, err)
+		require.Equal(t, tc.native, native)
+	}
+}
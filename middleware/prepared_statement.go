@@ -0,0 +1,173 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// maxPreparedRewrites is the most rewritten queries a prepared statement keeps, those used least recently are dropped
+// to make room for others
+const maxPreparedRewrites = 256
+
+// Stmt is a prepared statement on a private database which can be run for any RequestPolicy. The query is checked
+// when it is prepared and the query it is rewritten to is kept for each policy fingerprint, that is each requester and
+// purpose for a version of the DataPolicy, so running it again for the same requester is not parsed or rewritten again
+// and only brings the transformed tables it reads up to date. The rewritten queries are not used once the DataPolicy
+// changes, and are dropped once a query is rewritten for a later version, but columns added to a table after a query
+// was rewritten are not read by it until the statement is prepared again.
+type Stmt struct {
+	pd       *privateDatabase
+	query    string
+	rewrites rewriteCache
+}
+
+// rewriteCache holds the queries a prepared statement has been rewritten to, by policy fingerprint
+type rewriteCache struct {
+	mutex   sync.Mutex
+	queries map[string]*preparedRewrite
+}
+
+// preparedRewrite is a query a prepared statement has been rewritten to
+type preparedRewrite struct {
+	rewritten *rewrittenQuery
+	// policyUpdated is the version of the DataPolicy the query was rewritten for
+	policyUpdated time.Time
+	used          time.Time
+}
+
+// add keeps a query rewritten for a version of the DataPolicy, the mutex must be held. Queries rewritten for earlier
+// versions are dropped as they are no longer used, and the least recently used query if there are too many.
+func (r *rewriteCache) add(fingerprint string, rewritten *rewrittenQuery, policyUpdated time.Time) {
+	if r.queries == nil {
+		r.queries = make(map[string]*preparedRewrite)
+	}
+	var leastRecentlyUsed string
+	for key, entry := range r.queries {
+		if entry.policyUpdated.Before(policyUpdated) {
+			delete(r.queries, key)
+		} else if leastRecentlyUsed == "" || entry.used.Before(r.queries[leastRecentlyUsed].used) {
+			leastRecentlyUsed = key
+		}
+	}
+	if len(r.queries) >= maxPreparedRewrites {
+		delete(r.queries, leastRecentlyUsed)
+	}
+	r.queries[fingerprint] = &preparedRewrite{rewritten: rewritten, policyUpdated: policyUpdated, used: time.Now()}
+}
+
+// prepare returns a prepared statement for a query, the query is parsed so that errors in it are returned now
+func (pd *privateDatabase) prepare(query string) (*Stmt, error) {
+	parsedQuery, _, err := pd.dialect.normaliseQuery(query, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, err = pd.parseQuery(parsedQuery)
+	if err != nil {
+		return nil, err
+	}
+	return &Stmt{pd: pd, query: query}, nil
+}
+
+// Query runs the prepared statement for the requester of the RequestPolicy, see PrivateRelationalDatabase.Query
+func (s *Stmt) Query(requestPolicy *RequestPolicy, args ...interface{}) (*sql.Rows, error) {
+	return s.QueryContext(context.Background(), requestPolicy, args...)
+}
+
+// QueryContext runs the prepared statement for the requester of the RequestPolicy, see
+// PrivateRelationalDatabase.QueryContext
+func (s *Stmt) QueryContext(ctx context.Context, requestPolicy *RequestPolicy, args ...interface{}) (*sql.Rows, error) {
+	return s.pd.queryContext(ctx, queryOptions{rewrites: &s.rewrites}, s.query, requestPolicy, args...)
+}
+
+// QueryRow runs the prepared statement for the requester of the RequestPolicy, see PrivateRelationalDatabase.QueryRow
+func (s *Stmt) QueryRow(requestPolicy *RequestPolicy, args ...interface{}) (*sql.Row, error) {
+	return s.QueryRowContext(context.Background(), requestPolicy, args...)
+}
+
+// QueryRowContext runs the prepared statement for the requester of the RequestPolicy, see
+// PrivateRelationalDatabase.QueryRowContext
+func (s *Stmt) QueryRowContext(ctx context.Context, requestPolicy *RequestPolicy, args ...interface{}) (*sql.Row, error) {
+	return s.pd.queryRowContext(ctx, queryOptions{rewrites: &s.rewrites}, s.query, requestPolicy, args...)
+}
+
+// Exec runs the prepared statement for the requester of the RequestPolicy, see PrivateRelationalDatabase.Exec
+func (s *Stmt) Exec(requestPolicy *RequestPolicy, args ...interface{}) (sql.Result, error) {
+	return s.ExecContext(context.Background(), requestPolicy, args...)
+}
+
+// ExecContext runs the prepared statement for the requester of the RequestPolicy, see
+// PrivateRelationalDatabase.ExecContext
+func (s *Stmt) ExecContext(ctx context.Context, requestPolicy *RequestPolicy, args ...interface{}) (sql.Result, error) {
+	return s.pd.execContext(ctx, queryOptions{rewrites: &s.rewrites}, s.query, requestPolicy, args...)
+}
+
+// Close drops the rewritten queries kept by the prepared statement
+func (s *Stmt) Close() error {
+	s.rewrites.mutex.Lock()
+	defer s.rewrites.mutex.Unlock()
+	s.rewrites.queries = nil
+	return nil
+}
+
+// rewritePreparedQuery rewrites the query of a prepared statement like rewriteQuery, reusing the query it was rewritten
+// to for the same policy fingerprint if the transformed tables it reads have the same names
+func (pd *privateDatabase) rewritePreparedQuery(ctx context.Context, session *querySession, rewrites *rewriteCache,
+	query string, args []interface{}, requestPolicy *RequestPolicy) (string, error) {
+	// The version of the policy is read before it is resolved, so that a query rewritten for a policy which changes in
+	// the meantime is kept for the earlier version
+	policyUpdated := pd.DataPolicy.LastUpdated()
+	requesterID := requesterIDOrAnonymous(requestPolicy)
+	tableOperations, purpose, err := pd.resolveForQuery(requesterID, requestPolicy)
+	if err != nil {
+		return "", err
+	}
+	fingerprint := fmt.Sprintf("%d:%s%d:%s%d", len(requesterID), requesterID, len(purpose), purpose,
+		policyUpdated.UnixNano())
+
+	rewrites.mutex.Lock()
+	var rewritten *rewrittenQuery
+	entry, ok := rewrites.queries[fingerprint]
+	if ok {
+		entry.used = time.Now()
+		rewritten = entry.rewritten
+	}
+	rewrites.mutex.Unlock()
+	if ok {
+		// The transformed tables are brought up to date each time the query runs
+		groupPrefix := transformedTablePrefix(requesterID, purpose)
+		current := true
+		for tableName, transformedTableName := range rewritten.transformedTables {
+			name, err := pd.transformTable(ctx, session, tableName, groupPrefix, tableOperations, requesterID, purpose)
+			if err != nil {
+				return "", err
+			}
+			current = current && name == transformedTableName
+		}
+		if current {
+			return rewritten.query, nil
+		}
+	}
+
+	// The rewritten statement replaces the parsed one, so the query is parsed each time it is rewritten
+	parsed, err := pd.parseQuery(query)
+	if err != nil {
+		return "", err
+	}
+	rewritten, err = pd.rewriteParsedQuery(ctx, session, parsed, args, tableOperations, requesterID, purpose)
+	if err != nil {
+		return "", err
+	}
+
+	// Writes are checked against the table's columns and the values written each time they run, so that columns added
+	// to it are checked
+	if !parsed.reads {
+		return rewritten.query, nil
+	}
+	rewrites.mutex.Lock()
+	defer rewrites.mutex.Unlock()
+	rewrites.add(fingerprint, rewritten, policyUpdated)
+	return rewritten.query, nil
+}
@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestSQLitePrivateDatabase_Prepare(t *testing.T) {
+	tableOperations := NewTableOperations()
+	tableOperations.TableTransforms["people"] = TableTransform{"dob": truncateToYear(t)}
+	tableOperations.RowFilters["people"] = []RowFilter{{Column: "name", Operator: "!=", Value: "bob"}}
+	db := SQLitePrivateDatabase{DataPolicy: sqliteTestPolicy(tableOperations)}
+	sqlitePrivateDBConnection(t, &db)
+
+	stmt, err := db.Prepare("SELECT name, dob FROM people WHERE id <= ? ORDER BY id")
+	require.NoError(t, err)
+	defer stmt.Close()
+
+	names := func(requesterID string, id int) []string {
+		rows, err := stmt.Query(localRequestPolicy(requesterID), id)
+		require.NoError(t, err)
+		defer rows.Close()
+
+		var names []string
+		for rows.Next() {
+			var (
+				name string
+				dob  time.Time
+			)
+			require.NoError(t, rows.Scan(&name, &dob))
+			require.Equal(t, 1, dob.YearDay())
+			names = append(names, name)
+		}
+		require.NoError(t, rows.Err())
+		return names
+	}
+
+	// The query is rewritten once for each requester
+	require.Equal(t, []string{"alice"}, names("alice", 1))
+	require.Equal(t, []string{"alice", "charlie"}, names("alice", 3))
+	require.Len(t, stmt.rewrites.queries, 1)
+
+	// Changing the policy changes the fingerprints of the rewritten queries, those for the earlier version are dropped
+	time.Sleep(5 * time.Millisecond)
+	db.DataPolicy.(*StaticDataPolicy).privacyGroups[0].Add("bob")
+	require.Equal(t, []string{"alice", "charlie"}, names("bob", 3))
+	require.Equal(t, []string{"alice", "charlie"}, names("alice", 3))
+	require.Len(t, stmt.rewrites.queries, 2)
+
+	// The policy is still resolved for every request
+	_, err = stmt.Query(localRequestPolicy("mallory"), 1)
+	require.Equal(t, ErrAccessDenied, err)
+
+	_, err = db.Prepare("SELECT name FROM")
+	require.Error(t, err)
+}
+
+func TestSQLitePrivateDatabase_Prepare_Caching(t *testing.T) {
+	tableOperations := NewTableOperations()
+	tableOperations.ExcludedCols["people"] = []string{"dob"}
+	tableOperations.TableTransforms["people"] = TableTransform{"name": func(value interface{}) (interface{}, bool, error) {
+		return value, false, nil
+	}}
+	db := SQLitePrivateDatabase{DataPolicy: sqliteTestPolicy(tableOperations), CacheTables: true}
+	sqlitePrivateDBConnection(t, &db)
+
+	stmt, err := db.Prepare("SELECT COUNT(*) FROM people")
+	require.NoError(t, err)
+	count := func() int {
+		var count int
+		row, err := stmt.QueryRow(localRequestPolicy("alice"))
+		require.NoError(t, err)
+		require.NoError(t, row.Scan(&count))
+		return count
+	}
+	require.Equal(t, 3, count())
+
+	// The cached table is rebuilt when the table changes even though the query is not rewritten
+	time.Sleep(5 * time.Millisecond)
+	_, err = db.database.Exec(`INSERT INTO people (name, dob) VALUES ('dave', '1970-01-01')`)
+	require.NoError(t, err)
+	require.Equal(t, 4, count())
+	require.Equal(t, int64(1), db.Cache.Stats().Rebuilds)
+
+	// Writes are checked every time they run and are not kept
+	update, err := db.Prepare("UPDATE people SET dob = ?")
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = update.Exec(localRequestPolicy("alice"), "2000-01-01")
+		require.EqualError(t, err, "ERROR 1054 (42S22): Unknown column 'dob'")
+	}
+	require.Empty(t, update.rewrites.queries)
+}
+
+func TestSQLitePrivateDatabase_Prepare_Rewrite_Limit(t *testing.T) {
+	tableOperations := NewTableOperations()
+	tableOperations.RowFilters["people"] = []RowFilter{{Column: "name", Operator: "=", Value: RequesterIDValue}}
+	db := SQLitePrivateDatabase{DataPolicy: sqliteTestPolicy(tableOperations)}
+	sqlitePrivateDBConnection(t, &db)
+	requesterIDs := make([]string, maxPreparedRewrites+10)
+	for i := range requesterIDs {
+		requesterIDs[i] = fmt.Sprintf("requester%d", i)
+	}
+	db.DataPolicy.(*StaticDataPolicy).privacyGroups[0].AddMany(requesterIDs)
+
+	stmt, err := db.Prepare("SELECT COUNT(*) FROM people")
+	require.NoError(t, err)
+	defer stmt.Close()
+	for _, requesterID := range append(requesterIDs, "alice") {
+		row, err := stmt.QueryRow(localRequestPolicy(requesterID))
+		require.NoError(t, err)
+		var count int
+		require.NoError(t, row.Scan(&count))
+	}
+
+	// The statement keeps the most recently used rewritten queries
+	require.Len(t, stmt.rewrites.queries, maxPreparedRewrites)
+	aliceFingerprint := fmt.Sprintf("5:alice0:%d", db.DataPolicy.LastUpdated().UnixNano())
+	require.Contains(t, stmt.rewrites.queries, aliceFingerprint)
+}
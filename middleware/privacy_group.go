@@ -1,15 +1,39 @@
 package middleware
 
-// PrivacyGroup a struct which contain a data structure of RequesterID's which we can Add to and Remove from
+import (
+	"sync"
+	"time"
+)
+
+// PrivacyGroup a struct which contain a data structure of RequesterID's which we can Add to and Remove from. Members
+// can also be granted membership for a limited time with Grant.
 type PrivacyGroup struct {
 	name    string
 	members map[string]bool
+	grants  map[string]grant
+	// priority ranks the group against the others an entity is a member of for the HighestPriority ConflictStrategy
+	priority int
+	// changed is when members were last added or removed or the priority was set, it does not include grants starting
+	// or expiring
+	changed time.Time
+	mutex   sync.RWMutex
+}
+
+// grant is a time-limited membership of a PrivacyGroup, a zero start or expiry means there is no limit
+type grant struct {
+	start  time.Time
+	expiry time.Time
+}
+
+func (g grant) activeAt(t time.Time) bool {
+	return (g.start.IsZero() || !t.Before(g.start)) && (g.expiry.IsZero() || t.Before(g.expiry))
 }
 
 func NewPrivacyGroup(name string) *PrivacyGroup {
 	return &PrivacyGroup{
 		name:    name,
 		members: make(map[string]bool),
+		grants:  make(map[string]grant),
 	}
 }
 
@@ -17,25 +41,98 @@ func (pg *PrivacyGroup) Name() string {
 	return pg.name
 }
 
+// SetPriority sets the priority of the group, which is only used by the HighestPriority ConflictStrategy where the
+// operations of groups with higher values take precedence. It counts as a change to the group as it can change what
+// its members see.
+func (pg *PrivacyGroup) SetPriority(priority int) {
+	pg.mutex.Lock()
+	defer pg.mutex.Unlock()
+
+	pg.priority = priority
+	pg.changed = time.Now()
+}
+
+// Priority returns the priority of the group, see SetPriority
+func (pg *PrivacyGroup) Priority() int {
+	pg.mutex.RLock()
+	defer pg.mutex.RUnlock()
+
+	return pg.priority
+}
+
 func (pg *PrivacyGroup) Add(id string) {
+	pg.mutex.Lock()
+	defer pg.mutex.Unlock()
+
 	pg.members[id] = true
+	pg.changed = time.Now()
 }
 
 func (pg *PrivacyGroup) AddMany(ids []string) {
+	pg.mutex.Lock()
+	defer pg.mutex.Unlock()
+
 	for _, id := range ids {
 		pg.members[id] = true
 	}
+	pg.changed = time.Now()
+}
+
+// Grant makes id a member of the group from start until expiry, a zero start or expiry means the grant starts now or
+// never expires. Members added with Add stay members when a grant to them expires.
+func (pg *PrivacyGroup) Grant(id string, start time.Time, expiry time.Time) {
+	pg.mutex.Lock()
+	defer pg.mutex.Unlock()
+
+	// Lazily initialise map for groups which were not created with NewPrivacyGroup
+	if pg.grants == nil {
+		pg.grants = make(map[string]grant)
+	}
+	pg.grants[id] = grant{start: start, expiry: expiry}
+	pg.changed = time.Now()
 }
 
+// Remove revokes the membership of id, including any grant, with immediate effect
 func (pg *PrivacyGroup) Remove(id string) error {
-	_, ok := pg.members[id]
-	if ok {
+	pg.mutex.Lock()
+	defer pg.mutex.Unlock()
+
+	_, isMember := pg.members[id]
+	_, hasGrant := pg.grants[id]
+	if isMember || hasGrant {
 		delete(pg.members, id)
+		delete(pg.grants, id)
+		pg.changed = time.Now()
 	}
 	return nil
 }
 
+// LastChanged returns the last time the members of the group changed, either because members were added or removed
+// or because a grant started or expired, or its priority was set
+func (pg *PrivacyGroup) LastChanged() time.Time {
+	pg.mutex.RLock()
+	defer pg.mutex.RUnlock()
+
+	now := time.Now()
+	lastChanged := pg.changed
+	for _, g := range pg.grants {
+		for _, t := range []time.Time{g.start, g.expiry} {
+			if !t.IsZero() && !t.After(now) && t.After(lastChanged) {
+				lastChanged = t
+			}
+		}
+	}
+	return lastChanged
+}
+
 func (pg *PrivacyGroup) contains(id string) bool {
+	pg.mutex.RLock()
+	defer pg.mutex.RUnlock()
+
 	in, ok := pg.members[id]
-	return in && ok
+	if in && ok {
+		return true
+	}
+	g, ok := pg.grants[id]
+	return ok && g.activeAt(time.Now())
 }
@@ -3,6 +3,7 @@ package middleware
 import (
 	"github.com/stretchr/testify/require"
 	"testing"
+	"time"
 )
 
 func TestPrivacyGroup_Name(t *testing.T) {
@@ -35,3 +36,47 @@ func TestPrivacyGroup_Remove(t *testing.T) {
 	pg.Remove("alice")
 	require.False(t, pg.contains("alice"))
 }
+
+func TestPrivacyGroup_Grant(t *testing.T) {
+	pg := NewPrivacyGroup("g1")
+	now := time.Now()
+
+	pg.Grant("current", now.Add(-time.Hour), now.Add(time.Hour))
+	pg.Grant("future", now.Add(time.Hour), time.Time{})
+	pg.Grant("expired", time.Time{}, now.Add(-time.Hour))
+	pg.Grant("forever", time.Time{}, time.Time{})
+
+	require.True(t, pg.contains("current"))
+	require.False(t, pg.contains("future"))
+	require.False(t, pg.contains("expired"))
+	require.True(t, pg.contains("forever"))
+}
+
+func TestPrivacyGroup_Grant_Expires(t *testing.T) {
+	pg := NewPrivacyGroup("g1")
+	pg.Grant("contractor", time.Time{}, time.Now().Add(50*time.Millisecond))
+	require.True(t, pg.contains("contractor"))
+	granted := pg.LastChanged()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// The expiry is reflected in when the group last changed without any call to Remove
+	require.False(t, pg.contains("contractor"))
+	require.True(t, pg.LastChanged().After(granted))
+}
+
+func TestPrivacyGroup_Remove_Grant(t *testing.T) {
+	pg := NewPrivacyGroup("g1")
+	pg.Grant("contractor", time.Time{}, time.Now().Add(time.Hour))
+	granted := pg.LastChanged()
+
+	time.Sleep(time.Millisecond)
+	pg.Remove("contractor")
+	require.False(t, pg.contains("contractor"))
+	require.True(t, pg.LastChanged().After(granted))
+
+	// Permanent members are not affected by grants expiring
+	pg.Add("alice")
+	pg.Grant("alice", time.Time{}, time.Now().Add(-time.Hour))
+	require.True(t, pg.contains("alice"))
+}
@@ -2,14 +2,16 @@ package middleware
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/go-sql-driver/mysql"
 	"github.com/xwb1989/sqlparser"
 	"log"
-	"math/rand"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -17,6 +19,20 @@ import (
 
 const batchSize = 1000
 
+// mysqlDriverName is the name the MySQL driver is registered under
+const mysqlDriverName = "pam_mysql"
+
+// privacyBudgetTableName is the table privacy budgets are recorded in if a DifferentialPrivacyPolicy has no store
+const privacyBudgetTableName = "pam_privacy_budgets"
+
+// tableVersionsTableName is the table in which the middleware records when tables were created or last updated for
+// databases which do not record this themselves
+const tableVersionsTableName = "pam_table_versions"
+
+// builtTablesTableName is the table in which the middleware records the cached transformed tables it has built and
+// when, so that the tables a process leaves behind can be told apart from tables it did not create
+const builtTablesTableName = "pam_transformed_tables"
+
 // PrivateRelationalDatabase wraps an SQL database and edits queries so that they operate
 // over tables adjusted to match privacy policies
 type PrivateRelationalDatabase interface {
@@ -26,8 +42,11 @@ type PrivateRelationalDatabase interface {
 	QueryContext(ctx context.Context, query string, requestPolicy *RequestPolicy, args ...interface{}) (*sql.Rows, error)
 	QueryRow(query string, requestPolicy *RequestPolicy, args ...interface{}) (*sql.Row, error)
 	QueryRowContext(ctx context.Context, query string, requestPolicy *RequestPolicy, args ...interface{}) (*sql.Row, error)
-	Exec(ctx context.Context, query string, requestPolicy *RequestPolicy, args ...interface{}) (sql.Result, error)
+	Exec(query string, requestPolicy *RequestPolicy, args ...interface{}) (sql.Result, error)
 	ExecContext(ctx context.Context, query string, requestPolicy *RequestPolicy, args ...interface{}) (sql.Result, error)
+	Begin(requestPolicy *RequestPolicy) (*Tx, error)
+	BeginTx(ctx context.Context, requestPolicy *RequestPolicy, opts *sql.TxOptions) (*Tx, error)
+	Prepare(query string) (*Stmt, error)
 	Stats() sql.DBStats
 	SetConnMaxLifetime(d time.Duration)
 	SetMaxOpenConns(n int)
@@ -36,6 +55,10 @@ type PrivateRelationalDatabase interface {
 	PingContext(ctx context.Context) error
 }
 
+func init() {
+	sql.Register(mysqlDriverName, &afterRowsClosedDriver{Driver: &mysql.MySQLDriver{}})
+}
+
 type mutexMap struct {
 	sync.Mutex
 	rawMutexMap map[string]*sync.Mutex
@@ -59,28 +82,202 @@ func (m *mutexMap) GetMutex(key string) *sync.Mutex {
 	return mutex
 }
 
-// MySQLPrivateDatabase is a wrapper around a MySQL database which implements the PrivateRelationalDatabase interface,
-// it supports DataPolicies which specify transforms for columns and excluded columns on a per PrivacyGroup basis
-type MySQLPrivateDatabase struct {
-	DataPolicy   DataPolicy
-	CacheTables  bool
+// privateDatabase holds the fields shared by the PrivateRelationalDatabase implementations and rewrites their queries
+// to apply the policies. Each implementation is defined as a privateDatabase, so that they are configured in the same
+// way, and supplies the sqlDialect of its database.
+type privateDatabase struct {
+	DataPolicy  DataPolicy
+	CacheTables bool
+	// Cache limits the transformed tables which are kept when CacheTables is set, if it is not set when the database
+	// connects an unlimited TableCache is used
+	Cache *TableCache
+	// DifferentialPrivacy, if set, answers read queries from requesters in its privacy groups with differentially
+	// private aggregate results
+	DifferentialPrivacy *DifferentialPrivacyPolicy
+	// Consent, if set, removes rows about data subjects who have opted out from the tables built for requesters
+	Consent      *ConsentRegistry
 	database     *sql.DB
 	databaseName string
+	dialect      sqlDialect
 	tableMutexes mutexMap
 }
 
+// MySQLPrivateDatabase is a wrapper around a MySQL database which implements the PrivateRelationalDatabase interface,
+// it supports DataPolicies which specify transforms for columns and excluded columns on a per PrivacyGroup basis.
+// It is configured by setting its DataPolicy, CacheTables, Cache, DifferentialPrivacy and Consent fields.
+//
+// Without CacheTables each query builds its transformed tables as temporary tables on a connection of its own, which
+// are dropped when its rows are closed. MySQL cannot read a temporary table twice in one query, so queries which read
+// a transformed table more than once, such as self joins, need CacheTables to be set.
+type MySQLPrivateDatabase privateDatabase
+
+func (mspd *MySQLPrivateDatabase) core() *privateDatabase {
+	return (*privateDatabase)(mspd)
+}
+
 // Connect opens the connection to the MySQL database
 func (mspd *MySQLPrivateDatabase) Connect(user, password, databaseName, uri string, port int) error {
-	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?parseTime=true&loc=UTC&interpolateParams=true", user, password, uri, port, databaseName))
+	db, err := sql.Open(mysqlDriverName, fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?parseTime=true&loc=UTC&interpolateParams=true", user, password, uri, port, databaseName))
+	if err != nil {
+		return err
+	}
+	return mspd.core().connect(db, databaseName, mysqlDialect{})
+}
+
+// connect sets up the middleware's own tables in a newly opened database
+func (pd *privateDatabase) connect(db *sql.DB, databaseName string, dialect sqlDialect) error {
+	pd.database = db
+	pd.databaseName = databaseName
+	pd.dialect = dialect
+
+	err := dialect.prepare(db)
 	if err != nil {
 		return err
 	}
 
-	mspd.database = db
-	mspd.databaseName = databaseName
+	if pd.Consent != nil {
+		err = pd.Consent.createTable(db, dialect)
+		if err != nil {
+			return err
+		}
+	}
+
+	if pd.Cache == nil {
+		pd.Cache = &TableCache{}
+	}
+	if pd.CacheTables {
+		_, err = db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (table_name VARCHAR(255) NOT NULL PRIMARY KEY, "+
+			"built_at BIGINT NOT NULL)", builtTablesTableName))
+		if err != nil {
+			return err
+		}
+
+		err = pd.trackTableUpdates(context.Background())
+		if err != nil {
+			return err
+		}
+
+		// Tables left by a process which has stopped are dropped once they have expired, as another process may still
+		// be using the others. Those which are kept are rebuilt before they are used if the policies have changed.
+		err = pd.dropExpiredTables(time.Now())
+		if err != nil {
+			log.Printf("PAM: failed to drop the expired transformed tables of other processes: %s", err.Error())
+		}
+		err = pd.dropOrphanedTables(context.Background())
+		if err != nil {
+			log.Printf("PAM: failed to drop orphaned transformed tables: %s", err.Error())
+		}
+	}
+
+	// Warn about tables which no policy covers, failing to check should not stop us from connecting
+	pd.warnUncoveredTables()
+	return nil
+}
+
+// trackTableUpdates sets every table whose updates decide whether cached tables are valid up so that the dialect can
+// tell when it changes, these are the tables requesters query and the consent registry
+func (pd *privateDatabase) trackTableUpdates(ctx context.Context) error {
+	tableNames, err := pd.tableNames(ctx)
+	if err != nil {
+		return err
+	}
+	for _, tableName := range tableNames {
+		consentTable := pd.Consent != nil && strings.EqualFold(tableName, pd.Consent.tableName())
+		if pd.internalTable(tableName) && !consentTable {
+			continue
+		}
+		err = pd.dialect.trackUpdates(pd.database, pd.databaseName, tableName)
+		if err != nil {
+			return fmt.Errorf("failed to track updates to table %s: %s", tableName, err.Error())
+		}
+	}
 	return nil
 }
 
+// internalTable returns whether the middleware created the table for its own use, such as the consent registry, the
+// privacy budgets and the transformed tables, which requesters cannot query as they hold other requesters' data
+func (pd *privateDatabase) internalTable(tableName string) bool {
+	lowered := strings.ToLower(tableName)
+	return strings.HasPrefix(lowered, "pam_") || strings.HasPrefix(lowered, "transformed_") ||
+		pd.dialect.internalTable(tableName) || (pd.Consent != nil && strings.EqualFold(tableName, pd.Consent.tableName()))
+}
+
+// UncoveredTables returns the tables in the database which the DataPolicy has no TableOperations for, all of their
+// columns and rows are visible to any requester the policy resolves. The DataPolicy must implement CoverageReporter.
+func (mspd *MySQLPrivateDatabase) UncoveredTables(ctx context.Context) ([]string, error) {
+	return mspd.core().uncoveredTables(ctx)
+}
+
+func (pd *privateDatabase) uncoveredTables(ctx context.Context) ([]string, error) {
+	coverageReporter, ok := pd.DataPolicy.(CoverageReporter)
+	if !ok {
+		return nil, errors.New("the data policy cannot report which tables it covers")
+	}
+	coveredTables := coverageReporter.CoveredTables()
+
+	tableNames, err := pd.tableNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var uncoveredTables []string
+	for _, tableName := range tableNames {
+		// Ignore the tables we create
+		if pd.internalTable(tableName) {
+			continue
+		}
+		if !contains(coveredTables, tableName) {
+			uncoveredTables = append(uncoveredTables, tableName)
+		}
+	}
+	return uncoveredTables, nil
+}
+
+// tableNames returns the names of all of the tables in the database
+func (pd *privateDatabase) tableNames(ctx context.Context) ([]string, error) {
+	query, args := pd.dialect.tablesQuery(pd.databaseName)
+	rows, err := pd.database.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var (
+		tableName  string
+		tableNames []string
+	)
+	for rows.Next() {
+		err := rows.Scan(&tableName)
+		if err != nil {
+			return nil, err
+		}
+		tableNames = append(tableNames, tableName)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return tableNames, nil
+}
+
+func (pd *privateDatabase) warnUncoveredTables() {
+	if _, ok := pd.DataPolicy.(CoverageReporter); !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	uncoveredTables, err := pd.uncoveredTables(ctx)
+	if err != nil {
+		log.Printf("PAM: could not check which tables the data policy covers: %s", err.Error())
+		return
+	}
+	for _, tableName := range uncoveredTables {
+		log.Printf("PAM: warning: no data policy covers table %s, all of its columns are visible", tableName)
+	}
+}
+
 // Close closes the connection to the MySQL database
 func (mspd *MySQLPrivateDatabase) Close() error {
 	err := mspd.database.Close()
@@ -96,29 +293,153 @@ func (mspd *MySQLPrivateDatabase) Query(query string, requestPolicy *RequestPoli
 // QueryContext takes a query string and a RequestPolicy and resolves the DataPolicy from the MySQLPrivateDatabase with the
 // request policy to give a globalResult to the query on transformed versions of the actual database tables
 func (mspd *MySQLPrivateDatabase) QueryContext(ctx context.Context, query string, requestPolicy *RequestPolicy, args ...interface{}) (*sql.Rows, error) {
+	return mspd.core().queryContext(ctx, queryOptions{}, query, requestPolicy, args...)
+}
+
+// queryOptions are how a query is run, the zero queryOptions runs it on its own
+type queryOptions struct {
+	// tx is the session of the transaction the query is run in, if any
+	tx *querySession
+	// rewrites holds the queries rewritten for the prepared statement which is run, if any
+	rewrites *rewriteCache
+}
+
+// session returns the session a query is run in, which is nil if it is not run in a transaction and transformed tables
+// are cached
+func (pd *privateDatabase) session(ctx context.Context, options queryOptions) (*querySession, error) {
+	if options.tx != nil {
+		return options.tx, nil
+	}
+	return pd.newQuerySession(ctx)
+}
+
+func (pd *privateDatabase) queryContext(ctx context.Context, options queryOptions, query string, requestPolicy *RequestPolicy, args ...interface{}) (*sql.Rows, error) {
+	if pd.usesDifferentialPrivacy(requestPolicy) {
+		resultQuery, results, err := pd.differentiallyPrivateQuery(ctx, query, requestPolicy, args...)
+		if err != nil {
+			return nil, err
+		}
+		return pd.database.QueryContext(ctx, resultQuery, results...)
+	}
+
+	session, err := pd.session(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+
 	// Transform tables
-	transformedQuery, transformedTableNames, err := mspd.transformQuery(query, requestPolicy)
+	ctx, started := pd.trackReads(ctx)
+	defer started()
+	transformedQuery, args, err := pd.transformQuery(ctx, session, options.rewrites, query, args, requestPolicy)
 	if err != nil {
+		session.discard()
 		return nil, err
 	}
 
-	// Execute query
-	rows, err := mspd.database.QueryContext(ctx, transformedQuery, args...)
+	// Execute query, the session's temporary tables are dropped when the rows are closed
+	rows, err := pd.runner(session).QueryContext(session.dropAfterRowsClosed(ctx), transformedQuery, args...)
 	if err != nil {
+		session.discard()
 		return nil, err
 	}
+	session.closeAfterRows()
+	return rows, nil
+}
 
-	if !mspd.CacheTables {
-		// Drop the tables we created
-		for _, table := range transformedTableNames {
-			err = mspd.dropTableIfExists(table)
-			if err != nil {
-				return nil, err
-			}
+// sqlRunner runs statements on a database, it is implemented by sql.DB and by sql.Conn so that tables can be built on
+// the connection of the query which reads them
+type sqlRunner interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// querySession is a connection of its own which a query runs on when transformed tables are not cached. The tables
+// transformed for the query are temporary tables on the connection, which no other connection can see and which the
+// database drops itself if the connection is lost. A transaction is a session shared by each of its queries, whose
+// tables are dropped when it ends rather than after each query.
+type querySession struct {
+	conn            *sql.Conn
+	tx              *sql.Tx
+	dialect         sqlDialect
+	temporaryTables []string
+}
+
+// newQuerySession returns a session for a query, or nil if transformed tables are cached and shared between queries
+func (pd *privateDatabase) newQuerySession(ctx context.Context) (*querySession, error) {
+	if pd.CacheTables {
+		return nil, nil
+	}
+	conn, err := pd.database.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &querySession{conn: conn, dialect: pd.dialect}, nil
+}
+
+// runner returns the connection or transaction of the session, or the database if there is no session
+func (pd *privateDatabase) runner(session *querySession) sqlRunner {
+	switch {
+	case session == nil:
+		return pd.database
+	case session.tx != nil:
+		return session.tx
+	}
+	return session.conn
+}
+
+// dropAfterRowsClosed returns a context for running the session's query which makes the driver drop the session's
+// temporary tables once the query's rows are closed
+func (s *querySession) dropAfterRowsClosed(ctx context.Context) context.Context {
+	if s == nil || s.tx != nil || len(s.temporaryTables) == 0 {
+		return ctx
+	}
+	dropStatements := make([]string, len(s.temporaryTables))
+	for i, table := range s.temporaryTables {
+		dropStatements[i] = s.dialect.dropTemporaryTableSQL(table)
+	}
+	return context.WithValue(ctx, afterRowsClosedKey{}, dropStatements)
+}
+
+// closeAfterRows returns the session's connection to the pool once the rows of its query have been closed, which
+// drops its temporary tables
+func (s *querySession) closeAfterRows() {
+	if s == nil || s.tx != nil {
+		return
+	}
+	// Closing a sql.Conn waits for the rows read from it to be closed
+	go s.conn.Close()
+}
+
+// close drops the session's temporary tables and returns its connection to the pool, the session of a transaction is
+// left open until the transaction ends
+func (s *querySession) close() error {
+	if s == nil || s.tx != nil {
+		return nil
+	}
+	defer s.conn.Close()
+	return s.dropTemporaryTables(s.conn)
+}
+
+// dropTemporaryTables drops the session's temporary tables using its connection or transaction
+func (s *querySession) dropTemporaryTables(db sqlRunner) error {
+	for _, table := range s.temporaryTables {
+		_, err := db.ExecContext(context.Background(), s.dialect.dropTemporaryTableSQL(table))
+		if err != nil {
+			return err
 		}
 	}
+	s.temporaryTables = nil
+	return nil
+}
 
-	return rows, nil
+// discard closes the session of a query which failed, the error of the query matters more than any error dropping
+// the tables so these are only logged
+func (s *querySession) discard() {
+	err := s.close()
+	if err != nil {
+		log.Printf("PAM: failed to drop temporary tables: %s", err.Error())
+	}
 }
 
 // QueryRow takes a query string and a RequestPolicy and resolves the DataPolicy from the MySQLPrivateDatabase with the
@@ -130,25 +451,40 @@ func (mspd *MySQLPrivateDatabase) QueryRow(query string, requestPolicy *RequestP
 // QueryRowContext takes a query string and a RequestPolicy and resolves the DataPolicy from the MySQLPrivateDatabase with the
 // request policy to give a globalResult to the query on transformed versions of the actual database tables
 func (mspd *MySQLPrivateDatabase) QueryRowContext(ctx context.Context, query string, requestPolicy *RequestPolicy, args ...interface{}) (*sql.Row, error) {
-	// Transform tables
-	transformedQuery, transformedTableNames, err := mspd.transformQuery(query, requestPolicy)
+	return mspd.core().queryRowContext(ctx, queryOptions{}, query, requestPolicy, args...)
+}
+
+func (pd *privateDatabase) queryRowContext(ctx context.Context, options queryOptions, query string, requestPolicy *RequestPolicy, args ...interface{}) (*sql.Row, error) {
+	if pd.usesDifferentialPrivacy(requestPolicy) {
+		resultQuery, results, err := pd.differentiallyPrivateQuery(ctx, query, requestPolicy, args...)
+		if err != nil {
+			return nil, err
+		}
+		return pd.database.QueryRowContext(ctx, resultQuery, results...), nil
+	}
+
+	session, err := pd.session(ctx, options)
 	if err != nil {
 		return nil, err
 	}
 
-	// Execute query
-	row := mspd.database.QueryRowContext(ctx, transformedQuery, args...)
-
-	if !mspd.CacheTables {
-		// Drop the tables we created
-		for _, table := range transformedTableNames {
-			err = mspd.dropTableIfExists(table)
-			if err != nil {
-				return nil, err
-			}
-		}
+	// Transform tables
+	ctx, started := pd.trackReads(ctx)
+	defer started()
+	transformedQuery, args, err := pd.transformQuery(ctx, session, options.rewrites, query, args, requestPolicy)
+	if err != nil {
+		session.discard()
+		return nil, err
 	}
 
+	// Execute query, the session's temporary tables are dropped when the row is scanned
+	row := pd.runner(session).QueryRowContext(session.dropAfterRowsClosed(ctx), transformedQuery, args...)
+	if row.Err() != nil {
+		// There are no rows to drop the tables when they are closed
+		session.discard()
+	} else {
+		session.closeAfterRows()
+	}
 	return row, nil
 }
 
@@ -161,29 +497,73 @@ func (mspd *MySQLPrivateDatabase) Exec(query string, requestPolicy *RequestPolic
 // ExecContext takes a query string and a RequestPolicy and resolves the DataPolicy from the MySQLPrivateDatabase with the
 // request policy to give a globalResult to the query on transformed versions of the actual database tables
 func (mspd *MySQLPrivateDatabase) ExecContext(ctx context.Context, query string, requestPolicy *RequestPolicy, args ...interface{}) (sql.Result, error) {
+	return mspd.core().execContext(ctx, queryOptions{}, query, requestPolicy, args...)
+}
+
+// Begin begins a transaction whose statements are run for the requester of the request policy
+func (mspd *MySQLPrivateDatabase) Begin(requestPolicy *RequestPolicy) (*Tx, error) {
+	return mspd.BeginTx(context.Background(), requestPolicy, nil)
+}
+
+// BeginTx begins a transaction whose statements are run for the requester of the request policy, see sql.DB.BeginTx
+func (mspd *MySQLPrivateDatabase) BeginTx(ctx context.Context, requestPolicy *RequestPolicy, opts *sql.TxOptions) (*Tx, error) {
+	return mspd.core().beginTx(ctx, requestPolicy, opts)
+}
+
+// Prepare returns a prepared statement for a query which can be run for any request policy
+func (mspd *MySQLPrivateDatabase) Prepare(query string) (*Stmt, error) {
+	return mspd.core().prepare(query)
+}
+
+func (pd *privateDatabase) execContext(ctx context.Context, options queryOptions, query string, requestPolicy *RequestPolicy, args ...interface{}) (sql.Result, error) {
+	session, err := pd.session(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+
 	// Transform tables
-	transformedQuery, transformedTableNames, err := mspd.transformQuery(query, requestPolicy)
+	transformedQuery, args, err := pd.transformQuery(ctx, session, options.rewrites, query, args, requestPolicy)
 	if err != nil {
+		session.discard()
 		return nil, err
 	}
 
 	// Execute query
-	result, err := mspd.database.ExecContext(ctx, transformedQuery, args...)
+	result, err := pd.runner(session).ExecContext(ctx, transformedQuery, args...)
 	if err != nil {
+		session.discard()
 		return nil, err
 	}
+	return result, session.close()
+}
 
-	if !mspd.CacheTables {
-		// Drop the tables we created
-		for _, table := range transformedTableNames {
-			err = mspd.dropTableIfExists(table)
-			if err != nil {
-				return nil, err
-			}
-		}
-	}
+// Explain describes the TableOperations which apply to the requester of the request policy and, if a query is given,
+// how it would be rewritten. If there is no query every table the TableOperations refer to is explained. Explain is
+// meant for administrators, unlike the errors returned to requesters it says why access is restricted. It returns
+// the same errors as running the query would, such as ErrAccessDenied, and does not build any transformed tables.
+func (mspd *MySQLPrivateDatabase) Explain(query string, requestPolicy *RequestPolicy) (*Explanation, error) {
+	return mspd.core().explain(query, requestPolicy)
+}
+
+// Validate checks every table and column the DataPolicy and consent registry refer to against the database. It reports
+// references to unknown tables and columns, operations which are never applied and transforms which fail on a sample
+// value of the column's data type. Transforms are called once with the sample value to check this. An error is only
+// returned if the policy cannot be checked, the DataPolicy must implement OperationsReporter.
+func (mspd *MySQLPrivateDatabase) Validate(ctx context.Context) ([]PolicyProblem, error) {
+	return mspd.core().validate(ctx)
+}
+
+// OptOut records that the data subject has opted out of their data being seen by the requester for the purpose, an
+// empty requesterID or purpose opts out of every requester or purpose. Cached transformed tables are rebuilt the
+// next time they are used.
+func (mspd *MySQLPrivateDatabase) OptOut(ctx context.Context, subjectKey string, requesterID string,
+	purpose string) error {
+	return mspd.core().optOut(ctx, subjectKey, requesterID, purpose)
+}
 
-	return result, nil
+// OptIn removes every opt-out recorded for the data subject
+func (mspd *MySQLPrivateDatabase) OptIn(ctx context.Context, subjectKey string) error {
+	return mspd.core().optIn(ctx, subjectKey)
 }
 
 // Stats returns database statistics
@@ -238,165 +618,450 @@ func (mspd *MySQLPrivateDatabase) PingContext(ctx context.Context) error {
 	return mspd.database.PingContext(ctx)
 }
 
-func (mspd *MySQLPrivateDatabase) transformQuery(query string, requestPolicy *RequestPolicy) (string, []string, error) {
-	// Parse query
-	stmt, err := sqlparser.Parse(query)
+func (pd *privateDatabase) usesDifferentialPrivacy(requestPolicy *RequestPolicy) bool {
+	return pd.DifferentialPrivacy != nil && pd.DifferentialPrivacy.appliesTo(requesterIDOrAnonymous(requestPolicy))
+}
+
+// differentiallyPrivateQuery spends from the requester's privacy budget and computes noisy results for an aggregate
+// query. It returns a query and arguments which select these results so that they can be returned as rows.
+func (pd *privateDatabase) differentiallyPrivateQuery(ctx context.Context, query string,
+	requestPolicy *RequestPolicy, args ...interface{}) (string, []interface{}, error) {
+	dp := pd.DifferentialPrivacy
+	err := dp.validate()
 	if err != nil {
 		return "", nil, err
 	}
 
-	// Get all statements in the query
-	var statements []sqlparser.Statement
-	err = sqlparser.Walk(
-		func(node sqlparser.SQLNode) (kcontinue bool, err error) {
-			switch node := node.(type) {
-			case sqlparser.Statement:
-				statements = append(statements, node)
-			}
-			return true, nil
-		}, stmt)
+	query, args, err = pd.dialect.normaliseQuery(query, args)
 	if err != nil {
 		return "", nil, err
 	}
-
-	// Transform tables if the query only reads,
-	// don't transform them but check for excluded column access if it only writes,
-	// error if the query both reads and writes (the user needs to separate these queries)
-	queryReads := false
-	queryWrites := false
-
-	for _, s := range statements {
-		switch s.(type) {
-		case *sqlparser.Select:
-			queryReads = true
-		case *sqlparser.Update:
-			queryWrites = true
-		case *sqlparser.Insert:
-			queryWrites = true
-		case *sqlparser.Delete:
-			queryWrites = true
-		}
+	plan, err := dp.plan(query)
+	if err != nil {
+		return "", nil, err
 	}
 
-	if queryReads && queryWrites {
-		return "", nil, errors.New("cannot support SQL which both reads and writes to the database")
+	// Spend the budget before running the query so that concurrent queries cannot overspend
+	budgetStore, err := pd.privacyBudgetStore()
+	if err != nil {
+		return "", nil, err
 	}
-
-	// Get all tables in query
-	var tableNames []string
-	err = sqlparser.Walk(
-		func(node sqlparser.SQLNode) (kcontinue bool, err error) {
-			switch node := node.(type) {
-			case sqlparser.TableName:
-				tableName := node.Name.String()
-				if tableName != "" {
-					tableNames = append(tableNames, node.Name.String())
-				}
-			}
-			return true, nil
-		}, stmt)
+	err = budgetStore.Spend(requesterIDOrAnonymous(requestPolicy), dp.EpsilonPerQuery, dp.Budget)
 	if err != nil {
 		return "", nil, err
 	}
 
-	var transformedTableNames []string
+	// The data policy still applies to the tables the aggregates are computed over
+	session, err := pd.newQuerySession(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	readCtx, started := pd.trackReads(ctx)
+	defer started()
+	transformedQuery, err := pd.rewriteQuery(readCtx, session, plan.query, args, requestPolicy)
+	if err == nil && transformedQuery == "" {
+		transformedQuery, err = pd.dialect.nativeSQL(plan.query)
+	}
+	if err != nil {
+		session.discard()
+		return "", nil, err
+	}
 
-	groupPrefix := fmt.Sprintf("transformed_%s_", requestPolicy.RequesterID)
-	for _, tableName := range tableNames {
-		if queryReads {
-			// Create a version of the table with the privacy policy applied
-			tableOperations, err := mspd.DataPolicy.Resolve(requestPolicy.RequesterID)
-			if err != nil {
-				return "", nil, err
-			}
-			transformedTableName, err := mspd.transformTable(tableName, groupPrefix, tableOperations.TableTransforms[tableName], tableOperations.ExcludedCols[tableName])
-			if err != nil {
-				return "", nil, err
-			}
+	raw := make([]sql.NullFloat64, plan.rawColumns)
+	scanArgs := make([]interface{}, len(raw))
+	for i := range raw {
+		scanArgs[i] = &raw[i]
+	}
+	err = pd.runner(session).QueryRowContext(ctx, transformedQuery, args...).Scan(scanArgs...)
+	if err != nil {
+		session.discard()
+		return "", nil, err
+	}
+	err = session.close()
+	if err != nil {
+		return "", nil, err
+	}
 
-			transformedTableNames = append(transformedTableNames, transformedTableName)
+	resultQuery, err := pd.dialect.nativeSQL(plan.resultQuery())
+	if err != nil {
+		return "", nil, err
+	}
+	return resultQuery, plan.noisyResults(raw, dp.EpsilonPerQuery, dp.noise), nil
+}
 
-			// Replace table name with transformed table name in query
-			regexString := fmt.Sprintf("\\b%s\\b", tableName)
-			re := regexp.MustCompile(regexString)
-			query = re.ReplaceAllString(query, transformedTableName)
-		} else if queryWrites {
-			tableOperations, err := mspd.DataPolicy.Resolve(requestPolicy.RequesterID)
-			if err != nil {
-				return "", nil, err
-			}
+func (pd *privateDatabase) privacyBudgetStore() (PrivacyBudgetStore, error) {
+	dp := pd.DifferentialPrivacy
+	dp.budgetStoreMutex.Lock()
+	defer dp.budgetStoreMutex.Unlock()
 
-			err = mspd.checkForExcludedColumns(tableName, tableOperations.ExcludedCols[tableName])
-			if err != nil {
-				return "", nil, err
-			}
-		} else {
-			return "", nil, errors.New("unsupported query")
+	// Default to persisting budgets in the database being queried
+	if dp.BudgetStore == nil {
+		store, err := pd.dialect.privacyBudgetStore(pd.database, privacyBudgetTableName)
+		if err != nil {
+			return nil, err
 		}
+		dp.BudgetStore = store
 	}
-	return query, transformedTableNames, nil
+	return dp.BudgetStore, nil
 }
 
-func (mspd *MySQLPrivateDatabase) checkForExcludedColumns(tableName string, excludedColumns []string) error {
-	// Get the columns in the table
-	columnNamesString := fmt.Sprintf("SELECT column_name, data_type FROM information_schema.columns WHERE table_name='%s';", tableName)
-	columnNames, err := mspd.database.Query(columnNamesString)
+// transformQuery rewrites a query to read the tables with the policy applied, it returns the query to run with its
+// arguments. Transformed tables which are not cached are built in the session. Queries which need no rewriting run as
+// they were written. The queries of a prepared statement are rewritten using its rewriteCache.
+func (pd *privateDatabase) transformQuery(ctx context.Context, session *querySession, rewrites *rewriteCache,
+	query string, args []interface{}, requestPolicy *RequestPolicy) (string, []interface{}, error) {
+	parsedQuery, parsedArgs, err := pd.dialect.normaliseQuery(query, args)
 	if err != nil {
-		return err
+		return "", nil, err
 	}
-	defer columnNames.Close()
+	var transformedQuery string
+	if rewrites != nil {
+		transformedQuery, err = pd.rewritePreparedQuery(ctx, session, rewrites, parsedQuery, parsedArgs, requestPolicy)
+	} else {
+		transformedQuery, err = pd.rewriteQuery(ctx, session, parsedQuery, parsedArgs, requestPolicy)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if transformedQuery == "" {
+		return query, args, nil
+	}
+	return transformedQuery, parsedArgs, nil
+}
 
-	// Check if any columns which should be excluded are accessed
-	var (
-		colName string
-		colType string
-	)
+// rewriteQuery rewrites a query in the SQL the parser reads to read the tables with the policy applied, or to write
+// only the rows the policy allows. It returns the query written for the database, or an empty string if it was not
+// changed.
+func (pd *privateDatabase) rewriteQuery(ctx context.Context, session *querySession, query string, args []interface{},
+	requestPolicy *RequestPolicy) (string, error) {
+	parsed, err := pd.parseQuery(query)
+	if err != nil {
+		return "", err
+	}
 
-	for columnNames.Next() {
-		err := columnNames.Scan(&colName, &colType)
+	requesterID := requesterIDOrAnonymous(requestPolicy)
+	tableOperations, purpose, err := pd.resolveForQuery(requesterID, requestPolicy)
+	if err != nil {
+		return "", err
+	}
+
+	rewritten, err := pd.rewriteParsedQuery(ctx, session, parsed, args, tableOperations, requesterID, purpose)
+	if err != nil {
+		return "", err
+	}
+	return rewritten.query, nil
+}
+
+// parsedQuery is a query which has been parsed and found to either only read or only write
+type parsedQuery struct {
+	stmt       sqlparser.Statement
+	reads      bool
+	writes     bool
+	tableNames []string
+}
+
+// parseQuery parses a query in the SQL the parser reads
+func (pd *privateDatabase) parseQuery(query string) (*parsedQuery, error) {
+	// Parse query
+	stmt, err := sqlparser.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only queries which read or write rows are supported, so that changes to the schema cannot bypass the policy
+	switch stmt.(type) {
+	case *sqlparser.Select, *sqlparser.Union, *sqlparser.Insert, *sqlparser.Update, *sqlparser.Delete:
+	default:
+		return nil, errors.New("unsupported query")
+	}
+
+	// Get all statements in the query
+	var statements []sqlparser.Statement
+	err = sqlparser.Walk(
+		func(node sqlparser.SQLNode) (kcontinue bool, err error) {
+			switch node := node.(type) {
+			case sqlparser.Statement:
+				statements = append(statements, node)
+			}
+			return true, nil
+		}, stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Transform tables if the query only reads,
+	// don't transform them but check for excluded column access if it only writes,
+	// error if the query both reads and writes (the user needs to separate these queries)
+	parsed := &parsedQuery{stmt: stmt}
+
+	for _, s := range statements {
+		switch s.(type) {
+		case *sqlparser.Select:
+			parsed.reads = true
+		case *sqlparser.Update:
+			parsed.writes = true
+		case *sqlparser.Insert:
+			parsed.writes = true
+		case *sqlparser.Delete:
+			parsed.writes = true
+		}
+	}
+
+	if parsed.reads && parsed.writes {
+		return nil, errors.New("cannot support SQL which both reads and writes to the database")
+	}
+
+	// Get all tables in query
+	parsed.tableNames, err = pd.queryTableNames(stmt)
+	if err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+// resolveForQuery resolves the TableOperations and purpose of a query's requester, like resolve, and drops the tables
+// cached for the requester if they have been denied access
+func (pd *privateDatabase) resolveForQuery(requesterID string, requestPolicy *RequestPolicy) (*TableOperations, string,
+	error) {
+	tableOperations, purpose, err := pd.resolve(requesterID, requestPolicy)
+	if err == ErrAccessDenied && pd.CacheTables {
+		// The requester may have lost access since their tables were cached, so make sure none are left behind
+		dropErr := pd.dropCachedTables(transformedRequesterPrefix(requesterID))
+		if dropErr != nil {
+			log.Printf("PAM: failed to drop cached tables for %s: %s", requesterID, dropErr.Error())
+		}
+	}
+	return tableOperations, purpose, err
+}
+
+// rewrittenQuery is a query rewritten for a requester, with the transformed tables it reads by the name of the table
+// each was transformed from. The query is empty if it was not changed.
+type rewrittenQuery struct {
+	query             string
+	transformedTables map[string]string
+}
+
+// rewriteParsedQuery rewrites a parsed query to read the tables with the requester's TableOperations applied, building
+// the transformed tables it reads, or to write only the rows the requester's WriteFilters allow. The parsed statement
+// is changed, so it cannot be rewritten again.
+func (pd *privateDatabase) rewriteParsedQuery(ctx context.Context, session *querySession, parsed *parsedQuery,
+	args []interface{}, tableOperations *TableOperations, requesterID string, purpose string) (*rewrittenQuery, error) {
+	if tableOperations.AggregatesOnly {
+		err := checkAggregatesOnly(parsed.stmt)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if contains(excludedColumns, colName) {
-			// return an error if we access an excluded column but do not reveal the reason so we don't reveal
-			// information through error messages
-			return fmt.Errorf("ERROR 1054 (42S22): Unknown column '%s'", colName)
+	}
+
+	groupPrefix := transformedTablePrefix(requesterID, purpose)
+	substitutions := make(map[string]tableSubstitution)
+	rewritten := &rewrittenQuery{transformedTables: make(map[string]string)}
+	for _, tableName := range parsed.tableNames {
+		if parsed.reads && tableOperations.inline(tableName) {
+			// The database can apply the policy itself so read the table through a derived table rather than copying it
+			derivedTable, err := pd.derivedTableSQL(tableName, tableOperations, requesterID, purpose)
+			if err != nil {
+				return nil, err
+			}
+			substitutions[tableName] = tableSubstitution{derivedTable: derivedTable}
+		} else if parsed.reads {
+			// Create a version of the table with the privacy policy applied
+			transformedTableName, err := pd.transformTable(ctx, session, tableName, groupPrefix, tableOperations,
+				requesterID, purpose)
+			if err != nil {
+				return nil, err
+			}
+
+			substitutions[tableName] = tableSubstitution{transformedTable: transformedTableName}
+			rewritten.transformedTables[tableName] = transformedTableName
+		} else if !parsed.writes {
+			return nil, errors.New("unsupported query")
 		}
 	}
 
-	if columnNames.Err() != nil {
-		return columnNames.Err()
+	if parsed.writes {
+		// Writes go to the original tables so must not refer to the columns hidden in them
+		err := pd.checkWriteColumns(parsed.stmt, parsed.tableNames, tableOperations)
+		if err != nil {
+			return nil, err
+		}
+		err = pd.checkInsertedRows(ctx, session, parsed.stmt, args, tableOperations, requesterID)
+		if err != nil {
+			return nil, err
+		}
+		constrained, err := pd.constrainWrite(parsed.stmt, args, tableOperations, requesterID, purpose)
+		if err != nil {
+			return nil, err
+		}
+		if constrained {
+			rewritten.query = formatDialectSQL(parsed.stmt, pd.dialect)
+		}
+	}
+
+	// Replace the tables with their transformed versions in the query
+	if len(substitutions) == 0 {
+		return rewritten, nil
+	}
+	var err error
+	rewritten.query, err = pd.substituteTables(parsed.stmt, substitutions)
+	if err != nil {
+		return nil, err
+	}
+	return rewritten, nil
+}
+
+// transformedTablePrefix returns the prefix of the names of the tables transformed for the requester and purpose.
+// Tables transformed for a purpose are kept separate as the same requester can see different data for each. The
+// purpose is written as a fingerprint, like the requester's ID, or 0 if there is none.
+func transformedTablePrefix(requesterID string, purpose string) string {
+	if purpose != "" {
+		return fmt.Sprintf("%s%s_", transformedRequesterPrefix(requesterID), tableNameFingerprint(purpose))
+	}
+	return transformedRequesterPrefix(requesterID) + "0_"
+}
+
+// transformedRequesterPrefix returns the prefix of the names of the tables transformed for the requester for any
+// purpose. The requester's ID is written as a fingerprint of fixed length, so that no other requester's tables have
+// the prefix, even those of requesters whose IDs begin with the requester's or differ only in case, which databases
+// which fold table names would otherwise give the same tables.
+func transformedRequesterPrefix(requesterID string) string {
+	return fmt.Sprintf("transformed_%s_", tableNameFingerprint(requesterID))
+}
+
+// tableNameFingerprint returns a fingerprint of a value which can be written in a table name, it only has lower case
+// letters and digits so that it is the same in any database however table names are folded
+func tableNameFingerprint(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// sharedTableName returns the name of the cached transformed table of a table which is shared by every requester
+// whose operations on the table and rows of it are the same, it returns false if the table cannot be shared. The name
+// holds a fingerprint of the visible columns, the transforms and the condition rows must satisfy, which includes the
+// requester or purpose if the rows they can see depend on them.
+func (pd *privateDatabase) sharedTableName(tableName string, tableOperations *TableOperations, requesterID string,
+	purpose string) (string, bool, error) {
+	if len(tableOperations.RowTransforms[tableName]) > 0 {
+		return "", false, nil
+	}
+
+	fingerprint := sha256.New()
+	write := func(parts ...string) {
+		for _, part := range parts {
+			// Each part is prefixed with its length so that no two lists of parts are written the same way
+			fmt.Fprintf(fingerprint, "%d:%s", len(part), part)
+		}
+	}
+	write("table", tableName)
+	if allowedCols, ok := tableOperations.AllowedCols[tableName]; ok {
+		write("allowed", strconv.Itoa(len(allowedCols)))
+		write(sortedStrings(allowedCols)...)
+	}
+	excludedCols := tableOperations.ExcludedCols[tableName]
+	write("excluded", strconv.Itoa(len(excludedCols)))
+	write(sortedStrings(excludedCols)...)
+
+	for _, col := range tableOperations.transformedColumns(tableName) {
+		if _, ok := tableOperations.TableTransforms[tableName][col]; ok {
+			transformID, ok := tableOperations.TransformIDs[tableName][col]
+			if !ok {
+				return "", false, nil
+			}
+			write("transform", col, transformID)
+		}
+		if transform, ok := tableOperations.SQLTransforms[tableName][col]; ok {
+			write("sql", col, transform(fmt.Sprintf("`%s`", col)))
+		}
+	}
+
+	rowFilter, rowFilterArgs, err := pd.rowFilter(tableName, tableOperations, requesterID, purpose)
+	if err != nil {
+		return "", false, err
+	}
+	write("filter", rowFilter, strconv.Itoa(len(rowFilterArgs)))
+	for _, arg := range rowFilterArgs {
+		write(fmt.Sprintf("%T:%v", arg, arg))
+	}
+
+	return fmt.Sprintf("transformed_shared_%s_%s", hex.EncodeToString(fingerprint.Sum(nil))[:16], tableName), true,
+		nil
+}
+
+// resolve returns the TableOperations for the requester and, if the DataPolicy is a PurposeAwareDataPolicy, the
+// purpose of the request. The purpose is returned if it was used to resolve the operations.
+func (pd *privateDatabase) resolve(requesterID string, requestPolicy *RequestPolicy) (*TableOperations, string, error) {
+	purposeAwareDataPolicy, ok := pd.DataPolicy.(PurposeAwareDataPolicy)
+	if !ok || requestPolicy == nil || requestPolicy.Purpose == "" {
+		tableOperations, err := pd.DataPolicy.Resolve(requesterID)
+		return tableOperations, "", err
+	}
+
+	// The purpose is used in the names of transformed tables
+	purpose := requestPolicy.Purpose
+	if !identifierRegexp.MatchString(purpose) {
+		return nil, "", fmt.Errorf("%q is not a valid purpose", purpose)
+	}
+	tableOperations, err := purposeAwareDataPolicy.ResolvePurpose(requesterID, purpose)
+	return tableOperations, purpose, err
+}
+
+// checkWriteColumns returns an error if a write refers to a column which is hidden from the requester in one of the
+// tables it writes to, or reads a column the requester only sees transformed, see hiddenColumnReferenced. Writes which
+// only refer to visible columns are allowed even if the tables have hidden columns.
+func (pd *privateDatabase) checkWriteColumns(stmt sqlparser.Statement, tableNames []string,
+	tableOperations *TableOperations) error {
+	hiddenColumns := make(map[string][]string)
+	unreadableColumns := make(map[string][]string)
+	for _, tableName := range tableNames {
+		_, colsToDrop, err := pd.getColsToCopy(tableName, tableOperations)
+		if err != nil {
+			return err
+		}
+		hiddenColumns[tableName] = colsToDrop
+		// The rows a write affects would reveal the exact values of transformed columns which it compares
+		unreadableColumns[tableName] = tableOperations.transformedColumns(tableName)
 	}
 
+	if column := hiddenColumnReferenced(stmt, hiddenColumns, unreadableColumns); column != "" {
+		// return an error if we access an excluded column but do not reveal the reason so we don't reveal
+		// information through error messages
+		return fmt.Errorf("ERROR 1054 (42S22): Unknown column '%s'", column)
+	}
 	return nil
 }
 
-func (mspd *MySQLPrivateDatabase) transformTable(tableName string, groupPrefix string,
-	transforms TableTransform, excludedColumns []string) (string, error) {
+func (pd *privateDatabase) transformTable(ctx context.Context, session *querySession, tableName string,
+	groupPrefix string, tableOperations *TableOperations, requesterID string, purpose string) (string, error) {
 
 	transformedTableName := groupPrefix + tableName
 
-	if mspd.CacheTables {
-		// A lock on a table is required while we check if it has a cached transform to avoid two concurrent requests
-		// getting a cache miss and then both attempting to create a transform with the same name simultaneously.
-		mutex := mspd.tableMutexes.GetMutex(tableName)
-		mutex.Lock()
-		defer mutex.Unlock()
-
-		// Check if we have a valid cached table
-		valid, err := mspd.checkCache(tableName, transformedTableName)
+	if session == nil {
+		sharedTableName, shared, err := pd.sharedTableName(tableName, tableOperations, requesterID, purpose)
 		if err != nil {
 			return "", err
 		}
-		if valid {
-			return transformedTableName, nil
+		if shared {
+			transformedTableName = sharedTableName
 		}
-	} else {
-		// Add a random ID to the table name to avoid clashes with concurrent requests
-		transformedTableName += fmt.Sprintf("%d", rand.Intn(99999))
+
+		err = pd.cacheTable(ctx, tableName, transformedTableName, tableOperations, requesterID, purpose)
+		if err != nil {
+			return "", err
+		}
+
+		// Evicting a table takes the lock on the table it was transformed from, so this is done once the lock on this
+		// table has been released
+		pd.evictCachedTables(transformedTableName)
+		return transformedTableName, nil
 	}
 
-	err := mspd.doTransform(tableName, transformedTableName, transforms, excludedColumns)
+	// The table is only visible to the query's session so its name cannot clash with those of concurrent requests, it
+	// is dropped with the session's other tables even if building it fails
+	if !contains(session.temporaryTables, transformedTableName) {
+		session.temporaryTables = append(session.temporaryTables, transformedTableName)
+	}
+	_, err := pd.doTransform(ctx, session, tableName, transformedTableName, tableOperations, requesterID, purpose, "",
+		nil)
 	if err != nil {
 		return "", err
 	}
@@ -404,56 +1069,242 @@ func (mspd *MySQLPrivateDatabase) transformTable(tableName string, groupPrefix s
 	return transformedTableName, nil
 }
 
-func (mspd *MySQLPrivateDatabase) doTransform(tableName string, transformedTableName string,
-	transforms TableTransform, excludedColumns []string) error {
-	// Get the column types
-	colsToCopy, err := mspd.getColsToCopy(tableName, excludedColumns)
+// cacheTable builds the cached transformed table of a table if there is not a valid one
+func (pd *privateDatabase) cacheTable(ctx context.Context, tableName string, transformedTableName string,
+	tableOperations *TableOperations, requesterID string, purpose string) error {
+	// A lock on a table is required while we check if it has a cached transform to avoid two concurrent requests
+	// getting a cache miss and then both attempting to create a transform with the same name simultaneously.
+	mutex := pd.tableMutexes.GetMutex(tableName)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	// The table is recorded as read while the lock is held so that it cannot be evicted and dropped before the query
+	// which reads it starts
+	pd.readCachedTable(ctx, transformedTableName)
+
+	refresh, incremental := pd.Cache.incrementalRefresh(tableName, tableOperations)
+	if incremental {
+		refreshed, err := pd.refreshCachedTable(ctx, tableName, transformedTableName, refresh, tableOperations,
+			requesterID, purpose)
+		if err != nil || refreshed {
+			return err
+		}
+	}
+
+	// Check if we have a valid cached table
+	valid, err := pd.checkCache(tableName, transformedTableName)
 	if err != nil {
 		return err
 	}
+	if valid {
+		pd.Cache.hit(transformedTableName, tableName, time.Now())
+		return nil
+	}
 
-	// Create a string of the column names to be copied over and another string with the names and types
-	columnString := strings.Join(colsToCopy, ", ")
-
-	if columnString == "" {
-		return errors.New("all columns are excluded, cannot create transformed table")
+	// A table which is refreshed incrementally is built from the rows up to its marks, so rows added while it is built
+	// are merged into it when it is next refreshed rather than being copied twice
+	var (
+		marks         *refreshMarks
+		condition     string
+		conditionArgs []interface{}
+	)
+	if incremental {
+		marks, _, err = pd.readRefreshMarks(ctx, tableName, refresh, nil)
+		if err != nil {
+			return err
+		}
+		condition, conditionArgs = refresh.condition(nil, marks)
 	}
-	// Drop the table if it already exists - it should not exist at this point
-	err = mspd.dropTableIfExists(transformedTableName)
+
+	bytes, err := pd.doTransform(ctx, nil, tableName, transformedTableName, tableOperations, requesterID, purpose,
+		condition, conditionArgs)
 	if err != nil {
+		// The table may have been dropped or only partly built
+		pd.Cache.forget(transformedTableName)
 		return err
 	}
+	pd.Cache.built(transformedTableName, tableName, bytes, marks, time.Now())
+	return nil
+}
+
+// evictCachedTables drops the tables evicted from the cache to keep it within its limits, apart from the table which
+// is kept. Tables which queries have been rewritten to read are dropped once those queries have started, see
+// trackReads. Failing to drop a table is only logged as the query which caused the eviction can still run.
+func (pd *privateDatabase) evictCachedTables(keep string) {
+	for _, entry := range pd.Cache.evict(keep, time.Now()) {
+		pd.dropEvictedTable(entry, true)
+	}
+}
 
-	// Copy table
-	createTableString := fmt.Sprintf("CREATE TABLE %s LIKE %s;", transformedTableName, tableName)
-	_, err = mspd.database.Exec(createTableString)
+// dropEvictedTable drops a table evicted from the cache unless it has been rebuilt since or, if the drop can be
+// deferred, a query is about to read it
+func (pd *privateDatabase) dropEvictedTable(entry cacheEntry, canDefer bool) {
+	mutex := pd.tableMutexes.GetMutex(entry.tableName)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if pd.Cache.contains(entry.transformedTableName) || (canDefer && pd.Cache.deferDrop(entry)) {
+		return
+	}
+	err := pd.dropTableIfExists(entry.transformedTableName)
 	if err != nil {
-		return err
+		log.Printf("PAM: failed to drop evicted table %s: %s", entry.transformedTableName, err.Error())
+	}
+}
+
+// tableReadsKey is the context key of the tableReads of a query
+type tableReadsKey struct{}
+
+// tableReads are the cached tables a query has been rewritten to read
+type tableReads struct {
+	mutex  sync.Mutex
+	tables []string
+}
+
+// trackReads returns a context for rewriting a query which records the cached tables it will read, so that they are
+// not dropped when evicted before the query starts, and a function to call once it has started. Once a query has
+// started the tables can be dropped, as the databases wait for it or, for SQLite, it reads from its snapshot.
+func (pd *privateDatabase) trackReads(ctx context.Context) (context.Context, func()) {
+	reads := &tableReads{}
+	return context.WithValue(ctx, tableReadsKey{}, reads), func() {
+		reads.mutex.Lock()
+		defer reads.mutex.Unlock()
+
+		for _, table := range reads.tables {
+			if entry, ok := pd.Cache.doneReading(table); ok {
+				pd.dropEvictedTable(entry, false)
+			}
+		}
+		reads.tables = nil
+	}
+}
+
+// readCachedTable records that the query being rewritten with the context will read a cached table
+func (pd *privateDatabase) readCachedTable(ctx context.Context, transformedTableName string) {
+	reads, ok := ctx.Value(tableReadsKey{}).(*tableReads)
+	if !ok {
+		return
+	}
+	reads.mutex.Lock()
+	defer reads.mutex.Unlock()
+
+	reads.tables = append(reads.tables, transformedTableName)
+	pd.Cache.read(transformedTableName)
+}
+
+// doTransform builds the transformed table of a table from the rows satisfying the condition, or every row if it is
+// empty, and returns the number of bytes of the values written to it
+func (pd *privateDatabase) doTransform(ctx context.Context, session *querySession, tableName string,
+	transformedTableName string, tableOperations *TableOperations, requesterID string, purpose string,
+	condition string, conditionArgs []interface{}) (int64, error) {
+	// Get the column types
+	colsToCopy, colsToDrop, err := pd.getColsToCopy(tableName, tableOperations)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(colsToCopy) == 0 {
+		return 0, errors.New("all columns are excluded, cannot create transformed table")
 	}
+	if session == nil {
+		// Drop the table if it already exists - it should not exist at this point
+		err = pd.dropTableIfExists(transformedTableName)
+		if err != nil {
+			return 0, err
+		}
 
-	// Drop unnecessary columns
-	if len(excludedColumns) > 0 {
-		dropString := "DROP COLUMN " + strings.Join(excludedColumns, ", DROP COLUMN ")
+		// The table is recorded before it is created, so that a table which is not recorded is never one another
+		// process is building
+		err = pd.recordBuiltTable(transformedTableName, time.Now())
+		if err != nil {
+			return 0, err
+		}
 
-		dropTableString := fmt.Sprintf("ALTER TABLE %s %s;", transformedTableName, dropString)
-		_, err = mspd.database.Exec(dropTableString)
+		// Copy the table without the unnecessary columns
+		err = pd.dialect.createTableLike(pd.database, tableName, transformedTableName, colsToDrop)
 		if err != nil {
-			return err
+			return 0, err
+		}
+	} else {
+		// The connection may still have the table if dropping it after an earlier query failed, or the transaction
+		// if an earlier query in it read the table
+		_, err = pd.runner(session).ExecContext(ctx, pd.dialect.dropTemporaryTableSQL(transformedTableName))
+		if err != nil {
+			return 0, err
+		}
+
+		// Copy the table without the unnecessary columns
+		err = pd.dialect.createTemporaryTableLike(ctx, pd.runner(session), tableName, transformedTableName, colsToDrop)
+		if err != nil {
+			return 0, err
 		}
 	}
 
-	// Get necessary columns from database
-	selectedColumnsString := fmt.Sprintf("SELECT %s FROM %s", columnString, tableName)
-	rows, err := mspd.database.Query(selectedColumnsString)
+	return pd.copyRows(ctx, session, tableName, transformedTableName, colsToCopy, tableOperations, requesterID,
+		purpose, condition, conditionArgs)
+}
+
+// copyRows transforms the rows of a table satisfying the condition, or every row if it is empty, and writes them to
+// its transformed table in the session. It returns the number of bytes of the values written.
+func (pd *privateDatabase) copyRows(ctx context.Context, session *querySession, tableName string,
+	transformedTableName string,
+	colsToCopy []string, tableOperations *TableOperations, requesterID string, purpose string, condition string,
+	conditionArgs []interface{}) (int64, error) {
+	transforms := tableOperations.TableTransforms[tableName]
+	rowTransforms := tableOperations.RowTransforms[tableName]
+	rowFilter, rowFilterArgs, err := pd.rowFilter(tableName, tableOperations, requesterID, purpose)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	if rowFilter != "" && condition != "" {
+		rowFilter = fmt.Sprintf("(%s) AND %s", rowFilter, condition)
+	} else if condition != "" {
+		rowFilter = condition
+	}
+	rowFilterArgs = append(rowFilterArgs, conditionArgs...)
+
+	// Create a string of the column names to be copied over
+	columnString := strings.Join(colsToCopy, ", ")
+
+	// Get necessary columns from database, applying SQL transforms and filtering out rows in the database where possible
+	selectedColumnsString := fmt.Sprintf("SELECT %s FROM %s", selectList(tableName, colsToCopy, tableOperations),
+		tableName)
+	if rowFilter != "" {
+		selectedColumnsString += " WHERE " + rowFilter
+	}
+	selectedColumnsString, err = pd.dialect.nativeSQL(selectedColumnsString)
+	if err != nil {
+		return 0, err
+	}
+	// The rows are read on another connection as they are written to the session's connection while they are read,
+	// apart from in a transaction as only it can see the rows it has written. A connection cannot run statements while
+	// it is sending rows, so a transaction reads every row before writing any.
+	var (
+		source  sqlRunner = pd.database
+		pending []batch
+	)
+	inTx := session != nil && session.tx != nil
+	if inTx {
+		source = session.tx
+	}
+	write := func(rowsToWrite string, rowArguments []interface{}) error {
+		if inTx {
+			pending = append(pending, batch{rowsToWrite, append([]interface{}(nil), rowArguments...)})
+			return nil
+		}
+		return pd.writeToTable(ctx, pd.runner(session), transformedTableName, columnString, rowsToWrite, rowArguments)
+	}
+
+	rows, err := source.QueryContext(ctx, selectedColumnsString, rowFilterArgs...)
+	if err != nil {
+		return 0, err
 	}
 	defer rows.Close()
 
 	// Create variables to scan values into
 	cols, err := rows.Columns()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	vals := make([]interface{}, len(cols))
@@ -464,20 +1315,23 @@ func (mspd *MySQLPrivateDatabase) doTransform(tableName string, transformedTable
 		scanArgs[i] = &vals[i]
 	}
 
-	var rowArguments []interface{}
+	var (
+		rowArguments []interface{}
+		bytes        int64
+	)
 	rowCount := 0
 	rowsToWrite := ""
 	for rows.Next() {
 		// Read rows into variables
 		err = rows.Scan(scanArgs...)
 		if err != nil {
-			return err
+			return 0, err
 		}
 
 		// Apply transforms to rows
-		excludeRow, err := applyTransformsToRows(&vals, colsToCopy, transforms)
+		excludeRow, err := applyTransformsToRows(&vals, colsToCopy, rowTransforms, transforms)
 		if err != nil {
-			return err
+			return 0, err
 		}
 
 		if !excludeRow {
@@ -489,6 +1343,9 @@ func (mspd *MySQLPrivateDatabase) doTransform(tableName string, transformedTable
 			rowsToWrite = strings.TrimSuffix(rowsToWrite, ", ")
 			rowsToWrite += "), "
 			rowArguments = append(rowArguments, vals...)
+			for _, val := range vals {
+				bytes += valueSize(val)
+			}
 
 			rowCount += 1
 			if rowCount == batchSize {
@@ -496,9 +1353,9 @@ func (mspd *MySQLPrivateDatabase) doTransform(tableName string, transformedTable
 				rowsToWrite = strings.TrimSuffix(rowsToWrite, ", ")
 
 				// Write to database and then continue
-				err := mspd.writeToTable(transformedTableName, columnString, rowsToWrite, rowArguments)
+				err := write(rowsToWrite, rowArguments)
 				if err != nil {
-					return err
+					return 0, err
 				}
 
 				// Reset accumulators
@@ -510,22 +1367,69 @@ func (mspd *MySQLPrivateDatabase) doTransform(tableName string, transformedTable
 	}
 
 	if rows.Err() != nil {
-		return rows.Err()
+		return 0, rows.Err()
 	}
 
 	if rowCount > 0 {
 		// Remove the last comma and space
 		rowsToWrite = strings.TrimSuffix(rowsToWrite, ", ")
-		err := mspd.writeToTable(transformedTableName, columnString, rowsToWrite, rowArguments)
+		err := write(rowsToWrite, rowArguments)
 		if err != nil {
-			return err
+			return 0, err
 		}
 	}
-	return nil
+
+	err = rows.Close()
+	if err != nil {
+		return 0, err
+	}
+	for _, pendingBatch := range pending {
+		err = pd.writeToTable(ctx, session.tx, transformedTableName, columnString, pendingBatch.rows,
+			pendingBatch.args)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return bytes, nil
+}
+
+// batch is rows to write to a transformed table, with the arguments for their placeholders
+type batch struct {
+	rows string
+	args []interface{}
+}
+
+// rowFilter returns the condition rows of the table must satisfy to be copied into a transformed table, and the
+// arguments for its placeholders
+func (pd *privateDatabase) rowFilter(tableName string, tableOperations *TableOperations, requesterID string,
+	purpose string) (string, []interface{}, error) {
+	rowFilter, rowFilterArgs, err := rowFiltersSQL(tableOperations.RowFilters[tableName], requesterID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Remove the rows of data subjects who have opted out
+	if pd.Consent != nil {
+		consentFilter, consentArgs := pd.Consent.sql(tableName, requesterID, purpose)
+		if consentFilter != "" && rowFilter != "" {
+			rowFilter = fmt.Sprintf("(%s) AND %s", rowFilter, consentFilter)
+		} else if consentFilter != "" {
+			rowFilter = consentFilter
+		}
+		rowFilterArgs = append(rowFilterArgs, consentArgs...)
+	}
+	return rowFilter, rowFilterArgs, nil
 }
 
-func applyTransformsToRows(vals *[]interface{}, colsToCopy []string,
+func applyTransformsToRows(vals *[]interface{}, colsToCopy []string, rowTransforms []RowTransform,
 	transforms TableTransform) (bool, error) {
+	if len(rowTransforms) > 0 {
+		excludeRow, err := applyRowTransforms(vals, colsToCopy, rowTransforms)
+		if err != nil || excludeRow {
+			return true, err
+		}
+	}
+
 	for i, val := range *vals {
 		currentCol := colsToCopy[i]
 		transform, ok := transforms[currentCol]
@@ -543,123 +1447,294 @@ func applyTransformsToRows(vals *[]interface{}, colsToCopy []string,
 	return false, nil
 }
 
-func (mspd *MySQLPrivateDatabase) writeToTable(tableName string, columns string, rowsToWrite string, rowArguments []interface{}) error {
+// applyRowTransforms passes the values of a row by column name to each of the row transforms in turn and writes back
+// the changed values
+func applyRowTransforms(vals *[]interface{}, colsToCopy []string, rowTransforms []RowTransform) (bool, error) {
+	row := make(map[string]interface{}, len(colsToCopy))
+	for i, col := range colsToCopy {
+		row[col] = (*vals)[i]
+	}
+
+	for _, rowTransform := range rowTransforms {
+		excludeRow, err := rowTransform(row)
+		if err != nil || excludeRow {
+			return true, err
+		}
+	}
+
+	// Only copied columns are written to the transformed table
+	for col := range row {
+		if !contains(colsToCopy, col) {
+			return true, fmt.Errorf("a row transform set the column %s which is not copied", col)
+		}
+	}
+	for i, col := range colsToCopy {
+		(*vals)[i] = row[col]
+	}
+	return false, nil
+}
+
+func (pd *privateDatabase) writeToTable(ctx context.Context, db sqlRunner, tableName string, columns string,
+	rowsToWrite string, rowArguments []interface{}) error {
 	// Write rows to transformed table
-	insertString := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", tableName, columns, rowsToWrite)
-	_, err := mspd.database.Exec(insertString, rowArguments...)
+	insertString, err := pd.dialect.nativeSQL(fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", tableName, columns,
+		rowsToWrite))
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, insertString, rowArguments...)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (mspd *MySQLPrivateDatabase) dropTableIfExists(table string) error {
-	dropTableString := fmt.Sprintf("DROP TABLE IF EXISTS %s;", table)
-	_, err := mspd.database.Exec(dropTableString)
+// dropTableIfExists drops a transformed table and forgets that it was built
+func (pd *privateDatabase) dropTableIfExists(table string) error {
+	for _, dropTableString := range pd.dialect.dropTableSQL(table) {
+		_, err := pd.database.Exec(dropTableString)
+		if err != nil {
+			return err
+		}
+	}
+	deleteString, err := pd.dialect.nativeSQL(fmt.Sprintf("DELETE FROM %s WHERE table_name = ?", builtTablesTableName))
+	if err != nil {
+		return err
+	}
+	_, err = pd.database.Exec(deleteString, table)
 	return err
 }
 
-func (mspd *MySQLPrivateDatabase) isTransformedTableValid(tableName string, transformedTableName string) (bool, error) {
-	// Check when the data policy was last updated
-	timeOfLastPolicyUpdate := mspd.DataPolicy.LastUpdated()
+// recordBuiltTable records that the middleware built a cached transformed table
+func (pd *privateDatabase) recordBuiltTable(table string, builtAt time.Time) error {
+	deleteString, err := pd.dialect.nativeSQL(fmt.Sprintf("DELETE FROM %s WHERE table_name = ?", builtTablesTableName))
+	if err != nil {
+		return err
+	}
+	_, err = pd.database.Exec(deleteString, table)
+	if err != nil {
+		return err
+	}
+	insertString, err := pd.dialect.nativeSQL(fmt.Sprintf("INSERT INTO %s (table_name, built_at) VALUES (?, ?)",
+		builtTablesTableName))
+	if err != nil {
+		return err
+	}
+	_, err = pd.database.Exec(insertString, table, builtAt.UnixNano())
+	return err
+}
 
-	// Check when the table was last updated
-	timeOfLastUpdateRow := mspd.database.QueryRow(
-		`SELECT create_time, update_time FROM information_schema.tables WHERE table_schema = ? AND table_name = ?`,
-		mspd.databaseName, tableName)
+// builtTables returns when each cached transformed table the middleware has built, in this process or another, was
+// built
+func (pd *privateDatabase) builtTables() (map[string]time.Time, error) {
+	rows, err := pd.database.Query(fmt.Sprintf("SELECT table_name, built_at FROM %s", builtTablesTableName))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	var (
-		timeOfLastUpdate     time.Time
-		nullCreateTime       mysql.NullTime
-		nullTimeOfLastUpdate mysql.NullTime
-	)
-	switch err := timeOfLastUpdateRow.Scan(&nullCreateTime, &nullTimeOfLastUpdate); err {
-	case nil:
-		if nullTimeOfLastUpdate.Valid {
-			timeOfLastUpdate = nullTimeOfLastUpdate.Time
-		} else if nullCreateTime.Valid {
-			// use the creation time
-			timeOfLastUpdate = nullCreateTime.Time
-		} else {
-			// Can't find a create or updated time
-			return false, fmt.Errorf("no creation or last updated time could be found for %s", tableName)
+	builtTables := make(map[string]time.Time)
+	for rows.Next() {
+		var (
+			table   string
+			builtAt int64
+		)
+		err = rows.Scan(&table, &builtAt)
+		if err != nil {
+			return nil, err
 		}
-	case sql.ErrNoRows:
-		// Table doesn't exist
-		return false, fmt.Errorf("table %s doesn't exist", tableName)
-	default:
-		return false, fmt.Errorf("error reading table %s", tableName)
+		builtTables[table] = time.Unix(0, builtAt)
 	}
+	return builtTables, rows.Err()
+}
 
-	// Check when the transform was created
-	timeOfTransformCreationRow := mspd.database.QueryRow(
-		`SELECT create_time FROM information_schema.tables WHERE table_schema = ? AND table_name = ?`,
-		mspd.databaseName, transformedTableName)
+// dropCachedTables drops every cached transformed table the middleware has built whose name starts with prefix
+func (pd *privateDatabase) dropCachedTables(prefix string) error {
+	return pd.dropBuiltTables(func(table string, builtAt time.Time) bool {
+		return strings.HasPrefix(table, prefix)
+	})
+}
 
-	var (
-		nullTimeOfTransformCreation mysql.NullTime
-		timeOfTransformCreation     time.Time
-	)
+// dropExpiredTables drops every cached transformed table the middleware has built which is older than the cache's
+// TTL. None are dropped if there is no TTL, as it cannot be known whether another process is still using them.
+func (pd *privateDatabase) dropExpiredTables(now time.Time) error {
+	if pd.Cache.TTL <= 0 {
+		return nil
+	}
+	return pd.dropBuiltTables(func(table string, builtAt time.Time) bool {
+		return now.Sub(builtAt) > pd.Cache.TTL
+	})
+}
 
-	switch err := timeOfTransformCreationRow.Scan(&nullTimeOfTransformCreation); err {
-	case nil:
-		if nullTimeOfTransformCreation.Valid {
-			timeOfTransformCreation = nullTimeOfTransformCreation.Time
-		} else {
-			// Continue and recreate table but log it
-			log.Printf("malformed table entry %s, recreating", transformedTableName)
+// transformedTableRegexp matches the names the middleware gives cached transformed tables
+var transformedTableRegexp = regexp.MustCompile(`^transformed_(shared_[0-9a-f]{16}|[0-9a-f]{16}_([0-9a-f]{16}|0))_.+$`)
+
+// dropOrphanedTables drops the tables named as the middleware names transformed tables which it has not recorded
+// building. As tables are recorded before they are built these were left by earlier versions of the middleware, which
+// named them transformed_<requester>_<table>, with a random suffix if they were not cached, and did not record them.
+func (pd *privateDatabase) dropOrphanedTables(ctx context.Context) error {
+	tableNames, err := pd.tableNames(ctx)
+	if err != nil {
+		return err
+	}
+	builtTables, err := pd.builtTables()
+	if err != nil {
+		return err
+	}
+
+	var sourceTables []string
+	for _, tableName := range tableNames {
+		if !pd.internalTable(tableName) {
+			sourceTables = append(sourceTables, tableName)
 		}
-	case sql.ErrNoRows:
-		// No transform has been built so we can continue
-		log.Printf("No transform found, creating table %s", transformedTableName)
-	default:
-		// Create the table anyway but log the errors
-		log.Printf(err.Error())
+	}
+	orphaned := func(tableName string) bool {
+		if transformedTableRegexp.MatchString(tableName) {
+			return true
+		}
+		// transformed_<requester>_<table> followed by any digits, for a table in the database
+		unsuffixed := strings.TrimRight(tableName, "0123456789")
+		for _, sourceTable := range sourceTables {
+			requesterEnd := len(unsuffixed) - len(sourceTable) - 1
+			if strings.HasPrefix(unsuffixed, "transformed_") && requesterEnd > len("transformed_") &&
+				strings.HasSuffix(unsuffixed, "_"+sourceTable) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, tableName := range tableNames {
+		if _, recorded := builtTables[tableName]; recorded || !orphaned(tableName) {
+			continue
+		}
+		err = pd.dropTableIfExists(tableName)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropBuiltTables drops the cached transformed tables the middleware has built which are selected
+func (pd *privateDatabase) dropBuiltTables(selected func(table string, builtAt time.Time) bool) error {
+	builtTables, err := pd.builtTables()
+	if err != nil {
+		return err
+	}
+
+	for table, builtAt := range builtTables {
+		if !selected(table, builtAt) {
+			continue
+		}
+		err = pd.dropTableIfExists(table)
+		if err != nil {
+			return err
+		}
+		pd.Cache.forget(table)
+	}
+	return nil
+}
+
+func (pd *privateDatabase) isTransformedTableValid(tableName string, transformedTableName string) (bool, error) {
+	timeOfTransformCreation, afterPolicyUpdate, err := pd.transformedTableCreated(tableName, transformedTableName)
+	if err != nil {
+		return false, err
 	}
 
+	// Check when the table was last updated
+	timeOfLastUpdate, err := pd.tableLastUpdated(tableName)
+	if err != nil {
+		return false, err
+	}
 	afterTableUpdate := timeOfTransformCreation.After(timeOfLastUpdate)
-	afterPolicyUpdate := timeOfTransformCreation.After(timeOfLastPolicyUpdate)
 
 	// Work out whether the transform is valid
 	return afterTableUpdate && afterPolicyUpdate, nil
 }
 
-func (mspd *MySQLPrivateDatabase) getColsToCopy(tableName string, excludedColumns []string) ([]string, error) {
+// transformedTableCreated returns when a transformed table was created, which is the zero time if it does not exist,
+// and whether that was after the policies which decide its contents were last updated. These are the data policy and,
+// if it applies to the table, the consent of data subjects, as opting in or out changes which rows are visible.
+func (pd *privateDatabase) transformedTableCreated(tableName string, transformedTableName string) (time.Time, bool,
+	error) {
+	// Check when the data policy was last updated
+	timeOfLastPolicyUpdate := pd.DataPolicy.LastUpdated()
+
+	if pd.Consent != nil && pd.Consent.appliesTo(tableName) {
+		timeOfLastConsentUpdate, err := pd.tableLastUpdated(pd.Consent.tableName())
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		if timeOfLastConsentUpdate.After(timeOfLastPolicyUpdate) {
+			timeOfLastPolicyUpdate = timeOfLastConsentUpdate
+		}
+	}
+
+	// Check when the transform was created
+	timeOfTransformCreation, exists, err := pd.dialect.tableCreated(pd.database, pd.databaseName, transformedTableName)
+	if err != nil {
+		// Create the table anyway but log the errors
+		log.Printf(err.Error())
+	} else if !exists {
+		// No transform has been built so we can continue
+		log.Printf("No transform found, creating table %s", transformedTableName)
+	}
+
+	return timeOfTransformCreation, timeOfTransformCreation.After(timeOfLastPolicyUpdate), nil
+}
+
+// tableLastUpdated returns when a table was last updated, or when it was created if it has not been updated
+func (pd *privateDatabase) tableLastUpdated(tableName string) (time.Time, error) {
+	return pd.dialect.tableLastUpdated(pd.database, pd.databaseName, tableName)
+}
+
+func (pd *privateDatabase) getColsToCopy(tableName string, tableOperations *TableOperations) ([]string, []string, error) {
 	// Get the columns in the table
-	columnNamesString := fmt.Sprintf("SELECT column_name, data_type FROM information_schema.columns WHERE table_name='%s';", tableName)
-	columnNames, err := mspd.database.Query(columnNamesString)
+	columnNamesString, columnNamesArgs := pd.dialect.columnsQuery(pd.databaseName, tableName)
+	columnNames, err := pd.database.Query(columnNamesString, columnNamesArgs...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer columnNames.Close()
 
-	// Remove any columns which should be excluded
+	// Separate the columns which are visible from those which should be dropped
 	var (
 		colName string
 		colType string
 	)
-	var colsToCopy []string
+	var (
+		colsToCopy []string
+		colsToDrop []string
+	)
 
 	for columnNames.Next() {
 		err := columnNames.Scan(&colName, &colType)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		if !contains(excludedColumns, colName) {
+		if tableOperations.columnVisible(tableName, colName) {
 			colsToCopy = append(colsToCopy, colName)
+		} else {
+			colsToDrop = append(colsToDrop, colName)
 		}
 	}
 
 	if columnNames.Err() != nil {
-		return nil, columnNames.Err()
+		return nil, nil, columnNames.Err()
 	}
 
-	return colsToCopy, nil
+	return colsToCopy, colsToDrop, nil
 }
 
-func (mspd *MySQLPrivateDatabase) checkCache(tableName string, transformedTableName string) (bool, error) {
+func (pd *privateDatabase) checkCache(tableName string, transformedTableName string) (bool, error) {
+	// Rebuild tables which have expired
+	if pd.Cache.expired(transformedTableName, time.Now()) {
+		return false, nil
+	}
+
 	// Check if transform is valid
-	transformValid, err := mspd.isTransformedTableValid(tableName, transformedTableName)
+	transformValid, err := pd.isTransformedTableValid(tableName, transformedTableName)
 	if err != nil {
 		return false, err
 	}
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -60,7 +61,7 @@ func TestMySqlPrivateDatabase_Query_NoCaching(t *testing.T) {
 	db.SetMaxIdleConns(100)
 	db.SetMaxOpenConns(100)
 	db.SetConnMaxLifetime(time.Second * 20)
-	_, err = db.Query("SELECT * from people", &RequestPolicy{"alice", Local, true})
+	_, err = db.Query("SELECT * from people", localRequestPolicy("alice"))
 	require.NoError(t, err)
 }
 
@@ -74,10 +75,10 @@ func TestMySqlPrivateDatabase_Query_Caching(t *testing.T) {
 	db.SetConnMaxLifetime(time.Second * 20)
 
 	// Make sure the query has been run before
-	_, err = db.Query("SELECT * from people", &RequestPolicy{"alice", Local, true})
+	_, err = db.Query("SELECT * from people", localRequestPolicy("alice"))
 	require.NoError(t, err)
 	// Make the query again
-	_, err = db.Query("SELECT * from people", &RequestPolicy{"alice", Local, true})
+	_, err = db.Query("SELECT * from people", localRequestPolicy("alice"))
 	require.NoError(t, err)
 }
 
@@ -86,10 +87,10 @@ func TestMySQLPrivateDatabase_Query_Excluded_Row(t *testing.T) {
 	funcMap := validEmptyFuncMap()
 	colMap := map[string][]string{"people": {"dob"}}
 
-	group := &PrivacyGroup{"TestGroup", map[string]bool{"alice": true}}
+	group := &PrivacyGroup{name: "TestGroup", members: map[string]bool{"alice": true}}
 
 	staticDataPolicy := NewStaticDataPolicy([]*PrivacyGroup{group},
-		DataTransforms{group: &TableOperations{funcMap, colMap}})
+		DataTransforms{group: &TableOperations{TableTransforms: funcMap, ExcludedCols: colMap}})
 
 	db := MySQLPrivateDatabase{
 		DataPolicy: staticDataPolicy,
@@ -101,7 +102,7 @@ func TestMySQLPrivateDatabase_Query_Excluded_Row(t *testing.T) {
 	db.SetMaxOpenConns(100)
 	db.SetConnMaxLifetime(time.Second * 20)
 
-	_, err = db.Query("SELECT name, dob from people", &RequestPolicy{"alice", Local, true})
+	_, err = db.Query("SELECT name, dob from people", localRequestPolicy("alice"))
 
 	// We get an error as the column does not exist
 	require.EqualError(t, err, `Error 1054: Unknown column 'dob' in 'field list'`)
@@ -112,10 +113,10 @@ func TestMySQLPrivateDatabase_Query_All_Excluded_Row(t *testing.T) {
 	funcMap := validEmptyFuncMap()
 	colMap := map[string][]string{"people": {"dob"}}
 
-	group := &PrivacyGroup{"TestGroup", map[string]bool{"alice": true}}
+	group := &PrivacyGroup{name: "TestGroup", members: map[string]bool{"alice": true}}
 
 	staticDataPolicy := NewStaticDataPolicy([]*PrivacyGroup{group},
-		DataTransforms{group: &TableOperations{funcMap, colMap}})
+		DataTransforms{group: &TableOperations{TableTransforms: funcMap, ExcludedCols: colMap}})
 
 	db := MySQLPrivateDatabase{
 		DataPolicy:  staticDataPolicy,
@@ -128,7 +129,7 @@ func TestMySQLPrivateDatabase_Query_All_Excluded_Row(t *testing.T) {
 	db.SetMaxOpenConns(100)
 	db.SetConnMaxLifetime(time.Second * 20)
 
-	row, err := db.QueryRow("SELECT * from people", &RequestPolicy{"alice", Local, true})
+	row, err := db.QueryRow("SELECT * from people", localRequestPolicy("alice"))
 	require.NoError(t, err)
 
 	var (
@@ -145,10 +146,10 @@ func TestTransforms(t *testing.T) {
 	funcMap := validFuncMap()
 	colMap := map[string][]string{}
 
-	group := &PrivacyGroup{"TestGroup", map[string]bool{"alice": true}}
+	group := &PrivacyGroup{name: "TestGroup", members: map[string]bool{"alice": true}}
 
 	staticDataPolicy := NewStaticDataPolicy([]*PrivacyGroup{group},
-		DataTransforms{group: &TableOperations{funcMap, colMap}})
+		DataTransforms{group: &TableOperations{TableTransforms: funcMap, ExcludedCols: colMap}})
 
 	db := MySQLPrivateDatabase{
 		DataPolicy:  staticDataPolicy,
@@ -170,7 +171,7 @@ func TestTransforms(t *testing.T) {
 
 	// Query the database
 	row, err := db.QueryRow("SELECT name, dob from people WHERE id=?",
-		&RequestPolicy{"alice", Local, true}, writeID)
+		localRequestPolicy("alice"), writeID)
 	require.NoError(t, err)
 
 	var (
@@ -184,43 +185,434 @@ func TestTransforms(t *testing.T) {
 	require.Equal(t, dob, time.Date(1997, 1, 1, 0, 0, 0, 0, time.UTC))
 }
 
+func TestMySQLPrivateDatabase_Query_Row_Transforms(t *testing.T) {
+	group := &PrivacyGroup{name: "TestGroup", members: map[string]bool{"alice": true}}
+
+	// Hide the names of people born before 1990 and drop people born before 1900
+	rowTransform := func(row map[string]interface{}) (bool, error) {
+		dob := row["dob"].(time.Time)
+		if dob.Year() < 1900 {
+			return true, nil
+		}
+		if dob.Year() < 1990 {
+			row["name"] = []uint8("hidden")
+		}
+		return false, nil
+	}
+
+	staticDataPolicy := NewStaticDataPolicy([]*PrivacyGroup{group},
+		DataTransforms{group: &TableOperations{
+			TableTransforms: validFuncMap(),
+			RowTransforms:   map[string][]RowTransform{"people": {rowTransform}},
+		}})
+
+	db := MySQLPrivateDatabase{
+		DataPolicy:  staticDataPolicy,
+		CacheTables: false,
+	}
+
+	err := db.Connect("demouser", "demopassword", "store1", "127.0.0.1", 3306)
+	require.NoError(t, err)
+
+	result, err := db.database.Exec(`INSERT INTO people (name, dob) VALUES ('alice', '1985-11-01')`)
+	require.NoError(t, err)
+	hiddenID, err := result.LastInsertId()
+	require.NoError(t, err)
+	result, err = db.database.Exec(`INSERT INTO people (name, dob) VALUES ('alice', '1850-11-01')`)
+	require.NoError(t, err)
+	droppedID, err := result.LastInsertId()
+	require.NoError(t, err)
+
+	// The row transform sees the raw values and the column transforms are applied to its output
+	var name string
+	row, err := db.QueryRow("SELECT name from people WHERE id=?", localRequestPolicy("alice"), hiddenID)
+	require.NoError(t, err)
+	require.NoError(t, row.Scan(&name))
+	require.Equal(t, "hid***", name)
+
+	row, err = db.QueryRow("SELECT name from people WHERE id=?", localRequestPolicy("alice"), droppedID)
+	require.NoError(t, err)
+	require.Equal(t, sql.ErrNoRows, row.Scan(&name))
+}
+
+func TestApplyTransformsToRows_RowTransforms(t *testing.T) {
+	cols := []string{"address", "consent_flag", "age"}
+	upperAge := func(i interface{}) (interface{}, bool, error) { return i.(int) / 10 * 10, false, nil }
+
+	redactWithoutConsent := func(row map[string]interface{}) (bool, error) {
+		if !row["consent_flag"].(bool) {
+			row["address"] = nil
+		}
+		return false, nil
+	}
+	dropMinors := func(row map[string]interface{}) (bool, error) {
+		return row["age"].(int) < 18, nil
+	}
+	rowTransforms := []RowTransform{redactWithoutConsent, dropMinors}
+
+	vals := []interface{}{"1 High Street", false, 47}
+	excludeRow, err := applyTransformsToRows(&vals, cols, rowTransforms, TableTransform{"age": upperAge})
+	require.NoError(t, err)
+	require.False(t, excludeRow)
+	require.Equal(t, []interface{}{nil, false, 40}, vals)
+
+	vals = []interface{}{"1 High Street", true, 47}
+	_, err = applyTransformsToRows(&vals, cols, rowTransforms, nil)
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{"1 High Street", true, 47}, vals)
+
+	vals = []interface{}{"1 High Street", true, 12}
+	excludeRow, err = applyTransformsToRows(&vals, cols, rowTransforms, nil)
+	require.NoError(t, err)
+	require.True(t, excludeRow)
+
+	// Row transforms cannot add columns which are not copied
+	addColumn := func(row map[string]interface{}) (bool, error) {
+		row["postcode"] = "AB1 2CD"
+		return false, nil
+	}
+	_, err = applyTransformsToRows(&vals, cols, []RowTransform{addColumn}, nil)
+	require.EqualError(t, err, "a row transform set the column postcode which is not copied")
+}
+
+func TestMySQLPrivateDatabase_Query_Allowed_Cols(t *testing.T) {
+	// Only allow the id and name columns to be accessed
+	group := &PrivacyGroup{name: "TestGroup", members: map[string]bool{"alice": true}}
+
+	staticDataPolicy := NewStaticDataPolicy([]*PrivacyGroup{group},
+		DataTransforms{group: &TableOperations{
+			TableTransforms: validEmptyFuncMap(),
+			ExcludedCols:    map[string][]string{},
+			AllowedCols:     map[string][]string{"people": {"id", "name"}},
+		}})
+
+	db := MySQLPrivateDatabase{
+		DataPolicy:  staticDataPolicy,
+		CacheTables: false,
+	}
+
+	err := db.Connect("demouser", "demopassword", "store1", "127.0.0.1", 3306)
+	require.NoError(t, err)
+
+	requestPolicy := localRequestPolicy("alice")
+
+	_, err = db.Query("SELECT name, dob from people", requestPolicy)
+	require.EqualError(t, err, `Error 1054: Unknown column 'dob' in 'field list'`)
+
+	rows, err := db.Query("SELECT * from people", requestPolicy)
+	require.NoError(t, err)
+	defer rows.Close()
+	cols, err := rows.Columns()
+	require.NoError(t, err)
+	require.Equal(t, []string{"id", "name"}, cols)
+
+	// Writes which refer to columns which are not allowed are rejected
+	_, err = db.Exec(`UPDATE people SET name = 'William' WHERE dob < '2000-01-01'`, requestPolicy)
+	require.EqualError(t, err, "ERROR 1054 (42S22): Unknown column 'dob'")
+}
+
+func TestMySQLPrivateDatabase_Query_Row_Filters(t *testing.T) {
+	group := &PrivacyGroup{name: "TestGroup", members: map[string]bool{"alice": true}}
+
+	// Only show alice the rows with her name
+	rowFilters := map[string][]RowFilter{"people": {{Column: "name", Operator: "=", Value: RequesterIDValue}}}
+	staticDataPolicy := NewStaticDataPolicy([]*PrivacyGroup{group},
+		DataTransforms{group: &TableOperations{
+			TableTransforms: validEmptyFuncMap(),
+			ExcludedCols:    map[string][]string{},
+			RowFilters:      rowFilters,
+		}})
+
+	db := MySQLPrivateDatabase{
+		DataPolicy:  staticDataPolicy,
+		CacheTables: false,
+	}
+
+	err := db.Connect("demouser", "demopassword", "store1", "127.0.0.1", 3306)
+	require.NoError(t, err)
+
+	// Write a row for alice and one for steve using the unwrapped database
+	_, err = db.database.Exec(`INSERT INTO people (name, dob) VALUES ('alice', '1997-11-01'), ('steve', '1996-02-07')`)
+	require.NoError(t, err)
+
+	rows, err := db.Query("SELECT name FROM people", localRequestPolicy("alice"))
+	require.NoError(t, err)
+	defer rows.Close()
+
+	rowCount := 0
+	var name string
+	for rows.Next() {
+		err = rows.Scan(&name)
+		require.NoError(t, err)
+		require.Equal(t, "alice", name)
+		rowCount++
+	}
+	require.NoError(t, rows.Err())
+	require.True(t, rowCount > 0)
+}
+
+func TestMySQLPrivateDatabase_Query_Default_Aggregates_Only(t *testing.T) {
+	group := &PrivacyGroup{name: "TestGroup", members: map[string]bool{"alice": true}}
+
+	staticDataPolicy := NewStaticDataPolicy([]*PrivacyGroup{group},
+		DataTransforms{group: &TableOperations{
+			TableTransforms: validEmptyFuncMap(),
+			ExcludedCols:    map[string][]string{},
+		}})
+	staticDataPolicy.Default = DefaultAggregatesOnly
+
+	db := MySQLPrivateDatabase{
+		DataPolicy:  staticDataPolicy,
+		CacheTables: false,
+	}
+
+	err := db.Connect("demouser", "demopassword", "store1", "127.0.0.1", 3306)
+	require.NoError(t, err)
+
+	// Requests with no requester are anonymous and only get aggregates
+	anonymousPolicy := &RequestPolicy{PreferredProcessingLocation: Local, HasAllRequiredData: true}
+	var count int
+	row, err := db.QueryRow("SELECT COUNT(*) FROM people", anonymousPolicy)
+	require.NoError(t, err)
+	require.NoError(t, row.Scan(&count))
+
+	_, err = db.Query("SELECT name FROM people", anonymousPolicy)
+	require.Equal(t, ErrAggregatesOnly, err)
+	_, err = db.Exec("DELETE FROM people", anonymousPolicy)
+	require.Equal(t, ErrAggregatesOnly, err)
+
+	// Alice is not restricted
+	rows, err := db.Query("SELECT name FROM people", localRequestPolicy("alice"))
+	require.NoError(t, err)
+	require.NoError(t, rows.Close())
+
+	// Without a default unknown requesters are denied
+	staticDataPolicy.Default = DefaultDenyAll
+	_, err = db.Query("SELECT COUNT(*) FROM people", localRequestPolicy("mallory"))
+	require.Equal(t, ErrAccessDenied, err)
+}
+
+func TestMySQLPrivateDatabase_Query_Purpose(t *testing.T) {
+	group := &PrivacyGroup{name: "TestGroup", members: map[string]bool{"alice": true}}
+
+	staticDataPolicy := NewStaticDataPolicy([]*PrivacyGroup{group}, DataTransforms{})
+	staticDataPolicy.Purposes = PurposeTransforms{group: {
+		"billing":  {AllowedCols: map[string][]string{"people": {"id", "name"}}},
+		"research": {AllowedCols: map[string][]string{"people": {"id", "dob"}}},
+	}}
+
+	db := MySQLPrivateDatabase{
+		DataPolicy:  staticDataPolicy,
+		CacheTables: true,
+	}
+
+	err := db.Connect("demouser", "demopassword", "store1", "127.0.0.1", 3306)
+	require.NoError(t, err)
+
+	// Cached tables are kept separate for each purpose
+	for purpose, expectedCols := range map[string][]string{
+		"billing":  {"id", "name"},
+		"research": {"id", "dob"},
+	} {
+		requestPolicy := localRequestPolicy("alice")
+		requestPolicy.Purpose = purpose
+
+		rows, err := db.Query("SELECT * FROM people", requestPolicy)
+		require.NoError(t, err)
+		cols, err := rows.Columns()
+		require.NoError(t, err)
+		require.Equal(t, expectedCols, cols)
+		require.NoError(t, rows.Close())
+	}
+
+	requestPolicy := localRequestPolicy("alice")
+	requestPolicy.Purpose = "marketing"
+	_, err = db.Query("SELECT * FROM people", requestPolicy)
+	require.Equal(t, ErrPurposeNotDeclared, err)
+}
+
+func TestMySQLPrivateDatabase_Query_Consent(t *testing.T) {
+	group := &PrivacyGroup{name: "TestGroup", members: map[string]bool{"alice": true}}
+
+	staticDataPolicy := NewStaticDataPolicy([]*PrivacyGroup{group},
+		DataTransforms{group: &TableOperations{TableTransforms: validEmptyFuncMap(), ExcludedCols: map[string][]string{}}})
+
+	db := MySQLPrivateDatabase{
+		DataPolicy:  staticDataPolicy,
+		CacheTables: true,
+		Consent:     &ConsentRegistry{SubjectColumns: map[string]string{"people": "name"}},
+	}
+
+	err := db.Connect("demouser", "demopassword", "store1", "127.0.0.1", 3306)
+	require.NoError(t, err)
+
+	_, err = db.database.Exec(`INSERT INTO people (name, dob) VALUES ('optout', '1990-01-01')`)
+	require.NoError(t, err)
+	defer db.OptIn(context.Background(), "optout")
+
+	countOptOut := func() int {
+		var count int
+		row, err := db.QueryRow("SELECT COUNT(*) FROM people WHERE name = 'optout'", localRequestPolicy("alice"))
+		require.NoError(t, err)
+		require.NoError(t, row.Scan(&count))
+		return count
+	}
+	require.True(t, countOptOut() > 0)
+
+	// Wait so the opt-out is recorded after the cached table was created
+	time.Sleep(time.Second)
+	err = db.OptOut(context.Background(), "optout", "alice", "")
+	require.NoError(t, err)
+	require.Equal(t, 0, countOptOut())
+
+	// Opting out of a different requester does not affect alice
+	time.Sleep(time.Second)
+	require.NoError(t, db.OptIn(context.Background(), "optout"))
+	require.NoError(t, db.OptOut(context.Background(), "optout", "bob", ""))
+	require.True(t, countOptOut() > 0)
+}
+
+func TestMySQLPrivateDatabase_Validate(t *testing.T) {
+	group := &PrivacyGroup{name: "TestGroup", members: map[string]bool{"alice": true}}
+	tableOperations := NewTableOperations()
+	tableOperations.TableTransforms = validFuncMap()
+	tableOperations.ExcludedCols["people"] = []string{"adress"}
+
+	db := MySQLPrivateDatabase{
+		DataPolicy: NewStaticDataPolicy([]*PrivacyGroup{group}, DataTransforms{group: tableOperations}),
+	}
+	err := db.Connect("demouser", "demopassword", "store1", "127.0.0.1", 3306)
+	require.NoError(t, err)
+
+	problems, err := db.Validate(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []PolicyProblem{{
+		Kind:    UnknownColumn,
+		Source:  "privacy group TestGroup",
+		Table:   "people",
+		Column:  "adress",
+		Message: "the column adress of table people does not exist",
+	}}, problems)
+}
+
+func TestMySQLPrivateDatabase_Explain(t *testing.T) {
+	group := &PrivacyGroup{name: "TestGroup", members: map[string]bool{"alice": true}}
+	tableOperations := NewTableOperations()
+	tableOperations.TableTransforms = validFuncMap()
+	tableOperations.ExcludedCols["people"] = []string{"id"}
+	tableOperations.RowFilters["people"] = []RowFilter{{Column: "name", Operator: "=", Value: RequesterIDValue}}
+
+	db := MySQLPrivateDatabase{
+		DataPolicy:  NewStaticDataPolicy([]*PrivacyGroup{group}, DataTransforms{group: tableOperations}),
+		CacheTables: true,
+	}
+	err := db.Connect("demouser", "demopassword", "store1", "127.0.0.1", 3306)
+	require.NoError(t, err)
+	err = db.core().dropCachedTables(transformedRequesterPrefix("alice"))
+	require.NoError(t, err)
+
+	explanation, err := db.Explain("SELECT name FROM people WHERE dob > ?", localRequestPolicy("alice"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"TestGroup"}, explanation.MatchedGroups)
+	require.False(t, explanation.UsedDefault)
+	require.Equal(t, "select name from "+transformedTablePrefix("alice", "")+"people as people where dob > ?",
+		explanation.RewrittenQuery)
+	require.Equal(t, []TableExplanation{{
+		Table:              "people",
+		VisibleColumns:     []string{"name", "dob"},
+		HiddenColumns:      []string{"id"},
+		TransformedColumns: []string{"name", "dob"},
+		RowFilter:          "`name` = ?",
+		RowFilterArgs:      []interface{}{"alice"},
+		TransformedTable:   transformedTablePrefix("alice", "") + "people",
+		Cached:             false,
+	}}, explanation.Tables)
+
+	// Running the query caches the transformed table
+	_, err = db.Query("SELECT name FROM people", localRequestPolicy("alice"))
+	require.NoError(t, err)
+	explanation, err = db.Explain("", localRequestPolicy("alice"))
+	require.NoError(t, err)
+	require.Empty(t, explanation.RewrittenQuery)
+	require.True(t, explanation.Tables[0].Cached)
+
+	_, err = db.Explain("", localRequestPolicy("eve"))
+	require.Equal(t, ErrAccessDenied, err)
+}
+
+func TestMySQLPrivateDatabase_Query_Inline(t *testing.T) {
+	group := &PrivacyGroup{name: "TestGroup", members: map[string]bool{"alice": true}}
+	truncateYear, err := TruncateDateSQLTransform("year")
+	require.NoError(t, err)
+	tableOperations := NewTableOperations()
+	tableOperations.SQLTransforms["people"] = SQLTableTransform{"dob": truncateYear}
+	tableOperations.RowFilters["people"] = []RowFilter{{Column: "name", Operator: "=", Value: RequesterIDValue}}
+
+	db := MySQLPrivateDatabase{
+		DataPolicy:  NewStaticDataPolicy([]*PrivacyGroup{group}, DataTransforms{group: tableOperations}),
+		CacheTables: true,
+	}
+	err = db.Connect("demouser", "demopassword", "store1", "127.0.0.1", 3306)
+	require.NoError(t, err)
+	err = db.core().dropCachedTables(transformedRequesterPrefix("alice"))
+	require.NoError(t, err)
+
+	result, err := db.database.Exec(`INSERT INTO people (name, dob) VALUES ('alice', '1997-11-01')`)
+	require.NoError(t, err)
+	id, err := result.LastInsertId()
+	require.NoError(t, err)
+
+	var dob time.Time
+	row, err := db.QueryRow("SELECT p.dob FROM people p WHERE p.id = ?", localRequestPolicy("alice"), id)
+	require.NoError(t, err)
+	require.NoError(t, row.Scan(&dob))
+	require.Equal(t, time.Date(1997, 1, 1, 0, 0, 0, 0, time.UTC), dob)
+
+	// The database applied the policy so nothing was copied
+	var count int
+	err = db.database.QueryRow(`SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = ? AND `+
+		`table_name LIKE ?`, db.databaseName, transformedRequesterPrefix("alice")+"%").Scan(&count)
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+}
+
 func TestMySqlPrivateDatabase_QueryRow_No_Caching(t *testing.T) {
 	db := validPrivateDBConnection(t, "store1", false)
-	_, err := db.QueryRow("SELECT * from people", &RequestPolicy{"alice", Local, true})
+	_, err := db.QueryRow("SELECT * from people", localRequestPolicy("alice"))
 	require.NoError(t, err)
 }
 
 func TestMySqlPrivateDatabase_QueryRow_Caching(t *testing.T) {
 	db := validPrivateDBConnection(t, "store1", true)
 	// Make sure the query has been run before
-	_, err := db.QueryRow("SELECT * from people", &RequestPolicy{"alice", Local, true})
+	_, err := db.QueryRow("SELECT * from people", localRequestPolicy("alice"))
 	require.NoError(t, err)
 	// Make the query again
-	_, err = db.QueryRow("SELECT * from people", &RequestPolicy{"alice", Local, true})
+	_, err = db.QueryRow("SELECT * from people", localRequestPolicy("alice"))
 	require.NoError(t, err)
 }
 
 func TestMySqlPrivateDatabase_Exec_Read_No_Caching(t *testing.T) {
 	db := validPrivateDBConnection(t, "store1", false)
 
-	_, err := db.Exec("SELECT * from people", &RequestPolicy{"alice", Local, true})
+	_, err := db.Exec("SELECT * from people", localRequestPolicy("alice"))
 	require.NoError(t, err)
 }
 
 func TestMySqlPrivateDatabase_Exec_Read_Caching(t *testing.T) {
 	db := validPrivateDBConnection(t, "store1", true)
 	// Make sure the query has been run before
-	_, err := db.Exec("SELECT * from people", &RequestPolicy{"alice", Local, true})
+	_, err := db.Exec("SELECT * from people", localRequestPolicy("alice"))
 	require.NoError(t, err)
 	// Make the query again
-	_, err = db.Exec("SELECT * from people", &RequestPolicy{"alice", Local, true})
+	_, err = db.Exec("SELECT * from people", localRequestPolicy("alice"))
 	require.NoError(t, err)
 }
 
 func TestMySqlPrivateDatabase_Exec_Write(t *testing.T) {
 	db := validPrivateDBConnection(t, "store1", true)
 
-	requestPolicy := &RequestPolicy{"alice", Local, true}
+	requestPolicy := localRequestPolicy("alice")
 
 	// Write a record
 	result, err := db.Exec(`INSERT INTO people (name, dob) VALUES ('steve', '1996-02-07')`,
@@ -254,10 +646,10 @@ func TestMySqlPrivateDatabase_Exec_Write_To_Excluded_Col(t *testing.T) {
 	funcMap := validEmptyFuncMap()
 	colMap := map[string][]string{"people": {"dob"}}
 
-	group := &PrivacyGroup{"TestGroup", map[string]bool{"alice": true}}
+	group := &PrivacyGroup{name: "TestGroup", members: map[string]bool{"alice": true}}
 
 	staticDataPolicy := NewStaticDataPolicy([]*PrivacyGroup{group},
-		DataTransforms{group: &TableOperations{funcMap, colMap}})
+		DataTransforms{group: &TableOperations{TableTransforms: funcMap, ExcludedCols: colMap}})
 
 	db := MySQLPrivateDatabase{
 		DataPolicy: staticDataPolicy,
@@ -274,8 +666,14 @@ func TestMySqlPrivateDatabase_Exec_Write_To_Excluded_Col(t *testing.T) {
 	require.NoError(t, err)
 
 	// Attempt to update the dob column (we assume the existence of (id, alice, 1997-11-01 in the database)
-	_, err = db.Exec(`UPDATE people SET dob = '1996-02-07' WHERE name = alice`,
-		&RequestPolicy{"alice", Local, true})
+	_, err = db.Exec(`UPDATE people SET dob = '1996-02-07' WHERE name = 'alice'`,
+		localRequestPolicy("alice"))
+	require.EqualError(t, err, "ERROR 1054 (42S22): Unknown column 'dob'")
+
+	// Inserting into the dob column, or into every column, is refused too
+	_, err = db.Exec(`INSERT INTO people (name, dob) VALUES ('steve', '1996-02-07')`, localRequestPolicy("alice"))
+	require.EqualError(t, err, "ERROR 1054 (42S22): Unknown column 'dob'")
+	_, err = db.Exec(`INSERT INTO people VALUES (NULL, 'steve', '1996-02-07')`, localRequestPolicy("alice"))
 	require.EqualError(t, err, "ERROR 1054 (42S22): Unknown column 'dob'")
 }
 
@@ -284,10 +682,10 @@ func TestMySqlPrivateDatabase_Exec_Write_Not_To_Excluded_Col(t *testing.T) {
 	funcMap := validEmptyFuncMap()
 	colMap := map[string][]string{"people": {"dob"}}
 
-	group := &PrivacyGroup{"TestGroup", map[string]bool{"alice": true}}
+	group := &PrivacyGroup{name: "TestGroup", members: map[string]bool{"alice": true}}
 
 	staticDataPolicy := NewStaticDataPolicy([]*PrivacyGroup{group},
-		DataTransforms{group: &TableOperations{funcMap, colMap}})
+		DataTransforms{group: &TableOperations{TableTransforms: funcMap, ExcludedCols: colMap}})
 
 	db := MySQLPrivateDatabase{
 		DataPolicy: staticDataPolicy,
@@ -304,21 +702,25 @@ func TestMySqlPrivateDatabase_Exec_Write_Not_To_Excluded_Col(t *testing.T) {
 	_, err = db.database.Exec(`INSERT INTO people (name, dob) VALUES ('alice', '1997-11-01')`)
 	require.NoError(t, err)
 
-	requestPolicy := &RequestPolicy{"alice", Local, true}
+	requestPolicy := localRequestPolicy("alice")
+
+	// Update the name column, which does not rely on the excluded column
+	_, err = db.Exec(`UPDATE people SET name = 'William' WHERE name = 'alice'`, requestPolicy)
+	require.NoError(t, err)
 
-	// Update the name column
-	_, err = db.Exec(`UPDATE people SET name = 'William' WHERE name = alice`, requestPolicy)
+	// Insert a row without the excluded column
+	_, err = db.Exec(`INSERT INTO people (name) VALUES ('steve')`, requestPolicy)
+	require.NoError(t, err)
 
-	// It was considered whether to not you should be able to update columns from a table where some are excluded from
-	// you as long as you don't rely on any of these columns. However it was decided that as the parser does not always
-	// make it clear which table a column is from this would not be possible.
+	// Updates which read the excluded column are refused
+	_, err = db.Exec(`UPDATE people SET name = dob WHERE name = 'William'`, requestPolicy)
 	require.EqualError(t, err, "ERROR 1054 (42S22): Unknown column 'dob'")
 }
 
 func TestMySqlPrivateDatabase_Exec_Delete(t *testing.T) {
 	db := validPrivateDBConnection(t, "store1", false)
 
-	requestPolicy := &RequestPolicy{"alice", Local, true}
+	requestPolicy := localRequestPolicy("alice")
 
 	// Write a record
 	result, err := db.Exec(`INSERT INTO people (name, dob) VALUES ('steve', '1996-02-07')`,
@@ -349,16 +751,16 @@ func TestMySqlPrivateDatabase_Exec_Delete_With_Excluded_Col(t *testing.T) {
 	funcMap := validEmptyFuncMap()
 	colMap := map[string][]string{"people": {"dob"}}
 
-	group := &PrivacyGroup{"TestGroup", map[string]bool{"alice": true}}
+	group := &PrivacyGroup{name: "TestGroup", members: map[string]bool{"alice": true}}
 
 	staticDataPolicy := NewStaticDataPolicy([]*PrivacyGroup{group},
-		DataTransforms{group: &TableOperations{funcMap, colMap}})
+		DataTransforms{group: &TableOperations{TableTransforms: funcMap, ExcludedCols: colMap}})
 
 	db := MySQLPrivateDatabase{
 		DataPolicy: staticDataPolicy,
 	}
 
-	requestPolicy := &RequestPolicy{"alice", Local, true}
+	requestPolicy := localRequestPolicy("alice")
 
 	err := db.Connect("demouser", "demopassword", "store1", "127.0.0.1", 3306)
 	require.NoError(t, err)
@@ -370,8 +772,63 @@ func TestMySqlPrivateDatabase_Exec_Delete_With_Excluded_Col(t *testing.T) {
 	writeID, err := result.LastInsertId()
 	require.NoError(t, err)
 
-	_, err = db.Exec(`DELETE FROM people WHERE id=?`, requestPolicy, writeID)
+	// Deletes which select rows by the excluded column are refused
+	_, err = db.Exec(`DELETE FROM people WHERE dob = '1997-11-01'`, requestPolicy)
 	require.EqualError(t, err, `ERROR 1054 (42S22): Unknown column 'dob'`)
+	_, err = db.Exec(`DELETE FROM people WHERE id=? ORDER BY dob LIMIT 1`, requestPolicy, writeID)
+	require.EqualError(t, err, `ERROR 1054 (42S22): Unknown column 'dob'`)
+
+	// Deletes which only rely on visible columns are allowed
+	_, err = db.Exec(`DELETE FROM people WHERE id=?`, requestPolicy, writeID)
+	require.NoError(t, err)
+}
+
+func TestMySQLPrivateDatabase_Query_Differential_Privacy(t *testing.T) {
+	group := &PrivacyGroup{name: "TestGroup", members: map[string]bool{"alice": true}}
+
+	staticDataPolicy := NewStaticDataPolicy([]*PrivacyGroup{group},
+		DataTransforms{group: &TableOperations{TableTransforms: validEmptyFuncMap(), ExcludedCols: map[string][]string{}}})
+
+	db := MySQLPrivateDatabase{
+		DataPolicy: staticDataPolicy,
+		DifferentialPrivacy: &DifferentialPrivacyPolicy{
+			PrivacyGroups:   []*PrivacyGroup{group},
+			Mechanism:       Laplace,
+			EpsilonPerQuery: 0.5,
+			Budget:          1,
+			Bounds: map[string]map[string]ColumnBounds{
+				"household_power_consumption": {"global_active_power": {Lower: 0, Upper: 10}},
+			},
+			BudgetStore: NewInMemoryPrivacyBudgetStore(),
+		},
+	}
+
+	err := db.Connect("demouser", "demopassword", "power_consumption", "127.0.0.1", 3306)
+	require.NoError(t, err)
+
+	requestPolicy := localRequestPolicy("alice")
+
+	var (
+		count   int64
+		average float64
+	)
+	row, err := db.QueryRow("SELECT COUNT(*), AVG(global_active_power) FROM household_power_consumption",
+		requestPolicy)
+	require.NoError(t, err)
+	err = row.Scan(&count, &average)
+	require.NoError(t, err)
+	require.True(t, count >= 0)
+	require.True(t, average >= 0 && average <= 10)
+
+	// Individual rows cannot be read
+	_, err = db.Query("SELECT global_active_power FROM household_power_consumption", requestPolicy)
+	require.Error(t, err)
+
+	// The second query uses the rest of the budget and the third is refused
+	_, err = db.Query("SELECT COUNT(*) FROM household_power_consumption", requestPolicy)
+	require.NoError(t, err)
+	_, err = db.Query("SELECT COUNT(*) FROM household_power_consumption", requestPolicy)
+	require.Equal(t, ErrPrivacyBudgetExhausted, err)
 }
 
 func validEmptyFuncMap() map[string]TableTransform {
@@ -416,14 +873,18 @@ func validFuncMap() map[string]TableTransform {
 	return funcMap
 }
 
+func localRequestPolicy(requesterID string) *RequestPolicy {
+	return &RequestPolicy{RequesterID: requesterID, PreferredProcessingLocation: Local, HasAllRequiredData: true}
+}
+
 func validPrivateDBConnection(t *testing.T, databaseName string, cacheTables bool) MySQLPrivateDatabase {
 	funcMap := validEmptyFuncMap()
 	colMap := map[string][]string{}
 
-	group := &PrivacyGroup{"TestGroup", map[string]bool{"alice": true}}
+	group := &PrivacyGroup{name: "TestGroup", members: map[string]bool{"alice": true}}
 
 	staticDataPolicy := NewStaticDataPolicy([]*PrivacyGroup{group},
-		DataTransforms{group: &TableOperations{funcMap, colMap}})
+		DataTransforms{group: &TableOperations{TableTransforms: funcMap, ExcludedCols: colMap}})
 
 	db := MySQLPrivateDatabase{
 		DataPolicy:  staticDataPolicy,
@@ -444,10 +905,10 @@ func TestIsTransformedTableValidTrue(t *testing.T) {
 	funcMap := validFuncMap()
 	colMap := map[string][]string{}
 
-	group := &PrivacyGroup{"TestGroup", map[string]bool{"alice": true}}
+	group := &PrivacyGroup{name: "TestGroup", members: map[string]bool{"alice": true}}
 
 	staticDataPolicy := NewStaticDataPolicy([]*PrivacyGroup{group},
-		DataTransforms{group: &TableOperations{funcMap, colMap}})
+		DataTransforms{group: &TableOperations{TableTransforms: funcMap, ExcludedCols: colMap}})
 
 	db := MySQLPrivateDatabase{
 		DataPolicy:  staticDataPolicy,
@@ -464,10 +925,10 @@ func TestIsTransformedTableValidTrue(t *testing.T) {
 
 	// Allow for slight clock skew between the database and Go time.Time
 	time.Sleep(1 * time.Second)
-	_, err = db.Query("SELECT * from people", &RequestPolicy{"alice", Local, true})
+	_, err = db.Query("SELECT * from people", localRequestPolicy("alice"))
 	require.NoError(t, err)
 
-	valid, err := db.isTransformedTableValid("people", "transformed_alice_people")
+	valid, err := db.core().isTransformedTableValid("people", transformedTablePrefix("alice", "")+"people")
 	require.NoError(t, err)
 
 	// Check that the transformed table is valid
@@ -475,13 +936,14 @@ func TestIsTransformedTableValidTrue(t *testing.T) {
 }
 
 func TestIsTransformedTableValidFalseTableUpdated(t *testing.T) {
-	funcMap := validEmptyFuncMap()
+	// The table must be copied to be cached so the policy needs a Go transform
+	funcMap := validFuncMap()
 	colMap := map[string][]string{}
 
-	group := &PrivacyGroup{"TestGroup", map[string]bool{"alice": true}}
+	group := &PrivacyGroup{name: "TestGroup", members: map[string]bool{"alice": true}}
 
 	staticDataPolicy := NewStaticDataPolicy([]*PrivacyGroup{group},
-		DataTransforms{group: &TableOperations{funcMap, colMap}})
+		DataTransforms{group: &TableOperations{TableTransforms: funcMap, ExcludedCols: colMap}})
 
 	db := MySQLPrivateDatabase{
 		DataPolicy:  staticDataPolicy,
@@ -496,7 +958,7 @@ func TestIsTransformedTableValidFalseTableUpdated(t *testing.T) {
 	db.SetMaxOpenConns(100)
 	db.SetConnMaxLifetime(time.Second * 20)
 
-	requestPolicy := &RequestPolicy{"alice", Local, true}
+	requestPolicy := localRequestPolicy("alice")
 
 	// Ensure a transform exists
 	_, err = db.Query("SELECT * from people", requestPolicy)
@@ -507,21 +969,55 @@ func TestIsTransformedTableValidFalseTableUpdated(t *testing.T) {
 		requestPolicy)
 	require.NoError(t, err)
 
-	valid, err := db.isTransformedTableValid("people", "transformed_alice_people")
+	valid, err := db.core().isTransformedTableValid("people", transformedTablePrefix("alice", "")+"people")
 	require.NoError(t, err)
 
 	// Check that the transformed table is valid
 	require.False(t, valid)
 }
 
+func TestMySQLPrivateDatabase_Query_Grant_Revoked(t *testing.T) {
+	group := NewPrivacyGroup("TestGroup")
+	group.Grant("contractor", time.Time{}, time.Time{})
+
+	staticDataPolicy := NewStaticDataPolicy([]*PrivacyGroup{group},
+		DataTransforms{group: &TableOperations{TableTransforms: validFuncMap(), ExcludedCols: map[string][]string{}}})
+
+	db := MySQLPrivateDatabase{
+		DataPolicy:  staticDataPolicy,
+		CacheTables: true,
+	}
+	err := db.Connect("demouser", "demopassword", "store1", "127.0.0.1", 3306)
+	require.NoError(t, err)
+
+	requestPolicy := localRequestPolicy("contractor")
+
+	// Ensure a transform exists
+	rows, err := db.Query("SELECT * from people", requestPolicy)
+	require.NoError(t, err)
+	require.NoError(t, rows.Close())
+
+	// Once access is revoked queries are denied and the cached table is dropped
+	group.Remove("contractor")
+	_, err = db.Query("SELECT * from people", requestPolicy)
+	require.Equal(t, ErrAccessDenied, err)
+
+	var count int
+	err = db.database.QueryRow(`SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = ? AND `+
+		`table_name = ?`, db.databaseName, transformedTablePrefix("contractor", "")+"people").Scan(&count)
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+}
+
 func TestIsTransformedTableValidFalsePolicyUpdated(t *testing.T) {
-	funcMap := validEmptyFuncMap()
+	// The table must be copied to be cached so the policy needs a Go transform
+	funcMap := validFuncMap()
 	colMap := map[string][]string{}
 
-	group := &PrivacyGroup{"TestGroup", map[string]bool{"alice": true}}
+	group := &PrivacyGroup{name: "TestGroup", members: map[string]bool{"alice": true}}
 
 	staticDataPolicy := NewStaticDataPolicy([]*PrivacyGroup{group},
-		DataTransforms{group: &TableOperations{funcMap, colMap}})
+		DataTransforms{group: &TableOperations{TableTransforms: funcMap, ExcludedCols: colMap}})
 
 	db := MySQLPrivateDatabase{
 		DataPolicy:  staticDataPolicy,
@@ -536,7 +1032,7 @@ func TestIsTransformedTableValidFalsePolicyUpdated(t *testing.T) {
 	db.SetMaxOpenConns(100)
 	db.SetConnMaxLifetime(time.Second * 20)
 
-	requestPolicy := &RequestPolicy{"alice", Local, true}
+	requestPolicy := localRequestPolicy("alice")
 
 	// Ensure a transform exists
 	_, err = db.Query("SELECT * from people", requestPolicy)
@@ -545,7 +1041,7 @@ func TestIsTransformedTableValidFalsePolicyUpdated(t *testing.T) {
 	// Updated the created time for the data policy so that it is more recent than the transform
 	staticDataPolicy.created = timeWithUTCLocation(time.Now())
 
-	valid, err := db.isTransformedTableValid("people", "transformed_alice_people")
+	valid, err := db.core().isTransformedTableValid("people", transformedTablePrefix("alice", "")+"people")
 	require.NoError(t, err)
 
 	// Check that the transformed table is valid
@@ -676,10 +1172,10 @@ func benchmarkMySQLPrivateDatabaseQueryReadNoCaching(b *testing.B, queryString s
 	funcMap := validEmptyFuncMap()
 	colMap := map[string][]string{}
 
-	group := &PrivacyGroup{"TestGroup", map[string]bool{"alice": true}}
+	group := &PrivacyGroup{name: "TestGroup", members: map[string]bool{"alice": true}}
 
 	staticDataPolicy := NewStaticDataPolicy([]*PrivacyGroup{group},
-		DataTransforms{group: &TableOperations{funcMap, colMap}})
+		DataTransforms{group: &TableOperations{TableTransforms: funcMap, ExcludedCols: colMap}})
 
 	db := MySQLPrivateDatabase{
 		DataPolicy:  staticDataPolicy,
@@ -790,7 +1286,7 @@ func BenchmarkMySQLPrivateDatabase_Query_Read_No_Caching_25000(b *testing.B) {
 }
 
 func benchmarkMySQLPrivateDatabaseQuery(b *testing.B, db MySQLPrivateDatabase, queryString string) *sql.Rows {
-	r, err := db.Query(queryString, &RequestPolicy{"alice", Local, true})
+	r, err := db.Query(queryString, localRequestPolicy("alice"))
 	if err != nil {
 		b.Error(err.Error())
 	}
@@ -802,10 +1298,10 @@ func benchmarkMySQLPrivateDatabaseQueryReadCaching(b *testing.B, queryString str
 	funcMap := validEmptyFuncMap()
 	colMap := map[string][]string{}
 
-	group := &PrivacyGroup{"TestGroup", map[string]bool{"alice": true}}
+	group := &PrivacyGroup{name: "TestGroup", members: map[string]bool{"alice": true}}
 
 	staticDataPolicy := NewStaticDataPolicy([]*PrivacyGroup{group},
-		DataTransforms{group: &TableOperations{funcMap, colMap}})
+		DataTransforms{group: &TableOperations{TableTransforms: funcMap, ExcludedCols: colMap}})
 
 	db := MySQLPrivateDatabase{
 		DataPolicy:  staticDataPolicy,
@@ -820,7 +1316,7 @@ func benchmarkMySQLPrivateDatabaseQueryReadCaching(b *testing.B, queryString str
 	db.SetConnMaxLifetime(time.Second * 20)
 
 	// Make the query once so we know we have a cached version of the table
-	_, err = db.Query(queryString, &RequestPolicy{"alice", Local, true})
+	_, err = db.Query(queryString, localRequestPolicy("alice"))
 	if err != nil {
 		b.Error(err.Error())
 	}
@@ -1065,10 +1561,10 @@ func benchmarkMySQLPrivateDatabaseExecWrite(b *testing.B, execString string, arg
 	funcMap := validEmptyFuncMap()
 	colMap := map[string][]string{}
 
-	group := &PrivacyGroup{"TestGroup", map[string]bool{"alice": true}}
+	group := &PrivacyGroup{name: "TestGroup", members: map[string]bool{"alice": true}}
 
 	staticDataPolicy := NewStaticDataPolicy([]*PrivacyGroup{group},
-		DataTransforms{group: &TableOperations{funcMap, colMap}})
+		DataTransforms{group: &TableOperations{TableTransforms: funcMap, ExcludedCols: colMap}})
 
 	db := MySQLPrivateDatabase{
 		DataPolicy:  staticDataPolicy,
@@ -1085,7 +1581,7 @@ func benchmarkMySQLPrivateDatabaseExecWrite(b *testing.B, execString string, arg
 	b.StartTimer()
 
 	_, err = db.Exec(execString,
-		&RequestPolicy{"alice", Local, true},
+		localRequestPolicy("alice"),
 		args...)
 	if err != nil {
 		b.Error(err.Error())
@@ -1184,3 +1680,20 @@ func BenchmarkMySQLPrivateDatabase_Exec_Write_20000(b *testing.B) {
 func BenchmarkMySQLPrivateDatabase_Exec_Write_25000(b *testing.B) {
 	benchmarkMySQLPrivateDatabaseEvecWriteN(b, 25000)
 }
+
+func TestTransformedTablePrefix(t *testing.T) {
+	require.Equal(t, "transformed_2bd806c97f0e00af_0_", transformedTablePrefix("alice", ""))
+	require.Equal(t, "transformed_2bd806c97f0e00af_66f62d1807d3821a_", transformedTablePrefix("alice", "research"))
+
+	// Requester IDs and purposes which differ only in case have different tables, as table names may be folded
+	require.NotEqual(t, strings.ToLower(transformedTablePrefix("Alice", "")),
+		strings.ToLower(transformedTablePrefix("alice", "")))
+	require.NotEqual(t, strings.ToLower(transformedTablePrefix("alice", "Research")),
+		strings.ToLower(transformedTablePrefix("alice", "research")))
+	require.False(t, strings.HasPrefix(transformedTablePrefix("alice", ""), transformedRequesterPrefix("ali")))
+
+	// Requester IDs and purposes containing underscores cannot be confused with each other
+	require.False(t, strings.HasPrefix(transformedTablePrefix("a_p", ""), transformedTablePrefix("a", "p")))
+	require.False(t, strings.HasPrefix(transformedTablePrefix("a", "p"), transformedTablePrefix("a_p", "")))
+	require.False(t, strings.HasPrefix(transformedTablePrefix("a", "p_q"), transformedTablePrefix("a_p", "q")))
+}
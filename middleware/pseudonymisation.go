@@ -0,0 +1,140 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sync"
+)
+
+// ErrUnknownPseudonym is returned when a PseudonymVault has no value recorded for a token
+var ErrUnknownPseudonym = errors.New("the pseudonym is not recorded in the vault")
+
+// PseudonymFormat is the form of the tokens a Pseudonymiser replaces values with
+type PseudonymFormat int
+
+const (
+	// HexPseudonym tokens are 32 hex characters so need a column which can hold strings of that length
+	HexPseudonym PseudonymFormat = iota
+	// IntegerPseudonym tokens are positive 63-bit integers which fit in a BIGINT column
+	IntegerPseudonym PseudonymFormat = iota
+)
+
+// Pseudonymiser replaces identifiers with tokens computed by a keyed HMAC. Tokens are the same for the same key,
+// value and scope, so joins across tables in a query still work, but differ between scopes so requesters in different
+// scopes cannot link their results. The key must be kept secret as anyone with it can check guesses of a value.
+type Pseudonymiser struct {
+	Key    []byte
+	Format PseudonymFormat
+	// Vault, if set, records the value behind each token so that it can be re-identified by the AuthorisedGroups.
+	// The columns it is used for should be marked in TableOperations.SideEffects.
+	Vault            PseudonymVault
+	AuthorisedGroups []*PrivacyGroup
+}
+
+// GroupTransform returns a ColumnTransform giving tokens which are shared by every requester using the transform,
+// the scope is usually the name of the privacy group the transform is for
+func (p *Pseudonymiser) GroupTransform(scope string) ColumnTransform {
+	return p.transform("group:" + scope)
+}
+
+// RequesterTransform returns a RequesterColumnTransform giving tokens which differ for each requester
+func (p *Pseudonymiser) RequesterTransform() RequesterColumnTransform {
+	return func(requesterID string) ColumnTransform {
+		return p.transform("requester:" + requesterID)
+	}
+}
+
+func (p *Pseudonymiser) transform(scope string) ColumnTransform {
+	return func(arg interface{}) (interface{}, bool, error) {
+		if arg == nil {
+			return nil, false, nil
+		}
+		if len(p.Key) == 0 {
+			return nil, false, errors.New("a pseudonymisation key is required")
+		}
+
+		value := toString(arg)
+		token := p.token(scope, value)
+		if p.Vault != nil {
+			err := p.Vault.Store(toString(token), value)
+			if err != nil {
+				return nil, false, err
+			}
+		}
+		return token, false, nil
+	}
+}
+
+func (p *Pseudonymiser) token(scope string, value string) interface{} {
+	mac := hmac.New(sha256.New, p.Key)
+	// Separate the scope from the value so that different pairs cannot give the same input
+	mac.Write([]byte(scope))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	sum := mac.Sum(nil)
+
+	if p.Format == IntegerPseudonym {
+		return int64(binary.BigEndian.Uint64(sum[:8]) >> 1)
+	}
+	return hex.EncodeToString(sum[:16])
+}
+
+// Reidentify returns the value behind a token if the requester is in one of the AuthorisedGroups, otherwise it
+// returns ErrAccessDenied
+func (p *Pseudonymiser) Reidentify(requesterID string, token string) (string, error) {
+	if p.Vault == nil {
+		return "", errors.New("the pseudonymiser does not have a vault")
+	}
+
+	authorised := false
+	for _, group := range p.AuthorisedGroups {
+		if group.contains(requesterID) {
+			authorised = true
+			break
+		}
+	}
+	if !authorised {
+		return "", ErrAccessDenied
+	}
+
+	return p.Vault.Lookup(token)
+}
+
+// PseudonymVault records the value behind each token given by a Pseudonymiser
+type PseudonymVault interface {
+	Store(token string, value string) error
+	Lookup(token string) (string, error)
+}
+
+// InMemoryPseudonymVault is a PseudonymVault which holds tokens in memory, they are lost when the process exits
+type InMemoryPseudonymVault struct {
+	sync.RWMutex
+	values map[string]string
+}
+
+// NewInMemoryPseudonymVault returns a pointer to an InMemoryPseudonymVault with initialised fields
+func NewInMemoryPseudonymVault() *InMemoryPseudonymVault {
+	return &InMemoryPseudonymVault{values: make(map[string]string)}
+}
+
+func (v *InMemoryPseudonymVault) Store(token string, value string) error {
+	v.Lock()
+	defer v.Unlock()
+
+	v.values[token] = value
+	return nil
+}
+
+func (v *InMemoryPseudonymVault) Lookup(token string) (string, error) {
+	v.RLock()
+	defer v.RUnlock()
+
+	value, ok := v.values[token]
+	if !ok {
+		return "", ErrUnknownPseudonym
+	}
+	return value, nil
+}
@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func applyColumnTransform(t *testing.T, transform ColumnTransform, value interface{}) interface{} {
+	transformed, excludeRow, err := transform(value)
+	require.NoError(t, err)
+	require.False(t, excludeRow)
+	return transformed
+}
+
+func TestPseudonymiser_GroupTransform(t *testing.T) {
+	p := &Pseudonymiser{Key: []byte("secret")}
+	analysts := p.GroupTransform("Analysts")
+
+	// Tokens are stable for the same value whatever type it was scanned as, so joins still work
+	token := applyColumnTransform(t, analysts, []byte("42"))
+	require.Len(t, token, 32)
+	require.Equal(t, token, applyColumnTransform(t, analysts, "42"))
+	require.Equal(t, token, applyColumnTransform(t, p.GroupTransform("Analysts"), int64(42)))
+	require.NotEqual(t, token, applyColumnTransform(t, analysts, "43"))
+
+	// Tokens differ between scopes and keys
+	require.NotEqual(t, token, applyColumnTransform(t, p.GroupTransform("Support"), "42"))
+	other := &Pseudonymiser{Key: []byte("other")}
+	require.NotEqual(t, token, applyColumnTransform(t, other.GroupTransform("Analysts"), "42"))
+
+	require.Nil(t, applyColumnTransform(t, analysts, nil))
+
+	_, _, err := (&Pseudonymiser{}).GroupTransform("Analysts")("42")
+	require.EqualError(t, err, "a pseudonymisation key is required")
+}
+
+func TestPseudonymiser_RequesterTransform(t *testing.T) {
+	p := &Pseudonymiser{Key: []byte("secret"), Format: IntegerPseudonym}
+	requesterTransform := p.RequesterTransform()
+
+	alice := applyColumnTransform(t, requesterTransform("alice"), "42")
+	require.IsType(t, int64(0), alice)
+	require.True(t, alice.(int64) >= 0)
+	require.Equal(t, alice, applyColumnTransform(t, requesterTransform("alice"), "42"))
+	require.NotEqual(t, alice, applyColumnTransform(t, requesterTransform("bob"), "42"))
+
+	// A requester's tokens do not match a group with the same name
+	require.NotEqual(t, alice, applyColumnTransform(t, p.GroupTransform("alice"), "42"))
+}
+
+func TestPseudonymiser_Reidentify(t *testing.T) {
+	auditors := NewPrivacyGroup("Auditors")
+	auditors.Add("carol")
+	p := &Pseudonymiser{
+		Key:              []byte("secret"),
+		Vault:            NewInMemoryPseudonymVault(),
+		AuthorisedGroups: []*PrivacyGroup{auditors},
+	}
+
+	token := applyColumnTransform(t, p.GroupTransform("Analysts"), "42").(string)
+
+	value, err := p.Reidentify("carol", token)
+	require.NoError(t, err)
+	require.Equal(t, "42", value)
+
+	_, err = p.Reidentify("alice", token)
+	require.Equal(t, ErrAccessDenied, err)
+	_, err = p.Reidentify("carol", "unknown")
+	require.Equal(t, ErrUnknownPseudonym, err)
+
+	_, err = (&Pseudonymiser{Key: []byte("secret")}).Reidentify("carol", token)
+	require.EqualError(t, err, "the pseudonymiser does not have a vault")
+}
+
+func TestStaticDataPolicy_Resolve_RequesterTransforms(t *testing.T) {
+	group := NewPrivacyGroup("Analysts")
+	group.AddMany([]string{"alice", "bob"})
+	p := &Pseudonymiser{Key: []byte("secret")}
+
+	dataPolicy := NewStaticDataPolicy([]*PrivacyGroup{group}, DataTransforms{
+		group: {
+			TableTransforms:     map[string]TableTransform{"people": {"name": NullOutTransform()}},
+			RequesterTransforms: map[string]RequesterTableTransform{"people": {"id": p.RequesterTransform()}},
+		},
+	})
+
+	aliceOperations, err := dataPolicy.Resolve("alice")
+	require.NoError(t, err)
+	bobOperations, err := dataPolicy.Resolve("bob")
+	require.NoError(t, err)
+
+	// Requester transforms are built for the requester alongside the other transforms
+	require.Empty(t, aliceOperations.RequesterTransforms)
+	require.Contains(t, aliceOperations.TableTransforms["people"], "name")
+	aliceToken := applyColumnTransform(t, aliceOperations.TableTransforms["people"]["id"], "1")
+	bobToken := applyColumnTransform(t, bobOperations.TableTransforms["people"]["id"], "1")
+	require.NotEqual(t, aliceToken, bobToken)
+
+	// The policy itself is not changed
+	require.NotContains(t, dataPolicy.transforms[group].TableTransforms["people"], "id")
+}
+
+func TestTableOperations_ForRequester_Clash(t *testing.T) {
+	p := &Pseudonymiser{Key: []byte("secret")}
+	tableOperations := &TableOperations{
+		TableTransforms:     map[string]TableTransform{"people": {"id": NullOutTransform()}},
+		RequesterTransforms: map[string]RequesterTableTransform{"people": {"id": p.RequesterTransform()}},
+	}
+
+	_, err := tableOperations.ForRequester("alice")
+	require.EqualError(t, err, "the column id of table people has both a transform and a requester transform")
+}
@@ -0,0 +1,144 @@
+package middleware
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+type requesterIDValue struct{}
+
+// RequesterIDValue can be used as the Value of a RowFilter to compare a column with the ID of the requester, for
+// example to only show rows which the requester owns
+var RequesterIDValue = requesterIDValue{}
+
+// RowFilter is a condition which rows of a table must satisfy to be visible to a requester. Filters are applied by the
+// database when a transformed table is built so excluded rows are never read out of it. The supported operators are
+// =, !=, <, <=, >, >=, LIKE, NOT LIKE, IN and NOT IN, which take a slice as their value, and IS NULL and IS NOT NULL,
+// which take no value. If AnyOf is set the filter is instead satisfied by rows which satisfy every filter in at least
+// one of its sets, and Column, Operator and Value are ignored.
+type RowFilter struct {
+	Column   string
+	Operator string
+	Value    interface{}
+	AnyOf    [][]RowFilter
+}
+
+var identifierRegexp = regexp.MustCompile(`^[A-Za-z0-9_$]+$`)
+
+func (f RowFilter) validate() error {
+	if f.AnyOf != nil {
+		for _, filters := range f.AnyOf {
+			if len(filters) == 0 {
+				return fmt.Errorf("every set of row filters in a disjunction must be non-empty")
+			}
+			for _, filter := range filters {
+				err := filter.validate()
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	if !identifierRegexp.MatchString(f.Column) {
+		return fmt.Errorf("%q is not a valid column name for a row filter", f.Column)
+	}
+
+	switch strings.ToUpper(f.Operator) {
+	case "=", "!=", "<", "<=", ">", ">=", "LIKE", "NOT LIKE":
+		if f.Value == nil {
+			return fmt.Errorf("the row filter on %s requires a value", f.Column)
+		}
+		if reflect.ValueOf(f.Value).Kind() == reflect.Slice && !isBytes(f.Value) {
+			return fmt.Errorf("the row filter on %s cannot compare with a list using %s", f.Column, f.Operator)
+		}
+	case "IN", "NOT IN":
+		if f.Value == nil || reflect.ValueOf(f.Value).Kind() != reflect.Slice || isBytes(f.Value) ||
+			reflect.ValueOf(f.Value).Len() == 0 {
+			return fmt.Errorf("the row filter on %s requires a non-empty list of values", f.Column)
+		}
+	case "IS NULL", "IS NOT NULL":
+		if f.Value != nil {
+			return fmt.Errorf("the row filter on %s cannot have a value with %s", f.Column, f.Operator)
+		}
+	default:
+		return fmt.Errorf("unknown row filter operator %q", f.Operator)
+	}
+	return nil
+}
+
+// sql returns the condition as SQL with placeholders for its values, and the arguments for those placeholders
+func (f RowFilter) sql(requesterID string) (string, []interface{}, error) {
+	err := f.validate()
+	if err != nil {
+		return "", nil, err
+	}
+
+	if f.AnyOf != nil {
+		var (
+			conditions []string
+			args       []interface{}
+		)
+		for _, filters := range f.AnyOf {
+			condition, filterArgs, err := rowFiltersSQL(filters, requesterID)
+			if err != nil {
+				return "", nil, err
+			}
+			conditions = append(conditions, fmt.Sprintf("(%s)", condition))
+			args = append(args, filterArgs...)
+		}
+		return fmt.Sprintf("(%s)", strings.Join(conditions, " OR ")), args, nil
+	}
+
+	operator := strings.ToUpper(f.Operator)
+	column := fmt.Sprintf("`%s`", f.Column)
+
+	switch operator {
+	case "IS NULL", "IS NOT NULL":
+		return fmt.Sprintf("%s %s", column, operator), nil, nil
+	case "IN", "NOT IN":
+		values := reflect.ValueOf(f.Value)
+		placeholders := make([]string, values.Len())
+		args := make([]interface{}, values.Len())
+		for i := 0; i < values.Len(); i++ {
+			placeholders[i] = "?"
+			args[i] = filterArgument(values.Index(i).Interface(), requesterID)
+		}
+		return fmt.Sprintf("%s %s (%s)", column, operator, strings.Join(placeholders, ", ")), args, nil
+	default:
+		return fmt.Sprintf("%s %s ?", column, operator), []interface{}{filterArgument(f.Value, requesterID)}, nil
+	}
+}
+
+func filterArgument(value interface{}, requesterID string) interface{} {
+	if _, ok := value.(requesterIDValue); ok {
+		return requesterID
+	}
+	return value
+}
+
+func isBytes(value interface{}) bool {
+	_, ok := value.([]byte)
+	return ok
+}
+
+// rowFiltersSQL returns a condition which is true for rows satisfying all of the passed filters, and the arguments
+// for its placeholders. The condition is empty if there are no filters.
+func rowFiltersSQL(filters []RowFilter, requesterID string) (string, []interface{}, error) {
+	var (
+		conditions []string
+		args       []interface{}
+	)
+	for _, filter := range filters {
+		condition, filterArgs, err := filter.sql(requesterID)
+		if err != nil {
+			return "", nil, err
+		}
+		conditions = append(conditions, condition)
+		args = append(args, filterArgs...)
+	}
+	return strings.Join(conditions, " AND "), args, nil
+}
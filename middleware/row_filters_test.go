@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestRowFiltersSQL(t *testing.T) {
+	filters := []RowFilter{
+		{Column: "region", Operator: "=", Value: "EU"},
+		{Column: "owner_id", Operator: "=", Value: RequesterIDValue},
+		{Column: "status", Operator: "not in", Value: []string{"deleted", "archived"}},
+		{Column: "dob", Operator: "IS NOT NULL"},
+	}
+
+	condition, args, err := rowFiltersSQL(filters, "alice")
+	require.NoError(t, err)
+	require.Equal(t, "`region` = ? AND `owner_id` = ? AND `status` NOT IN (?, ?) AND `dob` IS NOT NULL", condition)
+	require.Equal(t, []interface{}{"EU", "alice", "deleted", "archived"}, args)
+}
+
+func TestRowFiltersSQL_AnyOf(t *testing.T) {
+	filters := []RowFilter{
+		{AnyOf: [][]RowFilter{
+			{{Column: "region", Operator: "=", Value: "EU"}, {Column: "dob", Operator: "IS NOT NULL"}},
+			{{Column: "owner_id", Operator: "=", Value: RequesterIDValue}},
+		}},
+		{Column: "deleted", Operator: "IS NULL"},
+	}
+
+	condition, args, err := rowFiltersSQL(filters, "alice")
+	require.NoError(t, err)
+	require.Equal(t, "((`region` = ? AND `dob` IS NOT NULL) OR (`owner_id` = ?)) AND `deleted` IS NULL", condition)
+	require.Equal(t, []interface{}{"EU", "alice"}, args)
+}
+
+func TestRowFiltersSQL_Empty(t *testing.T) {
+	condition, args, err := rowFiltersSQL(nil, "alice")
+	require.NoError(t, err)
+	require.Equal(t, "", condition)
+	require.Empty(t, args)
+}
+
+func TestRowFilter_Invalid(t *testing.T) {
+	testCases := []struct {
+		filter RowFilter
+		err    string
+	}{
+		{RowFilter{Column: "region; DROP TABLE people", Operator: "=", Value: "EU"},
+			`"region; DROP TABLE people" is not a valid column name for a row filter`},
+		{RowFilter{Column: "region", Operator: "==", Value: "EU"}, `unknown row filter operator "=="`},
+		{RowFilter{Column: "region", Operator: "="}, "the row filter on region requires a value"},
+		{RowFilter{Column: "region", Operator: "=", Value: []string{"EU"}},
+			"the row filter on region cannot compare with a list using ="},
+		{RowFilter{Column: "region", Operator: "IN", Value: "EU"},
+			"the row filter on region requires a non-empty list of values"},
+		{RowFilter{Column: "region", Operator: "IN", Value: []string{}},
+			"the row filter on region requires a non-empty list of values"},
+		{RowFilter{Column: "region", Operator: "IS NULL", Value: "EU"},
+			"the row filter on region cannot have a value with IS NULL"},
+		{RowFilter{AnyOf: [][]RowFilter{{}}}, "every set of row filters in a disjunction must be non-empty"},
+		{RowFilter{AnyOf: [][]RowFilter{{{Column: "region", Operator: "~"}}}}, `unknown row filter operator "~"`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.err, func(t *testing.T) {
+			_, _, err := rowFiltersSQL([]RowFilter{tc.filter}, "alice")
+			require.EqualError(t, err, tc.err)
+		})
+	}
+}
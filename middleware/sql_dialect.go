@@ -0,0 +1,240 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/xwb1989/sqlparser"
+	"strings"
+	"time"
+)
+
+// sqlDialect is the part of rewriting queries which depends on the database the queries run on
+type sqlDialect interface {
+	// prepare creates anything the middleware needs in a newly opened database
+	prepare(db *sql.DB) error
+	// internalTable returns whether the middleware created the table for its own use
+	internalTable(tableName string) bool
+	// storedTableName returns the name the database stores a table under when a query names it as given, which is the
+	// name itself if there is no such table
+	storedTableName(db *sql.DB, databaseName string, tableName string) (string, error)
+	// tablesQuery returns a query for the name of every table in the database and its arguments
+	tablesQuery(databaseName string) (string, []interface{})
+	// columnsQuery returns a query for the name and data type of each column of a table, in order, and its arguments
+	columnsQuery(databaseName string, tableName string) (string, []interface{})
+	// schemaQuery returns a query for the table name, column name and data type of every column in the database
+	schemaQuery(databaseName string) (string, []interface{})
+	// createTableLike creates an empty table with the columns of another, apart from those dropped
+	createTableLike(db *sql.DB, tableName string, newTableName string, colsToDrop []string) error
+	// dropTableSQL returns the statements which drop a table if it exists
+	dropTableSQL(tableName string) []string
+	// createTemporaryTableLike creates an empty temporary table with the columns of another, apart from those dropped,
+	// which only the connection it is created on can see
+	createTemporaryTableLike(ctx context.Context, db sqlRunner, tableName string, newTableName string,
+		colsToDrop []string) error
+	// dropTemporaryTableSQL returns the statement which drops a temporary table if it exists, leaving any table of the
+	// same name which is not temporary
+	dropTemporaryTableSQL(tableName string) string
+	// tableCreated returns when a table was created and whether it exists
+	tableCreated(db *sql.DB, databaseName string, tableName string) (time.Time, bool, error)
+	// trackUpdates sets a table up so that tableLastUpdated can tell when it changes, if it is not already
+	trackUpdates(db *sql.DB, databaseName string, tableName string) error
+	// tableLastUpdated returns when a table was last updated, or when it was created if it has not been updated
+	tableLastUpdated(db *sql.DB, databaseName string, tableName string) (time.Time, error)
+	// consentTableSQL returns the statement which creates the table of a ConsentRegistry if it does not exist
+	consentTableSQL(tableName string) string
+	// privacyBudgetStore returns the PrivacyBudgetStore used if a DifferentialPrivacyPolicy does not have one
+	privacyBudgetStore(db *sql.DB, tableName string) (PrivacyBudgetStore, error)
+	// sampleValue returns a value like those scanned from a column of the data type
+	sampleValue(dataType string) interface{}
+	// normaliseQuery returns a query written in the database's SQL as one the SQL parser reads, with ? placeholders,
+	// and its arguments in the order of its placeholders
+	normaliseQuery(query string, args []interface{}) (string, []interface{}, error)
+	// nativeSQL returns a query built by the middleware, which is written in the SQL the parser reads, in the
+	// database's own SQL
+	nativeSQL(query string) (string, error)
+	// formatNode writes a parsed SQL node in the database's own SQL, it returns false to leave the node to formatSQL
+	formatNode(buf *sqlparser.TrackedBuffer, node sqlparser.SQLNode) bool
+	// placeholder returns the placeholder for the nth argument of a query, counting from 1
+	placeholder(n int) string
+}
+
+// mysqlDialect is the sqlDialect of MySQL, which keeps the times tables were created and updated in its
+// information_schema
+type mysqlDialect struct{}
+
+func (mysqlDialect) prepare(db *sql.DB) error {
+	return nil
+}
+
+func (mysqlDialect) internalTable(tableName string) bool {
+	return false
+}
+
+func (mysqlDialect) storedTableName(db *sql.DB, databaseName string, tableName string) (string, error) {
+	return tableName, nil
+}
+
+func (mysqlDialect) tablesQuery(databaseName string) (string, []interface{}) {
+	return `SELECT table_name FROM information_schema.tables WHERE table_schema = ?`, []interface{}{databaseName}
+}
+
+func (mysqlDialect) columnsQuery(databaseName string, tableName string) (string, []interface{}) {
+	return `SELECT column_name, data_type FROM information_schema.columns WHERE table_schema = ? AND table_name = ? ` +
+		`ORDER BY ordinal_position`, []interface{}{databaseName, tableName}
+}
+
+func (mysqlDialect) schemaQuery(databaseName string) (string, []interface{}) {
+	return `SELECT table_name, column_name, data_type FROM information_schema.columns WHERE table_schema = ?`,
+		[]interface{}{databaseName}
+}
+
+func (mysqlDialect) createTableLike(db *sql.DB, tableName string, newTableName string, colsToDrop []string) error {
+	createTableString := fmt.Sprintf("CREATE TABLE %s LIKE %s;", newTableName, tableName)
+	_, err := db.Exec(createTableString)
+	if err != nil {
+		return err
+	}
+
+	// Drop unnecessary columns
+	if len(colsToDrop) > 0 {
+		dropString := "DROP COLUMN " + strings.Join(colsToDrop, ", DROP COLUMN ")
+
+		dropTableString := fmt.Sprintf("ALTER TABLE %s %s;", newTableName, dropString)
+		_, err = db.Exec(dropTableString)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mysqlDialect) dropTableSQL(tableName string) []string {
+	return []string{fmt.Sprintf("DROP TABLE IF EXISTS %s;", tableName)}
+}
+
+func (mysqlDialect) createTemporaryTableLike(ctx context.Context, db sqlRunner, tableName string,
+	newTableName string, colsToDrop []string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("CREATE TEMPORARY TABLE %s LIKE %s;", newTableName, tableName))
+	if err != nil {
+		return err
+	}
+
+	// Drop unnecessary columns
+	if len(colsToDrop) > 0 {
+		dropString := "DROP COLUMN " + strings.Join(colsToDrop, ", DROP COLUMN ")
+		_, err = db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s %s;", newTableName, dropString))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mysqlDialect) dropTemporaryTableSQL(tableName string) string {
+	return fmt.Sprintf("DROP TEMPORARY TABLE IF EXISTS %s;", tableName)
+}
+
+func (mysqlDialect) tableCreated(db *sql.DB, databaseName string, tableName string) (time.Time, bool, error) {
+	timeOfCreationRow := db.QueryRow(
+		`SELECT create_time FROM information_schema.tables WHERE table_schema = ? AND table_name = ?`,
+		databaseName, tableName)
+
+	var nullTimeOfCreation mysql.NullTime
+	switch err := timeOfCreationRow.Scan(&nullTimeOfCreation); err {
+	case nil:
+		if !nullTimeOfCreation.Valid {
+			return time.Time{}, true, fmt.Errorf("malformed table entry %s, recreating", tableName)
+		}
+		return nullTimeOfCreation.Time, true, nil
+	case sql.ErrNoRows:
+		return time.Time{}, false, nil
+	default:
+		return time.Time{}, false, err
+	}
+}
+
+// trackUpdates does nothing as MySQL records when each table was last updated
+func (mysqlDialect) trackUpdates(db *sql.DB, databaseName string, tableName string) error {
+	return nil
+}
+
+func (mysqlDialect) tableLastUpdated(db *sql.DB, databaseName string, tableName string) (time.Time, error) {
+	timeOfLastUpdateRow := db.QueryRow(
+		`SELECT create_time, update_time FROM information_schema.tables WHERE table_schema = ? AND table_name = ?`,
+		databaseName, tableName)
+
+	var (
+		nullCreateTime       mysql.NullTime
+		nullTimeOfLastUpdate mysql.NullTime
+	)
+	switch err := timeOfLastUpdateRow.Scan(&nullCreateTime, &nullTimeOfLastUpdate); err {
+	case nil:
+		if nullTimeOfLastUpdate.Valid {
+			return nullTimeOfLastUpdate.Time, nil
+		} else if nullCreateTime.Valid {
+			// use the creation time
+			return nullCreateTime.Time, nil
+		}
+		// Can't find a create or updated time
+		return time.Time{}, fmt.Errorf("no creation or last updated time could be found for %s", tableName)
+	case sql.ErrNoRows:
+		// Table doesn't exist
+		return time.Time{}, fmt.Errorf("table %s doesn't exist", tableName)
+	default:
+		return time.Time{}, fmt.Errorf("error reading table %s", tableName)
+	}
+}
+
+func (mysqlDialect) consentTableSQL(tableName string) string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%s` ("+
+		"subject_key VARCHAR(255) NOT NULL, "+
+		"requester_id VARCHAR(255), "+
+		"purpose VARCHAR(255), "+
+		"INDEX (subject_key));", tableName)
+}
+
+func (mysqlDialect) privacyBudgetStore(db *sql.DB, tableName string) (PrivacyBudgetStore, error) {
+	return NewMySQLPrivacyBudgetStore(db, tableName)
+}
+
+// sampleValue returns a value like those scanned from a column of the MySQL data type when building transformed
+// tables, dates and times are parsed and everything else is read as bytes
+func (mysqlDialect) sampleValue(dataType string) interface{} {
+	switch dataType {
+	case "date", "datetime", "timestamp":
+		return time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	case "tinyint", "smallint", "mediumint", "int", "integer", "bigint", "decimal", "numeric", "float", "double",
+		"real", "year", "bit":
+		return []byte("1")
+	case "time":
+		return []byte("00:00:00")
+	}
+	return []byte("sample")
+}
+
+func (mysqlDialect) formatNode(buf *sqlparser.TrackedBuffer, node sqlparser.SQLNode) bool {
+	return false
+}
+
+func (mysqlDialect) normaliseQuery(query string, args []interface{}) (string, []interface{}, error) {
+	return query, args, nil
+}
+
+func (mysqlDialect) nativeSQL(query string) (string, error) {
+	return query, nil
+}
+
+func (mysqlDialect) placeholder(n int) string {
+	return "?"
+}
+
+// formatNativeSQL parses a query built by the middleware and writes it in the SQL of the dialect
+func formatNativeSQL(query string, dialect sqlDialect) (string, error) {
+	stmt, err := sqlparser.Parse(query)
+	if err != nil {
+		return "", err
+	}
+	return formatDialectSQL(stmt, dialect), nil
+}
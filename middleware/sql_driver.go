@@ -0,0 +1,158 @@
+package middleware
+
+import (
+	"context"
+	"database/sql/driver"
+	"reflect"
+)
+
+// afterRowsClosedKey is the context key of the statements a driver runs on the connection of a query once its rows
+// are closed
+type afterRowsClosedKey struct{}
+
+// afterRowsClosedDriver wraps the driver of a database so that any statements under afterRowsClosedKey in the context
+// of a query are run on the query's connection once its rows are closed. Uncached transformed tables are temporary
+// tables, which only the connection they were created on can drop and which cannot be dropped while they are read.
+type afterRowsClosedDriver struct {
+	driver.Driver
+}
+
+func (d *afterRowsClosedDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &afterRowsClosedConn{Conn: conn}, nil
+}
+
+// afterRowsClosedConn passes everything through to the connection of the wrapped driver, optional interfaces the
+// connection does not implement behave as database/sql treats connections without them
+type afterRowsClosedConn struct {
+	driver.Conn
+}
+
+func (c *afterRowsClosedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	rows, err := queryer.QueryContext(ctx, query, args)
+	afterRowsClosed, ok := ctx.Value(afterRowsClosedKey{}).([]string)
+	if err != nil || !ok {
+		return rows, err
+	}
+	return &afterRowsClosedRows{Rows: rows, conn: c, afterClosed: afterRowsClosed}, nil
+}
+
+func (c *afterRowsClosedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	return execer.ExecContext(ctx, query, args)
+}
+
+func (c *afterRowsClosedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	preparer, ok := c.Conn.(driver.ConnPrepareContext)
+	if !ok {
+		return c.Conn.Prepare(query)
+	}
+	return preparer.PrepareContext(ctx, query)
+}
+
+func (c *afterRowsClosedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	beginner, ok := c.Conn.(driver.ConnBeginTx)
+	if !ok {
+		return c.Conn.Begin()
+	}
+	return beginner.BeginTx(ctx, opts)
+}
+
+func (c *afterRowsClosedConn) Ping(ctx context.Context) error {
+	pinger, ok := c.Conn.(driver.Pinger)
+	if !ok {
+		return nil
+	}
+	return pinger.Ping(ctx)
+}
+
+func (c *afterRowsClosedConn) ResetSession(ctx context.Context) error {
+	resetter, ok := c.Conn.(driver.SessionResetter)
+	if !ok {
+		return nil
+	}
+	return resetter.ResetSession(ctx)
+}
+
+func (c *afterRowsClosedConn) IsValid() bool {
+	validator, ok := c.Conn.(driver.Validator)
+	return !ok || validator.IsValid()
+}
+
+func (c *afterRowsClosedConn) CheckNamedValue(value *driver.NamedValue) error {
+	checker, ok := c.Conn.(driver.NamedValueChecker)
+	if !ok {
+		return driver.ErrSkip
+	}
+	return checker.CheckNamedValue(value)
+}
+
+type afterRowsClosedRows struct {
+	driver.Rows
+	conn        *afterRowsClosedConn
+	afterClosed []string
+}
+
+func (r *afterRowsClosedRows) Close() error {
+	err := r.Rows.Close()
+	if err != nil {
+		return err
+	}
+	for _, statement := range r.afterClosed {
+		_, err = r.conn.ExecContext(context.Background(), statement, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *afterRowsClosedRows) ColumnTypeScanType(index int) reflect.Type {
+	scanTyper, ok := r.Rows.(driver.RowsColumnTypeScanType)
+	if !ok {
+		return reflect.TypeOf(new(interface{})).Elem()
+	}
+	return scanTyper.ColumnTypeScanType(index)
+}
+
+func (r *afterRowsClosedRows) ColumnTypeDatabaseTypeName(index int) string {
+	typeNamer, ok := r.Rows.(driver.RowsColumnTypeDatabaseTypeName)
+	if !ok {
+		return ""
+	}
+	return typeNamer.ColumnTypeDatabaseTypeName(index)
+}
+
+func (r *afterRowsClosedRows) ColumnTypeLength(index int) (int64, bool) {
+	lengther, ok := r.Rows.(driver.RowsColumnTypeLength)
+	if !ok {
+		return 0, false
+	}
+	return lengther.ColumnTypeLength(index)
+}
+
+func (r *afterRowsClosedRows) ColumnTypeNullable(index int) (bool, bool) {
+	nullabler, ok := r.Rows.(driver.RowsColumnTypeNullable)
+	if !ok {
+		return false, false
+	}
+	return nullabler.ColumnTypeNullable(index)
+}
+
+func (r *afterRowsClosedRows) ColumnTypePrecisionScale(index int) (int64, int64, bool) {
+	precisionScaler, ok := r.Rows.(driver.RowsColumnTypePrecisionScale)
+	if !ok {
+		return 0, 0, false
+	}
+	return precisionScaler.ColumnTypePrecisionScale(index)
+}
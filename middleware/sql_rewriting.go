@@ -0,0 +1,292 @@
+package middleware
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/xwb1989/sqlparser"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// sqlLiteral returns a value as an SQL literal. Policy values are written into rewritten queries as literals because
+// placeholders would change the positions of the query's own arguments.
+func sqlLiteral(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprint(v)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case time.Time:
+		return quoteSQLString(v.Format("2006-01-02 15:04:05.999999"))
+	case []byte:
+		if !utf8.Valid(v) {
+			return "X'" + hex.EncodeToString(v) + "'"
+		}
+		return quoteSQLString(string(v))
+	}
+	return quoteSQLString(toString(value))
+}
+
+func quoteSQLString(value string) string {
+	return sqlparser.String(sqlparser.NewStrVal([]byte(value)))
+}
+
+// inlineArgs replaces each placeholder in a condition built by the middleware with its argument as a literal. The
+// conditions only contain ? as placeholders since their identifiers are validated and their values are arguments.
+func inlineArgs(condition string, args []interface{}) string {
+	parts := strings.Split(condition, "?")
+	var inlined strings.Builder
+	for i, part := range parts {
+		inlined.WriteString(part)
+		if i < len(parts)-1 && i < len(args) {
+			inlined.WriteString(sqlLiteral(args[i]))
+		}
+	}
+	return inlined.String()
+}
+
+// selectList returns the expressions which read the columns of a table with any SQLTransforms applied
+func selectList(tableName string, colsToCopy []string, tableOperations *TableOperations) string {
+	expressions := make([]string, len(colsToCopy))
+	for i, col := range colsToCopy {
+		quotedCol := fmt.Sprintf("`%s`", col)
+		if transform, ok := tableOperations.SQLTransforms[tableName][col]; ok {
+			expressions[i] = fmt.Sprintf("%s AS %s", transform(quotedCol), quotedCol)
+		} else {
+			expressions[i] = quotedCol
+		}
+	}
+	return strings.Join(expressions, ", ")
+}
+
+// derivedTableSQL returns a SELECT which reads the table with the TableOperations applied by the database. It can only
+// be used for tables which do not need to be copied.
+func (pd *privateDatabase) derivedTableSQL(tableName string, tableOperations *TableOperations,
+	requesterID string, purpose string) (string, error) {
+	colsToCopy, _, err := pd.getColsToCopy(tableName, tableOperations)
+	if err != nil {
+		return "", err
+	}
+	if len(colsToCopy) == 0 {
+		return "", fmt.Errorf("all columns are excluded, cannot read %s", tableName)
+	}
+
+	rowFilter, rowFilterArgs, err := pd.rowFilter(tableName, tableOperations, requesterID, purpose)
+	if err != nil {
+		return "", err
+	}
+
+	derivedTable := fmt.Sprintf("SELECT %s FROM `%s`", selectList(tableName, colsToCopy, tableOperations), tableName)
+	if rowFilter != "" {
+		derivedTable += " WHERE " + inlineArgs(rowFilter, rowFilterArgs)
+	}
+	return derivedTable, nil
+}
+
+// tableSubstitution is what a table in a query is replaced with, either a transformed copy of the table or a derived
+// table which applies the policy as the query runs
+type tableSubstitution struct {
+	transformedTable string
+	derivedTable     string
+}
+
+// queryTableNames returns the names of the tables the statement reads from or writes to, without duplicates. Names
+// qualified by the database are returned unqualified, tables in other databases are an error as the policy cannot be
+// applied to them. Each table in the statement is renamed to the name the database stores it under, so that a name
+// written in another case cannot escape the policy for the table. The middleware's own tables are an error as though
+// they did not exist.
+func (pd *privateDatabase) queryTableNames(stmt sqlparser.Statement) ([]string, error) {
+	var tableNames []string
+	resolveTableName := func(tableName sqlparser.TableName) (sqlparser.TableName, error) {
+		if !tableName.Qualifier.IsEmpty() && tableName.Qualifier.String() != pd.databaseName {
+			return tableName, fmt.Errorf("cannot query tables in the database %s", tableName.Qualifier.String())
+		}
+		if tableName.Name.IsEmpty() {
+			return tableName, nil
+		}
+		storedName, err := pd.dialect.storedTableName(pd.database, pd.databaseName, tableName.Name.String())
+		if err != nil {
+			return tableName, err
+		}
+		if pd.internalTable(storedName) {
+			return tableName, fmt.Errorf("ERROR 1146 (42S02): Table '%s' doesn't exist", storedName)
+		}
+		tableName.Name = sqlparser.NewTableIdent(storedName)
+		tableNames = mergeStringSlice(tableNames, []string{storedName})
+		return tableName, nil
+	}
+
+	err := sqlparser.Walk(
+		func(node sqlparser.SQLNode) (kcontinue bool, err error) {
+			switch node := node.(type) {
+			case *sqlparser.AliasedTableExpr:
+				if tableName, ok := node.Expr.(sqlparser.TableName); ok {
+					node.Expr, err = resolveTableName(tableName)
+				}
+			case *sqlparser.Insert:
+				node.Table, err = resolveTableName(node.Table)
+			case *sqlparser.Delete:
+				for i, target := range node.Targets {
+					node.Targets[i], err = resolveTableName(target)
+					if err != nil {
+						break
+					}
+				}
+			}
+			return err == nil, err
+		}, stmt)
+	return tableNames, err
+}
+
+// substituteTables replaces each table in the statement which has a substitution and returns the resulting query.
+// Replaced tables keep their aliases, or are aliased to their own names, so that the rest of the query still refers
+// to them. Qualifiers naming the database are removed from the references to replaced tables in column names as the
+// aliases are not qualified.
+func (pd *privateDatabase) substituteTables(stmt sqlparser.Statement,
+	substitutions map[string]tableSubstitution) (string, error) {
+	derivedTables := make(map[string]*sqlparser.Subquery)
+	for tableName, substitution := range substitutions {
+		if substitution.derivedTable == "" {
+			continue
+		}
+		derivedStmt, err := sqlparser.Parse(substitution.derivedTable)
+		if err != nil {
+			return "", fmt.Errorf("the policy for %s could not be rewritten: %s", tableName, err.Error())
+		}
+		derivedTables[tableName] = &sqlparser.Subquery{Select: derivedStmt.(sqlparser.SelectStatement)}
+	}
+
+	unqualify := func(tableName *sqlparser.TableName) {
+		if _, ok := substitutions[tableName.Name.String()]; ok && tableName.Qualifier.String() == pd.databaseName {
+			tableName.Qualifier = sqlparser.NewTableIdent("")
+		}
+	}
+
+	err := sqlparser.Walk(
+		func(node sqlparser.SQLNode) (kcontinue bool, err error) {
+			switch node := node.(type) {
+			case *sqlparser.ColName:
+				unqualify(&node.Qualifier)
+			case *sqlparser.StarExpr:
+				unqualify(&node.TableName)
+			case *sqlparser.AliasedTableExpr:
+				tableName, ok := node.Expr.(sqlparser.TableName)
+				if !ok {
+					return true, nil
+				}
+				substitution, ok := substitutions[tableName.Name.String()]
+				if !ok || (!tableName.Qualifier.IsEmpty() && tableName.Qualifier.String() != pd.databaseName) {
+					return true, nil
+				}
+
+				if derivedTable, ok := derivedTables[tableName.Name.String()]; ok {
+					node.Expr = derivedTable
+				} else {
+					node.Expr = sqlparser.TableName{
+						Name:      sqlparser.NewTableIdent(substitution.transformedTable),
+						Qualifier: tableName.Qualifier,
+					}
+				}
+				if node.As.IsEmpty() {
+					node.As = tableName.Name
+				}
+				// Do not walk into the replacement, a derived table refers to the table it replaces
+				return false, nil
+			}
+			return true, nil
+		}, stmt)
+	if err != nil {
+		return "", err
+	}
+	return formatDialectSQL(stmt, pd.dialect), nil
+}
+
+// hiddenColumnReferenced returns a column hidden from the requester which a write refers to, or "" if it refers to
+// none. hiddenColumns holds the hidden columns of each table the write refers to and unreadableColumns the columns
+// which the requester only sees transformed, which may be written but not read. The columns an INSERT lists and an
+// UPDATE sets are written, any column named elsewhere in the statement, such as in its WHERE clause or in the values
+// it sets, is read. An INSERT without a column list writes every column. A column qualified by a table or alias is
+// looked up in that table. A column which is unqualified, or whose qualifier is not a table or alias of the
+// statement as written, is hidden if it is hidden in any of the tables as it may belong to any of them.
+func hiddenColumnReferenced(stmt sqlparser.Statement, hiddenColumns map[string][]string,
+	unreadableColumns map[string][]string) string {
+	hidden := func(columns map[string][]string, tableName string, column string) bool {
+		for _, hiddenColumn := range columns[tableName] {
+			if strings.EqualFold(hiddenColumn, column) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Columns are looked up once the aliases of every table are known
+	aliases := make(map[string]string)
+	var columns []*sqlparser.ColName
+	written := make(map[*sqlparser.ColName]bool)
+	_ = sqlparser.Walk(
+		func(node sqlparser.SQLNode) (kcontinue bool, err error) {
+			switch node := node.(type) {
+			case *sqlparser.AliasedTableExpr:
+				if tableName, ok := node.Expr.(sqlparser.TableName); ok && !node.As.IsEmpty() {
+					aliases[node.As.String()] = tableName.Name.String()
+				}
+			case *sqlparser.Insert:
+				insertColumns := node.Columns
+				if len(insertColumns) == 0 && len(hiddenColumns[node.Table.Name.String()]) > 0 {
+					insertColumns = sqlparser.Columns{sqlparser.NewColIdent(hiddenColumns[node.Table.Name.String()][0])}
+				}
+				for _, column := range insertColumns {
+					column := &sqlparser.ColName{Name: column, Qualifier: sqlparser.TableName{Name: node.Table.Name}}
+					columns = append(columns, column)
+					written[column] = true
+				}
+				for _, updateExpr := range node.OnDup {
+					written[updateExpr.Name] = true
+				}
+			case *sqlparser.Update:
+				for _, updateExpr := range node.Exprs {
+					written[updateExpr.Name] = true
+				}
+			case *sqlparser.ColName:
+				columns = append(columns, node)
+			}
+			return true, nil
+		}, stmt)
+
+	for _, column := range columns {
+		referenced := func(tableName string) bool {
+			return hidden(hiddenColumns, tableName, column.Name.String()) ||
+				(!written[column] && hidden(unreadableColumns, tableName, column.Name.String()))
+		}
+
+		tableName, ok := aliases[column.Qualifier.Name.String()]
+		if !ok {
+			tableName = column.Qualifier.Name.String()
+		}
+		if _, known := hiddenColumns[tableName]; known {
+			if referenced(tableName) {
+				return column.Name.String()
+			}
+			continue
+		}
+
+		// Unqualified columns, and qualifiers the database may match in another case, could be any table's
+		for tableName := range hiddenColumns {
+			if referenced(tableName) {
+				return column.Name.String()
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,190 @@
+package middleware
+
+import (
+	"github.com/stretchr/testify/require"
+	"github.com/xwb1989/sqlparser"
+	"testing"
+	"time"
+)
+
+func TestSQLLiteral(t *testing.T) {
+	testCases := []struct {
+		value   interface{}
+		literal string
+	}{
+		{nil, "NULL"},
+		{true, "1"},
+		{42, "42"},
+		{int64(-7), "-7"},
+		{2.5, "2.5"},
+		{"it's", "'it\\'s'"},
+		{[]byte("bob"), "'bob'"},
+		{[]byte{0xff, 0x00}, "X'ff00'"},
+		{time.Date(2007, 3, 17, 13, 45, 12, 0, time.UTC), "'2007-03-17 13:45:12'"},
+	}
+
+	for _, tc := range testCases {
+		require.Equal(t, tc.literal, sqlLiteral(tc.value))
+	}
+}
+
+func TestInlineArgs(t *testing.T) {
+	condition, args, err := rowFiltersSQL([]RowFilter{
+		{Column: "owner", Operator: "=", Value: RequesterIDValue},
+		{Column: "region", Operator: "IN", Value: []interface{}{"EU", "UK"}},
+	}, "alice")
+	require.NoError(t, err)
+
+	require.Equal(t, "`owner` = 'alice' AND `region` IN ('EU', 'UK')", inlineArgs(condition, args))
+}
+
+func TestQueryTableNames(t *testing.T) {
+	mspd := &MySQLPrivateDatabase{databaseName: "store1", dialect: mysqlDialect{}}
+
+	testCases := []struct {
+		query      string
+		tableNames []string
+	}{
+		{"SELECT p.id FROM people p JOIN people q ON p.id = q.id", []string{"people"}},
+		{"SELECT people.id FROM store1.people WHERE id IN (SELECT person_id FROM orders o)",
+			[]string{"people", "orders"}},
+		{"SELECT id FROM (SELECT id FROM people) AS orders", []string{"people"}},
+		{"INSERT INTO people (name) VALUES ('orders')", []string{"people"}},
+		{"UPDATE people SET name = ? WHERE id = ?", []string{"people"}},
+	}
+
+	for _, tc := range testCases {
+		stmt, err := sqlparser.Parse(tc.query)
+		require.NoError(t, err)
+		tableNames, err := mspd.core().queryTableNames(stmt)
+		require.NoError(t, err)
+		require.Equal(t, tc.tableNames, tableNames, tc.query)
+	}
+
+	stmt, err := sqlparser.Parse("SELECT id FROM other.people")
+	require.NoError(t, err)
+	_, err = mspd.core().queryTableNames(stmt)
+	require.EqualError(t, err, "cannot query tables in the database other")
+
+	// The privacy budgets cannot be read or reset by requesters
+	for _, query := range []string{"SELECT * FROM pam_privacy_budgets", "UPDATE pam_privacy_budgets SET spent = 0"} {
+		stmt, err = sqlparser.Parse(query)
+		require.NoError(t, err)
+		_, err = mspd.core().queryTableNames(stmt)
+		require.EqualError(t, err, "ERROR 1146 (42S02): Table 'pam_privacy_budgets' doesn't exist", query)
+	}
+}
+
+func TestSubstituteTables(t *testing.T) {
+	mspd := &MySQLPrivateDatabase{databaseName: "store1"}
+	substitutions := map[string]tableSubstitution{
+		"people": {transformedTable: "transformed_alice_people"},
+		"orders": {derivedTable: "SELECT `id`, `person_id`, ROUND(`total`, -1) AS `total` FROM `orders`"},
+	}
+	derivedOrders := "(select id, person_id, ROUND(total, -1) as total from orders) as orders"
+
+	// Each query exercises a case which replacing the names in the query text gets wrong
+	testCases := []struct {
+		query     string
+		rewritten string
+	}{
+		{
+			"SELECT * FROM people WHERE age > ?",
+			"select * from transformed_alice_people as people where age > ?",
+		},
+		{
+			"SELECT p.name FROM people AS p WHERE p.name = 'people'",
+			"select p.name from transformed_alice_people as p where p.name = 'people'",
+		},
+		{
+			"SELECT people, people_count FROM people_archive",
+			"select people, people_count from people_archive",
+		},
+		{
+			"SELECT people.name, people.* FROM people",
+			"select people.name, people.* from transformed_alice_people as people",
+		},
+		{
+			"SELECT store1.people.name FROM store1.people",
+			"select people.name from store1.transformed_alice_people as people",
+		},
+		{
+			"SELECT people.total FROM invoices people",
+			"select people.total from invoices as people",
+		},
+		{
+			"SELECT p.name, o.total FROM people p JOIN orders o ON o.person_id = p.id WHERE o.total > ?",
+			"select p.name, o.total from transformed_alice_people as p join " +
+				"(select id, person_id, ROUND(total, -1) as total from orders) as o on o.person_id = p.id " +
+				"where o.total > ?",
+		},
+		{
+			"SELECT name FROM people WHERE id IN (SELECT person_id FROM orders WHERE total > ?) AND name != ?",
+			"select name from transformed_alice_people as people where id in " +
+				"(select person_id from " + derivedOrders + " where total > ?) and name != ?",
+		},
+		{
+			"SELECT a.name FROM people a JOIN people b ON a.id = b.id",
+			"select a.name from transformed_alice_people as a join transformed_alice_people as b on a.id = b.id",
+		},
+		{
+			"SELECT id FROM people UNION SELECT person_id FROM orders",
+			"select id from transformed_alice_people as people union select person_id from " + derivedOrders,
+		},
+		{
+			"SELECT COUNT(*) FROM (SELECT person_id FROM orders GROUP BY person_id) AS people",
+			"select COUNT(*) from (select person_id from " + derivedOrders + " group by person_id) as people",
+		},
+	}
+
+	for _, tc := range testCases {
+		stmt, err := sqlparser.Parse(tc.query)
+		require.NoError(t, err)
+		rewritten, err := mspd.core().substituteTables(stmt, substitutions)
+		require.NoError(t, err)
+		require.Equal(t, tc.rewritten, rewritten, tc.query)
+	}
+}
+
+func TestHiddenColumnReferenced(t *testing.T) {
+	hiddenColumns := map[string][]string{"people": {"dob"}, "orders": {"total"}}
+	unreadableColumns := map[string][]string{"people": {"salary"}}
+
+	testCases := []struct {
+		query  string
+		column string
+	}{
+		{"INSERT INTO people (name) VALUES ('alice')", ""},
+		{"INSERT INTO people (name, DOB) VALUES ('alice', '2000-01-01')", "DOB"},
+		{"INSERT INTO people VALUES (1, 'alice', '2000-01-01')", "dob"},
+		{"INSERT INTO orders (id) VALUES (1)", ""},
+		{"INSERT INTO people (id, name) VALUES (1, 'alice') ON DUPLICATE KEY UPDATE name = VALUES(dob)", "dob"},
+		{"UPDATE people SET name = 'bob' WHERE id = 1", ""},
+		{"UPDATE people SET dob = '2000-01-01' WHERE id = 1", "dob"},
+		{"UPDATE people SET name = dob", "dob"},
+		{"UPDATE people SET name = 'bob' WHERE dob < '2000-01-01'", "dob"},
+		{"UPDATE people SET name = 'bob' ORDER BY dob LIMIT 1", "dob"},
+		{"UPDATE people p JOIN orders o ON p.id = o.person_id SET p.name = 'bob' WHERE o.id = 1", ""},
+		{"UPDATE people p JOIN orders o ON p.id = o.person_id SET p.name = 'bob' WHERE o.total > 10", "total"},
+		{"UPDATE people p JOIN orders o ON p.id = o.person_id SET p.name = 'bob' WHERE p.total > 10", ""},
+		{"UPDATE people JOIN orders ON people.id = orders.person_id SET name = 'bob' WHERE total > 10", "total"},
+		{"DELETE FROM people WHERE id = 1", ""},
+		{"DELETE FROM people", ""},
+		{"DELETE FROM people WHERE dob IS NULL", "dob"},
+		{"DELETE FROM store1.people WHERE store1.people.dob IS NULL", "dob"},
+		{"DELETE FROM people WHERE PEOPLE.dob IS NULL", "dob"},
+		{"UPDATE people SET salary = 0 WHERE id = 1", ""},
+		{"UPDATE people SET name = 'bob' WHERE salary > 10", "salary"},
+		{"UPDATE people SET name = salary", "salary"},
+		{"UPDATE people p SET p.salary = p.salary + 1", "salary"},
+		{"DELETE FROM people WHERE salary = 50000", "salary"},
+		{"INSERT INTO people (name, salary) VALUES ('alice', 1)", ""},
+		{"INSERT INTO people (id, salary) VALUES (1, 1) ON DUPLICATE KEY UPDATE salary = 2", ""},
+	}
+
+	for _, tc := range testCases {
+		stmt, err := sqlparser.Parse(tc.query)
+		require.NoError(t, err)
+		require.Equal(t, tc.column, hiddenColumnReferenced(stmt, hiddenColumns, unreadableColumns), tc.query)
+	}
+}
@@ -0,0 +1,727 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/xwb1989/sqlparser"
+	"hash"
+	"math"
+	"modernc.org/sqlite"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// sqliteDriverName is the name the SQLite driver is registered under, its connections have the MySQL functions used
+// by SQLTransforms
+const sqliteDriverName = "pam_sqlite3"
+
+// sqliteFunctionPrefix is added to the names the MySQL functions are registered under, so that they do not replace
+// SQLite's functions or those of other users of the driver
+const sqliteFunctionPrefix = "pam_"
+
+// sqliteTimeFormat is the format times are recorded in, they are read back with any number of fractional digits
+const sqliteTimeFormat = "2006-01-02 15:04:05.000000000"
+
+// sqliteTimeFormats are the formats the driver reads and writes times in, tried in order when reading a date
+var sqliteTimeFormats = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+var (
+	sqliteDriverOnce sync.Once
+	sqliteDriverErr  error
+)
+
+// registerSQLiteDriver registers the driver under sqliteDriverName the first time it is called. The pure Go driver
+// adds functions to every connection it opens, rather than through a hook on each connection, so the MySQL functions
+// are registered with it under names starting with sqliteFunctionPrefix, which sqliteDialect writes calls to them with.
+func registerSQLiteDriver() error {
+	sqliteDriverOnce.Do(func() {
+		for name, function := range sqliteMySQLFunctions {
+			function := function
+			err := sqlite.RegisterDeterministicScalarFunction(sqliteFunctionPrefix+name, function.arguments,
+				func(ctx *sqlite.FunctionContext, arguments []driver.Value) (driver.Value, error) {
+					return function.call(arguments)
+				})
+			if err != nil {
+				sqliteDriverErr = err
+				return
+			}
+		}
+		db, err := sql.Open("sqlite", "")
+		if err != nil {
+			sqliteDriverErr = err
+			return
+		}
+		sql.Register(sqliteDriverName, &afterRowsClosedDriver{Driver: db.Driver()})
+	})
+	return sqliteDriverErr
+}
+
+// SQLitePrivateDatabase is a wrapper around an SQLite database file which implements the PrivateRelationalDatabase
+// interface, it applies DataPolicies in the same way as MySQLPrivateDatabase so that a data client can run without a
+// database server. It is configured by setting its DataPolicy, CacheTables, Cache, DifferentialPrivacy and Consent
+// fields, a DifferentialPrivacyPolicy must be given a BudgetStore as there is no default one for SQLite.
+//
+// SQLite does not record when tables were last updated, so to tell whether cached tables are valid Connect adds
+// triggers to each table which record its changes in pam_table_versions. The transformed tables of a table created
+// since then are rebuilt each time they are used, until the next Connect adds its triggers.
+type SQLitePrivateDatabase privateDatabase
+
+func (spd *SQLitePrivateDatabase) core() *privateDatabase {
+	return (*privateDatabase)(spd)
+}
+
+// Connect opens the SQLite database file named databaseName, creating it if it does not exist. The user, password,
+// uri and port are not used. Tables in the file are qualified by the database name main in queries.
+func (spd *SQLitePrivateDatabase) Connect(user, password, databaseName, uri string, port int) error {
+	err := registerSQLiteDriver()
+	if err != nil {
+		return err
+	}
+	// Write-ahead logging lets transformed tables be dropped while their rows are still being read
+	db, err := sql.Open(sqliteDriverName, sqliteDataSourceName(databaseName))
+	if err != nil {
+		return err
+	}
+	return spd.core().connect(db, "main", sqliteDialect{})
+}
+
+// sqliteDataSourceName returns the data source name the driver opens a database file with, times are written in the
+// format the driver reads them back in
+func sqliteDataSourceName(path string) string {
+	return fmt.Sprintf("%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate&_time_format=sqlite",
+		path)
+}
+
+// UncoveredTables returns the tables in the database which the DataPolicy has no TableOperations for, see
+// MySQLPrivateDatabase.UncoveredTables
+func (spd *SQLitePrivateDatabase) UncoveredTables(ctx context.Context) ([]string, error) {
+	return spd.core().uncoveredTables(ctx)
+}
+
+// Close closes the SQLite database
+func (spd *SQLitePrivateDatabase) Close() error {
+	return spd.database.Close()
+}
+
+// Query runs a query over the tables as the DataPolicy resolved for the request policy allows them to be seen
+func (spd *SQLitePrivateDatabase) Query(query string, requestPolicy *RequestPolicy, args ...interface{}) (*sql.Rows, error) {
+	return spd.QueryContext(context.Background(), query, requestPolicy, args...)
+}
+
+// QueryContext runs a query over the tables as the DataPolicy resolved for the request policy allows them to be seen
+func (spd *SQLitePrivateDatabase) QueryContext(ctx context.Context, query string, requestPolicy *RequestPolicy, args ...interface{}) (*sql.Rows, error) {
+	return spd.core().queryContext(ctx, queryOptions{}, query, requestPolicy, args...)
+}
+
+// QueryRow runs a query which returns at most one row over the tables as the DataPolicy resolved for the request
+// policy allows them to be seen
+func (spd *SQLitePrivateDatabase) QueryRow(query string, requestPolicy *RequestPolicy, args ...interface{}) (*sql.Row, error) {
+	return spd.QueryRowContext(context.Background(), query, requestPolicy, args...)
+}
+
+// QueryRowContext runs a query which returns at most one row over the tables as the DataPolicy resolved for the
+// request policy allows them to be seen
+func (spd *SQLitePrivateDatabase) QueryRowContext(ctx context.Context, query string, requestPolicy *RequestPolicy, args ...interface{}) (*sql.Row, error) {
+	return spd.core().queryRowContext(ctx, queryOptions{}, query, requestPolicy, args...)
+}
+
+// Exec runs a statement, writes are refused if they touch columns the requester cannot see and only change the rows
+// their WriteFilters allow
+func (spd *SQLitePrivateDatabase) Exec(query string, requestPolicy *RequestPolicy, args ...interface{}) (sql.Result, error) {
+	return spd.ExecContext(context.Background(), query, requestPolicy, args...)
+}
+
+// ExecContext runs a statement, writes are refused if they touch columns the requester cannot see and only change the
+// rows their WriteFilters allow
+func (spd *SQLitePrivateDatabase) ExecContext(ctx context.Context, query string, requestPolicy *RequestPolicy, args ...interface{}) (sql.Result, error) {
+	return spd.core().execContext(ctx, queryOptions{}, query, requestPolicy, args...)
+}
+
+// Begin begins a transaction whose statements are run for the requester of the request policy
+func (spd *SQLitePrivateDatabase) Begin(requestPolicy *RequestPolicy) (*Tx, error) {
+	return spd.BeginTx(context.Background(), requestPolicy, nil)
+}
+
+// BeginTx begins a transaction whose statements are run for the requester of the request policy, see sql.DB.BeginTx
+func (spd *SQLitePrivateDatabase) BeginTx(ctx context.Context, requestPolicy *RequestPolicy, opts *sql.TxOptions) (*Tx, error) {
+	return spd.core().beginTx(ctx, requestPolicy, opts)
+}
+
+// Prepare returns a prepared statement for a query which can be run for any request policy
+func (spd *SQLitePrivateDatabase) Prepare(query string) (*Stmt, error) {
+	return spd.core().prepare(query)
+}
+
+// Stats returns database statistics
+func (spd *SQLitePrivateDatabase) Stats() sql.DBStats {
+	return spd.database.Stats()
+}
+
+// SetConnMaxLifetime sets the maximum amount of time a connection may be reused, see sql.DB.SetConnMaxLifetime
+func (spd *SQLitePrivateDatabase) SetConnMaxLifetime(d time.Duration) {
+	spd.database.SetConnMaxLifetime(d)
+}
+
+// SetMaxOpenConns sets the maximum number of open connections to the database, see sql.DB.SetMaxOpenConns
+func (spd *SQLitePrivateDatabase) SetMaxOpenConns(n int) {
+	spd.database.SetMaxOpenConns(n)
+}
+
+// SetMaxIdleConns sets the maximum number of idle connections to the database, see sql.DB.SetMaxIdleConns
+func (spd *SQLitePrivateDatabase) SetMaxIdleConns(n int) {
+	spd.database.SetMaxIdleConns(n)
+}
+
+// Ping verifies the database can still be used
+func (spd *SQLitePrivateDatabase) Ping() error {
+	return spd.database.Ping()
+}
+
+// PingContext verifies the database can still be used
+func (spd *SQLitePrivateDatabase) PingContext(ctx context.Context) error {
+	return spd.database.PingContext(ctx)
+}
+
+// Explain describes the TableOperations which apply to the requester and how a query would be rewritten, see
+// MySQLPrivateDatabase.Explain
+func (spd *SQLitePrivateDatabase) Explain(query string, requestPolicy *RequestPolicy) (*Explanation, error) {
+	return spd.core().explain(query, requestPolicy)
+}
+
+// Validate checks the DataPolicy and consent registry against the database, see MySQLPrivateDatabase.Validate
+func (spd *SQLitePrivateDatabase) Validate(ctx context.Context) ([]PolicyProblem, error) {
+	return spd.core().validate(ctx)
+}
+
+// OptOut records that the data subject has opted out of their data being seen by the requester for the purpose, see
+// MySQLPrivateDatabase.OptOut
+func (spd *SQLitePrivateDatabase) OptOut(ctx context.Context, subjectKey string, requesterID string,
+	purpose string) error {
+	return spd.core().optOut(ctx, subjectKey, requesterID, purpose)
+}
+
+// OptIn removes every opt-out recorded for the data subject
+func (spd *SQLitePrivateDatabase) OptIn(ctx context.Context, subjectKey string) error {
+	return spd.core().optIn(ctx, subjectKey)
+}
+
+// sqliteDialect is the sqlDialect of SQLite, the times tables were created and updated are recorded by the middleware
+// in pam_table_versions
+type sqliteDialect struct{}
+
+func (sqliteDialect) prepare(db *sql.DB) error {
+	_, err := db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s ("+
+		"table_name TEXT NOT NULL PRIMARY KEY, "+
+		"updated_at TEXT NOT NULL);", tableVersionsTableName))
+	return err
+}
+
+func (sqliteDialect) internalTable(tableName string) bool {
+	return tableName == tableVersionsTableName || strings.HasPrefix(tableName, "sqlite_")
+}
+
+// storedTableName looks the table up in the schema as SQLite matches table names regardless of case
+func (sqliteDialect) storedTableName(db *sql.DB, databaseName string, tableName string) (string, error) {
+	var storedName string
+	err := db.QueryRow(`SELECT name FROM sqlite_master WHERE type = 'table' AND name = ? COLLATE NOCASE`,
+		tableName).Scan(&storedName)
+	if err == sql.ErrNoRows {
+		return tableName, nil
+	}
+	return storedName, err
+}
+
+func (sqliteDialect) tablesQuery(databaseName string) (string, []interface{}) {
+	return `SELECT name FROM sqlite_master WHERE type = 'table'`, nil
+}
+
+func (sqliteDialect) columnsQuery(databaseName string, tableName string) (string, []interface{}) {
+	return `SELECT name, type FROM pragma_table_info(?) ORDER BY cid`, []interface{}{tableName}
+}
+
+func (sqliteDialect) schemaQuery(databaseName string) (string, []interface{}) {
+	return `SELECT m.name, p.name, p.type FROM sqlite_master m JOIN pragma_table_info(m.name) p ` +
+		`WHERE m.type = 'table'`, nil
+}
+
+// createTableLike creates a table with the declared types of the columns of the other table, which the driver uses to
+// read dates and times back, and records when it was created
+func (d sqliteDialect) createTableLike(db *sql.DB, tableName string, newTableName string, colsToDrop []string) error {
+	definitions, err := d.columnDefinitions(context.Background(), db, tableName, colsToDrop)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(fmt.Sprintf("CREATE TABLE %s (%s);", newTableName, definitions))
+	if err != nil {
+		return err
+	}
+	err = sqliteRecordUpdate(tx, newTableName)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// createTemporaryTableLike creates a temporary table with the declared types of the columns of the other table, it is
+// never cached so its creation is not recorded
+func (d sqliteDialect) createTemporaryTableLike(ctx context.Context, db sqlRunner, tableName string,
+	newTableName string, colsToDrop []string) error {
+	definitions, err := d.columnDefinitions(ctx, db, tableName, colsToDrop)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, fmt.Sprintf("CREATE TEMPORARY TABLE %s (%s);", newTableName, definitions))
+	return err
+}
+
+// columnDefinitions returns the definitions of the columns of a table which are not dropped with their declared types
+func (d sqliteDialect) columnDefinitions(ctx context.Context, db sqlRunner, tableName string,
+	colsToDrop []string) (string, error) {
+	columnsQuery, columnsArgs := d.columnsQuery("main", tableName)
+	columns, err := db.QueryContext(ctx, columnsQuery, columnsArgs...)
+	if err != nil {
+		return "", err
+	}
+	defer columns.Close()
+
+	var (
+		colName     string
+		colType     string
+		definitions []string
+	)
+	for columns.Next() {
+		err := columns.Scan(&colName, &colType)
+		if err != nil {
+			return "", err
+		}
+		if !contains(colsToDrop, colName) {
+			definitions = append(definitions, strings.TrimSpace(fmt.Sprintf("`%s` %s", colName, colType)))
+		}
+	}
+	if columns.Err() != nil {
+		return "", columns.Err()
+	}
+	return strings.Join(definitions, ", "), nil
+}
+
+func (sqliteDialect) dropTableSQL(tableName string) []string {
+	return []string{
+		fmt.Sprintf("DROP TABLE IF EXISTS %s;", tableName),
+		fmt.Sprintf("DELETE FROM %s WHERE table_name = %s;", tableVersionsTableName, sqlLiteral(tableName)),
+	}
+}
+
+func (sqliteDialect) dropTemporaryTableSQL(tableName string) string {
+	return fmt.Sprintf("DROP TABLE IF EXISTS temp.%s;", tableName)
+}
+
+func (sqliteDialect) tableCreated(db *sql.DB, databaseName string, tableName string) (time.Time, bool, error) {
+	var createdAt sql.NullString
+	err := db.QueryRow(fmt.Sprintf("SELECT v.updated_at FROM sqlite_master m "+
+		"LEFT JOIN %s v ON v.table_name = m.name WHERE m.type = 'table' AND m.name = ?", tableVersionsTableName),
+		tableName).Scan(&createdAt)
+	switch {
+	case err == sql.ErrNoRows:
+		return time.Time{}, false, nil
+	case err != nil:
+		return time.Time{}, false, err
+	case !createdAt.Valid:
+		return time.Time{}, true, fmt.Errorf("no creation time is recorded for %s, recreating", tableName)
+	}
+
+	timeOfCreation, err := time.ParseInLocation("2006-01-02 15:04:05", createdAt.String, time.UTC)
+	return timeOfCreation, true, err
+}
+
+// trackUpdates adds triggers to the table which record when it changes if it does not have them, in which case it is
+// recorded as having been updated now
+func (sqliteDialect) trackUpdates(db *sql.DB, databaseName string, tableName string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	tracked, err := sqliteTracksUpdates(tx, tableName)
+	if err != nil || tracked {
+		return err
+	}
+	for _, operation := range sqliteTrackedOperations {
+		_, err = tx.Exec(fmt.Sprintf("CREATE TRIGGER IF NOT EXISTS `pam_updated_%s_%s` AFTER %s ON `%s` "+
+			"BEGIN %s END;", strings.ToLower(operation), tableName, operation, tableName,
+			sqliteTriggerUpdateSQL(tableName)))
+		if err != nil {
+			return err
+		}
+	}
+	err = sqliteRecordUpdate(tx, tableName)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// tableLastUpdated reads when the triggers added by trackUpdates last recorded a change to the table, a table without
+// them, such as one created since the middleware connected, is treated as having been updated now
+func (sqliteDialect) tableLastUpdated(db *sql.DB, databaseName string, tableName string) (time.Time, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	var tables int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, tableName).Scan(&tables)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if tables == 0 {
+		return time.Time{}, fmt.Errorf("table %s doesn't exist", tableName)
+	}
+
+	tracked, err := sqliteTracksUpdates(tx, tableName)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !tracked {
+		return timeWithUTCLocation(time.Now()), nil
+	}
+
+	var updatedAt string
+	err = tx.QueryRow(fmt.Sprintf("SELECT updated_at FROM %s WHERE table_name = ?", tableVersionsTableName),
+		tableName).Scan(&updatedAt)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error reading table %s", tableName)
+	}
+	return time.ParseInLocation("2006-01-02 15:04:05", updatedAt, time.UTC)
+}
+
+// sqliteTrackedOperations are the operations which have a trigger recording that they changed the table
+var sqliteTrackedOperations = []string{"INSERT", "UPDATE", "DELETE"}
+
+// sqliteTracksUpdates returns whether the table has all of the triggers which record its changes
+func sqliteTracksUpdates(tx *sql.Tx, tableName string) (bool, error) {
+	var triggers int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND tbl_name = ? AND name LIKE ?`,
+		tableName, "pam_updated_%").Scan(&triggers)
+	return triggers == len(sqliteTrackedOperations), err
+}
+
+// sqliteRecordUpdate records that a table was updated, or created, now. Local times are recorded, as MySQL does,
+// because they are compared with policy update times which are local times labelled as UTC.
+func sqliteRecordUpdate(tx *sql.Tx, tableName string) error {
+	_, err := tx.Exec(fmt.Sprintf("INSERT OR REPLACE INTO %s (table_name, updated_at) VALUES (?, ?);",
+		tableVersionsTableName), tableName, timeWithUTCLocation(time.Now()).Format(sqliteTimeFormat))
+	return err
+}
+
+// sqliteTriggerUpdateSQL returns the statement the triggers on a table run to record that it was updated. SQLite's
+// clock only has millisecond precision so the end of the current millisecond is recorded, a cached table built in the
+// same millisecond is then treated as out of date rather than possibly missing the update.
+func sqliteTriggerUpdateSQL(tableName string) string {
+	return fmt.Sprintf("INSERT OR REPLACE INTO %s (table_name, updated_at) "+
+		"VALUES (%s, strftime('%%Y-%%m-%%d %%H:%%M:%%f', 'now', 'localtime', '+0.001 seconds'));",
+		tableVersionsTableName, sqlLiteral(tableName))
+}
+
+func (sqliteDialect) consentTableSQL(tableName string) string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%s` ("+
+		"subject_key VARCHAR(255) NOT NULL, "+
+		"requester_id VARCHAR(255), "+
+		"purpose VARCHAR(255)); "+
+		"CREATE INDEX IF NOT EXISTS `%s_subject_key` ON `%s` (subject_key);", tableName, tableName, tableName)
+}
+
+func (sqliteDialect) privacyBudgetStore(db *sql.DB, tableName string) (PrivacyBudgetStore, error) {
+	return nil, errors.New("there is no default privacy budget store for SQLite, the differential privacy policy " +
+		"needs a BudgetStore")
+}
+
+// sampleValue returns a value like those the driver scans from a column with the declared type, following SQLite's
+// rules for the affinity of a type
+func (sqliteDialect) sampleValue(dataType string) interface{} {
+	dataType = strings.TrimSpace(strings.SplitN(dataType, "(", 2)[0])
+	switch {
+	case dataType == "date" || dataType == "datetime" || dataType == "timestamp":
+		return time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	case strings.Contains(dataType, "int"):
+		return int64(1)
+	case strings.Contains(dataType, "char") || strings.Contains(dataType, "clob") || strings.Contains(dataType, "text"):
+		return "sample"
+	case dataType == "" || strings.Contains(dataType, "blob"):
+		return []byte("sample")
+	case strings.Contains(dataType, "real") || strings.Contains(dataType, "floa") || strings.Contains(dataType, "doub"):
+		return float64(1)
+	}
+	return int64(1)
+}
+
+func (sqliteDialect) normaliseQuery(query string, args []interface{}) (string, []interface{}, error) {
+	return query, args, nil
+}
+
+func (d sqliteDialect) nativeSQL(query string) (string, error) {
+	return formatNativeSQL(query, d)
+}
+
+func (sqliteDialect) placeholder(n int) string {
+	return "?"
+}
+
+// formatNode writes MySQL's casts in SQLite, where casting to a type without a storage class of its own only changes
+// the value's affinity, so "1990-05-01" cast to DATETIME would become the number 1990. Selecting from MySQL's dual
+// table is written without a FROM clause, and the MySQL functions SQLite does not have call those registered with
+// the driver.
+func (sqliteDialect) formatNode(buf *sqlparser.TrackedBuffer, node sqlparser.SQLNode) bool {
+	switch node := node.(type) {
+	case *sqlparser.FuncExpr:
+		if _, ok := sqliteMySQLFunctions[node.Name.Lowered()]; !ok || !node.Qualifier.IsEmpty() || node.Distinct {
+			return false
+		}
+		buf.Myprintf("%s%s(%v)", sqliteFunctionPrefix, node.Name.Lowered(), node.Exprs)
+	case *sqlparser.Select:
+		if len(node.From) != 1 || sqlparser.String(node.From[0]) != "dual" {
+			return false
+		}
+		buf.Myprintf("select %v%s%v%v%v%v%v%v", node.Comments, node.Distinct, node.SelectExprs, node.Where,
+			node.GroupBy, node.Having, node.OrderBy, node.Limit)
+	case *sqlparser.ConvertExpr:
+		switch strings.ToLower(node.Type.Type) {
+		case "date":
+			buf.Myprintf("date(%v)", node.Expr)
+		case "datetime", "timestamp":
+			buf.Myprintf("datetime(%v)", node.Expr)
+		case "char", "nchar", "binary":
+			buf.Myprintf("cast(%v as text)", node.Expr)
+		case "signed", "unsigned":
+			buf.Myprintf("cast(%v as integer)", node.Expr)
+		default:
+			return false
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// sqliteFunction is a function registered with the SQLite driver, which is called with the number of arguments given
+// or any number if it is -1
+type sqliteFunction struct {
+	arguments int32
+	call      func(arguments []driver.Value) (driver.Value, error)
+}
+
+// sqliteMySQLFunctions are the MySQL functions used in SQLTransforms and differentially private queries which SQLite
+// does not have or which behave differently, so that the same policies can be applied to either database
+var sqliteMySQLFunctions = map[string]sqliteFunction{
+	"date_format": {arguments: 2, call: func(arguments []driver.Value) (driver.Value, error) {
+		if arguments[0] == nil {
+			return nil, nil
+		}
+		date, err := sqliteTime(arguments[0])
+		if err != nil {
+			return nil, err
+		}
+		return mysqlDateFormat(date, toString(arguments[1])), nil
+	}},
+	"sha2": {arguments: 2, call: func(arguments []driver.Value) (driver.Value, error) {
+		if arguments[0] == nil {
+			return nil, nil
+		}
+		bits, err := sqliteInteger(arguments[1])
+		if err != nil {
+			return nil, err
+		}
+		var h hash.Hash
+		switch bits {
+		case 224:
+			h = sha256.New224()
+		case 0, 256:
+			h = sha256.New()
+		case 384:
+			h = sha512.New384()
+		case 512:
+			h = sha512.New()
+		default:
+			return nil, nil
+		}
+		h.Write([]byte(toString(arguments[0])))
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}},
+	"left": {arguments: 2, call: func(arguments []driver.Value) (driver.Value, error) {
+		if arguments[0] == nil {
+			return nil, nil
+		}
+		length, err := sqliteInteger(arguments[1])
+		if err != nil {
+			return nil, err
+		}
+		runes := []rune(toString(arguments[0]))
+		if length < 0 {
+			length = 0
+		}
+		if int(length) < len(runes) {
+			runes = runes[:length]
+		}
+		return string(runes), nil
+	}},
+	"repeat": {arguments: 2, call: func(arguments []driver.Value) (driver.Value, error) {
+		if arguments[0] == nil {
+			return nil, nil
+		}
+		count, err := sqliteInteger(arguments[1])
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			count = 0
+		}
+		return strings.Repeat(toString(arguments[0]), int(count)), nil
+	}},
+	"char_length": {arguments: 1, call: func(arguments []driver.Value) (driver.Value, error) {
+		if arguments[0] == nil {
+			return nil, nil
+		}
+		return int64(utf8.RuneCountInString(toString(arguments[0]))), nil
+	}},
+	"floor": {arguments: 1, call: func(arguments []driver.Value) (driver.Value, error) {
+		if arguments[0] == nil {
+			return nil, nil
+		}
+		number, err := toFloat64(arguments[0])
+		if err != nil {
+			return nil, err
+		}
+		return math.Floor(number), nil
+	}},
+	"greatest": {arguments: -1, call: func(arguments []driver.Value) (driver.Value, error) {
+		return sqliteExtreme(arguments, 1)
+	}},
+	"least": {arguments: -1, call: func(arguments []driver.Value) (driver.Value, error) {
+		return sqliteExtreme(arguments, -1)
+	}},
+}
+
+// sqliteInteger reads an integer argument of a function, which SQLite passes as whichever storage class it has
+func sqliteInteger(value driver.Value) (int64, error) {
+	if integer, ok := value.(int64); ok {
+		return integer, nil
+	}
+	number, err := toFloat64(value)
+	if err != nil {
+		return 0, err
+	}
+	return int64(number), nil
+}
+
+// sqliteTime reads a date stored by the driver, which writes times as text
+func sqliteTime(value interface{}) (time.Time, error) {
+	if date, ok := value.(time.Time); ok {
+		return date, nil
+	}
+	text := strings.TrimSuffix(toString(value), "Z")
+	for _, format := range sqliteTimeFormats {
+		date, err := time.ParseInLocation(format, text, time.UTC)
+		if err == nil {
+			return date, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot read %q as a date", text)
+}
+
+// mysqlDateFormat formats a date as MySQL's DATE_FORMAT does, for the specifiers used by the transform library
+func mysqlDateFormat(date time.Time, format string) string {
+	var formatted strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i == len(format)-1 {
+			formatted.WriteByte(format[i])
+			continue
+		}
+		i++
+		switch format[i] {
+		case 'Y':
+			formatted.WriteString(fmt.Sprintf("%04d", date.Year()))
+		case 'm':
+			formatted.WriteString(fmt.Sprintf("%02d", int(date.Month())))
+		case 'd':
+			formatted.WriteString(fmt.Sprintf("%02d", date.Day()))
+		case 'H':
+			formatted.WriteString(fmt.Sprintf("%02d", date.Hour()))
+		case 'i':
+			formatted.WriteString(fmt.Sprintf("%02d", date.Minute()))
+		case 's', 'S':
+			formatted.WriteString(fmt.Sprintf("%02d", date.Second()))
+		default:
+			formatted.WriteByte(format[i])
+		}
+	}
+	return formatted.String()
+}
+
+// sqliteExtreme returns the greatest value if sign is 1 or the least if it is -1, comparing numbers as numbers and
+// anything else as text. As in MySQL the result is NULL if any value is.
+func sqliteExtreme(values []driver.Value, sign int) (driver.Value, error) {
+	if len(values) == 0 {
+		return nil, errors.New("expected at least one argument")
+	}
+	numeric := true
+	for _, value := range values {
+		if value == nil {
+			return nil, nil
+		}
+		switch value.(type) {
+		case int64, float64:
+		default:
+			numeric = false
+		}
+	}
+
+	extreme := values[0]
+	for _, value := range values[1:] {
+		var comparison int
+		if numeric {
+			a, _ := toFloat64(value)
+			b, _ := toFloat64(extreme)
+			comparison = compareFloat64(a, b)
+		} else {
+			comparison = strings.Compare(toString(value), toString(extreme))
+		}
+		if comparison*sign > 0 {
+			extreme = value
+		}
+	}
+	return extreme, nil
+}
+
+func compareFloat64(a float64, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
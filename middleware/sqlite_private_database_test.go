@@ -0,0 +1,649 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"github.com/xwb1989/sqlparser"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var _ PrivateRelationalDatabase = &SQLitePrivateDatabase{}
+var _ PrivateRelationalDatabase = &MySQLPrivateDatabase{}
+
+// sqlitePrivateDBConnection connects to a new SQLite database holding a "people" table like the one the MySQL tests use,
+// the table is created before connecting so that its updates are tracked
+func sqlitePrivateDBConnection(t *testing.T, db *SQLitePrivateDatabase) {
+	path := filepath.Join(t.TempDir(), "store1.db")
+	require.NoError(t, registerSQLiteDriver())
+	setup, err := sql.Open(sqliteDriverName, sqliteDataSourceName(path))
+	require.NoError(t, err)
+	defer setup.Close()
+	_, err = setup.Exec(`CREATE TABLE people (id INTEGER PRIMARY KEY, name VARCHAR(255), dob DATE)`)
+	require.NoError(t, err)
+	_, err = setup.Exec(`INSERT INTO people (name, dob) VALUES (?, ?), (?, ?), (?, ?)`,
+		"alice", time.Date(1990, 5, 17, 0, 0, 0, 0, time.UTC),
+		"bob", time.Date(1985, 11, 2, 0, 0, 0, 0, time.UTC),
+		"charlie", time.Date(2001, 1, 30, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+
+	err = db.Connect("", "", path, "", 0)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+}
+
+func truncateToYear(t *testing.T) ColumnTransform {
+	transform, err := TruncateDateTransform("year")
+	require.NoError(t, err)
+	return transform
+}
+
+func sqliteTestPolicy(tableOperations *TableOperations) *StaticDataPolicy {
+	group := &PrivacyGroup{name: "TestGroup", members: map[string]bool{"alice": true}}
+	return NewStaticDataPolicy([]*PrivacyGroup{group}, DataTransforms{group: tableOperations})
+}
+
+func TestSQLitePrivateDatabase_Query_Excluded_Col(t *testing.T) {
+	tableOperations := NewTableOperations()
+	tableOperations.ExcludedCols["people"] = []string{"dob"}
+	db := SQLitePrivateDatabase{DataPolicy: sqliteTestPolicy(tableOperations)}
+	sqlitePrivateDBConnection(t, &db)
+
+	_, err := db.Query("SELECT name, dob FROM people", localRequestPolicy("alice"))
+	require.EqualError(t, err, "SQL logic error: no such column: dob (1)")
+
+	rows, err := db.Query("SELECT * FROM people ORDER BY id", localRequestPolicy("alice"))
+	require.NoError(t, err)
+	cols, err := rows.Columns()
+	require.NoError(t, err)
+	require.Equal(t, []string{"id", "name"}, cols)
+	require.NoError(t, rows.Close())
+
+	// Writes to excluded columns are refused
+	_, err = db.Exec("UPDATE people SET dob = '2000-01-01'", localRequestPolicy("alice"))
+	require.EqualError(t, err, "ERROR 1054 (42S22): Unknown column 'dob'")
+	_, err = db.Exec("DELETE FROM people WHERE dob < '2000-01-01'", localRequestPolicy("alice"))
+	require.EqualError(t, err, "ERROR 1054 (42S22): Unknown column 'dob'")
+
+	// Writes which only refer to visible columns are allowed
+	_, err = db.Exec("UPDATE people SET name = 'alicia' WHERE name = 'alice'", localRequestPolicy("alice"))
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO people (name) VALUES ('dave')", localRequestPolicy("alice"))
+	require.NoError(t, err)
+	_, err = db.Exec("DELETE FROM people WHERE name = 'bob'", localRequestPolicy("alice"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"alicia", "charlie", "dave"}, incrementalTestNames(t, &db))
+}
+
+func TestSQLitePrivateDatabase_Query_Transforms(t *testing.T) {
+	tableOperations := NewTableOperations()
+	tableOperations.TableTransforms["people"] = TableTransform{"dob": truncateToYear(t)}
+	tableOperations.RowFilters["people"] = []RowFilter{{Column: "name", Operator: "!=", Value: "bob"}}
+	db := SQLitePrivateDatabase{DataPolicy: sqliteTestPolicy(tableOperations)}
+	sqlitePrivateDBConnection(t, &db)
+
+	rows, err := db.Query("SELECT name, dob FROM people ORDER BY id", localRequestPolicy("alice"))
+	require.NoError(t, err)
+	defer rows.Close()
+
+	var (
+		names []string
+		dobs  []time.Time
+	)
+	for rows.Next() {
+		var (
+			name string
+			dob  time.Time
+		)
+		require.NoError(t, rows.Scan(&name, &dob))
+		names = append(names, name)
+		dobs = append(dobs, dob.UTC())
+	}
+	require.NoError(t, rows.Err())
+	require.Equal(t, []string{"alice", "charlie"}, names)
+	require.Equal(t, []time.Time{
+		time.Date(1990, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC),
+	}, dobs)
+}
+
+func TestSQLitePrivateDatabase_Query_SQLTransforms(t *testing.T) {
+	tableOperations := NewTableOperations()
+	truncate, err := TruncateDateSQLTransform("month")
+	require.NoError(t, err)
+	redact, err := RedactSQLTransform(1, "*")
+	require.NoError(t, err)
+	tableOperations.SQLTransforms["people"] = SQLTableTransform{"dob": truncate, "name": redact}
+	db := SQLitePrivateDatabase{DataPolicy: sqliteTestPolicy(tableOperations)}
+	sqlitePrivateDBConnection(t, &db)
+
+	// The table is read through a derived table with MySQL's functions provided to SQLite
+	row, err := db.QueryRow("SELECT name, dob FROM people WHERE id = ?", localRequestPolicy("alice"), 1)
+	require.NoError(t, err)
+	var name, dob string
+	require.NoError(t, row.Scan(&name, &dob))
+	require.Equal(t, "a****", name)
+	require.Equal(t, "1990-05-01 00:00:00", dob)
+
+	hash := HashSQLTransform("salt")
+	require.Equal(t, "SHA2(CONCAT('salt', `name`), 256)", hash("`name`"))
+	tableOperations.SQLTransforms["people"] = SQLTableTransform{"name": hash}
+	row, err = db.QueryRow("SELECT name FROM people WHERE id = 1", localRequestPolicy("alice"))
+	require.NoError(t, err)
+	require.NoError(t, row.Scan(&name))
+	hashed, _, err := HashTransform("salt")("alice")
+	require.NoError(t, err)
+	require.Equal(t, hashed, name)
+}
+
+func TestSQLitePrivateDatabase_Query_Caching(t *testing.T) {
+	tableOperations := NewTableOperations()
+	tableOperations.TableTransforms["people"] = TableTransform{"dob": truncateToYear(t)}
+	db := SQLitePrivateDatabase{DataPolicy: sqliteTestPolicy(tableOperations), CacheTables: true}
+	sqlitePrivateDBConnection(t, &db)
+
+	count := func() int {
+		var count int
+		row, err := db.QueryRow("SELECT COUNT(*) FROM people", localRequestPolicy("alice"))
+		require.NoError(t, err)
+		require.NoError(t, row.Scan(&count))
+		return count
+	}
+	require.Equal(t, 3, count())
+
+	// The cached table is used while it is valid
+	valid, err := db.core().isTransformedTableValid("people", transformedTablePrefix("alice", "")+"people")
+	require.NoError(t, err)
+	require.True(t, valid)
+	require.Equal(t, 3, count())
+
+	// Changing the table invalidates the cached table
+	time.Sleep(5 * time.Millisecond)
+	_, err = db.database.Exec(`INSERT INTO people (name, dob) VALUES ('dave', '1970-01-01')`)
+	require.NoError(t, err)
+	valid, err = db.core().isTransformedTableValid("people", transformedTablePrefix("alice", "")+"people")
+	require.NoError(t, err)
+	require.False(t, valid)
+	require.Equal(t, 4, count())
+
+	// Changing the policy invalidates the cached table
+	time.Sleep(5 * time.Millisecond)
+	db.DataPolicy.(*StaticDataPolicy).privacyGroups[0].Add("bob")
+	valid, err = db.core().isTransformedTableValid("people", transformedTablePrefix("alice", "")+"people")
+	require.NoError(t, err)
+	require.False(t, valid)
+}
+
+func TestSQLitePrivateDatabase_Query_No_Caching(t *testing.T) {
+	tableOperations := NewTableOperations()
+	tableOperations.TableTransforms["people"] = TableTransform{"dob": truncateToYear(t)}
+	db := SQLitePrivateDatabase{DataPolicy: sqliteTestPolicy(tableOperations)}
+	sqlitePrivateDBConnection(t, &db)
+
+	rows, err := db.Query("SELECT name FROM people", localRequestPolicy("alice"))
+	require.NoError(t, err)
+	rowCount := 0
+	for rows.Next() {
+		rowCount++
+	}
+	require.NoError(t, rows.Close())
+	require.Equal(t, 3, rowCount)
+
+	// The transformed table was dropped after the query
+	tableNames, err := db.core().tableNames(context.Background())
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"people", tableVersionsTableName}, tableNames)
+}
+
+func TestSQLitePrivateDatabase_Connect_Tracks_Updates(t *testing.T) {
+	tableOperations := NewTableOperations()
+	tableOperations.TableTransforms["people"] = TableTransform{"dob": truncateToYear(t)}
+	db := SQLitePrivateDatabase{DataPolicy: sqliteTestPolicy(tableOperations), CacheTables: true}
+	sqlitePrivateDBConnection(t, &db)
+
+	triggers := func(tableName string) int {
+		var triggers int
+		err := db.database.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND tbl_name = ?`,
+			tableName).Scan(&triggers)
+		require.NoError(t, err)
+		return triggers
+	}
+	require.Equal(t, 3, triggers("people"))
+
+	// Reading a table created since connecting does not add its triggers, it is treated as updated now
+	_, err := db.database.Exec(`CREATE TABLE pets (id INTEGER PRIMARY KEY, name VARCHAR(255))`)
+	require.NoError(t, err)
+	before := timeWithUTCLocation(time.Now())
+	updatedAt, err := db.core().tableLastUpdated("pets")
+	require.NoError(t, err)
+	require.False(t, updatedAt.Before(before))
+	rows, err := db.Query("SELECT * FROM pets", localRequestPolicy("alice"))
+	require.NoError(t, err)
+	require.NoError(t, rows.Close())
+	require.Equal(t, 0, triggers("pets"))
+}
+
+func TestSQLitePrivateDatabase_Exec_Refuses_Schema_Changes(t *testing.T) {
+	tableOperations := NewTableOperations()
+	tableOperations.TableTransforms["people"] = TableTransform{"dob": truncateToYear(t)}
+	db := SQLitePrivateDatabase{
+		DataPolicy:  sqliteTestPolicy(tableOperations),
+		CacheTables: true,
+		Consent:     &ConsentRegistry{SubjectColumns: map[string]string{"people": "name"}},
+	}
+	sqlitePrivateDBConnection(t, &db)
+	rows, err := db.Query("SELECT * FROM people", localRequestPolicy("alice"))
+	require.NoError(t, err)
+	require.NoError(t, rows.Close())
+	tableNames, err := db.core().tableNames(context.Background())
+	require.NoError(t, err)
+
+	for _, statement := range []string{
+		"DROP TABLE " + consentTableName,
+		"DROP TABLE people",
+		"ALTER TABLE people RENAME TO x",
+		"CREATE TABLE notes (id INTEGER PRIMARY KEY, note TEXT)",
+		"DROP TABLE " + tableVersionsTableName,
+		"DROP TABLE " + transformedTablePrefix("alice", "") + "people",
+	} {
+		_, err = db.Exec(statement, localRequestPolicy("alice"))
+		require.EqualError(t, err, "unsupported query", statement)
+
+		tx, err := db.Begin(localRequestPolicy("alice"))
+		require.NoError(t, err)
+		_, err = tx.Exec(statement)
+		require.EqualError(t, err, "unsupported query", statement)
+		require.NoError(t, tx.Rollback())
+	}
+
+	unchanged, err := db.core().tableNames(context.Background())
+	require.NoError(t, err)
+	require.ElementsMatch(t, tableNames, unchanged)
+}
+
+func TestSQLitePrivateDatabase_Query_Caching_Requester_Case(t *testing.T) {
+	tableOperations := NewTableOperations()
+	tableOperations.TableTransforms["people"] = TableTransform{"dob": truncateToYear(t)}
+	upperOperations := NewTableOperations()
+	upperOperations.RowFilters["people"] = []RowFilter{{Column: "name", Operator: "=", Value: "bob"}}
+	policy := sqliteTestPolicy(tableOperations)
+	upper := NewPrivacyGroup("UpperGroup")
+	upper.Add("Alice")
+	policy.privacyGroups = append(policy.privacyGroups, upper)
+	policy.transforms[upper] = upperOperations
+	db := SQLitePrivateDatabase{DataPolicy: policy, CacheTables: true}
+	sqlitePrivateDBConnection(t, &db)
+
+	count := func(requesterID string) int {
+		var count int
+		row, err := db.QueryRow("SELECT COUNT(*) FROM people", localRequestPolicy(requesterID))
+		require.NoError(t, err)
+		require.NoError(t, row.Scan(&count))
+		return count
+	}
+
+	// SQLite matches table names regardless of case, so requesters whose IDs differ only in case must not share a
+	// cached table
+	require.Equal(t, 3, count("alice"))
+	require.Equal(t, 1, count("Alice"))
+	require.Equal(t, 3, count("alice"))
+}
+
+func TestSQLitePrivateDatabase_Query_Consent(t *testing.T) {
+	tableOperations := NewTableOperations()
+	tableOperations.TableTransforms["people"] = TableTransform{"dob": truncateToYear(t)}
+	db := SQLitePrivateDatabase{
+		DataPolicy:  sqliteTestPolicy(tableOperations),
+		CacheTables: true,
+		Consent:     &ConsentRegistry{SubjectColumns: map[string]string{"people": "name"}},
+	}
+	sqlitePrivateDBConnection(t, &db)
+
+	countBob := func() int {
+		var count int
+		row, err := db.QueryRow("SELECT COUNT(*) FROM people WHERE name = 'bob'", localRequestPolicy("alice"))
+		require.NoError(t, err)
+		require.NoError(t, row.Scan(&count))
+		return count
+	}
+	require.Equal(t, 1, countBob())
+
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, db.OptOut(context.Background(), "bob", "alice", ""))
+	require.Equal(t, 0, countBob())
+
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, db.OptIn(context.Background(), "bob"))
+	require.Equal(t, 1, countBob())
+
+	// Requesters cannot read or change the registry, or the middleware's other tables
+	require.NoError(t, db.OptOut(context.Background(), "charlie", "", ""))
+	for _, query := range []string{
+		"SELECT * FROM pam_consent",
+		"SELECT * FROM PAM_CONSENT",
+		"DELETE FROM pam_consent",
+		"SELECT * FROM people WHERE name IN (SELECT subject_key FROM pam_consent)",
+		"DELETE FROM " + tableVersionsTableName,
+		"SELECT * FROM transformed_alice_people",
+	} {
+		_, err := db.Exec(query, localRequestPolicy("alice"))
+		require.Error(t, err, query)
+	}
+	var optedOut int
+	require.NoError(t, db.database.QueryRow("SELECT COUNT(*) FROM pam_consent").Scan(&optedOut))
+	require.Equal(t, 1, optedOut)
+}
+
+func TestSQLitePrivateDatabase_Validate(t *testing.T) {
+	tableOperations := NewTableOperations()
+	tableOperations.ExcludedCols["people"] = []string{"address"}
+	tableOperations.TableTransforms["people"] = TableTransform{"id": truncateToYear(t)}
+	db := SQLitePrivateDatabase{DataPolicy: sqliteTestPolicy(tableOperations)}
+	sqlitePrivateDBConnection(t, &db)
+
+	problems, err := db.Validate(context.Background())
+	require.NoError(t, err)
+	require.Len(t, problems, 2)
+	require.Equal(t, UnknownColumn, problems[0].Kind)
+	require.Equal(t, "address", problems[0].Column)
+	require.Equal(t, InapplicableTransform, problems[1].Kind)
+	require.Equal(t, "id", problems[1].Column)
+
+	uncoveredTables, err := db.UncoveredTables(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, uncoveredTables)
+}
+
+func TestSQLiteMySQLFunctions(t *testing.T) {
+	date := time.Date(1990, 5, 17, 10, 30, 15, 0, time.UTC)
+	require.Equal(t, "1990-05-01", mysqlDateFormat(date, truncateDateFormats["month"]))
+	require.Equal(t, "1990-05-17 10:30:00", mysqlDateFormat(date, truncateDateFormats["minute"]))
+	require.Equal(t, "17/05 10:30:15 100%", mysqlDateFormat(date, "%d/%m %H:%i:%s 100%%"))
+
+	parsed, err := sqliteTime("1990-05-17 10:30:15+00:00")
+	require.NoError(t, err)
+	require.True(t, date.Equal(parsed))
+
+	greatest, err := sqliteExtreme([]driver.Value{int64(2), 3.5, int64(-1)}, 1)
+	require.NoError(t, err)
+	require.Equal(t, 3.5, greatest)
+	least, err := sqliteExtreme([]driver.Value{"b", "a", "c"}, -1)
+	require.NoError(t, err)
+	require.Equal(t, "a", least)
+	null, err := sqliteExtreme([]driver.Value{int64(2), nil}, 1)
+	require.NoError(t, err)
+	require.Nil(t, null)
+}
+
+func TestSQLiteDialect_FormatNode(t *testing.T) {
+	stmt, err := sqlparser.Parse("SELECT CAST(a AS DATETIME), CONVERT(b, DATE), CAST(c AS CHAR), CAST(d AS DECIMAL) FROM t")
+	require.NoError(t, err)
+	require.Equal(t, "select datetime(a), date(b), cast(c as text), cast(d as decimal) from t",
+		formatDialectSQL(stmt, sqliteDialect{}))
+	require.Equal(t, "select cast(a as datetime), cast(b as date), cast(c as char), cast(d as decimal) from t",
+		formatSQL(stmt))
+
+	stmt, err = sqlparser.Parse("SELECT FLOOR(a), LEFT(b, 2), ROUND(c), COUNT(DISTINCT d) FROM t")
+	require.NoError(t, err)
+	require.Equal(t, "select pam_floor(a), pam_left(b, 2), ROUND(c), COUNT(distinct d) from t",
+		formatDialectSQL(stmt, sqliteDialect{}))
+}
+
+func TestSQLitePrivateDatabase_Functions_Not_Shared(t *testing.T) {
+	tableOperations := NewTableOperations()
+	transform, err := RedactSQLTransform(2, "*")
+	require.NoError(t, err)
+	tableOperations.SQLTransforms["people"] = SQLTableTransform{"name": transform}
+	db := SQLitePrivateDatabase{DataPolicy: sqliteTestPolicy(tableOperations)}
+	sqlitePrivateDBConnection(t, &db)
+
+	var name string
+	row, err := db.QueryRow("SELECT name FROM people WHERE id = 3", localRequestPolicy("alice"))
+	require.NoError(t, err)
+	require.NoError(t, row.Scan(&name))
+	require.Equal(t, "ch*****", name)
+
+	// Other users of the driver keep SQLite's functions and do not get the MySQL ones
+	other, err := sql.Open("sqlite", ":memory:")
+	require.NoError(t, err)
+	defer other.Close()
+	var floor float64
+	require.NoError(t, other.QueryRow("SELECT floor(2.5)").Scan(&floor))
+	require.Equal(t, 2.0, floor)
+	_, err = other.Exec("SELECT left('abc', 1)")
+	require.Error(t, err)
+}
+
+func TestSQLitePrivateDatabase_Query_Temporary_Tables(t *testing.T) {
+	tableOperations := NewTableOperations()
+	tableOperations.TableTransforms["people"] = TableTransform{"dob": truncateToYear(t)}
+	db := SQLitePrivateDatabase{DataPolicy: sqliteTestPolicy(tableOperations)}
+	sqlitePrivateDBConnection(t, &db)
+
+	// Concurrent queries from the same requester build tables of the same name on their own connections
+	first, err := db.Query("SELECT name FROM people ORDER BY id", localRequestPolicy("alice"))
+	require.NoError(t, err)
+	second, err := db.Query("SELECT name FROM people ORDER BY id", localRequestPolicy("alice"))
+	require.NoError(t, err)
+
+	// The tables are temporary so they cannot be seen from other connections
+	tableNames, err := db.core().tableNames(context.Background())
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"people", tableVersionsTableName}, tableNames)
+
+	// The tables last as long as the rows
+	for _, rows := range []*sql.Rows{first, second} {
+		var names []string
+		for rows.Next() {
+			var name string
+			require.NoError(t, rows.Scan(&name))
+			names = append(names, name)
+		}
+		require.NoError(t, rows.Err())
+		require.Equal(t, []string{"alice", "bob", "charlie"}, names)
+		require.NoError(t, rows.Close())
+	}
+
+	// Each connection is returned to the pool without its temporary tables
+	require.Eventually(t, func() bool { return db.Stats().InUse == 0 }, time.Second, time.Millisecond)
+	var temporaryTables int
+	require.NoError(t, db.database.QueryRow("SELECT COUNT(*) FROM sqlite_temp_master").Scan(&temporaryTables))
+	require.Equal(t, 0, temporaryTables)
+}
+
+func TestSQLitePrivateDatabase_Query_Cache_Limits(t *testing.T) {
+	tableOperations := NewTableOperations()
+	tableOperations.TableTransforms["people"] = TableTransform{"dob": truncateToYear(t)}
+	tableOperations.TableTransforms["pets"] = TableTransform{"name": func(value interface{}) (interface{}, bool, error) {
+		return value, false, nil
+	}}
+	db := SQLitePrivateDatabase{
+		DataPolicy:  sqliteTestPolicy(tableOperations),
+		CacheTables: true,
+		Cache:       &TableCache{MaxTables: 1},
+	}
+	sqlitePrivateDBConnection(t, &db)
+	_, err := db.database.Exec(`CREATE TABLE pets (id INTEGER PRIMARY KEY, name VARCHAR(255))`)
+	require.NoError(t, err)
+
+	count := func(table string) int {
+		var count int
+		row, err := db.QueryRow("SELECT COUNT(*) FROM "+table, localRequestPolicy("alice"))
+		require.NoError(t, err)
+		require.NoError(t, row.Scan(&count))
+		return count
+	}
+	require.Equal(t, 3, count("people"))
+	require.Equal(t, 3, count("people"))
+
+	// Caching the pets table evicts the people table
+	require.Equal(t, 0, count("pets"))
+	tableNames, err := db.core().tableNames(context.Background())
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"people", "pets", transformedTablePrefix("alice", "") + "pets",
+		tableVersionsTableName, builtTablesTableName}, tableNames)
+	require.Equal(t, CacheStats{Hits: 1, Misses: 2, Evictions: 1, Tables: 1}, db.Cache.Stats())
+}
+
+func TestSQLitePrivateDatabase_Connect_Drops_Orphaned_Tables(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store1.db")
+	tableOperations := NewTableOperations()
+	tableOperations.TableTransforms["people"] = TableTransform{"dob": truncateToYear(t)}
+	policy := sqliteTestPolicy(tableOperations)
+	policy.privacyGroups[0].Add("bob")
+	db := SQLitePrivateDatabase{DataPolicy: policy, CacheTables: true}
+	require.NoError(t, db.Connect("", "", path, "", 0))
+	_, err := db.database.Exec(`CREATE TABLE people (id INTEGER PRIMARY KEY, name VARCHAR(255), dob DATE)`)
+	require.NoError(t, err)
+	_, err = db.database.Exec(`CREATE TABLE transformed_notes (id INTEGER PRIMARY KEY, note TEXT)`)
+	require.NoError(t, err)
+	rows, err := db.Query("SELECT * FROM people", localRequestPolicy("alice"))
+	require.NoError(t, err)
+	require.NoError(t, rows.Close())
+	time.Sleep(50 * time.Millisecond)
+	rows, err = db.Query("SELECT * FROM people", localRequestPolicy("bob"))
+	require.NoError(t, err)
+	require.NoError(t, rows.Close())
+	require.NoError(t, db.Close())
+
+	// Only the tables the middleware built which have expired are dropped when a caching database connects, tables
+	// it did not build are left however they are named
+	db = SQLitePrivateDatabase{DataPolicy: policy, CacheTables: true, Cache: &TableCache{TTL: 25 * time.Millisecond}}
+	require.NoError(t, db.Connect("", "", path, "", 0))
+	defer db.Close()
+	tableNames, err := db.core().tableNames(context.Background())
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"people", "transformed_notes", transformedTablePrefix("bob", "") + "people",
+		tableVersionsTableName, builtTablesTableName}, tableNames)
+
+	// Without a TTL the tables another process built are kept, but those named as the middleware names transformed
+	// tables which it did not record building, such as those of earlier versions, are dropped
+	for _, table := range []string{transformedTablePrefix("carol", "") + "people", "transformed_carol_people",
+		"transformed_carol_people4242", "transformed_carol_pets"} {
+		_, err = db.database.Exec(fmt.Sprintf("CREATE TABLE %s (id INTEGER PRIMARY KEY)", table))
+		require.NoError(t, err)
+	}
+	require.NoError(t, db.Close())
+	db = SQLitePrivateDatabase{DataPolicy: policy, CacheTables: true}
+	require.NoError(t, db.Connect("", "", path, "", 0))
+	tableNames, err = db.core().tableNames(context.Background())
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"people", "transformed_notes", "transformed_carol_pets",
+		transformedTablePrefix("bob", "") + "people", tableVersionsTableName, builtTablesTableName}, tableNames)
+}
+
+func TestSQLitePrivateDatabase_Eviction_Waits_For_Readers(t *testing.T) {
+	tableOperations := NewTableOperations()
+	tableOperations.TableTransforms["people"] = TableTransform{"dob": truncateToYear(t)}
+	policy := sqliteTestPolicy(tableOperations)
+	policy.privacyGroups[0].Add("bob")
+	db := SQLitePrivateDatabase{DataPolicy: policy, CacheTables: true, Cache: &TableCache{MaxTables: 1}}
+	sqlitePrivateDBConnection(t, &db)
+	aliceTable := transformedTablePrefix("alice", "") + "people"
+
+	// Alice's query has been rewritten to read her table but has not started when Bob's query evicts it
+	ctx, started := db.core().trackReads(context.Background())
+	transformedTable, err := db.core().transformTable(ctx, nil, "people", transformedTablePrefix("alice", ""),
+		tableOperations, "alice", "")
+	require.NoError(t, err)
+	require.Equal(t, aliceTable, transformedTable)
+	rows, err := db.Query("SELECT * FROM people", localRequestPolicy("bob"))
+	require.NoError(t, err)
+	require.NoError(t, rows.Close())
+	require.Equal(t, int64(1), db.Cache.Stats().Evictions)
+
+	exists := func() bool {
+		_, exists, err := db.core().dialect.tableCreated(db.database, db.databaseName, aliceTable)
+		require.NoError(t, err)
+		return exists
+	}
+	require.True(t, exists())
+
+	// The table is dropped once the query has started
+	started()
+	require.False(t, exists())
+}
+
+func TestSQLitePrivateDatabase_Query_Shared_Tables(t *testing.T) {
+	tableOperations := NewTableOperations()
+	tableOperations.TableTransforms["people"] = TableTransform{"dob": truncateToYear(t)}
+	transformID, err := TransformID("truncate-date", TransformParams{"unit": "year"})
+	require.NoError(t, err)
+	tableOperations.setTransformID("people", "dob", transformID)
+	policy := sqliteTestPolicy(tableOperations)
+	policy.privacyGroups[0].Add("bob")
+	db := SQLitePrivateDatabase{DataPolicy: policy, CacheTables: true}
+	sqlitePrivateDBConnection(t, &db)
+
+	count := func(requesterID string) int {
+		var count int
+		row, err := db.QueryRow("SELECT COUNT(*) FROM people", localRequestPolicy(requesterID))
+		require.NoError(t, err)
+		require.NoError(t, row.Scan(&count))
+		return count
+	}
+	transformedTables := func() []string {
+		tableNames, err := db.core().tableNames(context.Background())
+		require.NoError(t, err)
+		var transformedTables []string
+		for _, tableName := range tableNames {
+			if strings.HasPrefix(tableName, "transformed_") {
+				transformedTables = append(transformedTables, tableName)
+			}
+		}
+		return transformedTables
+	}
+
+	// Alice and Bob have the same operations on the table so they share its transformed table
+	require.Equal(t, 3, count("alice"))
+	require.Equal(t, 3, count("bob"))
+	require.Len(t, transformedTables(), 1)
+	require.Regexp(t, "^transformed_shared_[0-9a-f]{16}_people$", transformedTables()[0])
+	stats := db.Cache.Stats()
+	require.Equal(t, int64(1), stats.Hits)
+	require.Equal(t, int64(1), stats.Misses)
+
+	// Rows which depend on the requester are not shared
+	tableOperations.RowFilters["people"] = []RowFilter{{Column: "name", Operator: "=", Value: RequesterIDValue}}
+	require.Equal(t, 1, count("alice"))
+	require.Equal(t, 1, count("bob"))
+	require.Len(t, transformedTables(), 3)
+
+	// Nor are tables with transforms which have no ID
+	tableOperations.RowFilters["people"] = nil
+	delete(tableOperations.TransformIDs, "people")
+	require.Equal(t, 3, count("alice"))
+	require.Equal(t, 3, count("bob"))
+	require.Contains(t, transformedTables(), transformedTablePrefix("alice", "")+"people")
+	require.Contains(t, transformedTables(), transformedTablePrefix("bob", "")+"people")
+}
+
+func TestSQLitePrivateDatabase_Query_Access_Revoked(t *testing.T) {
+	tableOperations := NewTableOperations()
+	tableOperations.TableTransforms["people"] = TableTransform{"dob": truncateToYear(t)}
+	policy := sqliteTestPolicy(tableOperations)
+	policy.privacyGroups[0].Add("bob")
+	policy.privacyGroups[0].Add("bob_smith")
+	db := SQLitePrivateDatabase{DataPolicy: policy, CacheTables: true}
+	sqlitePrivateDBConnection(t, &db)
+
+	for _, requesterID := range []string{"bob", "bob_smith"} {
+		rows, err := db.Query("SELECT * FROM people", localRequestPolicy(requesterID))
+		require.NoError(t, err)
+		require.NoError(t, rows.Close())
+	}
+
+	// Only the tables of the requester who lost access are dropped, not those of requesters whose IDs begin with theirs
+	policy.privacyGroups[0].Remove("bob")
+	_, err := db.Query("SELECT * FROM people", localRequestPolicy("bob"))
+	require.Equal(t, ErrAccessDenied, err)
+	tableNames, err := db.core().tableNames(context.Background())
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"people", transformedTablePrefix("bob_smith", "") + "people",
+		tableVersionsTableName, builtTablesTableName}, tableNames)
+}
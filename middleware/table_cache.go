@@ -0,0 +1,266 @@
+package middleware
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// TableCache manages the transformed tables a private database keeps when CacheTables is set. Tables are evicted,
+// least recently used first, once there are more than MaxTables of them or their values take more than MaxBytes, and
+// are rebuilt once they are older than TTL. A zero limit means there is no limit. When the private database connects
+// it sweeps away orphaned transformed tables: those left by earlier versions of the middleware, which did not record
+// the tables they built, are always dropped, while those built by another process are dropped once they are older than
+// TTL. Without a TTL the tables another process built are kept, as it cannot be known whether it is still using them.
+//
+// A transformed table is rebuilt whenever the table it was transformed from changes, unless the table is in
+// Incremental. The rows added or changed since those tables were built are transformed and merged into their
+// transformed tables instead, which are only rebuilt when the policies which apply to them change, when they expire or
+// when rows are deleted from the tables.
+type TableCache struct {
+	// MaxTables is the most transformed tables which are kept
+	MaxTables int
+	// MaxBytes is the most bytes the values written to the transformed tables may take, the database uses more space
+	// than this to store them
+	MaxBytes int64
+	// TTL is how long a transformed table is used for after it is built
+	TTL time.Duration
+	// Incremental holds how the transformed tables of each table which is refreshed incrementally are brought up to
+	// date, by table name
+	Incremental map[string]IncrementalRefresh
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	// recentlyUsed holds the cacheEntry of each table with the most recently used first
+	recentlyUsed list.List
+	stats        CacheStats
+	// readers counts the queries which have been rewritten to read each table but have not started, as a table
+	// cannot be dropped until they have
+	readers map[string]int
+	// deferred holds the evicted tables which are dropped once the queries about to read them have started
+	deferred map[string]cacheEntry
+}
+
+// CacheStats counts how the transformed tables of a TableCache have been used
+type CacheStats struct {
+	// Hits is the number of times a valid transformed table was used
+	Hits int64
+	// Misses is the number of times a table was transformed as there was no transformed table
+	Misses int64
+	// Rebuilds is the number of times a transformed table was rebuilt as it was out of date or had expired
+	Rebuilds int64
+	// Refreshes is the number of times rows added or changed since a transformed table was built were merged into it
+	Refreshes int64
+	// Evictions is the number of transformed tables dropped to keep within the limits
+	Evictions int64
+	// Tables is the number of transformed tables which are cached
+	Tables int
+	// Bytes is the size of the values written to the cached tables, including those of rows which have since been
+	// replaced by refreshing the tables
+	Bytes int64
+}
+
+// cacheEntry is a transformed table in a TableCache
+type cacheEntry struct {
+	transformedTableName string
+	// tableName is the table which was transformed
+	tableName string
+	bytes     int64
+	built     time.Time
+	// marks is how much of the table has been transformed if the transformed table can be refreshed incrementally
+	marks *refreshMarks
+}
+
+// Stats returns how the cached tables have been used
+func (c *TableCache) Stats() CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.stats
+}
+
+// expired returns whether a transformed table was built longer ago than the TTL
+func (c *TableCache) expired(transformedTableName string, now time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[transformedTableName]
+	return ok && c.TTL > 0 && now.Sub(element.Value.(*cacheEntry).built) > c.TTL
+}
+
+// hit records that a valid transformed table was used. Tables the cache does not know of, which were built by another
+// process, are added with no size.
+func (c *TableCache) hit(transformedTableName string, tableName string, now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.stats.Hits++
+	element, ok := c.entries[transformedTableName]
+	if !ok {
+		c.add(&cacheEntry{transformedTableName: transformedTableName, tableName: tableName, built: now})
+		return
+	}
+	c.recentlyUsed.MoveToFront(element)
+}
+
+// built records that a table was transformed, replacing any earlier version of the transformed table. The marks are
+// nil unless the transformed table can be refreshed incrementally.
+func (c *TableCache) built(transformedTableName string, tableName string, bytes int64, marks *refreshMarks,
+	now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.remove(transformedTableName) {
+		c.stats.Rebuilds++
+	} else {
+		c.stats.Misses++
+	}
+	c.add(&cacheEntry{transformedTableName: transformedTableName, tableName: tableName, bytes: bytes, built: now,
+		marks: marks})
+}
+
+// marks returns how much of its table a transformed table has been built from, if it can be refreshed incrementally
+func (c *TableCache) marks(transformedTableName string) (refreshMarks, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[transformedTableName]
+	if !ok || element.Value.(*cacheEntry).marks == nil {
+		return refreshMarks{}, false
+	}
+	return *element.Value.(*cacheEntry).marks, true
+}
+
+// refreshed records that the rows added or changed since a transformed table was built were merged into it
+func (c *TableCache) refreshed(transformedTableName string, bytes int64, marks *refreshMarks) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[transformedTableName]
+	if !ok {
+		return
+	}
+	entry := element.Value.(*cacheEntry)
+	entry.bytes += bytes
+	entry.marks = marks
+	c.stats.Bytes += bytes
+	c.stats.Refreshes++
+	c.recentlyUsed.MoveToFront(element)
+}
+
+// evict removes the expired tables and then the least recently used tables, apart from the table which is kept,
+// until the cache is within its limits. The evicted tables are returned so that they can be dropped.
+func (c *TableCache) evict(keep string, now time.Time) []cacheEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var evicted []cacheEntry
+	for element := c.recentlyUsed.Back(); element != nil; {
+		entry := element.Value.(*cacheEntry)
+		element = element.Prev()
+
+		overLimit := (c.MaxTables > 0 && c.stats.Tables > c.MaxTables) || (c.MaxBytes > 0 && c.stats.Bytes > c.MaxBytes)
+		expired := c.TTL > 0 && now.Sub(entry.built) > c.TTL
+		if entry.transformedTableName == keep || !(overLimit || expired) {
+			continue
+		}
+		c.remove(entry.transformedTableName)
+		c.stats.Evictions++
+		evicted = append(evicted, *entry)
+	}
+	return evicted
+}
+
+// read records that a query has been rewritten to read a transformed table
+func (c *TableCache) read(transformedTableName string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.readers == nil {
+		c.readers = make(map[string]int)
+	}
+	c.readers[transformedTableName]++
+}
+
+// doneReading records that a query which was rewritten to read a transformed table has started, it returns the
+// evicted table if its drop was deferred and no other query is about to read it
+func (c *TableCache) doneReading(transformedTableName string) (cacheEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.readers[transformedTableName]--
+	if c.readers[transformedTableName] > 0 {
+		return cacheEntry{}, false
+	}
+	delete(c.readers, transformedTableName)
+	entry, ok := c.deferred[transformedTableName]
+	delete(c.deferred, transformedTableName)
+	return entry, ok
+}
+
+// deferDrop defers dropping an evicted table if a query is about to read it, it returns whether it did
+func (c *TableCache) deferDrop(entry cacheEntry) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.readers[entry.transformedTableName] == 0 {
+		return false
+	}
+	if c.deferred == nil {
+		c.deferred = make(map[string]cacheEntry)
+	}
+	c.deferred[entry.transformedTableName] = entry
+	return true
+}
+
+// contains returns whether the cache has a transformed table
+func (c *TableCache) contains(transformedTableName string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	_, ok := c.entries[transformedTableName]
+	return ok
+}
+
+// forget removes a transformed table which was dropped from the cache
+func (c *TableCache) forget(transformedTableName string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.remove(transformedTableName)
+}
+
+// add adds an entry as the most recently used, the mutex must be held
+func (c *TableCache) add(entry *cacheEntry) {
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+	}
+	c.entries[entry.transformedTableName] = c.recentlyUsed.PushFront(entry)
+	c.stats.Tables++
+	c.stats.Bytes += entry.bytes
+}
+
+// remove removes an entry and returns whether there was one, the mutex must be held
+func (c *TableCache) remove(transformedTableName string) bool {
+	element, ok := c.entries[transformedTableName]
+	if !ok {
+		return false
+	}
+	entry := c.recentlyUsed.Remove(element).(*cacheEntry)
+	delete(c.entries, transformedTableName)
+	c.stats.Tables--
+	c.stats.Bytes -= entry.bytes
+	return true
+}
+
+// valueSize returns the number of bytes a value scanned from a database takes, numbers and times are counted as eight
+func valueSize(value interface{}) int64 {
+	switch value := value.(type) {
+	case nil:
+		return 0
+	case []byte:
+		return int64(len(value))
+	case string:
+		return int64(len(value))
+	}
+	return 8
+}
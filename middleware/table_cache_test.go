@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestTableCache_Evict_Least_Recently_Used(t *testing.T) {
+	cache := TableCache{MaxTables: 2}
+	now := time.Now()
+	cache.built("transformed_alice_people", "people", 10, nil, now)
+	cache.built("transformed_alice_orders", "orders", 20, nil, now)
+	cache.hit("transformed_alice_people", "people", now)
+	cache.built("transformed_bob_people", "people", 30, nil, now)
+
+	evicted := cache.evict("transformed_bob_people", now)
+	require.Equal(t, []cacheEntry{
+		{transformedTableName: "transformed_alice_orders", tableName: "orders", bytes: 20, built: now},
+	}, evicted)
+	require.False(t, cache.contains("transformed_alice_orders"))
+	require.True(t, cache.contains("transformed_alice_people"))
+	require.Equal(t, CacheStats{Hits: 1, Misses: 3, Evictions: 1, Tables: 2, Bytes: 40}, cache.Stats())
+}
+
+func TestTableCache_Evict_Bytes(t *testing.T) {
+	cache := TableCache{MaxBytes: 100}
+	now := time.Now()
+	cache.built("transformed_alice_people", "people", 60, nil, now)
+	cache.built("transformed_bob_people", "people", 60, nil, now)
+
+	// The table which was just built is kept even if it is over the limit on its own
+	evicted := cache.evict("transformed_bob_people", now)
+	require.Len(t, evicted, 1)
+	require.Equal(t, "transformed_alice_people", evicted[0].transformedTableName)
+	cache.built("transformed_bob_people", "people", 200, nil, now)
+	require.Empty(t, cache.evict("transformed_bob_people", now))
+	require.Equal(t, CacheStats{Misses: 2, Rebuilds: 1, Evictions: 1, Tables: 1, Bytes: 200}, cache.Stats())
+}
+
+func TestTableCache_TTL(t *testing.T) {
+	cache := TableCache{TTL: time.Minute}
+	now := time.Now()
+	cache.built("transformed_alice_people", "people", 10, nil, now)
+	cache.built("transformed_alice_orders", "orders", 10, nil, now.Add(time.Minute))
+
+	require.False(t, cache.expired("transformed_alice_people", now.Add(time.Minute)))
+	require.True(t, cache.expired("transformed_alice_people", now.Add(time.Minute+time.Second)))
+	require.False(t, cache.expired("transformed_bob_people", now.Add(time.Hour)))
+
+	// Expired tables are evicted even when the cache is within its limits
+	evicted := cache.evict("transformed_alice_orders", now.Add(time.Minute+time.Second))
+	require.Len(t, evicted, 1)
+	require.Equal(t, "transformed_alice_people", evicted[0].transformedTableName)
+}
+
+func TestValueSize(t *testing.T) {
+	require.Equal(t, int64(0), valueSize(nil))
+	require.Equal(t, int64(5), valueSize([]byte("alice")))
+	require.Equal(t, int64(3), valueSize("bob"))
+	require.Equal(t, int64(8), valueSize(int64(1)))
+	require.Equal(t, int64(8), valueSize(time.Now()))
+}
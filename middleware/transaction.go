@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"log"
+)
+
+// Tx is a transaction on a private database whose statements are all run for the requester of the RequestPolicy it
+// was begun with. Reads and writes in the transaction are checked and rewritten as they are outside of it. Tables read
+// in the transaction are always transformed within it as temporary tables, rather than read from the cache, so that
+// the transaction reads its own writes, and they are dropped when it ends.
+//
+// Queries answered with differential privacy are run outside the transaction, so they do not see its writes and the
+// privacy budget they spend is not returned if it is rolled back.
+type Tx struct {
+	pd            *privateDatabase
+	requestPolicy *RequestPolicy
+	session       *querySession
+}
+
+// beginTx begins a transaction for the requester of the request policy
+func (pd *privateDatabase) beginTx(ctx context.Context, requestPolicy *RequestPolicy, opts *sql.TxOptions) (*Tx,
+	error) {
+	tx, err := pd.database.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{pd: pd, requestPolicy: requestPolicy, session: &querySession{tx: tx, dialect: pd.dialect}}, nil
+}
+
+// Query runs a query in the transaction, see PrivateRelationalDatabase.Query
+func (tx *Tx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.QueryContext(context.Background(), query, args...)
+}
+
+// QueryContext runs a query in the transaction, see PrivateRelationalDatabase.QueryContext
+func (tx *Tx) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.pd.queryContext(ctx, queryOptions{tx: tx.session}, query, tx.requestPolicy, args...)
+}
+
+// QueryRow runs a query in the transaction, see PrivateRelationalDatabase.QueryRow
+func (tx *Tx) QueryRow(query string, args ...interface{}) (*sql.Row, error) {
+	return tx.QueryRowContext(context.Background(), query, args...)
+}
+
+// QueryRowContext runs a query in the transaction, see PrivateRelationalDatabase.QueryRowContext
+func (tx *Tx) QueryRowContext(ctx context.Context, query string, args ...interface{}) (*sql.Row, error) {
+	return tx.pd.queryRowContext(ctx, queryOptions{tx: tx.session}, query, tx.requestPolicy, args...)
+}
+
+// Exec runs a statement in the transaction, see PrivateRelationalDatabase.Exec
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.ExecContext(context.Background(), query, args...)
+}
+
+// ExecContext runs a statement in the transaction, see PrivateRelationalDatabase.ExecContext
+func (tx *Tx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return tx.pd.execContext(ctx, queryOptions{tx: tx.session}, query, tx.requestPolicy, args...)
+}
+
+// Commit drops the tables transformed in the transaction and commits it
+func (tx *Tx) Commit() error {
+	err := tx.session.dropTemporaryTables(tx.session.tx)
+	if err != nil {
+		tx.session.tx.Rollback()
+		return err
+	}
+	return tx.session.tx.Commit()
+}
+
+// Rollback drops the tables transformed in the transaction and rolls it back. Not every database drops tables created
+// in a transaction which is rolled back, but those which fail to drop them after an error also roll back their
+// creation, so failing to drop them is only logged.
+func (tx *Tx) Rollback() error {
+	err := tx.session.dropTemporaryTables(tx.session.tx)
+	if err != nil {
+		log.Printf("PAM: failed to drop temporary tables: %s", err.Error())
+	}
+	return tx.session.tx.Rollback()
+}
@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSQLitePrivateDatabase_Tx_Reads_Own_Writes(t *testing.T) {
+	tableOperations := NewTableOperations()
+	tableOperations.TableTransforms["people"] = TableTransform{"dob": truncateToYear(t)}
+	db := SQLitePrivateDatabase{DataPolicy: sqliteTestPolicy(tableOperations)}
+	sqlitePrivateDBConnection(t, &db)
+
+	txCount := func(tx *Tx) int {
+		var count int
+		row, err := tx.QueryRow("SELECT COUNT(*) FROM people")
+		require.NoError(t, err)
+		require.NoError(t, row.Scan(&count))
+		return count
+	}
+	dbCount := func() int {
+		var count int
+		row, err := db.QueryRow("SELECT COUNT(*) FROM people", localRequestPolicy("alice"))
+		require.NoError(t, err)
+		require.NoError(t, row.Scan(&count))
+		return count
+	}
+
+	tx, err := db.Begin(localRequestPolicy("alice"))
+	require.NoError(t, err)
+	_, err = tx.Exec("INSERT INTO people (name, dob) VALUES (?, ?)", "dave", "1970-06-01")
+	require.NoError(t, err)
+
+	// The transaction reads its own writes through the transformed table, other queries do not see them
+	require.Equal(t, 4, txCount(tx))
+	require.Equal(t, 3, dbCount())
+	var dob time.Time
+	row, err := tx.QueryRow("SELECT dob FROM people WHERE name = ?", "dave")
+	require.NoError(t, err)
+	require.NoError(t, row.Scan(&dob))
+	require.Equal(t, 1, dob.YearDay())
+
+	require.NoError(t, tx.Commit())
+	require.Empty(t, tx.session.temporaryTables)
+	require.Equal(t, 4, dbCount())
+
+	// Rolled back writes are not kept
+	tx, err = db.Begin(localRequestPolicy("alice"))
+	require.NoError(t, err)
+	_, err = tx.Exec("DELETE FROM people")
+	require.NoError(t, err)
+	require.Equal(t, 0, txCount(tx))
+	require.NoError(t, tx.Rollback())
+	require.Equal(t, 4, dbCount())
+}
+
+func TestSQLitePrivateDatabase_Tx_Policy(t *testing.T) {
+	tableOperations := NewTableOperations()
+	tableOperations.ExcludedCols["people"] = []string{"dob"}
+	tableOperations.TableTransforms["people"] = TableTransform{"name": func(value interface{}) (interface{}, bool, error) {
+		return strings.ToUpper(toString(value)), false, nil
+	}}
+	db := SQLitePrivateDatabase{DataPolicy: sqliteTestPolicy(tableOperations), CacheTables: true}
+	sqlitePrivateDBConnection(t, &db)
+
+	tx, err := db.BeginTx(context.Background(), localRequestPolicy("alice"), nil)
+	require.NoError(t, err)
+
+	// Reads are transformed and writes to excluded columns are refused
+	rows, err := tx.Query("SELECT * FROM people ORDER BY id")
+	require.NoError(t, err)
+	cols, err := rows.Columns()
+	require.NoError(t, err)
+	require.Equal(t, []string{"id", "name"}, cols)
+	require.True(t, rows.Next())
+	var (
+		id   int
+		name string
+	)
+	require.NoError(t, rows.Scan(&id, &name))
+	require.Equal(t, "ALICE", name)
+	require.NoError(t, rows.Close())
+
+	_, err = tx.Exec("UPDATE people SET dob = '2000-01-01'")
+	require.EqualError(t, err, "ERROR 1054 (42S22): Unknown column 'dob'")
+
+	// Tables are transformed in the transaction rather than cached
+	require.Equal(t, []string{transformedTablePrefix("alice", "") + "people"}, tx.session.temporaryTables)
+	require.Equal(t, CacheStats{}, db.Cache.Stats())
+	require.NoError(t, tx.Rollback())
+
+	// The request policy is checked for every statement
+	tx, err = db.Begin(localRequestPolicy("mallory"))
+	require.NoError(t, err)
+	defer tx.Rollback()
+	_, err = tx.Query("SELECT name FROM people")
+	require.Equal(t, ErrAccessDenied, err)
+}
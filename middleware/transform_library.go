@@ -0,0 +1,657 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// TransformParams holds the named parameters used to build a transform from the built-in transform library
+type TransformParams map[string]interface{}
+
+type transformBuilder struct {
+	params []string
+	build  func(params TransformParams) (ColumnTransform, error)
+	// buildSQL is nil for transforms which the database cannot evaluate
+	buildSQL func(params TransformParams) (SQLTransform, error)
+}
+
+// transformLibrary maps the name of each built-in transform to the parameters it accepts and a function to build it
+var transformLibrary = map[string]transformBuilder{
+	"truncate-date": {
+		params: []string{"unit"},
+		build: func(params TransformParams) (ColumnTransform, error) {
+			unit, err := params.stringParam("unit", "")
+			if err != nil {
+				return nil, err
+			}
+			return TruncateDateTransform(unit)
+		},
+		buildSQL: func(params TransformParams) (SQLTransform, error) {
+			unit, err := params.stringParam("unit", "")
+			if err != nil {
+				return nil, err
+			}
+			return TruncateDateSQLTransform(unit)
+		},
+	},
+	"round": {
+		params: []string{"places"},
+		build: func(params TransformParams) (ColumnTransform, error) {
+			places, err := params.intParam("places", 0)
+			if err != nil {
+				return nil, err
+			}
+			return RoundTransform(places), nil
+		},
+		buildSQL: func(params TransformParams) (SQLTransform, error) {
+			places, err := params.intParam("places", 0)
+			if err != nil {
+				return nil, err
+			}
+			return RoundSQLTransform(places), nil
+		},
+	},
+	"bucket": {
+		params: []string{"width", "origin"},
+		build: func(params TransformParams) (ColumnTransform, error) {
+			width, err := params.floatParam("width", 0)
+			if err != nil {
+				return nil, err
+			}
+			origin, err := params.floatParam("origin", 0)
+			if err != nil {
+				return nil, err
+			}
+			return BucketTransform(width, origin)
+		},
+		buildSQL: func(params TransformParams) (SQLTransform, error) {
+			width, err := params.floatParam("width", 0)
+			if err != nil {
+				return nil, err
+			}
+			origin, err := params.floatParam("origin", 0)
+			if err != nil {
+				return nil, err
+			}
+			return BucketSQLTransform(width, origin)
+		},
+	},
+	"hash": {
+		params: []string{"salt"},
+		build: func(params TransformParams) (ColumnTransform, error) {
+			salt, err := params.stringParam("salt", "")
+			if err != nil {
+				return nil, err
+			}
+			return HashTransform(salt), nil
+		},
+		buildSQL: func(params TransformParams) (SQLTransform, error) {
+			salt, err := params.stringParam("salt", "")
+			if err != nil {
+				return nil, err
+			}
+			return HashSQLTransform(salt), nil
+		},
+	},
+	"redact": {
+		params: []string{"keep", "mask"},
+		build: func(params TransformParams) (ColumnTransform, error) {
+			keep, err := params.intParam("keep", 0)
+			if err != nil {
+				return nil, err
+			}
+			mask, err := params.stringParam("mask", "*")
+			if err != nil {
+				return nil, err
+			}
+			return RedactTransform(keep, mask)
+		},
+		buildSQL: func(params TransformParams) (SQLTransform, error) {
+			keep, err := params.intParam("keep", 0)
+			if err != nil {
+				return nil, err
+			}
+			mask, err := params.stringParam("mask", "*")
+			if err != nil {
+				return nil, err
+			}
+			return RedactSQLTransform(keep, mask)
+		},
+	},
+	"null-out": {
+		build: func(params TransformParams) (ColumnTransform, error) {
+			return NullOutTransform(), nil
+		},
+		buildSQL: func(params TransformParams) (SQLTransform, error) {
+			return NullOutSQLTransform(), nil
+		},
+	},
+	"constant": {
+		params: []string{"value"},
+		build: func(params TransformParams) (ColumnTransform, error) {
+			value, ok := params["value"]
+			if !ok {
+				return nil, fmt.Errorf("the parameter value is required")
+			}
+			return ConstantTransform(value), nil
+		},
+		buildSQL: func(params TransformParams) (SQLTransform, error) {
+			return ConstantSQLTransform(params["value"]), nil
+		},
+	},
+	"regex-mask": {
+		params: []string{"pattern", "replacement"},
+		build: func(params TransformParams) (ColumnTransform, error) {
+			pattern, err := params.stringParam("pattern", "")
+			if err != nil {
+				return nil, err
+			}
+			replacement, err := params.stringParam("replacement", "*")
+			if err != nil {
+				return nil, err
+			}
+			return RegexMaskTransform(pattern, replacement)
+		},
+	},
+	"drop-row-if": {
+		params: []string{"operator", "value"},
+		build: func(params TransformParams) (ColumnTransform, error) {
+			operator, err := params.stringParam("operator", "")
+			if err != nil {
+				return nil, err
+			}
+			return DropRowIfTransform(operator, params["value"])
+		},
+	},
+}
+
+// TransformNames returns the names of all of the transforms in the built-in transform library
+func TransformNames() []string {
+	var names []string
+	for name := range transformLibrary {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// BuildTransform returns the ColumnTransform from the built-in transform library with the passed name, configured
+// with the passed parameters. An error is returned if the transform does not exist or the parameters are invalid.
+func BuildTransform(name string, params TransformParams) (ColumnTransform, error) {
+	builder, ok := transformLibrary[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown transform %s", name)
+	}
+
+	// Reject unknown parameters so that typos do not silently fall back to defaults
+	for param := range params {
+		if !contains(builder.params, param) {
+			return nil, fmt.Errorf("unknown parameter %s for transform %s", param, name)
+		}
+	}
+
+	transform, err := builder.build(params)
+	if err != nil {
+		return nil, fmt.Errorf("invalid parameters for transform %s: %s", name, err.Error())
+	}
+	return transform, nil
+}
+
+// transformLibraryVersion is part of every TransformID, it must be increased whenever a built-in transform changes
+// the values it returns so that tables transformed by the old version are not shared with requesters using the new
+// one
+const transformLibraryVersion = 1
+
+// TransformID returns an ID for the transform from the built-in transform library with the passed name and parameters,
+// for use in TableOperations.TransformIDs. Transforms built with the same name and parameters have the same ID.
+func TransformID(name string, params TransformParams) (string, error) {
+	encodedParams, err := json.Marshal(params)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/v%d/%s", name, transformLibraryVersion, encodedParams), nil
+}
+
+// ErrNotSQLExpressible is returned by BuildSQLTransform for transforms which the database cannot evaluate
+var ErrNotSQLExpressible = errors.New("the transform cannot be expressed in SQL")
+
+// BuildSQLTransform returns the SQLTransform equivalent of the transform from the built-in transform library with the
+// passed name and parameters. ErrNotSQLExpressible is returned if it can only be applied in Go.
+func BuildSQLTransform(name string, params TransformParams) (SQLTransform, error) {
+	// Building the Go transform checks the name and parameters
+	_, err := BuildTransform(name, params)
+	if err != nil {
+		return nil, err
+	}
+
+	builder := transformLibrary[name]
+	if builder.buildSQL == nil {
+		return nil, ErrNotSQLExpressible
+	}
+	return builder.buildSQL(params)
+}
+
+// TruncateDateTransform returns a ColumnTransform which truncates dates to the start of the year, month, day, hour or
+// minute they fall in
+func TruncateDateTransform(unit string) (ColumnTransform, error) {
+	var truncate func(time.Time) time.Time
+	switch strings.ToLower(unit) {
+	case "year":
+		truncate = func(t time.Time) time.Time { return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, t.Location()) }
+	case "month":
+		truncate = func(t time.Time) time.Time { return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location()) }
+	case "day":
+		truncate = func(t time.Time) time.Time { return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()) }
+	case "hour":
+		truncate = func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+		}
+	case "minute":
+		truncate = func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, t.Location())
+		}
+	default:
+		return nil, fmt.Errorf("cannot truncate dates to %q, expected year, month, day, hour or minute", unit)
+	}
+
+	return func(arg interface{}) (interface{}, bool, error) {
+		if arg == nil {
+			return nil, false, nil
+		}
+		date, err := toTime(arg)
+		if err != nil {
+			return nil, true, err
+		}
+		return truncate(date), false, nil
+	}, nil
+}
+
+// truncateDateFormats are the MySQL DATE_FORMAT formats which truncate a date to each unit
+var truncateDateFormats = map[string]string{
+	"year":   "%Y-01-01",
+	"month":  "%Y-%m-01",
+	"day":    "%Y-%m-%d",
+	"hour":   "%Y-%m-%d %H:00:00",
+	"minute": "%Y-%m-%d %H:%i:00",
+}
+
+// TruncateDateSQLTransform is the SQLTransform equivalent of TruncateDateTransform
+func TruncateDateSQLTransform(unit string) (SQLTransform, error) {
+	format, ok := truncateDateFormats[strings.ToLower(unit)]
+	if !ok {
+		return nil, fmt.Errorf("cannot truncate dates to %q, expected year, month, day, hour or minute", unit)
+	}
+	return func(column string) string {
+		return fmt.Sprintf("CAST(DATE_FORMAT(%s, %s) AS DATETIME)", column, sqlLiteral(format))
+	}, nil
+}
+
+// RoundTransform returns a ColumnTransform which rounds numbers to the given number of decimal places, negative
+// values round to tens, hundreds etc.
+func RoundTransform(places int) ColumnTransform {
+	scale := math.Pow(10, float64(places))
+	return func(arg interface{}) (interface{}, bool, error) {
+		if arg == nil {
+			return nil, false, nil
+		}
+		number, err := toFloat64(arg)
+		if err != nil {
+			return nil, true, err
+		}
+		return math.Round(number*scale) / scale, false, nil
+	}
+}
+
+// RoundSQLTransform is the SQLTransform equivalent of RoundTransform
+func RoundSQLTransform(places int) SQLTransform {
+	return func(column string) string {
+		return fmt.Sprintf("ROUND(%s, %d)", column, places)
+	}
+}
+
+// BucketTransform returns a ColumnTransform which replaces numbers with the lower bound of the bucket of the given
+// width they fall in, buckets are aligned to origin
+func BucketTransform(width float64, origin float64) (ColumnTransform, error) {
+	if width <= 0 {
+		return nil, fmt.Errorf("bucket width must be positive, got %v", width)
+	}
+	return func(arg interface{}) (interface{}, bool, error) {
+		if arg == nil {
+			return nil, false, nil
+		}
+		number, err := toFloat64(arg)
+		if err != nil {
+			return nil, true, err
+		}
+		return math.Floor((number-origin)/width)*width + origin, false, nil
+	}, nil
+}
+
+// BucketSQLTransform is the SQLTransform equivalent of BucketTransform
+func BucketSQLTransform(width float64, origin float64) (SQLTransform, error) {
+	if width <= 0 {
+		return nil, fmt.Errorf("bucket width must be positive, got %v", width)
+	}
+	return func(column string) string {
+		return fmt.Sprintf("FLOOR((%s - %s) / %s) * %s + %s", column, sqlLiteral(origin), sqlLiteral(width),
+			sqlLiteral(width), sqlLiteral(origin))
+	}, nil
+}
+
+// HashTransform returns a ColumnTransform which replaces values with the hex encoded SHA-256 hash of the salt followed
+// by the value
+func HashTransform(salt string) ColumnTransform {
+	return func(arg interface{}) (interface{}, bool, error) {
+		if arg == nil {
+			return nil, false, nil
+		}
+		sum := sha256.Sum256([]byte(salt + toString(arg)))
+		return hex.EncodeToString(sum[:]), false, nil
+	}
+}
+
+// HashSQLTransform is the SQLTransform equivalent of HashTransform. Dates are hashed as MySQL formats them, so the
+// hashes of DATE columns differ from those given by HashTransform.
+func HashSQLTransform(salt string) SQLTransform {
+	return func(column string) string {
+		return fmt.Sprintf("SHA2(CONCAT(%s, %s), 256)", sqlLiteral(salt), column)
+	}
+}
+
+// RedactTransform returns a ColumnTransform which keeps the first keep characters of a value and replaces each of the
+// rest with mask
+func RedactTransform(keep int, mask string) (ColumnTransform, error) {
+	if keep < 0 {
+		return nil, fmt.Errorf("the number of characters to keep cannot be negative, got %d", keep)
+	}
+	return func(arg interface{}) (interface{}, bool, error) {
+		if arg == nil {
+			return nil, false, nil
+		}
+		value := toString(arg)
+
+		redacted := ""
+		for i, c := range []rune(value) {
+			if i < keep {
+				redacted += string(c)
+			} else {
+				redacted += mask
+			}
+		}
+		return redacted, false, nil
+	}, nil
+}
+
+// RedactSQLTransform is the SQLTransform equivalent of RedactTransform
+func RedactSQLTransform(keep int, mask string) (SQLTransform, error) {
+	if keep < 0 {
+		return nil, fmt.Errorf("the number of characters to keep cannot be negative, got %d", keep)
+	}
+	return func(column string) string {
+		return fmt.Sprintf("CONCAT(LEFT(%s, %d), REPEAT(%s, GREATEST(CHAR_LENGTH(%s) - %d, 0)))", column, keep,
+			sqlLiteral(mask), column, keep)
+	}, nil
+}
+
+// NullOutTransform returns a ColumnTransform which replaces every value with NULL
+func NullOutTransform() ColumnTransform {
+	return func(arg interface{}) (interface{}, bool, error) {
+		return nil, false, nil
+	}
+}
+
+// ConstantTransform returns a ColumnTransform which replaces every value with the passed value
+func ConstantTransform(value interface{}) ColumnTransform {
+	return func(arg interface{}) (interface{}, bool, error) {
+		return value, false, nil
+	}
+}
+
+// NullOutSQLTransform is the SQLTransform equivalent of NullOutTransform
+func NullOutSQLTransform() SQLTransform {
+	return func(column string) string {
+		return "NULL"
+	}
+}
+
+// ConstantSQLTransform is the SQLTransform equivalent of ConstantTransform
+func ConstantSQLTransform(value interface{}) SQLTransform {
+	return func(column string) string {
+		return sqlLiteral(value)
+	}
+}
+
+// RegexMaskTransform returns a ColumnTransform which replaces each match of pattern with replacement, the replacement
+// may refer to capture groups as described by regexp.Expand
+func RegexMaskTransform(pattern string, replacement string) (ColumnTransform, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("a pattern is required")
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return func(arg interface{}) (interface{}, bool, error) {
+		if arg == nil {
+			return nil, false, nil
+		}
+		return re.ReplaceAllString(toString(arg), replacement), false, nil
+	}, nil
+}
+
+// DropRowIfTransform returns a ColumnTransform which excludes any row where the value in the column satisfies the
+// comparison and otherwise leaves the value unchanged. The supported operators are =, !=, <, <=, >, >=, is-null,
+// not-null and matches (which takes a regular expression).
+func DropRowIfTransform(operator string, value interface{}) (ColumnTransform, error) {
+	var condition func(interface{}) (bool, error)
+	switch operator {
+	case "is-null":
+		condition = func(arg interface{}) (bool, error) { return arg == nil, nil }
+	case "not-null":
+		condition = func(arg interface{}) (bool, error) { return arg != nil, nil }
+	case "matches":
+		pattern, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("the matches operator requires a string value")
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		condition = func(arg interface{}) (bool, error) {
+			return arg != nil && re.MatchString(toString(arg)), nil
+		}
+	case "=", "!=", "<", "<=", ">", ">=":
+		if value == nil {
+			return nil, fmt.Errorf("the %s operator requires a value", operator)
+		}
+		condition = func(arg interface{}) (bool, error) {
+			if arg == nil {
+				// NULL never compares equal or unequal to anything, as in SQL
+				return false, nil
+			}
+			cmp, err := compareValues(arg, value)
+			if err != nil {
+				return false, err
+			}
+			switch operator {
+			case "=":
+				return cmp == 0, nil
+			case "!=":
+				return cmp != 0, nil
+			case "<":
+				return cmp < 0, nil
+			case "<=":
+				return cmp <= 0, nil
+			case ">":
+				return cmp > 0, nil
+			default:
+				return cmp >= 0, nil
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown operator %q", operator)
+	}
+
+	return func(arg interface{}) (interface{}, bool, error) {
+		drop, err := condition(arg)
+		if err != nil {
+			return nil, true, err
+		}
+		return arg, drop, nil
+	}, nil
+}
+
+// compareValues compares a value read from the database with a value from a policy. Times are compared as times,
+// values which can both be read as numbers are compared numerically and anything else is compared as a string.
+func compareValues(arg interface{}, value interface{}) (int, error) {
+	if argTime, ok := arg.(time.Time); ok {
+		valueTime, err := toTime(value)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case argTime.Before(valueTime):
+			return -1, nil
+		case argTime.After(valueTime):
+			return 1, nil
+		default:
+			return 0, nil
+		}
+	}
+
+	argNumber, argErr := toFloat64(arg)
+	valueNumber, valueErr := toFloat64(value)
+	if argErr == nil && valueErr == nil {
+		switch {
+		case argNumber < valueNumber:
+			return -1, nil
+		case argNumber > valueNumber:
+			return 1, nil
+		default:
+			return 0, nil
+		}
+	}
+
+	return strings.Compare(toString(arg), toString(value)), nil
+}
+
+// toFloat64 converts a value scanned from the database into a float64
+func toFloat64(arg interface{}) (float64, error) {
+	switch v := arg.(type) {
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case int8:
+		return float64(v), nil
+	case int16:
+		return float64(v), nil
+	case int32:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case uint:
+		return float64(v), nil
+	case uint8:
+		return float64(v), nil
+	case uint16:
+		return float64(v), nil
+	case uint32:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case []byte:
+		return strconv.ParseFloat(string(v), 64)
+	case string:
+		return strconv.ParseFloat(v, 64)
+	}
+	return 0, fmt.Errorf("argument of type %T could not be read as a number", arg)
+}
+
+// toString converts a value scanned from the database into a string
+func toString(arg interface{}) string {
+	switch v := arg.(type) {
+	case string:
+		return v
+	case []byte:
+		if utf8.Valid(v) {
+			return string(v)
+		}
+		return hex.EncodeToString(v)
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05")
+	}
+	return fmt.Sprint(arg)
+}
+
+// toTime converts a value scanned from the database into a time.Time
+func toTime(arg interface{}) (time.Time, error) {
+	switch v := arg.(type) {
+	case time.Time:
+		return v, nil
+	case []byte:
+		return parseTime(string(v))
+	case string:
+		return parseTime(v)
+	}
+	return time.Time{}, fmt.Errorf("argument of type %T could not be read as a time", arg)
+}
+
+func parseTime(value string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02", time.RFC3339} {
+		t, err := time.ParseInLocation(layout, value, time.UTC)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q could not be read as a time", value)
+}
+
+func (p TransformParams) stringParam(name string, defaultValue string) (string, error) {
+	value, ok := p[name]
+	if !ok {
+		return defaultValue, nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("the parameter %s must be a string", name)
+	}
+	return s, nil
+}
+
+func (p TransformParams) floatParam(name string, defaultValue float64) (float64, error) {
+	value, ok := p[name]
+	if !ok {
+		return defaultValue, nil
+	}
+	f, err := toFloat64(value)
+	if err != nil {
+		return 0, fmt.Errorf("the parameter %s must be a number", name)
+	}
+	return f, nil
+}
+
+func (p TransformParams) intParam(name string, defaultValue int) (int, error) {
+	value, ok := p[name]
+	if !ok {
+		return defaultValue, nil
+	}
+	f, err := toFloat64(value)
+	if err != nil || f != math.Trunc(f) {
+		return 0, fmt.Errorf("the parameter %s must be an integer", name)
+	}
+	return int(f), nil
+}
@@ -0,0 +1,145 @@
+package middleware
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestBuildTransform_Unknown(t *testing.T) {
+	_, err := BuildTransform("scramble", nil)
+	require.EqualError(t, err, "unknown transform scramble")
+}
+
+func TestBuildTransform_UnknownParam(t *testing.T) {
+	_, err := BuildTransform("round", TransformParams{"place": 2.0})
+	require.EqualError(t, err, "unknown parameter place for transform round")
+}
+
+func TestTransformID(t *testing.T) {
+	transformID, err := TransformID("round", TransformParams{"places": 1.0})
+	require.NoError(t, err)
+	require.Equal(t, `round/v1/{"places":1}`, transformID)
+
+	// Params are encoded in the same order however they were built
+	transformID, err = TransformID("regex-mask", TransformParams{"replacement": "#", "pattern": "[0-9]"})
+	require.NoError(t, err)
+	require.Equal(t, `regex-mask/v1/{"pattern":"[0-9]","replacement":"#"}`, transformID)
+}
+
+func TestBuildTransform_InvalidParam(t *testing.T) {
+	_, err := BuildTransform("truncate-date", TransformParams{"unit": "fortnight"})
+	require.Error(t, err)
+
+	_, err = BuildTransform("bucket", TransformParams{"width": 0.0})
+	require.Error(t, err)
+
+	_, err = BuildTransform("regex-mask", TransformParams{"pattern": "("})
+	require.Error(t, err)
+
+	_, err = BuildTransform("round", TransformParams{"places": 1.5})
+	require.Error(t, err)
+}
+
+func TestTransformLibrary(t *testing.T) {
+	date := time.Date(2007, 3, 17, 13, 45, 12, 0, time.UTC)
+
+	testCases := []struct {
+		name       string
+		params     TransformParams
+		input      interface{}
+		output     interface{}
+		excludeRow bool
+	}{
+		{"truncate-date", TransformParams{"unit": "month"}, date, time.Date(2007, 3, 1, 0, 0, 0, 0, time.UTC), false},
+		{"truncate-date", TransformParams{"unit": "year"}, []byte("2007-03-17"), time.Date(2007, 1, 1, 0, 0, 0, 0, time.UTC), false},
+		{"truncate-date", TransformParams{"unit": "hour"}, date, time.Date(2007, 3, 17, 13, 0, 0, 0, time.UTC), false},
+		{"truncate-date", TransformParams{"unit": "day"}, nil, nil, false},
+		{"round", TransformParams{"places": 1.0}, []byte("3.14159"), 3.1, false},
+		{"round", TransformParams{}, int64(7), 7.0, false},
+		{"round", TransformParams{"places": -2.0}, 1234.0, 1200.0, false},
+		{"bucket", TransformParams{"width": 10.0}, int64(37), 30.0, false},
+		{"bucket", TransformParams{"width": 5.0, "origin": 1.0}, 3.0, 1.0, false},
+		{"redact", TransformParams{"keep": 3.0}, []byte("alice"), "ali**", false},
+		{"redact", TransformParams{"mask": "#"}, "bob", "###", false},
+		{"null-out", nil, []byte("secret"), nil, false},
+		{"constant", TransformParams{"value": "REDACTED"}, []byte("secret"), "REDACTED", false},
+		{"regex-mask", TransformParams{"pattern": "[0-9]"}, []byte("CB2 1TN"), "CB* *TN", false},
+		{"regex-mask", TransformParams{"pattern": "^(..).*$", "replacement": "${1}..."}, "CB2 1TN", "CB...", false},
+		{"drop-row-if", TransformParams{"operator": ">", "value": 100.0}, []byte("240.5"), []byte("240.5"), true},
+		{"drop-row-if", TransformParams{"operator": ">", "value": 100.0}, []byte("20"), []byte("20"), false},
+		{"drop-row-if", TransformParams{"operator": "=", "value": "EU"}, []byte("EU"), []byte("EU"), true},
+		{"drop-row-if", TransformParams{"operator": "is-null"}, nil, nil, true},
+		{"drop-row-if", TransformParams{"operator": "matches", "value": "^test_"}, "test_user", "test_user", true},
+		{"drop-row-if", TransformParams{"operator": "<", "value": "2000-01-01"}, date, date, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			transform, err := BuildTransform(tc.name, tc.params)
+			require.NoError(t, err)
+
+			output, excludeRow, err := transform(tc.input)
+			require.NoError(t, err)
+			require.Equal(t, tc.excludeRow, excludeRow)
+			require.Equal(t, tc.output, output)
+		})
+	}
+}
+
+func TestHashTransform_Stable(t *testing.T) {
+	transform := HashTransform("pepper")
+
+	first, _, err := transform([]byte("alice"))
+	require.NoError(t, err)
+	second, _, err := transform("alice")
+	require.NoError(t, err)
+	other, _, err := HashTransform("salt")("alice")
+	require.NoError(t, err)
+
+	require.Len(t, first, 64)
+	require.Equal(t, first, second)
+	require.NotEqual(t, first, other)
+}
+
+func TestTruncateDateTransform_BadValue(t *testing.T) {
+	transform, err := TruncateDateTransform("month")
+	require.NoError(t, err)
+
+	_, excludeRow, err := transform(42)
+	require.Error(t, err)
+	require.True(t, excludeRow)
+}
+
+func TestBuildSQLTransform(t *testing.T) {
+	testCases := []struct {
+		name       string
+		params     TransformParams
+		expression string
+	}{
+		{"truncate-date", TransformParams{"unit": "hour"},
+			"CAST(DATE_FORMAT(`col`, '%Y-%m-%d %H:00:00') AS DATETIME)"},
+		{"round", TransformParams{"places": -1.0}, "ROUND(`col`, -1)"},
+		{"bucket", TransformParams{"width": 10.0, "origin": 5.0}, "FLOOR((`col` - 5) / 10) * 10 + 5"},
+		{"hash", TransformParams{"salt": "pepper"}, "SHA2(CONCAT('pepper', `col`), 256)"},
+		{"redact", TransformParams{"keep": 1.0, "mask": "#"},
+			"CONCAT(LEFT(`col`, 1), REPEAT('#', GREATEST(CHAR_LENGTH(`col`) - 1, 0)))"},
+		{"null-out", nil, "NULL"},
+		{"constant", TransformParams{"value": "hidden"}, "'hidden'"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			transform, err := BuildSQLTransform(tc.name, tc.params)
+			require.NoError(t, err)
+			require.Equal(t, tc.expression, transform("`col`"))
+		})
+	}
+
+	_, err := BuildSQLTransform("regex-mask", TransformParams{"pattern": "[0-9]"})
+	require.Equal(t, ErrNotSQLExpressible, err)
+
+	_, err = BuildSQLTransform("truncate-date", TransformParams{"unit": "fortnight"})
+	require.Error(t, err)
+	require.NotEqual(t, ErrNotSQLExpressible, err)
+}
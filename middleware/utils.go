@@ -1,6 +1,9 @@
 package middleware
 
 import (
+	"github.com/xwb1989/sqlparser"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -25,6 +28,49 @@ func contains(stringList []string, element string) bool {
 	return false
 }
 
+// sortedStrings returns a sorted copy of the strings
+func sortedStrings(strs []string) []string {
+	sorted := append([]string{}, strs...)
+	sort.Strings(sorted)
+	return sorted
+}
+
 func timeWithUTCLocation(t time.Time) time.Time {
 	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
 }
+
+// formatSQL serialises a parsed SQL statement back into a query, placeholders are written as ? so that the query can
+// still be run with the arguments passed for the original query. Casts are written with CAST rather than MySQL's
+// CONVERT so that the query can run on any of the databases.
+func formatSQL(node sqlparser.SQLNode) string {
+	return formatDialectSQL(node, nil)
+}
+
+// formatDialectSQL is formatSQL for the database of a dialect, which writes any nodes that it needs written
+// differently. Without a dialect the query is written for MySQL.
+func formatDialectSQL(node sqlparser.SQLNode, dialect sqlDialect) string {
+	buf := sqlparser.NewTrackedBuffer(func(buf *sqlparser.TrackedBuffer, node sqlparser.SQLNode) {
+		if dialect != nil && dialect.formatNode(buf, node) {
+			return
+		}
+		switch node := node.(type) {
+		case *sqlparser.SQLVal:
+			if node.Type == sqlparser.ValArg {
+				// The parser names the nth ? placeholder :vn
+				n, err := strconv.Atoi(strings.TrimPrefix(string(node.Val), ":v"))
+				if dialect == nil || err != nil {
+					buf.WriteString("?")
+				} else {
+					buf.WriteString(dialect.placeholder(n))
+				}
+				return
+			}
+		case *sqlparser.ConvertExpr:
+			buf.Myprintf("cast(%v as %v)", node.Expr, node.Type)
+			return
+		}
+		node.Format(buf)
+	})
+	buf.Myprintf("%v", node)
+	return buf.String()
+}
@@ -0,0 +1,318 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// PolicyProblemKind is the kind of mistake Validate found in a data policy
+type PolicyProblemKind int
+
+const (
+	// UnknownTable problems are operations for a table which is not in the database, so they are never applied
+	UnknownTable PolicyProblemKind = iota
+	// UnknownColumn problems are references to a column which the table does not have
+	UnknownColumn PolicyProblemKind = iota
+	// UnusedPolicy problems are operations which can never be applied, such as transforms of hidden columns
+	UnusedPolicy PolicyProblemKind = iota
+	// InapplicableTransform problems are transforms which fail on values of the column's data type
+	InapplicableTransform PolicyProblemKind = iota
+)
+
+func (k PolicyProblemKind) ToString() string {
+	switch k {
+	case UnknownTable:
+		return "unknown-table"
+	case UnknownColumn:
+		return "unknown-column"
+	case UnusedPolicy:
+		return "unused-policy"
+	case InapplicableTransform:
+		return "inapplicable-transform"
+	}
+	return ""
+}
+
+// PolicyProblem is a mistake in a data policy found by Validate. Source is the privacy group, and purpose if there is
+// one, whose TableOperations have the problem.
+type PolicyProblem struct {
+	Kind    PolicyProblemKind
+	Source  string
+	Table   string
+	Column  string
+	Message string
+}
+
+func (p PolicyProblem) String() string {
+	return fmt.Sprintf("%s: %s", p.Source, p.Message)
+}
+
+// OperationsReporter is an optional interface for a DataPolicy which can list all of its TableOperations, it is used
+// by Validate to check them against the database
+type OperationsReporter interface {
+	// LabelledTableOperations returns every TableOperations which the policy can apply, keyed by the group and
+	// purpose they are for
+	LabelledTableOperations() map[string]*TableOperations
+	// UnusedTableOperations returns the labels of any TableOperations the policy holds but never applies
+	UnusedTableOperations() []string
+}
+
+// databaseSchema maps the name of each table to the data type of each of its columns, keyed by the lower case name
+type databaseSchema map[string]map[string]string
+
+func (pd *privateDatabase) validate(ctx context.Context) ([]PolicyProblem, error) {
+	operationsReporter, ok := pd.DataPolicy.(OperationsReporter)
+	if !ok {
+		return nil, errors.New("the data policy cannot list its table operations")
+	}
+
+	schema, err := pd.schema(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []PolicyProblem
+	for _, label := range operationsReporter.UnusedTableOperations() {
+		problems = append(problems, PolicyProblem{
+			Kind:    UnusedPolicy,
+			Source:  label,
+			Message: "the table operations are never applied",
+		})
+	}
+
+	labelledOperations := operationsReporter.LabelledTableOperations()
+	var labels []string
+	for label := range labelledOperations {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		problems = append(problems, schema.validateOperations(label, labelledOperations[label], pd.dialect.sampleValue)...)
+	}
+
+	if pd.Consent != nil {
+		problems = append(problems, schema.validateConsent(pd.Consent)...)
+	}
+	return problems, nil
+}
+
+// schema reads the columns of every table in the database
+func (pd *privateDatabase) schema(ctx context.Context) (databaseSchema, error) {
+	schemaQuery, schemaArgs := pd.dialect.schemaQuery(pd.databaseName)
+	columns, err := pd.database.QueryContext(ctx, schemaQuery, schemaArgs...)
+	if err != nil {
+		return nil, err
+	}
+	defer columns.Close()
+
+	schema := make(databaseSchema)
+	var tableName, columnName, dataType string
+	for columns.Next() {
+		err := columns.Scan(&tableName, &columnName, &dataType)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := schema[tableName]; !ok {
+			schema[tableName] = make(map[string]string)
+		}
+		schema[tableName][strings.ToLower(columnName)] = strings.ToLower(dataType)
+	}
+
+	if columns.Err() != nil {
+		return nil, columns.Err()
+	}
+	return schema, nil
+}
+
+// validateOperations returns the problems with the TableOperations labelled source, transforms are checked against
+// the values returned by sampleValue unless applying them has side effects, such as recording pseudonyms in a vault
+func (schema databaseSchema) validateOperations(source string, tableOperations *TableOperations,
+	sampleValue func(dataType string) interface{}) []PolicyProblem {
+	var problems []PolicyProblem
+	tables := tableOperations.tables()
+	sort.Strings(tables)
+	for _, table := range tables {
+		columns, ok := schema[table]
+		if !ok {
+			problems = append(problems, PolicyProblem{
+				Kind:    UnknownTable,
+				Source:  source,
+				Table:   table,
+				Message: fmt.Sprintf("the table %s does not exist", table),
+			})
+			continue
+		}
+
+		problem := func(kind PolicyProblemKind, column string, format string, args ...interface{}) {
+			problems = append(problems, PolicyProblem{
+				Kind:    kind,
+				Source:  source,
+				Table:   table,
+				Column:  column,
+				Message: fmt.Sprintf(format, args...),
+			})
+		}
+
+		for _, column := range referencedColumns(tableOperations, table) {
+			if _, ok := columns[strings.ToLower(column)]; !ok {
+				problem(UnknownColumn, column, "the column %s of table %s does not exist", column, table)
+			}
+		}
+
+		transforms := make(TableTransform)
+		for column, transform := range tableOperations.TableTransforms[table] {
+			transforms[column] = transform
+		}
+		for column, requesterTransform := range tableOperations.RequesterTransforms[table] {
+			transforms[column] = requesterTransform(AnonymousRequesterID)
+		}
+		transformedColumns := mergeStringSlice(tableOperations.transformedColumns(table), sortedColumns(transforms))
+		sort.Strings(transformedColumns)
+		for _, column := range transformedColumns {
+			if _, ok := columns[strings.ToLower(column)]; ok && !tableOperations.columnVisible(table, column) {
+				problem(UnusedPolicy, column, "the column %s of table %s is transformed but never visible",
+					column, table)
+			}
+		}
+		// SQLTransforms are checked by the database when it runs them
+		for _, column := range sortedColumns(transforms) {
+			dataType, ok := columns[strings.ToLower(column)]
+			if !ok || !tableOperations.columnVisible(table, column) ||
+				tableOperations.SideEffects[table][column] {
+				continue
+			}
+			_, _, err := transforms[column](sampleValue(dataType))
+			if err != nil {
+				problem(InapplicableTransform, column, "the transform of column %s of table %s cannot apply to %s: %s",
+					column, table, dataType, err)
+			}
+		}
+	}
+	return problems
+}
+
+// validateConsent returns the problems with the subject columns of a ConsentRegistry
+func (schema databaseSchema) validateConsent(consent *ConsentRegistry) []PolicyProblem {
+	var problems []PolicyProblem
+	var tables []string
+	for table := range consent.SubjectColumns {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		column := consent.SubjectColumns[table]
+		columns, ok := schema[table]
+		if !ok {
+			problems = append(problems, PolicyProblem{
+				Kind:    UnknownTable,
+				Source:  "consent registry",
+				Table:   table,
+				Message: fmt.Sprintf("the table %s does not exist", table),
+			})
+		} else if _, ok := columns[strings.ToLower(column)]; !ok {
+			problems = append(problems, PolicyProblem{
+				Kind:    UnknownColumn,
+				Source:  "consent registry",
+				Table:   table,
+				Column:  column,
+				Message: fmt.Sprintf("the column %s of table %s does not exist", column, table),
+			})
+		}
+	}
+	return problems
+}
+
+// referencedColumns returns every column of the table which the TableOperations refer to by name, row transforms are
+// not included as their columns cannot be known without running them
+func referencedColumns(tableOperations *TableOperations, table string) []string {
+	var columns []string
+	columns = mergeStringSlice(columns, tableOperations.transformedColumns(table))
+	for column := range tableOperations.RequesterTransforms[table] {
+		columns = mergeStringSlice(columns, []string{column})
+	}
+	columns = mergeStringSlice(columns, tableOperations.ExcludedCols[table])
+	columns = mergeStringSlice(columns, tableOperations.AllowedCols[table])
+	columns = mergeStringSlice(columns, rowFilterColumns(tableOperations.RowFilters[table]))
+	columns = mergeStringSlice(columns, rowFilterColumns(tableOperations.WriteFilters[table]))
+	sort.Strings(columns)
+	return columns
+}
+
+func rowFilterColumns(rowFilters []RowFilter) []string {
+	var columns []string
+	for _, rowFilter := range rowFilters {
+		if rowFilter.AnyOf != nil {
+			for _, filters := range rowFilter.AnyOf {
+				columns = mergeStringSlice(columns, rowFilterColumns(filters))
+			}
+			continue
+		}
+		columns = mergeStringSlice(columns, []string{rowFilter.Column})
+	}
+	return columns
+}
+
+func sortedColumns(transforms TableTransform) []string {
+	var columns []string
+	for column := range transforms {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+// LabelledTableOperations returns the TableOperations of each privacy group, including the public group, labelled by
+// the name of the group and the purpose they are for
+func (sdp *StaticDataPolicy) LabelledTableOperations() map[string]*TableOperations {
+	labelledOperations := make(map[string]*TableOperations)
+	groups := sdp.privacyGroups
+	if sdp.PublicGroup != nil {
+		groups = append([]*PrivacyGroup{sdp.PublicGroup}, groups...)
+	}
+	for _, group := range groups {
+		if purposes := sdp.Purposes[group]; len(purposes) > 0 {
+			for purpose, tableOperations := range purposes {
+				labelledOperations[fmt.Sprintf("privacy group %s, purpose %s", group.Name(), purpose)] = tableOperations
+			}
+		} else if tableOperations, ok := sdp.transforms[group]; ok {
+			labelledOperations["privacy group "+group.Name()] = tableOperations
+		}
+	}
+	return labelledOperations
+}
+
+// UnusedTableOperations returns the labels of TableOperations for groups which are not part of the policy and of the
+// DataTransforms of groups which declare purposes, as only their purposes' TableOperations are used
+func (sdp *StaticDataPolicy) UnusedTableOperations() []string {
+	isPolicyGroup := func(group *PrivacyGroup) bool {
+		if group == sdp.PublicGroup {
+			return true
+		}
+		for _, policyGroup := range sdp.privacyGroups {
+			if group == policyGroup {
+				return true
+			}
+		}
+		return false
+	}
+
+	var unused []string
+	for group := range sdp.transforms {
+		if !isPolicyGroup(group) || len(sdp.Purposes[group]) > 0 {
+			unused = append(unused, "privacy group "+group.Name())
+		}
+	}
+	for group, purposes := range sdp.Purposes {
+		if isPolicyGroup(group) {
+			continue
+		}
+		for purpose := range purposes {
+			unused = append(unused, fmt.Sprintf("privacy group %s, purpose %s", group.Name(), purpose))
+		}
+	}
+	sort.Strings(unused)
+	return unused
+}
@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func testSchema() databaseSchema {
+	return databaseSchema{
+		"people": {"id": "int", "name": "varchar", "dob": "date"},
+	}
+}
+
+func TestDatabaseSchema_ValidateOperations(t *testing.T) {
+	truncateYear, err := TruncateDateTransform("year")
+	require.NoError(t, err)
+
+	tableOperations := NewTableOperations()
+	tableOperations.TableTransforms["people"] = TableTransform{
+		"dob":  truncateYear,
+		"name": truncateYear,
+		"id":   RoundTransform(-1),
+	}
+	tableOperations.TableTransforms["peeple"] = TableTransform{"name": HashTransform("")}
+	tableOperations.ExcludedCols["people"] = []string{"id", "adress"}
+	tableOperations.RowFilters["people"] = []RowFilter{{AnyOf: [][]RowFilter{
+		{{Column: "nmae", Operator: "IS NULL"}},
+		{{Column: "dob", Operator: "IS NULL"}},
+	}}}
+
+	problems := testSchema().validateOperations("privacy group Group1", tableOperations, mysqlDialect{}.sampleValue)
+	require.Equal(t, []PolicyProblem{
+		{Kind: UnknownTable, Source: "privacy group Group1", Table: "peeple",
+			Message: "the table peeple does not exist"},
+		{Kind: UnknownColumn, Source: "privacy group Group1", Table: "people", Column: "adress",
+			Message: "the column adress of table people does not exist"},
+		{Kind: UnknownColumn, Source: "privacy group Group1", Table: "people", Column: "nmae",
+			Message: "the column nmae of table people does not exist"},
+		{Kind: UnusedPolicy, Source: "privacy group Group1", Table: "people", Column: "id",
+			Message: "the column id of table people is transformed but never visible"},
+		{Kind: InapplicableTransform, Source: "privacy group Group1", Table: "people", Column: "name",
+			Message: "the transform of column name of table people cannot apply to varchar: " +
+				"\"sample\" could not be read as a time"},
+	}, problems)
+}
+
+func TestDatabaseSchema_ValidateOperations_Valid(t *testing.T) {
+	tableOperations := NewTableOperations()
+	tableOperations.TableTransforms = validFuncMap()
+	tableOperations.RequesterTransforms["people"] = RequesterTableTransform{
+		"id": (&Pseudonymiser{Key: []byte("key")}).RequesterTransform(),
+	}
+	tableOperations.AllowedCols["people"] = []string{"ID", "name", "dob"}
+
+	require.Empty(t, testSchema().validateOperations("privacy group Group1", tableOperations, mysqlDialect{}.sampleValue))
+
+	// Transforms which record what they are applied to are not applied to samples
+	vault := NewInMemoryPseudonymVault()
+	pseudonymiser := &Pseudonymiser{Key: []byte("key"), Vault: vault}
+	tableOperations.TableTransforms["people"]["name"] = pseudonymiser.GroupTransform("Group1")
+	tableOperations.RequesterTransforms["people"]["id"] = pseudonymiser.RequesterTransform()
+	tableOperations.SideEffects["people"] = map[string]bool{"name": true, "id": true}
+	require.Empty(t, testSchema().validateOperations("privacy group Group1", tableOperations, mysqlDialect{}.sampleValue))
+	require.Empty(t, vault.values)
+
+	// Unless they are not marked as having side effects
+	delete(tableOperations.SideEffects["people"], "name")
+	require.Empty(t, testSchema().validateOperations("privacy group Group1", tableOperations, mysqlDialect{}.sampleValue))
+	require.Len(t, vault.values, 1)
+}
+
+func TestDatabaseSchema_ValidateConsent(t *testing.T) {
+	consent := &ConsentRegistry{SubjectColumns: map[string]string{"people": "subject", "orders": "customer_id"}}
+
+	require.Equal(t, []PolicyProblem{
+		{Kind: UnknownTable, Source: "consent registry", Table: "orders",
+			Message: "the table orders does not exist"},
+		{Kind: UnknownColumn, Source: "consent registry", Table: "people", Column: "subject",
+			Message: "the column subject of table people does not exist"},
+	}, testSchema().validateConsent(consent))
+}
+
+func TestStaticDataPolicy_LabelledTableOperations(t *testing.T) {
+	group1 := NewPrivacyGroup("Group1")
+	group2 := NewPrivacyGroup("Group2")
+	public := NewPrivacyGroup("Public")
+	notInPolicy := NewPrivacyGroup("NotInPolicy")
+
+	group1Operations := NewTableOperations()
+	researchOperations := NewTableOperations()
+	publicOperations := NewTableOperations()
+
+	dataPolicy := NewStaticDataPolicy([]*PrivacyGroup{group1, group2}, DataTransforms{
+		group1:      group1Operations,
+		group2:      NewTableOperations(),
+		public:      publicOperations,
+		notInPolicy: NewTableOperations(),
+	})
+	dataPolicy.PublicGroup = public
+	dataPolicy.Purposes = PurposeTransforms{
+		group2:      {"research": researchOperations},
+		notInPolicy: {"research": NewTableOperations()},
+	}
+
+	require.Equal(t, map[string]*TableOperations{
+		"privacy group Group1":                   group1Operations,
+		"privacy group Group2, purpose research": researchOperations,
+		"privacy group Public":                   publicOperations,
+	}, dataPolicy.LabelledTableOperations())
+	require.Equal(t, []string{
+		"privacy group Group2",
+		"privacy group NotInPolicy",
+		"privacy group NotInPolicy, purpose research",
+	}, dataPolicy.UnusedTableOperations())
+}
+
+func TestPolicyProblemKind_ToString(t *testing.T) {
+	require.Equal(t, "unknown-column", UnknownColumn.ToString())
+	require.Equal(t, "privacy group Group1: the table peeple does not exist",
+		PolicyProblem{Kind: UnknownTable, Source: "privacy group Group1",
+			Message: "the table peeple does not exist"}.String())
+}
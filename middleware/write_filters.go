@@ -0,0 +1,227 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/xwb1989/sqlparser"
+	"strconv"
+	"strings"
+)
+
+// ErrWriteDenied is returned when a row an INSERT writes does not satisfy the WriteFilters of the requester
+var ErrWriteDenied = errors.New("the rows written are not allowed by the data policy")
+
+// writeFilterCondition returns the condition the rows of a table must satisfy to be written by the requester, with the
+// values of the filters written as literals, or nil if the table has no WriteFilters
+func writeFilterCondition(tableName string, tableOperations *TableOperations, requesterID string) (sqlparser.Expr,
+	error) {
+	writeFilters := tableOperations.WriteFilters[tableName]
+	if len(writeFilters) == 0 {
+		return nil, nil
+	}
+	condition, args, err := rowFiltersSQL(writeFilters, requesterID)
+	if err != nil {
+		return nil, err
+	}
+	return parseCondition(inlineArgs(condition, args))
+}
+
+// parseCondition parses a condition in the SQL the parser reads
+func parseCondition(condition string) (sqlparser.Expr, error) {
+	stmt, err := sqlparser.Parse("SELECT 1 FROM dual WHERE " + condition)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.(*sqlparser.Select).Where.Expr, nil
+}
+
+// constrainWrite adds the RowFilters, the consent filter and the WriteFilters of the tables an UPDATE or DELETE refers
+// to to its WHERE clause, so that it only changes rows the requester may both read and write. Rows the requester
+// cannot read are neither changed nor counted as affected, so that the rows a write affects reveal nothing about
+// them. The WriteFilters must also be satisfied by the values an UPDATE sets, so that rows cannot be moved out of what
+// the requester may write. Every table the statement refers to is constrained as the parser does not say which of them
+// are changed. It returns whether the statement was changed.
+func (pd *privateDatabase) constrainWrite(stmt sqlparser.Statement, args []interface{},
+	tableOperations *TableOperations, requesterID string, purpose string) (bool, error) {
+	var (
+		tableExprs  sqlparser.TableExprs
+		where       **sqlparser.Where
+		updateExprs sqlparser.UpdateExprs
+	)
+	switch stmt := stmt.(type) {
+	case *sqlparser.Update:
+		tableExprs, where, updateExprs = stmt.TableExprs, &stmt.Where, stmt.Exprs
+	case *sqlparser.Delete:
+		tableExprs, where = stmt.TableExprs, &stmt.Where
+	default:
+		return false, nil
+	}
+
+	var conditions []string
+	err := sqlparser.Walk(
+		func(node sqlparser.SQLNode) (kcontinue bool, err error) {
+			aliasedTableExpr, ok := node.(*sqlparser.AliasedTableExpr)
+			if !ok {
+				return true, nil
+			}
+			tableName, ok := aliasedTableExpr.Expr.(sqlparser.TableName)
+			if !ok {
+				return true, nil
+			}
+			qualifier := aliasedTableExpr.As
+			if qualifier.IsEmpty() {
+				qualifier = tableName.Name
+			}
+
+			readFilter, readFilterArgs, err := pd.rowFilter(tableName.Name.String(), tableOperations, requesterID,
+				purpose)
+			if err != nil {
+				return false, err
+			}
+			if readFilter != "" {
+				readCondition, err := parseCondition(inlineArgs(readFilter, readFilterArgs))
+				if err != nil {
+					return false, err
+				}
+				conditions = append(conditions, writeCondition(readCondition, tableName.Name, qualifier, nil))
+			}
+
+			condition, err := writeFilterCondition(tableName.Name.String(), tableOperations, requesterID)
+			if err != nil || condition == nil {
+				return false, err
+			}
+			conditions = append(conditions, writeCondition(condition, tableName.Name, qualifier, nil))
+
+			// The row must satisfy the filters before and after it is updated
+			values := make(map[string]string)
+			for _, updateExpr := range updateExprs {
+				updateQualifier := updateExpr.Name.Qualifier
+				if !updateQualifier.IsEmpty() && !strings.EqualFold(updateQualifier.Name.String(), qualifier.String()) {
+					continue
+				}
+				for _, column := range rowFilterColumns(tableOperations.WriteFilters[tableName.Name.String()]) {
+					if updateExpr.Name.Name.EqualString(column) {
+						values[updateExpr.Name.Name.Lowered()] = inlinePlaceholders(updateExpr.Expr, args)
+					}
+				}
+			}
+			if len(values) > 0 {
+				conditions = append(conditions, writeCondition(condition, tableName.Name, qualifier, values))
+			}
+			return false, nil
+		}, tableExprs)
+	if err != nil || len(conditions) == 0 {
+		return false, err
+	}
+
+	condition, err := parseCondition(strings.Join(conditions, " AND "))
+	if err != nil {
+		return false, err
+	}
+	if *where == nil {
+		*where = sqlparser.NewWhere(sqlparser.WhereStr, condition)
+	} else {
+		(*where).Expr = &sqlparser.AndExpr{Left: &sqlparser.ParenExpr{Expr: (*where).Expr}, Right: condition}
+	}
+	return true, nil
+}
+
+// checkInsertedRows returns ErrWriteDenied unless every row an INSERT writes satisfies the WriteFilters of its table.
+// The database evaluates the filters with the values of each row, so the columns the filters refer to must be given
+// values rather than their defaults. INSERT ... ON DUPLICATE KEY UPDATE and REPLACE are refused as they can change
+// existing rows which do not satisfy the filters.
+func (pd *privateDatabase) checkInsertedRows(ctx context.Context, session *querySession, stmt sqlparser.Statement,
+	args []interface{}, tableOperations *TableOperations, requesterID string) error {
+	insert, ok := stmt.(*sqlparser.Insert)
+	if !ok {
+		return nil
+	}
+	tableName := insert.Table.Name.String()
+	condition, err := writeFilterCondition(tableName, tableOperations, requesterID)
+	if err != nil || condition == nil {
+		return err
+	}
+	rows, ok := insert.Rows.(sqlparser.Values)
+	if !ok || insert.Action == sqlparser.ReplaceStr || len(insert.OnDup) > 0 {
+		return ErrWriteDenied
+	}
+
+	var conditions []string
+	for _, row := range rows {
+		values := make(map[string]string)
+		for i, column := range insert.Columns {
+			if i >= len(row) {
+				break
+			}
+			if _, isDefault := row[i].(*sqlparser.Default); !isDefault {
+				values[column.Lowered()] = inlinePlaceholders(row[i], args)
+			}
+		}
+		// Columns which are not given values take their defaults, which are not known
+		for _, column := range rowFilterColumns(tableOperations.WriteFilters[tableName]) {
+			if _, ok := values[strings.ToLower(column)]; !ok {
+				return ErrWriteDenied
+			}
+		}
+		conditions = append(conditions, writeCondition(condition, insert.Table.Name, sqlparser.NewTableIdent(""),
+			values))
+	}
+
+	check, err := sqlparser.Parse(fmt.Sprintf("SELECT CASE WHEN %s THEN 1 ELSE 0 END",
+		strings.Join(conditions, " AND ")))
+	if err != nil {
+		return err
+	}
+	var allowed int
+	err = pd.runner(session).QueryRowContext(ctx, formatDialectSQL(check, pd.dialect)).Scan(&allowed)
+	if err != nil {
+		return err
+	}
+	if allowed != 1 {
+		return ErrWriteDenied
+	}
+	return nil
+}
+
+// writeCondition writes a condition on a table in the SQL the parser reads, with the table's columns which have values
+// replaced by them and the others qualified by the table's name or alias. Columns qualified by anything else, such as
+// those of the consent registry, are left as they are.
+func writeCondition(condition sqlparser.Expr, tableName sqlparser.TableIdent, qualifier sqlparser.TableIdent,
+	values map[string]string) string {
+	buf := sqlparser.NewTrackedBuffer(func(buf *sqlparser.TrackedBuffer, node sqlparser.SQLNode) {
+		column, ok := node.(*sqlparser.ColName)
+		if ok && (column.Qualifier.IsEmpty() || column.Qualifier.Name.String() == tableName.String()) {
+			if value, ok := values[column.Name.Lowered()]; ok {
+				buf.WriteString("(" + value + ")")
+				return
+			}
+			if !qualifier.IsEmpty() {
+				buf.Myprintf("%v.%v", qualifier, column.Name)
+				return
+			}
+		}
+		node.Format(buf)
+	})
+	buf.Myprintf("(%v)", condition)
+	return buf.String()
+}
+
+// inlinePlaceholders writes an expression in the SQL the parser reads with its placeholders replaced by the literals
+// of their arguments, so that it can be repeated in a query. Placeholders without an argument are left, as when a
+// query is explained.
+func inlinePlaceholders(expr sqlparser.Expr, args []interface{}) string {
+	buf := sqlparser.NewTrackedBuffer(func(buf *sqlparser.TrackedBuffer, node sqlparser.SQLNode) {
+		if value, ok := node.(*sqlparser.SQLVal); ok && value.Type == sqlparser.ValArg {
+			// The parser names the nth ? placeholder :vn
+			n, err := strconv.Atoi(strings.TrimPrefix(string(value.Val), ":v"))
+			if err == nil && n >= 1 && n <= len(args) {
+				buf.WriteString(sqlLiteral(args[n-1]))
+				return
+			}
+		}
+		node.Format(buf)
+	})
+	buf.Myprintf("%v", expr)
+	return buf.String()
+}
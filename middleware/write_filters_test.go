@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"github.com/stretchr/testify/require"
+	"github.com/xwb1989/sqlparser"
+	"testing"
+)
+
+func TestConstrainWrite(t *testing.T) {
+	pd := (&SQLitePrivateDatabase{}).core()
+	tableOperations := NewTableOperations()
+	tableOperations.WriteFilters["people"] = []RowFilter{{Column: "owner", Operator: "=", Value: RequesterIDValue}}
+
+	testCases := []struct {
+		query       string
+		constrained string
+	}{
+		{"UPDATE people SET name = 'bob' WHERE id = 1",
+			"update people set name = 'bob' where (id = 1) and (people.owner = 'alice')"},
+		{"DELETE FROM people",
+			"delete from people where (people.owner = 'alice')"},
+		{"DELETE FROM people WHERE id = 1 OR id = 2",
+			"delete from people where (id = 1 or id = 2) and (people.owner = 'alice')"},
+		{"UPDATE people SET owner = ? WHERE id = ?",
+			"update people set owner = ? where (id = ?) and (people.owner = 'alice') and (('bob') = 'alice')"},
+		{"UPDATE people p JOIN orders o ON p.id = o.person_id SET p.name = 'bob', o.owner = 'bob'",
+			"update people as p join orders as o on p.id = o.person_id set p.name = 'bob', o.owner = 'bob' where (p.owner = 'alice')"},
+		{"UPDATE orders SET total = 0", "update orders set total = 0"},
+		{"INSERT INTO people (name, owner) VALUES ('bob', 'alice')",
+			"insert into people(name, owner) values ('bob', 'alice')"},
+	}
+
+	for _, tc := range testCases {
+		stmt, err := sqlparser.Parse(tc.query)
+		require.NoError(t, err)
+		_, err = pd.constrainWrite(stmt, []interface{}{"bob", 1}, tableOperations, "alice", "")
+		require.NoError(t, err)
+		require.Equal(t, tc.constrained, formatSQL(stmt), tc.query)
+	}
+
+	// Rows the requester cannot read are not written either
+	tableOperations.RowFilters["people"] = []RowFilter{{Column: "name", Operator: "!=", Value: "bob"}}
+	pd.Consent = &ConsentRegistry{SubjectColumns: map[string]string{"people": "name"}}
+	stmt, err := sqlparser.Parse("UPDATE people p SET p.name = 'bob' WHERE id = 1")
+	require.NoError(t, err)
+	_, err = pd.constrainWrite(stmt, nil, tableOperations, "alice", "")
+	require.NoError(t, err)
+	require.Equal(t, "update people as p set p.name = 'bob' where (id = 1) and ((p.name != 'bob') and not exists (select 1 from "+
+		"pam_consent as consent where consent.subject_key = p.name and (consent.requester_id is null or "+
+		"consent.requester_id = 'alice'))) and (p.owner = 'alice')", formatSQL(stmt))
+}
+
+func TestSQLitePrivateDatabase_Write_Filters(t *testing.T) {
+	tableOperations := NewTableOperations()
+	tableOperations.WriteFilters["people"] = []RowFilter{{Column: "name", Operator: "=", Value: RequesterIDValue}}
+	db := SQLitePrivateDatabase{DataPolicy: sqliteTestPolicy(tableOperations)}
+	sqlitePrivateDBConnection(t, &db)
+	requestPolicy := localRequestPolicy("alice")
+
+	// Every row inserted must satisfy the filters, the values of placeholders are checked
+	_, err := db.Exec("INSERT INTO people (name, dob) VALUES (?, ?), (?, ?)", requestPolicy,
+		"alice", "1970-01-01", "bob", "1971-01-01")
+	require.Equal(t, ErrWriteDenied, err)
+	_, err = db.Exec("INSERT INTO people (name, dob) VALUES (DEFAULT, '1970-01-01')", requestPolicy)
+	require.Equal(t, ErrWriteDenied, err)
+	_, err = db.Exec("REPLACE INTO people (id, name) VALUES (2, 'alice')", requestPolicy)
+	require.Equal(t, ErrWriteDenied, err)
+	_, err = db.Exec("INSERT INTO people (id, name, dob) VALUES (?, ?, ?)", requestPolicy, 4, "alice", "1970-01-01")
+	require.NoError(t, err)
+
+	// Prepared updates only change the rows the requester may write
+	update, err := db.Prepare("UPDATE people SET dob = ? WHERE name = ?")
+	require.NoError(t, err)
+	for name, expected := range map[string]int64{"alice": 2, "bob": 0} {
+		result, err := update.Exec(requestPolicy, "2000-01-01", name)
+		require.NoError(t, err)
+		rowsAffected, err := result.RowsAffected()
+		require.NoError(t, err)
+		require.Equal(t, expected, rowsAffected, name)
+	}
+
+	result, err := db.Exec("DELETE FROM people", requestPolicy)
+	require.NoError(t, err)
+	rowsAffected, err := result.RowsAffected()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), rowsAffected)
+	require.Equal(t, []string{"bob", "charlie"}, incrementalTestNames(t, &db))
+
+	explanation, err := db.Explain("DELETE FROM people WHERE id = ?", requestPolicy)
+	require.NoError(t, err)
+	require.Equal(t, "delete from people where (id = ?) and (people.name = 'alice')", explanation.RewrittenQuery)
+	require.Equal(t, "`name` = ?", explanation.Tables[0].WriteFilter)
+	require.Equal(t, []interface{}{"alice"}, explanation.Tables[0].WriteFilterArgs)
+}
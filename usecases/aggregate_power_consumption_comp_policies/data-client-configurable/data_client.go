@@ -20,7 +20,7 @@ func createPowerConsumptionRawDataHandler() (func(http.ResponseWriter, *http.Req
 	group := middleware.NewPrivacyGroup("CentralServer")
 	group.Add("server")
 	groups := []*middleware.PrivacyGroup{group}
-	transforms := middleware.DataTransforms{group: &middleware.TableOperations{transformsForEntities, removedColumnsForEntities}}
+	transforms := middleware.DataTransforms{group: &middleware.TableOperations{TableTransforms: transformsForEntities, ExcludedCols: removedColumnsForEntities}}
 
 	db := middleware.MySQLPrivateDatabase{
 		DataPolicy:  middleware.NewStaticDataPolicy(groups, transforms),
@@ -118,7 +118,7 @@ func createAveragePowerConsumptionHandler() (func(http.ResponseWriter, *http.Req
 	group.Add("server")
 
 	groups := []*middleware.PrivacyGroup{group}
-	transforms := middleware.DataTransforms{group: &middleware.TableOperations{transformsForEntities, removedColumnsForEntities}}
+	transforms := middleware.DataTransforms{group: &middleware.TableOperations{TableTransforms: transformsForEntities, ExcludedCols: removedColumnsForEntities}}
 
 	db := middleware.MySQLPrivateDatabase{
 		DataPolicy:  middleware.NewStaticDataPolicy(groups, transforms),
@@ -31,7 +31,7 @@ func createPowerConsumptionDataHandler() (func(http.ResponseWriter, *http.Reques
 	group.Add("server")
 	groups := []*middleware.PrivacyGroup{group}
 	transforms := middleware.DataTransforms{
-		group: &middleware.TableOperations{transformsForEntities, removedColumnsForEntities}}
+		group: &middleware.TableOperations{TableTransforms: transformsForEntities, ExcludedCols: removedColumnsForEntities}}
 
 	db := middleware.MySQLPrivateDatabase{
 		DataPolicy:  middleware.NewStaticDataPolicy(groups, transforms),